@@ -0,0 +1,385 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/neutralinsomniac/exocortex/db"
+	"github.com/peterh/liner"
+)
+
+func checkErr(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "exo:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: exo [-db file] [-read-only] <command> [args]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  backup                 take a snapshot of the database")
+	fmt.Fprintln(os.Stderr, "  backup list            list the database's snapshots")
+	fmt.Fprintln(os.Stderr, "  backup restore <name>  replace the database with a snapshot")
+	fmt.Fprintln(os.Stderr, "  config                 list workspace settings")
+	fmt.Fprintln(os.Stderr, "  config <key>           print a workspace setting")
+	fmt.Fprintln(os.Stderr, "  config <key> <value>   change a workspace setting")
+	fmt.Fprintln(os.Stderr, "  encrypt                encrypt the database with a passphrase")
+	fmt.Fprintln(os.Stderr, "  decrypt                turn an encrypted database back into a plain one")
+	fmt.Fprintln(os.Stderr, "  generate [flags]       fill an empty database with synthetic notes for testing")
+	fmt.Fprintln(os.Stderr, "  fsck [-repair]         check refs, tags and row ranks for problems, and optionally fix them")
+	fmt.Fprintln(os.Stderr, "  graph [flags]          export the graph of links between tags as DOT, GraphML or JSON")
+	fmt.Fprintln(os.Stderr, "  lock <tag>             lock a tag with its own passphrase, hiding its rows until it's unlocked")
+	fmt.Fprintln(os.Stderr, "  unlock <tag>           remove the lock from a tag, turning it back into a normal tag")
+	fmt.Fprintln(os.Stderr, "  trash                  list deleted tags and rows")
+	fmt.Fprintln(os.Stderr, "  trash expire           permanently delete trash older than trash.expire_days")
+	fmt.Fprintln(os.Stderr, "  trash purge            permanently delete everything in the trash")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "The passphrase of an encrypted database is prompted for, or read from $EXOCORTEX_PASSPHRASE. Tag")
+	fmt.Fprintln(os.Stderr, "passphrases are prompted for, or read from $EXOCORTEX_TAG_PASSPHRASE.")
+	fmt.Fprintln(os.Stderr, "")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// passphrase returns the environment variable env if it's set, or prompts for the passphrase. New passphrases are
+// prompted for twice.
+func passphrase(env string, confirm bool) string {
+	if p, ok := os.LookupEnv(env); ok {
+		return p
+	}
+
+	line := liner.NewLiner()
+	defer line.Close()
+
+	p, err := line.PasswordPrompt("passphrase: ")
+	checkErr(err)
+	if confirm {
+		again, err := line.PasswordPrompt("passphrase again: ")
+		checkErr(err)
+		if again != p {
+			checkErr(fmt.Errorf("passphrases don't match"))
+		}
+	}
+
+	return p
+}
+
+func encrypt(dbFile string, args []string) {
+	if len(args) > 0 {
+		usage()
+	}
+
+	encrypted, err := db.IsEncrypted(dbFile)
+	checkErr(err)
+	if encrypted {
+		checkErr(db.ErrEncrypted)
+	}
+
+	snapshots, err := db.EncryptDatabase(dbFile, passphrase("EXOCORTEX_PASSPHRASE", true))
+	checkErr(err)
+	if len(snapshots) > 0 {
+		fmt.Fprintf(os.Stderr, "exo: the %d backups taken before are still in plaintext, in %s\n", len(snapshots), db.BackupDir(dbFile))
+	}
+}
+
+func decrypt(dbFile string, args []string) {
+	if len(args) > 0 {
+		usage()
+	}
+
+	encrypted, err := db.IsEncrypted(dbFile)
+	checkErr(err)
+	if !encrypted {
+		checkErr(db.ErrNotEncrypted)
+	}
+
+	checkErr(db.DecryptDatabase(dbFile, passphrase("EXOCORTEX_PASSPHRASE", false)))
+}
+
+// backupFile lists or restores the snapshots of the database in dbFile
+func backupFile(dbFile string, args []string) {
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		snapshots, err := db.ListBackups(dbFile)
+		checkErr(err)
+		for _, s := range snapshots {
+			fmt.Printf("%s  %8d  %s\n", s.Name, s.Size, s.Time.Format("Mon Jan 2 15:04"))
+		}
+	case len(args) == 2 && args[0] == "restore":
+		checkErr(db.RestoreBackup(dbFile, args[1]))
+		fmt.Printf("restored %s; the replaced database was kept as a snapshot\n", args[1])
+	default:
+		usage()
+	}
+}
+
+func backup(exoDB *db.ExoDB) {
+	snapshot, err := exoDB.Backup()
+	checkErr(err)
+	if snapshot.Name == "" {
+		checkErr(fmt.Errorf("backups are turned off"))
+	}
+	fmt.Println(snapshot.Path)
+}
+
+func config(exoDB *db.ExoDB, args []string) {
+	switch len(args) {
+	case 0:
+		settings, err := exoDB.GetAllSettings()
+		checkErr(err)
+
+		keys := make([]string, 0, len(settings))
+		for k := range settings {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			fmt.Printf("%s = %s\n", k, settings[k])
+		}
+	case 1:
+		value, err := exoDB.GetSetting(args[0], "")
+		checkErr(err)
+		fmt.Println(value)
+	case 2:
+		err := exoDB.SetSetting(args[0], args[1])
+		checkErr(err)
+	default:
+		usage()
+	}
+}
+
+func fsck(exoDB *db.ExoDB, args []string) {
+	var problems []db.Problem
+	var err error
+
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix the problems found")
+	flags.Parse(args)
+
+	if *repair {
+		problems, err = exoDB.Repair()
+	} else {
+		problems, err = exoDB.CheckIntegrity()
+	}
+	checkErr(err)
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	switch {
+	case len(problems) == 0:
+		fmt.Println("no problems found")
+	case *repair:
+		fmt.Printf("repaired %d problem(s)\n", len(problems))
+	default:
+		fmt.Printf("%d problem(s) found; run exo fsck -repair to fix them\n", len(problems))
+		os.Exit(1)
+	}
+}
+
+func generate(exoDB *db.ExoDB, args []string) {
+	opts := db.DefaultGenerateOptions
+
+	flags := flag.NewFlagSet("generate", flag.ExitOnError)
+	flags.IntVar(&opts.Days, "days", opts.Days, "number of date tags")
+	flags.IntVar(&opts.RowsPerDay, "rows", opts.RowsPerDay, "average number of rows per date tag")
+	flags.IntVar(&opts.Topics, "topics", opts.Topics, "number of other tags")
+	flags.IntVar(&opts.RowsPerTopic, "topic-rows", opts.RowsPerTopic, "average number of rows per other tag")
+	flags.Float64Var(&opts.LongRowRatio, "long", opts.LongRowRatio, "fraction of rows that are several sentences long")
+	flags.Int64Var(&opts.Seed, "seed", opts.Seed, "random seed")
+	flags.Parse(args)
+
+	tags, err := exoDB.GetAllTags()
+	checkErr(err)
+	if len(tags) > 0 {
+		checkErr(fmt.Errorf("generate: database isn't empty"))
+	}
+
+	checkErr(exoDB.Generate(opts))
+}
+
+func graph(exoDB *db.ExoDB, args []string) {
+	var g db.Graph
+	var filter db.GraphFilter
+	var err error
+
+	flags := flag.NewFlagSet("graph", flag.ExitOnError)
+	format := flags.String("format", "dot", "output `format`: dot, graphml or json")
+	since := flags.String("since", "", "only count rows changed on or after this `date` (YYYY-MM-DD)")
+	until := flags.String("until", "", "only count rows changed before this `date` (YYYY-MM-DD)")
+	flags.StringVar(&filter.Namespace, "namespace", "", "only keep links between the `tag` and the tags below it")
+	tag := flags.String("tag", "", "only export the neighborhood of the `tag`")
+	depth := flags.Int("depth", 1, "how many links away from -tag to go")
+	flags.Parse(args)
+
+	for _, d := range []struct {
+		value string
+		t     *time.Time
+	}{{*since, &filter.Since}, {*until, &filter.Until}} {
+		if d.value != "" {
+			*d.t, err = time.ParseInLocation("2006-01-02", d.value, time.Local)
+			checkErr(err)
+		}
+	}
+
+	if *tag != "" {
+		t, err := exoDB.GetTagByName(*tag)
+		checkErr(err)
+		g, err = exoDB.GetTagNeighborhood(t.ID, *depth)
+		checkErr(err)
+	} else {
+		g, err = exoDB.GetGraph(filter)
+		checkErr(err)
+	}
+
+	switch *format {
+	case "dot":
+		err = g.WriteDOT(os.Stdout)
+	case "graphml":
+		err = g.WriteGraphML(os.Stdout)
+	case "json":
+		err = g.WriteJSON(os.Stdout)
+	default:
+		err = fmt.Errorf("graph: unknown format %s", *format)
+	}
+	checkErr(err)
+}
+
+func lock(exoDB *db.ExoDB, args []string) {
+	if len(args) != 1 {
+		usage()
+	}
+
+	tag, err := exoDB.GetTagByName(args[0])
+	checkErr(err)
+
+	snapshots, err := exoDB.LockTag(tag.ID, passphrase("EXOCORTEX_TAG_PASSPHRASE", true))
+	checkErr(err)
+	if len(snapshots) > 0 {
+		fmt.Fprintf(os.Stderr, "exo: the %d backups taken before still hold the rows of %s in plaintext\n", len(snapshots), tag.Name)
+	}
+}
+
+func unlock(exoDB *db.ExoDB, args []string) {
+	if len(args) != 1 {
+		usage()
+	}
+
+	tag, err := exoDB.GetTagByName(args[0])
+	checkErr(err)
+	if tag.Kind != db.TagKindLocked {
+		checkErr(db.ErrTagNotLocked)
+	}
+
+	checkErr(exoDB.RemoveTagLock(tag.ID, passphrase("EXOCORTEX_TAG_PASSPHRASE", false)))
+}
+
+func trash(exoDB *db.ExoDB, args []string) {
+	if len(args) > 1 {
+		usage()
+	}
+
+	if len(args) == 0 {
+		trashedTags, err := exoDB.GetTrashedTags()
+		checkErr(err)
+		trashedRows, err := exoDB.GetTrashedRows()
+		checkErr(err)
+
+		for _, t := range trashedTags {
+			fmt.Printf("%s  tag %s (%d rows)\n", time.Unix(0, t.DeletedTS).Format("2006-01-02 15:04"), t.Name, t.RowCount)
+		}
+		for _, t := range trashedRows {
+			fmt.Printf("%s  row in %s: %s\n", time.Unix(0, t.DeletedTS).Format("2006-01-02 15:04"), t.TagName, t.Row.Text)
+		}
+		return
+	}
+
+	switch args[0] {
+	case "expire":
+		n, err := exoDB.ExpireTrash()
+		checkErr(err)
+		fmt.Printf("expired %d tag(s) and row(s)\n", n)
+	case "purge":
+		err := exoDB.PurgeTrash()
+		checkErr(err)
+	default:
+		usage()
+	}
+}
+
+func main() {
+	var exoDB db.ExoDB
+
+	dbFile := flag.String("db", "./exocortex.db", "database `file` to operate on")
+	readOnly := flag.Bool("read-only", false, "refuse to change the database")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+	}
+
+	// these work on the file rather than on an open database, which may be damaged
+	switch flag.Arg(0) {
+	case "encrypt":
+		encrypt(*dbFile, flag.Args()[1:])
+		return
+	case "decrypt":
+		decrypt(*dbFile, flag.Args()[1:])
+		return
+	case "backup":
+		if flag.NArg() > 1 {
+			backupFile(*dbFile, flag.Args()[1:])
+			return
+		}
+	}
+
+	open, openEncrypted := exoDB.Open, exoDB.OpenEncrypted
+	if *readOnly {
+		open, openEncrypted = exoDB.OpenReadOnly, exoDB.OpenEncryptedReadOnly
+	}
+
+	encrypted, err := db.IsEncrypted(*dbFile)
+	checkErr(err)
+	if encrypted {
+		err = openEncrypted(*dbFile, passphrase("EXOCORTEX_PASSPHRASE", false))
+	} else {
+		err = open(*dbFile)
+	}
+	checkErr(err)
+	defer exoDB.Close()
+
+	err = exoDB.LoadSchema()
+	checkErr(err)
+	for _, notice := range exoDB.Notices() {
+		fmt.Fprintln(os.Stderr, "exo:", notice)
+	}
+
+	switch flag.Arg(0) {
+	case "backup":
+		backup(&exoDB)
+	case "config":
+		config(&exoDB, flag.Args()[1:])
+	case "generate":
+		generate(&exoDB, flag.Args()[1:])
+	case "fsck":
+		fsck(&exoDB, flag.Args()[1:])
+	case "graph":
+		graph(&exoDB, flag.Args()[1:])
+	case "lock":
+		lock(&exoDB, flag.Args()[1:])
+	case "unlock":
+		unlock(&exoDB, flag.Args()[1:])
+	case "trash":
+		trash(&exoDB, flag.Args()[1:])
+	default:
+		usage()
+	}
+}
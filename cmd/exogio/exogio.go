@@ -1,17 +1,20 @@
 package main
 
 import (
+	"database/sql"
+	"flag"
 	"fmt"
 	"image"
-	"regexp"
 	"strings"
 	"time"
 
 	"gioui.org/app"
+	"gioui.org/io/key"
 	"gioui.org/io/pointer"
 	"gioui.org/io/system"
 	"gioui.org/layout"
 	"gioui.org/op"
+	"gioui.org/text"
 
 	//"gioui.org/op/clip"
 	"gioui.org/unit"
@@ -40,43 +43,195 @@ type state struct {
 	editingTagName   bool
 	currentUIRows    []uiRow
 	currentUIRefRows map[db.Tag][]uiRow
-	allTagButtons    []uiTagButton
-	filteredTags     []*uiTagButton
+	allTagButtons    []uiTagTreeItem
+	filteredTags     []*uiTagTreeItem
+	expandedTags     map[int64]bool // namespaces expanded in the tag list
+	ancestorButtons  []uiTagButton
+	childTagButtons  []uiTagButton
+	relatedButtons   []uiTagButton
+	queryEditor      widget.Editor
+	queryList        layout.List
+	clearQueryButton widget.Clickable
+	query            string
+	queryError       string
+	queryContent     []interface{} // *uiTagButton(s) + *uiRow(s)
+	saveQueryButton  widget.Clickable
+	tagQueryEditor   widget.Editor
+	tagQueryError    string
+	tagQueryContent  []interface{} // *uiTagButton(s) + *uiRow(s) for the current query tag
+	unlinkedRefList  layout.List
+	unlinkedContent  []interface{} // *uiTagButton(s) + *uiUnlinkedRef(s)
+	unlinkedButton   widget.Clickable
+	trashButton      widget.Clickable
+	emptyTrashButton widget.Clickable
+	showTrash        bool
+	trashList        layout.List
+	trashContent     []interface{} // *uiTrashedTag(s) + *uiTrashedRow(s)
+	graphButton      widget.Clickable
+	showGraph        bool
+	graph            *uiGraph // the current tag's neighborhood while the graph pane is shown
+	graphDepth       int
+	depthDownButton  widget.Clickable
+	depthUpButton    widget.Clickable
+	hideDatesBox     widget.Bool
+	registerEditor   widget.Editor
+	yankAllButton    widget.Clickable
+	pasteButton      widget.Clickable
+	snarfStatus      string
+	// set by -read-only, which hides everything that would change the database
+	readOnly bool
+	// set until an encrypted database is unlocked
+	locked           bool
+	passphraseEditor widget.Editor
+	unlockError      string
+	movingRow        *db.Row // row waiting for a tag to be clicked to move it under
+	cancelMoveButton widget.Clickable
+	tagLockEditor    widget.Editor // passphrase of the current tag's lock
+	lockButton       widget.Clickable
+	relockButton     widget.Clickable
+	removeLockButton widget.Clickable
+	lockStatus       string
+	completions      uiCompletions
+	switcher         *uiSwitcher // set while the quick switcher is open
+	recentTags       []string    // tag.Name, most recently visited first
+}
+
+// uiCompletions offers tag names for the link being typed in the focused editor
+type uiCompletions struct {
+	editor  *widget.Editor
+	query   string
+	tags    []db.Tag
+	buttons []widget.Clickable
 }
 
 type uiTagButton struct {
 	tag    db.Tag
+	label  string // shown instead of the tag name if set
 	button widget.Clickable
 }
 
+// uiTagTreeItem is a tag in the tag list, which shows namespaces as a collapsible tree
+type uiTagTreeItem struct {
+	uiTagButton
+	depth        int
+	treeLabel    string
+	hasChildren  bool
+	expandButton widget.Clickable
+}
+
+// uiPropertyKey is the key of a "key:: value" property row
+type uiPropertyKey string
+
+// uiCode is the contents of a `code` span
+type uiCode string
+
 type uiRow struct {
-	row     db.Row
-	content []interface{} // string(s) + uiTagButton(s)
-	editor  widget.Editor
-	editing bool
+	row        db.Row
+	content    []interface{} // string(s) + uiTagButton(s) + uiCode(s) + uiPropertyKey
+	editor     widget.Editor
+	editing    bool
+	readOnly   bool
+	yankButton widget.Clickable
+	cutButton  widget.Clickable
+	moveButton widget.Clickable
+}
+
+// uiUnlinkedRef is a row mentioning the current tag without linking to it
+type uiUnlinkedRef struct {
+	uiRow
+	linkButton widget.Clickable
+}
+
+type uiTrashedTag struct {
+	trashed       db.TrashedTag
+	restoreButton widget.Clickable
+}
+
+type uiTrashedRow struct {
+	trashed       db.TrashedRow
+	restoreButton widget.Clickable
 }
 
 var programState state
 
 func (p *state) FilterTags() {
-	p.filteredTags = make([]*uiTagButton, 0)
+	p.filteredTags = make([]*uiTagTreeItem, 0)
+
+	filter := strings.ToLower(p.tagFilterEditor.Text())
+	if filter != "" {
+		// matches are listed flat, with their full names
+		for i, t := range p.allTagButtons {
+			if strings.Contains(strings.ToLower(t.tag.Name), filter) {
+				p.allTagButtons[i].label = ""
+				p.filteredTags = append(p.filteredTags, &p.allTagButtons[i])
+			}
+		}
+		return
+	}
+
+	// skip the children of collapsed namespaces
+	collapsedDepth := -1
 	for i, t := range p.allTagButtons {
-		if strings.Contains(strings.ToLower(t.tag.Name), strings.ToLower(p.tagFilterEditor.Text())) {
-			p.filteredTags = append(p.filteredTags, &p.allTagButtons[i])
+		if collapsedDepth >= 0 && t.depth > collapsedDepth {
+			continue
+		}
+		collapsedDepth = -1
+		p.allTagButtons[i].label = t.treeLabel
+		p.filteredTags = append(p.filteredTags, &p.allTagButtons[i])
+		if t.hasChildren && !p.expandedTags[t.tag.ID] {
+			collapsedDepth = t.depth
 		}
 	}
 }
 
+// register returns the snarf register named in the register editor
+func (p *state) register() string {
+	if register := strings.TrimSpace(p.registerEditor.Text()); register != "" {
+		return register
+	}
+	return db.SnarfDefaultRegister
+}
+
 func (p *state) GoToToday() {
 	t := time.Now()
-	tag, err := programState.DB.AddTag(t.Format("January 02 2006"))
+	tag, err := p.DateTag(t)
 	checkErr(err)
 
 	p.CurrentDBTag = tag
 	p.Refresh()
 }
 
-var tagRe = regexp.MustCompile(`\[\[(.*?)\]\]`)
+// newUIRow splits the text of row into plain text, property keys and tag buttons
+func (p *state) newUIRow(row db.Row) uiRow {
+	uiRow := uiRow{row: row, editor: widget.Editor{SingleLine: true, Submit: true}, readOnly: p.readOnly}
+	uiRow.editor.SetText(uiRow.row.Text)
+	if _, ok := db.ParseProperty(row.Text); ok {
+		sep := strings.Index(row.Text, "::")
+		uiRow.content = append(uiRow.content, uiPropertyKey(strings.TrimSpace(row.Text[:sep])))
+		row.Text = row.Text[sep+2:]
+	}
+	for _, node := range db.ParseText(row.Text) {
+		switch node.Kind {
+		case db.NodeRef:
+			tag, err := p.LinkedTag(node.Text)
+			checkErr(err)
+			uiRow.content = append(uiRow.content, &uiTagButton{tag: tag})
+		case db.NodeCode:
+			uiRow.content = append(uiRow.content, uiCode(node.Text))
+		default:
+			// escapes join the text around them
+			if n := len(uiRow.content); n > 0 {
+				if text, ok := uiRow.content[n-1].(string); ok {
+					uiRow.content[n-1] = text + node.Text
+					continue
+				}
+			}
+			uiRow.content = append(uiRow.content, node.Text)
+		}
+	}
+
+	return uiRow
+}
 
 func (p *state) Refresh() error {
 	var err error
@@ -85,70 +240,174 @@ func (p *state) Refresh() error {
 	p.State.Refresh()
 
 	p.tagNameEditor.SetText(p.CurrentDBTag.Name)
+	p.pushRecentTag(p.CurrentDBTag.Name)
 	programState.editingTagName = false
+	programState.tagLockEditor.SetText("")
+
+	p.allTagButtons = make([]uiTagTreeItem, 0)
+	for _, node := range db.TagTree(p.AllDBTags) {
+		p.allTagButtons = append(p.allTagButtons, uiTagTreeItem{uiTagButton: uiTagButton{tag: node.Tag}, depth: node.Depth, treeLabel: node.Label, hasChildren: node.HasChildren})
+	}
 
-	p.allTagButtons = make([]uiTagButton, 0)
-	for _, tag := range p.AllDBTags {
-		p.allTagButtons = append(p.allTagButtons, uiTagButton{tag: tag})
+	p.ancestorButtons = make([]uiTagButton, 0)
+	for _, tag := range p.CurrentDBAncestors {
+		p.ancestorButtons = append(p.ancestorButtons, uiTagButton{tag: tag, label: db.BaseTagName(tag.Name)})
+		// the current tag is always visible in the tag list
+		p.expandedTags[tag.ID] = true
 	}
 	p.FilterTags()
 
+	p.childTagButtons = make([]uiTagButton, 0)
+	for _, tag := range p.CurrentDBChildTags {
+		p.childTagButtons = append(p.childTagButtons, uiTagButton{tag: tag, label: db.BaseTagName(tag.Name)})
+	}
+
+	p.relatedButtons = make([]uiTagButton, 0)
+	for _, tag := range p.CurrentDBRelatedTags {
+		p.relatedButtons = append(p.relatedButtons, uiTagButton{tag: tag})
+	}
+
 	p.currentUIRows = make([]uiRow, 0)
 
 	// split the text by tags and pre-calculate the row contents
 	for _, row := range p.CurrentDBRows {
-		uiRow := uiRow{row: row, editor: widget.Editor{SingleLine: true, Submit: true}}
-		uiRow.editor.SetText(uiRow.row.Text)
-		for tagIndex := tagRe.FindStringIndex(row.Text); tagIndex != nil; tagIndex = tagRe.FindStringIndex(row.Text) {
-			// leading text
-			uiRow.content = append(uiRow.content, row.Text[:tagIndex[0]])
-			// tag button
-			tag, err := p.DB.GetTagByName(row.Text[tagIndex[0]+2 : tagIndex[1]-2])
-			checkErr(err)
-			uiRow.content = append(uiRow.content, &uiTagButton{tag: tag})
-			row.Text = row.Text[tagIndex[1]:]
-		}
-		uiRow.content = append(uiRow.content, row.Text)
-		p.currentUIRows = append(p.currentUIRows, uiRow)
+		p.currentUIRows = append(p.currentUIRows, p.newUIRow(row))
 	}
 
 	p.currentUIRefRows = make(map[db.Tag][]uiRow)
 	for tag, rows := range p.CurrentDBRefs {
 		p.currentUIRefRows[tag] = make([]uiRow, 0)
 		for _, row := range rows {
-			uiRow := uiRow{row: row, editor: widget.Editor{SingleLine: true, Submit: true}}
-			uiRow.editor.SetText(uiRow.row.Text)
-			for tagIndex := tagRe.FindStringIndex(row.Text); tagIndex != nil; tagIndex = tagRe.FindStringIndex(row.Text) {
-				// leading text
-				uiRow.content = append(uiRow.content, row.Text[:tagIndex[0]])
-				// tag button
-				tag, err := p.DB.GetTagByName(row.Text[tagIndex[0]+2 : tagIndex[1]-2])
-				checkErr(err)
-				uiRow.content = append(uiRow.content, &uiTagButton{tag: tag})
-				row.Text = row.Text[tagIndex[1]:]
+			p.currentUIRefRows[tag] = append(p.currentUIRefRows[tag], p.newUIRow(row))
+		}
+	}
+
+	// query tag rows are owned by their source tags, so they can't be edited from here
+	p.tagQueryContent = nil
+	p.tagQueryError = ""
+	if p.CurrentDBTag.Kind == db.TagKindQuery {
+		p.tagQueryEditor.SetText(p.CurrentDBQuery)
+		for _, tag := range p.SortedQueryTagsKeys {
+			p.tagQueryContent = append(p.tagQueryContent, &uiTagButton{tag: tag})
+			for _, row := range p.CurrentDBQueryResults[tag] {
+				uiRow := p.newUIRow(row)
+				uiRow.readOnly = true
+				p.tagQueryContent = append(p.tagQueryContent, &uiRow)
 			}
-			uiRow.content = append(uiRow.content, row.Text)
-			p.currentUIRefRows[tag] = append(p.currentUIRefRows[tag], uiRow)
 		}
 	}
 
+	p.unlinkedContent = nil
+	for _, tag := range p.SortedUnlinkedRefTagsKeys {
+		p.unlinkedContent = append(p.unlinkedContent, &uiTagButton{tag: tag})
+		for _, row := range p.CurrentDBUnlinkedRefs[tag] {
+			p.unlinkedContent = append(p.unlinkedContent, &uiUnlinkedRef{uiRow: p.newUIRow(row)})
+		}
+	}
+
+	p.runQuery()
+	p.loadTrash()
+	p.loadGraph()
+
 	programState.newRowEditor.Focus()
 
 	return err
 }
 
-func main() {
-	var exoDB db.ExoDB
-	err := exoDB.Open("./exocortex.db")
+// runQuery refreshes the results of the active query, if any
+func (p *state) runQuery() {
+	p.queryContent = nil
+	p.queryError = ""
+
+	if p.query == "" {
+		return
+	}
+
+	refs, err := p.DB.RunQuery(p.query)
+	if _, ok := err.(*db.QueryError); ok {
+		p.queryError = err.Error()
+		return
+	}
 	checkErr(err)
-	defer exoDB.Close()
 
-	err = exoDB.LoadSchema()
+	for _, tag := range db.SortedRefTags(refs) {
+		p.queryContent = append(p.queryContent, &uiTagButton{tag: tag})
+		for _, row := range refs[tag] {
+			uiRow := p.newUIRow(row)
+			p.queryContent = append(p.queryContent, &uiRow)
+		}
+	}
+}
+
+// loadTrash refreshes the contents of the trash pane while it's shown
+func (p *state) loadTrash() {
+	p.trashContent = nil
+
+	if !p.showTrash {
+		return
+	}
+
+	trashedTags, err := p.DB.GetTrashedTags()
 	checkErr(err)
+	for _, t := range trashedTags {
+		p.trashContent = append(p.trashContent, &uiTrashedTag{trashed: t})
+	}
+
+	trashedRows, err := p.DB.GetTrashedRows()
+	checkErr(err)
+	for _, t := range trashedRows {
+		p.trashContent = append(p.trashContent, &uiTrashedRow{trashed: t})
+	}
+}
+
+// start loads the database once it's open
+func start() {
+	err := programState.DB.LoadSchema()
+	checkErr(err)
+	for _, notice := range programState.DB.Notices() {
+		fmt.Println(notice)
+	}
+
+	if !programState.readOnly {
+		_, err = programState.DB.ExpireTrash()
+		checkErr(err)
+
+		err = programState.DB.StartBackups()
+		if err != nil {
+			fmt.Println("backups are off:", err)
+		}
+	}
+
+	programState.GoToToday()
+}
+
+func main() {
+	var exoDB db.ExoDB
+	var err error
+
+	flag.BoolVar(&programState.readOnly, "read-only", false, "browse the database without changing it")
+	flag.Parse()
+
+	if programState.readOnly {
+		err = exoDB.OpenReadOnly("./exocortex.db")
+	} else {
+		err = exoDB.Open("./exocortex.db")
+	}
+	if err == db.ErrEncrypted {
+		// the passphrase is asked for in the window
+		programState.locked = true
+	} else {
+		checkErr(err)
+	}
+	defer exoDB.Close()
 
 	programState.DB = &exoDB
+	programState.passphraseEditor.SingleLine = true
+	programState.passphraseEditor.Submit = true
+	programState.passphraseEditor.Mask = '•'
 	programState.tagList.Axis = layout.Vertical
 	programState.tagList.Alignment = layout.Start
+	programState.expandedTags = make(map[int64]bool)
 	programState.rowList.Axis = layout.Vertical
 	programState.refList.Axis = layout.Vertical
 	programState.tagFilterEditor.SingleLine = true
@@ -157,8 +416,23 @@ func main() {
 	programState.tagNameEditor.Submit = true
 	programState.newRowEditor.SingleLine = true
 	programState.newRowEditor.Submit = true
+	programState.queryEditor.SingleLine = true
+	programState.queryEditor.Submit = true
+	programState.queryList.Axis = layout.Vertical
+	programState.unlinkedRefList.Axis = layout.Vertical
+	programState.trashList.Axis = layout.Vertical
+	programState.graphDepth = 1
+	programState.registerEditor.SingleLine = true
+	programState.registerEditor.SetText(db.SnarfDefaultRegister)
+	programState.tagQueryEditor.SingleLine = true
+	programState.tagQueryEditor.Submit = true
+	programState.tagLockEditor.SingleLine = true
+	programState.tagLockEditor.Submit = true
+	programState.tagLockEditor.Mask = '•'
 
-	programState.GoToToday()
+	if !programState.locked {
+		start()
+	}
 
 	go func() {
 		w := app.NewWindow()
@@ -176,10 +450,22 @@ func loop(w *app.Window) error {
 		case e := <-w.Events():
 			switch e := e.(type) {
 			case system.DestroyEvent:
+				if !programState.locked {
+					// takes the closing snapshot
+					programState.DB.Close()
+				}
 				return e.Err
+			case key.Event:
+				if handleSwitcherKey(e) {
+					w.Invalidate()
+				}
 			case system.FrameEvent:
 				gtx := layout.NewContext(&ops, e)
-				render(gtx, th)
+				if programState.locked {
+					renderUnlock(gtx, th)
+				} else {
+					render(gtx, th)
+				}
 				e.Frame(gtx.Ops)
 			}
 		}
@@ -192,11 +478,50 @@ type (
 	D = layout.Dimensions
 )
 
+// renderUnlock asks for the passphrase of an encrypted database
+func renderUnlock(gtx layout.Context, th *material.Theme) {
+	for _, e := range programState.passphraseEditor.Events() {
+		if e, ok := e.(widget.SubmitEvent); ok {
+			var err error
+			if programState.readOnly {
+				err = programState.DB.OpenEncryptedReadOnly("./exocortex.db", e.Text)
+			} else {
+				err = programState.DB.OpenEncrypted("./exocortex.db", e.Text)
+			}
+			if err == db.ErrPassphrase {
+				programState.unlockError = err.Error()
+				programState.passphraseEditor.SetText("")
+				continue
+			}
+			checkErr(err)
+			programState.locked = false
+			programState.passphraseEditor.SetText("")
+			start()
+			return
+		}
+	}
+
+	programState.passphraseEditor.Focus()
+
+	in := layout.UniformInset(unit.Dp(8))
+	layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return in.Layout(gtx, material.H3(th, "Unlock").Layout)
+		}),
+		layout.Rigid(func(gtx C) D {
+			return in.Layout(gtx, material.Editor(th, &programState.passphraseEditor, "Passphrase").Layout)
+		}),
+		layout.Rigid(func(gtx C) D {
+			return in.Layout(gtx, material.Body1(th, programState.unlockError).Layout)
+		}),
+	)
+}
+
 func render(gtx layout.Context, th *material.Theme) {
 	// click on tag header handler
 	for _, e := range gtx.Events(&programState.CurrentDBTag) {
 		if e, ok := e.(pointer.Event); ok {
-			if e.Type == pointer.Release {
+			if e.Type == pointer.Release && !programState.readOnly {
 				unEditAllTheThings()
 				programState.editingTagName = true
 				programState.tagNameEditor.Focus()
@@ -232,6 +557,10 @@ func render(gtx layout.Context, th *material.Theme) {
 		case widget.SubmitEvent:
 			if programState.newRowEditor.Text() != "" {
 				_, err := programState.DB.AddRow(programState.CurrentDBTag.ID, e.Text, 0)
+				if err == db.ErrTagLocked {
+					programState.lockStatus = err.Error()
+					break
+				}
 				checkErr(err)
 				programState.newRowEditor.SetText("")
 				programState.Refresh()
@@ -242,11 +571,58 @@ func render(gtx layout.Context, th *material.Theme) {
 	for programState.todayButton.Clicked() {
 		programState.GoToToday()
 	}
+	// snarf handlers
+	for programState.cancelMoveButton.Clicked() {
+		programState.movingRow = nil
+		programState.snarfStatus = ""
+	}
+	for programState.yankAllButton.Clicked() {
+		err := programState.DB.PushSnarf(programState.register(), programState.CurrentDBRows)
+		checkErr(err)
+		programState.snarfStatus = fmt.Sprintf("yanked %d rows", len(programState.CurrentDBRows))
+	}
+	for programState.pasteButton.Clicked() {
+		rows, err := programState.DB.PasteSnarf(programState.register(), programState.CurrentDBTag.ID, -1)
+		if err == db.ErrEmptyRegister || err == db.ErrQueryTag || err == db.ErrTagLocked {
+			programState.snarfStatus = err.Error()
+			break
+		}
+		checkErr(err)
+		programState.Refresh()
+		programState.snarfStatus = fmt.Sprintf("pasted %d rows", len(rows))
+	}
+	// trash button handlers
+	for programState.trashButton.Clicked() {
+		programState.showTrash = !programState.showTrash
+		programState.loadTrash()
+	}
+	for programState.unlinkedButton.Clicked() {
+		programState.ShowUnlinkedRefs = !programState.ShowUnlinkedRefs
+		programState.Refresh()
+	}
+	for programState.graphButton.Clicked() {
+		programState.showGraph = !programState.showGraph
+		programState.loadGraph()
+	}
+	for programState.emptyTrashButton.Clicked() {
+		err := programState.DB.PurgeTrash()
+		checkErr(err)
+		programState.loadTrash()
+	}
 	for _, e := range programState.tagFilterEditor.Events() {
 		switch e := e.(type) {
 		case widget.SubmitEvent:
 			if e.Text != "" {
-				tag, err := programState.DB.AddTag(e.Text)
+				var tag db.Tag
+				var err error
+				if programState.readOnly {
+					tag, err = programState.DB.GetTagByName(e.Text)
+					if err == sql.ErrNoRows {
+						break
+					}
+				} else {
+					tag, err = programState.DB.AddTag(e.Text)
+				}
 				checkErr(err)
 				programState.tagFilterEditor.SetText("")
 				programState.CurrentDBTag = tag
@@ -258,6 +634,45 @@ func render(gtx layout.Context, th *material.Theme) {
 		}
 
 	}
+	// query editor handler
+	for _, e := range programState.queryEditor.Events() {
+		switch e := e.(type) {
+		case widget.SubmitEvent:
+			programState.query = strings.TrimSpace(e.Text)
+			programState.Refresh()
+		}
+	}
+	for programState.saveQueryButton.Clicked() {
+		tag, err := programState.DB.AddQueryTag(programState.query, programState.query)
+		if err != nil {
+			programState.queryError = err.Error()
+			break
+		}
+		programState.query = ""
+		programState.queryEditor.SetText("")
+		programState.CurrentDBTag = tag
+		programState.Refresh()
+	}
+	// query tag editor handler
+	for _, e := range programState.tagQueryEditor.Events() {
+		switch e := e.(type) {
+		case widget.SubmitEvent:
+			err := programState.DB.UpdateQueryTag(programState.CurrentDBTag.ID, strings.TrimSpace(e.Text))
+			if _, ok := err.(*db.QueryError); ok {
+				programState.tagQueryError = err.Error()
+				break
+			}
+			checkErr(err)
+			programState.CurrentDBTag, err = programState.DB.GetTagByID(programState.CurrentDBTag.ID)
+			checkErr(err)
+			programState.Refresh()
+		}
+	}
+	for programState.clearQueryButton.Clicked() {
+		programState.query = ""
+		programState.queryEditor.SetText("")
+		programState.Refresh()
+	}
 	in := layout.UniformInset(unit.Dp(8))
 	outerInset := layout.UniformInset(unit.Dp(16))
 	outerInset.Layout(gtx, func(gtx C) layout.Dimensions {
@@ -277,6 +692,19 @@ func render(gtx layout.Context, th *material.Theme) {
 									return material.Button(th, &programState.todayButton, "Today").Layout(gtx)
 								})
 							}),
+							layout.Rigid(func(gtx C) D {
+								if programState.readOnly {
+									return D{}
+								}
+								return in.Layout(gtx, func(gtx C) D {
+									return material.Button(th, &programState.trashButton, "Trash").Layout(gtx)
+								})
+							}),
+							layout.Rigid(func(gtx C) D {
+								return in.Layout(gtx, func(gtx C) D {
+									return material.Button(th, &programState.graphButton, "Graph").Layout(gtx)
+								})
+							}),
 						)
 					}),
 					layout.Rigid(func(gtx C) D {
@@ -286,12 +714,22 @@ func render(gtx layout.Context, th *material.Theme) {
 							return editor.Layout(gtx)
 						})
 					}),
+					layout.Rigid(func(gtx C) D {
+						editor := material.Editor(th, &programState.queryEditor, "Query, e.g. [[todo]] -[[done]]")
+						return layout.Inset{Left: unit.Dp(16), Right: unit.Dp(16), Bottom: unit.Dp(16)}.Layout(gtx, func(gtx C) D {
+							return editor.Layout(gtx)
+						})
+					}),
+					// tags used alongside the current one
+					layout.Rigid(func(gtx C) D {
+						return layoutRelatedTags(gtx, th)
+					}),
 					layout.Rigid(func(gtx C) D {
 						return in.Layout(gtx, func(gtx C) D {
 							in := layout.UniformInset(unit.Dp(4))
 							return programState.tagList.Layout(gtx, len(programState.filteredTags), func(gtx C, i int) D {
 								return in.Layout(gtx, func(gtx C) D {
-									return programState.filteredTags[i].layout(gtx, th)
+									return programState.filteredTags[i].layoutTreeItem(gtx, th)
 								})
 							})
 						})
@@ -319,14 +757,47 @@ func render(gtx layout.Context, th *material.Theme) {
 									}
 								})
 							}),
-							// editor widget for adding a new row
+							// namespaces the tag is in, and the tags below it
 							layout.Rigid(func(gtx C) D {
+								return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+									layout.Rigid(func(gtx C) D {
+										return layoutTagButtonBar(gtx, th, "in:", programState.ancestorButtons)
+									}),
+									layout.Rigid(func(gtx C) D {
+										return layoutTagButtonBar(gtx, th, "children:", programState.childTagButtons)
+									}),
+								)
+							}),
+							// editor widget for adding a new row, or for the query of a query tag
+							layout.Rigid(func(gtx C) D {
+								if programState.readOnly {
+									return D{}
+								}
 								return layout.Inset{Top: unit.Dp(8), Left: unit.Dp(8), Right: unit.Dp(8), Bottom: unit.Dp(16)}.Layout(gtx, func(gtx C) D {
-									return material.Editor(th, &programState.newRowEditor, "New row").Layout(gtx)
+									if programState.CurrentDBTag.Kind == db.TagKindQuery {
+										return material.Editor(th, &programState.tagQueryEditor, "Query (empty to turn into a normal tag)").Layout(gtx)
+									}
+									return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+										layout.Rigid(material.Editor(th, &programState.newRowEditor, "New row").Layout),
+										layout.Rigid(func(gtx C) D {
+											return layoutCompletions(gtx, th, &programState.newRowEditor)
+										}),
+									)
 								})
 							}),
+							// snarf register bar
+							layout.Rigid(func(gtx C) D {
+								return layoutSnarfBar(gtx, th)
+							}),
+							// lock bar
+							layout.Rigid(func(gtx C) D {
+								return layoutLockBar(gtx, th)
+							}),
 							// rows for current tag
 							layout.Rigid(func(gtx C) D {
+								if programState.CurrentDBTag.Kind == db.TagKindQuery {
+									return layoutQueryTagRows(gtx, th)
+								}
 								return in.Layout(gtx, func(gtx C) D {
 									var cachedUIRows = programState.currentUIRows
 									return programState.rowList.Layout(gtx, len(cachedUIRows), func(gtx C, i int) D {
@@ -338,6 +809,18 @@ func render(gtx layout.Context, th *material.Theme) {
 							}),
 						)
 					}),
+					// trash pane
+					layout.Rigid(func(gtx C) D {
+						return layoutTrash(gtx, th)
+					}),
+					// graph pane
+					layout.Rigid(func(gtx C) D {
+						return layoutGraph(gtx, th)
+					}),
+					// query results pane
+					layout.Rigid(func(gtx C) D {
+						return layoutQueryResults(gtx, th)
+					}),
 					// references pane
 					layout.Rigid(func(gtx C) D {
 						if len(programState.CurrentDBRefs) > 0 {
@@ -384,10 +867,366 @@ func render(gtx layout.Context, th *material.Theme) {
 						}
 						return layout.Dimensions{}
 					}),
+					// unlinked references pane
+					layout.Rigid(func(gtx C) D {
+						return layoutUnlinkedRefs(gtx, th)
+					}),
 				)
 			}),
 		)
 	})
+	// quick switcher, over everything else
+	layoutSwitcher(gtx, th)
+}
+
+func layoutQueryResults(gtx C, th *material.Theme) D {
+	if programState.query == "" {
+		return D{}
+	}
+
+	in := layout.UniformInset(unit.Dp(8))
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+				layout.Rigid(func(gtx C) D {
+					return in.Layout(gtx, func(gtx C) D {
+						return material.H4(th, "Query results").Layout(gtx)
+					})
+				}),
+				layout.Rigid(func(gtx C) D {
+					if programState.readOnly {
+						return D{}
+					}
+					return in.Layout(gtx, func(gtx C) D {
+						return material.Button(th, &programState.saveQueryButton, "Save as tag").Layout(gtx)
+					})
+				}),
+				layout.Rigid(func(gtx C) D {
+					return in.Layout(gtx, func(gtx C) D {
+						return material.Button(th, &programState.clearQueryButton, "Clear").Layout(gtx)
+					})
+				}),
+			)
+		}),
+		layout.Rigid(func(gtx C) D {
+			if programState.queryError != "" {
+				return in.Layout(gtx, material.Body1(th, programState.queryError).Layout)
+			}
+			if len(programState.queryContent) == 0 {
+				return in.Layout(gtx, material.Body1(th, "No rows matched").Layout)
+			}
+			return programState.queryList.Layout(gtx, len(programState.queryContent), func(gtx C, i int) D {
+				return in.Layout(gtx, func(gtx C) D {
+					switch v := programState.queryContent[i].(type) {
+					case *uiTagButton:
+						// source tag for results
+						return v.layout(gtx, th)
+					case *uiRow:
+						return v.layout(gtx, th)
+					}
+					return D{}
+				})
+			})
+		}),
+	)
+}
+
+// layoutQueryTagRows lays out the read-only rows of the current query tag, grouped by source tag
+func layoutQueryTagRows(gtx C, th *material.Theme) D {
+	in := layout.UniformInset(unit.Dp(8))
+	if programState.tagQueryError != "" {
+		return in.Layout(gtx, material.Body1(th, programState.tagQueryError).Layout)
+	}
+	if len(programState.tagQueryContent) == 0 {
+		return in.Layout(gtx, material.Body1(th, "No rows matched").Layout)
+	}
+	return in.Layout(gtx, func(gtx C) D {
+		return programState.rowList.Layout(gtx, len(programState.tagQueryContent), func(gtx C, i int) D {
+			return layout.Inset{Top: unit.Dp(4), Bottom: unit.Dp(4)}.Layout(gtx, func(gtx C) D {
+				switch v := programState.tagQueryContent[i].(type) {
+				case *uiTagButton:
+					// source tag for the rows below it
+					return v.layout(gtx, th)
+				case *uiRow:
+					return v.layout(gtx, th)
+				}
+				return D{}
+			})
+		})
+	})
+}
+
+// layoutUnlinkedRefs lays out the rows mentioning the current tag without linking to it, which are only searched for
+// once the pane is opened
+func layoutUnlinkedRefs(gtx C, th *material.Theme) D {
+	in := layout.UniformInset(unit.Dp(8))
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+				layout.Rigid(func(gtx C) D {
+					return in.Layout(gtx, func(gtx C) D {
+						return material.H4(th, "Unlinked references").Layout(gtx)
+					})
+				}),
+				layout.Rigid(func(gtx C) D {
+					label := "Show"
+					if programState.ShowUnlinkedRefs {
+						label = "Hide"
+					}
+					return in.Layout(gtx, func(gtx C) D {
+						return material.Button(th, &programState.unlinkedButton, label).Layout(gtx)
+					})
+				}),
+			)
+		}),
+		layout.Rigid(func(gtx C) D {
+			if !programState.ShowUnlinkedRefs {
+				return D{}
+			}
+			if len(programState.unlinkedContent) == 0 {
+				return in.Layout(gtx, material.Body1(th, "No unlinked mentions").Layout)
+			}
+			return programState.unlinkedRefList.Layout(gtx, len(programState.unlinkedContent), func(gtx C, i int) D {
+				return in.Layout(gtx, func(gtx C) D {
+					switch v := programState.unlinkedContent[i].(type) {
+					case *uiTagButton:
+						// source tag for the mentions below it
+						return v.layout(gtx, th)
+					case *uiUnlinkedRef:
+						return v.layout(gtx, th)
+					}
+					return D{}
+				})
+			})
+		}),
+	)
+}
+
+func (r *uiUnlinkedRef) layout(gtx layout.Context, th *material.Theme) D {
+	for r.linkButton.Clicked() {
+		text, ok := db.LinkMention(r.row.Text, programState.CurrentDBTag.Name)
+		if ok {
+			err := programState.DB.UpdateRowText(r.row.ID, text)
+			checkErr(err)
+		}
+		programState.Refresh()
+	}
+
+	return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			if programState.readOnly {
+				return D{}
+			}
+			return layout.Inset{Right: unit.Dp(8)}.Layout(gtx, material.Button(th, &r.linkButton, "Link").Layout)
+		}),
+		layout.Flexed(1, func(gtx C) D {
+			return r.uiRow.layout(gtx, th)
+		}),
+	)
+}
+
+func layoutSnarfBar(gtx C, th *material.Theme) D {
+	if programState.readOnly {
+		return D{}
+	}
+
+	in := layout.Inset{Left: unit.Dp(8), Right: unit.Dp(8)}
+	return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return in.Layout(gtx, material.Body1(th, "Register").Layout)
+		}),
+		layout.Rigid(func(gtx C) D {
+			gtx.Constraints.Min.X = gtx.Px(unit.Dp(32))
+			gtx.Constraints.Max.X = gtx.Constraints.Min.X
+			return material.Editor(th, &programState.registerEditor, "").Layout(gtx)
+		}),
+		layout.Rigid(func(gtx C) D {
+			return in.Layout(gtx, material.Button(th, &programState.yankAllButton, "Yank all").Layout)
+		}),
+		layout.Rigid(func(gtx C) D {
+			return in.Layout(gtx, material.Button(th, &programState.pasteButton, "Paste").Layout)
+		}),
+		layout.Rigid(func(gtx C) D {
+			return in.Layout(gtx, material.Body1(th, programState.snarfStatus).Layout)
+		}),
+		layout.Rigid(func(gtx C) D {
+			if programState.movingRow == nil {
+				return D{}
+			}
+			return in.Layout(gtx, material.Button(th, &programState.cancelMoveButton, "Cancel move").Layout)
+		}),
+	)
+}
+
+// layoutLockBar lays out the passphrase editor and buttons locking the current tag, unlocking it for the session, or
+// removing its lock
+func layoutLockBar(gtx C, th *material.Theme) D {
+	tag := programState.CurrentDBTag
+	// read-only databases can still be unlocked
+	if tag.Kind == db.TagKindQuery || (programState.readOnly && tag.Kind != db.TagKindLocked) {
+		return D{}
+	}
+	unlocked := tag.Kind == db.TagKindLocked && programState.DB.IsTagUnlocked(tag.ID)
+
+	for _, e := range programState.tagLockEditor.Events() {
+		if _, ok := e.(widget.SubmitEvent); ok {
+			programState.lockButton.Click()
+		}
+	}
+	for programState.lockButton.Clicked() {
+		passphrase := programState.tagLockEditor.Text()
+		if passphrase == "" {
+			break
+		}
+		var snapshots []db.Snapshot
+		var err error
+		if tag.Kind == db.TagKindLocked {
+			err = programState.DB.UnlockTag(tag.ID, passphrase)
+		} else {
+			snapshots, err = programState.DB.LockTag(tag.ID, passphrase)
+		}
+		programState.tagLockEditor.SetText("")
+		if err == db.ErrPassphrase {
+			programState.lockStatus = err.Error()
+			break
+		}
+		checkErr(err)
+		programState.lockStatus = ""
+		if len(snapshots) > 0 {
+			programState.lockStatus = fmt.Sprintf("the %d backups taken before still hold its rows in plaintext", len(snapshots))
+		}
+		programState.CurrentDBTag, err = programState.DB.GetTagByID(tag.ID)
+		checkErr(err)
+		programState.Refresh()
+	}
+	for programState.relockButton.Clicked() {
+		programState.DB.RelockTag(tag.ID)
+		programState.lockStatus = ""
+		programState.Refresh()
+	}
+	for programState.removeLockButton.Clicked() {
+		err := programState.DB.RemoveTagLock(tag.ID, programState.tagLockEditor.Text())
+		programState.tagLockEditor.SetText("")
+		if err == db.ErrPassphrase {
+			programState.lockStatus = err.Error()
+			break
+		}
+		checkErr(err)
+		programState.lockStatus = ""
+		programState.CurrentDBTag, err = programState.DB.GetTagByID(tag.ID)
+		checkErr(err)
+		programState.Refresh()
+	}
+
+	in := layout.Inset{Left: unit.Dp(8), Right: unit.Dp(8)}
+	if unlocked {
+		return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+			layout.Rigid(func(gtx C) D {
+				return in.Layout(gtx, material.Body1(th, "Unlocked").Layout)
+			}),
+			layout.Rigid(func(gtx C) D {
+				return in.Layout(gtx, material.Button(th, &programState.relockButton, "Lock").Layout)
+			}),
+		)
+	}
+
+	lockLabel := "Lock"
+	if tag.Kind == db.TagKindLocked {
+		lockLabel = "Unlock"
+	}
+	return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			gtx.Constraints.Min.X = gtx.Px(unit.Dp(160))
+			gtx.Constraints.Max.X = gtx.Constraints.Min.X
+			return in.Layout(gtx, material.Editor(th, &programState.tagLockEditor, "Tag passphrase").Layout)
+		}),
+		layout.Rigid(func(gtx C) D {
+			return in.Layout(gtx, material.Button(th, &programState.lockButton, lockLabel).Layout)
+		}),
+		layout.Rigid(func(gtx C) D {
+			if tag.Kind != db.TagKindLocked || programState.readOnly {
+				return D{}
+			}
+			return in.Layout(gtx, material.Button(th, &programState.removeLockButton, "Remove lock").Layout)
+		}),
+		layout.Rigid(func(gtx C) D {
+			return in.Layout(gtx, material.Body1(th, programState.lockStatus).Layout)
+		}),
+	)
+}
+
+func layoutTrash(gtx C, th *material.Theme) D {
+	if !programState.showTrash {
+		return D{}
+	}
+
+	in := layout.UniformInset(unit.Dp(8))
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+				layout.Rigid(func(gtx C) D {
+					return in.Layout(gtx, func(gtx C) D {
+						return material.H4(th, "Trash").Layout(gtx)
+					})
+				}),
+				layout.Rigid(func(gtx C) D {
+					return in.Layout(gtx, func(gtx C) D {
+						return material.Button(th, &programState.emptyTrashButton, "Empty").Layout(gtx)
+					})
+				}),
+			)
+		}),
+		layout.Rigid(func(gtx C) D {
+			if len(programState.trashContent) == 0 {
+				return in.Layout(gtx, material.Body1(th, "Trash is empty").Layout)
+			}
+			return programState.trashList.Layout(gtx, len(programState.trashContent), func(gtx C, i int) D {
+				return in.Layout(gtx, func(gtx C) D {
+					switch v := programState.trashContent[i].(type) {
+					case *uiTrashedTag:
+						return v.layout(gtx, th)
+					case *uiTrashedRow:
+						return v.layout(gtx, th)
+					}
+					return D{}
+				})
+			})
+		}),
+	)
+}
+
+func (t *uiTrashedTag) layout(gtx layout.Context, th *material.Theme) D {
+	for t.restoreButton.Clicked() {
+		tag, err := programState.DB.RestoreTag(t.trashed.ID)
+		checkErr(err)
+		programState.CurrentDBTag = tag
+		programState.Refresh()
+	}
+
+	label := fmt.Sprintf("tag %s (%d rows, deleted %s)", t.trashed.Name, t.trashed.RowCount, time.Unix(0, t.trashed.DeletedTS).Format("2006-01-02 15:04"))
+	return layoutTrashItem(gtx, th, &t.restoreButton, label)
+}
+
+func (t *uiTrashedRow) layout(gtx layout.Context, th *material.Theme) D {
+	for t.restoreButton.Clicked() {
+		_, err := programState.DB.RestoreRow(t.trashed.ID)
+		if err != db.ErrQueryTag {
+			checkErr(err)
+		}
+		programState.Refresh()
+	}
+
+	label := fmt.Sprintf("%s: %s", t.trashed.TagName, t.trashed.Row.Text)
+	return layoutTrashItem(gtx, th, &t.restoreButton, label)
+}
+
+func layoutTrashItem(gtx layout.Context, th *material.Theme, restoreButton *widget.Clickable, label string) D {
+	return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return layout.Inset{Right: unit.Dp(8)}.Layout(gtx, material.Button(th, restoreButton, "Restore").Layout)
+		}),
+		layout.Flexed(1, material.Body1(th, label).Layout),
+	)
 }
 
 func unEditAllTheThings() {
@@ -403,12 +1242,22 @@ func unEditAllTheThings() {
 		}
 		programState.currentUIRefRows[tag] = rows
 	}
+	for _, item := range programState.queryContent {
+		if row, ok := item.(*uiRow); ok {
+			row.editing = false
+		}
+	}
+	for _, item := range programState.unlinkedContent {
+		if ref, ok := item.(*uiUnlinkedRef); ok {
+			ref.editing = false
+		}
+	}
 }
 
 func (r *uiRow) layout(gtx layout.Context, th *material.Theme) D {
 	for _, e := range gtx.Events(r) {
 		if e, ok := e.(pointer.Event); ok {
-			if e.Type == pointer.Release {
+			if e.Type == pointer.Release && !r.readOnly {
 				unEditAllTheThings()
 				if !r.editing {
 					r.editing = true
@@ -439,6 +1288,27 @@ func (r *uiRow) layout(gtx layout.Context, th *material.Theme) D {
 			programState.Refresh()
 		}
 	}
+	for r.yankButton.Clicked() {
+		err := programState.DB.PushSnarf(programState.register(), []db.Row{r.row})
+		checkErr(err)
+		r.editing = false
+		programState.snarfStatus = "yanked 1 row"
+	}
+	for r.moveButton.Clicked() {
+		row := r.row
+		programState.movingRow = &row
+		r.editing = false
+		programState.snarfStatus = "click a tag to move the row there"
+	}
+	for r.cutButton.Clicked() {
+		err := programState.DB.PushSnarf(programState.register(), []db.Row{r.row})
+		checkErr(err)
+		err = programState.DB.DeleteRowByID(r.row.ID)
+		checkErr(err)
+		r.editing = false
+		programState.Refresh()
+		programState.snarfStatus = "cut 1 row"
+	}
 	if !r.editing {
 		flexChildren := []layout.FlexChild{}
 		for _, item := range r.content {
@@ -451,6 +1321,19 @@ func (r *uiRow) layout(gtx layout.Context, th *material.Theme) D {
 				flexChildren = append(flexChildren, layout.Rigid(func(gtx C) D {
 					return v.layout(gtx, th)
 				}))
+			case uiCode:
+				flexChildren = append(flexChildren, layout.Rigid(func(gtx C) D {
+					label := material.Body1(th, string(v))
+					label.Font.Variant = "Mono"
+					return label.Layout(gtx)
+				}))
+			case uiPropertyKey:
+				flexChildren = append(flexChildren, layout.Rigid(func(gtx C) D {
+					label := material.Body1(th, string(v)+"::")
+					label.Font.Weight = text.Bold
+					label.Color = th.Palette.ContrastBg
+					return layout.Inset{Right: unit.Dp(4)}.Layout(gtx, label.Layout)
+				}))
 			default:
 				panic("unknown type encountered in uiRow.content")
 			}
@@ -458,6 +1341,9 @@ func (r *uiRow) layout(gtx layout.Context, th *material.Theme) D {
 		// edit row handler
 		return layout.Stack{}.Layout(gtx,
 			layout.Expanded(func(gtx C) D {
+				if r.readOnly {
+					return D{Size: gtx.Constraints.Min}
+				}
 				pointer.Rect(image.Rectangle{Max: gtx.Constraints.Min}).Add(gtx.Ops)
 				pointer.InputOp{Tag: r, Types: pointer.Release}.Add(gtx.Ops)
 				pointer.CursorNameOp{Name: pointer.CursorPointer}.Add(gtx.Ops)
@@ -470,16 +1356,198 @@ func (r *uiRow) layout(gtx layout.Context, th *material.Theme) D {
 			}),
 		)
 	} else {
-		return material.Editor(th, &r.editor, "").Layout(gtx)
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+			layout.Rigid(func(gtx C) D {
+				return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+					layout.Flexed(1, material.Editor(th, &r.editor, "").Layout),
+					layout.Rigid(func(gtx C) D {
+						return layout.Inset{Left: unit.Dp(8)}.Layout(gtx, material.Button(th, &r.yankButton, "Yank").Layout)
+					}),
+					layout.Rigid(func(gtx C) D {
+						return layout.Inset{Left: unit.Dp(8)}.Layout(gtx, material.Button(th, &r.cutButton, "Cut").Layout)
+					}),
+					layout.Rigid(func(gtx C) D {
+						return layout.Inset{Left: unit.Dp(8)}.Layout(gtx, material.Button(th, &r.moveButton, "Move").Layout)
+					}),
+				)
+			}),
+			layout.Rigid(func(gtx C) D {
+				return layoutCompletions(gtx, th, &r.editor)
+			}),
+		)
 	}
 }
 
 func (t *uiTagButton) layout(gtx layout.Context, th *material.Theme) D {
+	return t.layoutStyle(gtx, t.style(th))
+}
+
+// style returns the button showing the tag, with query and locked tags told apart from tags that hold rows
+func (t *uiTagButton) style(th *material.Theme) material.ButtonStyle {
+	label := t.tag.Name
+	if t.label != "" {
+		label = t.label
+	}
+	button := material.Button(th, &t.button, label)
+	switch t.tag.Kind {
+	case db.TagKindQuery:
+		button.Font.Style = text.Italic
+	case db.TagKindLocked:
+		button.Font.Weight = text.Bold
+	}
+	return button
+}
+
+// layoutStyle handles clicks on the tag button, and lays it out with the given style
+func (t *uiTagButton) layoutStyle(gtx layout.Context, button material.ButtonStyle) D {
 	for t.button.Clicked() {
+		if programState.movingRow != nil {
+			// tags are drop targets while a row is being moved
+			err := programState.DB.MoveRowsToTag([]int64{programState.movingRow.ID}, t.tag.ID, -1)
+			programState.movingRow = nil
+			if err == db.ErrQueryTag || err == db.ErrTagLocked {
+				programState.snarfStatus = err.Error()
+				break
+			}
+			checkErr(err)
+			programState.snarfStatus = "moved row to " + t.tag.Name
+			// the move may have cleaned up the current tag
+			if _, err := programState.DB.GetTagByID(programState.CurrentDBTag.ID); err != nil {
+				programState.GoToToday()
+			}
+			programState.Refresh()
+			break
+		}
 		programState.CurrentDBTag = t.tag
 		programState.Refresh()
 	}
 
-	button := material.Button(th, &t.button, t.tag.Name)
 	return button.Layout(gtx)
 }
+
+// layoutTreeItem lays out a tag of the tag list, indented below its namespace, with a button expanding or collapsing
+// its children
+func (t *uiTagTreeItem) layoutTreeItem(gtx layout.Context, th *material.Theme) D {
+	for t.expandButton.Clicked() {
+		programState.expandedTags[t.tag.ID] = !programState.expandedTags[t.tag.ID]
+		programState.FilterTags()
+	}
+
+	indent := 16 * t.depth
+	if programState.tagFilterEditor.Text() != "" {
+		// filtered tags are listed flat
+		indent = 0
+	}
+
+	return layout.Inset{Left: unit.Dp(float32(indent))}.Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+			layout.Rigid(func(gtx C) D {
+				if !t.hasChildren || programState.tagFilterEditor.Text() != "" {
+					return D{}
+				}
+				sign := "+"
+				if programState.expandedTags[t.tag.ID] {
+					sign = "-"
+				}
+				return layout.Inset{Right: unit.Dp(4)}.Layout(gtx, material.Button(th, &t.expandButton, sign).Layout)
+			}),
+			layout.Rigid(func(gtx C) D {
+				return t.layout(gtx, th)
+			}),
+		)
+	})
+}
+
+// layoutCompletions lays out the tag names completing the link being typed at the caret of editor, if it's focused.
+// Clicking one finishes the link with it.
+func layoutCompletions(gtx layout.Context, th *material.Theme, editor *widget.Editor) D {
+	c := &programState.completions
+	if !editor.Focused() {
+		return D{}
+	}
+
+	text := editor.Text()
+	caret, _ := editor.Selection()
+	if caret > len(text) {
+		return D{}
+	}
+	head := text[:caret]
+	start, ok := db.OpenLink(head)
+	if !ok {
+		return D{}
+	}
+
+	if c.editor != editor || c.query != head[start:] || c.buttons == nil {
+		var err error
+		c.editor, c.query = editor, head[start:]
+		c.tags, err = programState.DB.CompleteTags(c.query, db.MaxCompletions)
+		checkErr(err)
+		c.buttons = make([]widget.Clickable, len(c.tags))
+	}
+
+	for i := range c.buttons {
+		for c.buttons[i].Clicked() {
+			// replace what's been typed of the name
+			editor.SetCaret(start, caret)
+			editor.Insert(c.tags[i].Name + "]]")
+			editor.Focus()
+			c.buttons = nil
+			return D{}
+		}
+	}
+
+	children := make([]layout.FlexChild, 0, len(c.tags))
+	for i := range c.tags {
+		i := i
+		children = append(children, layout.Rigid(func(gtx C) D {
+			button := material.Button(th, &c.buttons[i], c.tags[i].Name)
+			button.TextSize = th.TextSize.Scale(0.8)
+			button.Inset = layout.UniformInset(unit.Dp(4))
+			return layout.Inset{Top: unit.Dp(4), Right: unit.Dp(4)}.Layout(gtx, button.Layout)
+		}))
+	}
+
+	return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx, children...)
+}
+
+// layoutRelatedTags lays out the tags related to the current one in the tags pane, one per line
+func layoutRelatedTags(gtx layout.Context, th *material.Theme) D {
+	if len(programState.relatedButtons) == 0 {
+		return D{}
+	}
+
+	children := []layout.FlexChild{layout.Rigid(material.Body1(th, "related:").Layout)}
+	for i := range programState.relatedButtons {
+		button := &programState.relatedButtons[i]
+		children = append(children, layout.Rigid(func(gtx C) D {
+			return layout.Inset{Top: unit.Dp(4), Left: unit.Dp(8)}.Layout(gtx, func(gtx C) D {
+				return button.layout(gtx, th)
+			})
+		}))
+	}
+
+	return layout.Inset{Left: unit.Dp(16), Right: unit.Dp(16), Bottom: unit.Dp(8)}.Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+	})
+}
+
+// layoutTagButtonBar lays out a row of tag buttons after a caption, or nothing if there are no buttons
+func layoutTagButtonBar(gtx layout.Context, th *material.Theme, caption string, buttons []uiTagButton) D {
+	if len(buttons) == 0 {
+		return D{}
+	}
+
+	children := []layout.FlexChild{layout.Rigid(material.Body1(th, caption).Layout)}
+	for i := range buttons {
+		button := &buttons[i]
+		children = append(children, layout.Rigid(func(gtx C) D {
+			return layout.Inset{Left: unit.Dp(4)}.Layout(gtx, func(gtx C) D {
+				return button.layout(gtx, th)
+			})
+		}))
+	}
+
+	return layout.Inset{Left: unit.Dp(8), Right: unit.Dp(8)}.Layout(gtx, func(gtx C) D {
+		return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx, children...)
+	})
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+	"time"
+
+	"gioui.org/f32"
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/op/clip"
+	"gioui.org/op/paint"
+	"gioui.org/unit"
+	"gioui.org/widget/material"
+	"github.com/neutralinsomniac/exocortex/db"
+)
+
+const (
+	// maxGraphNodes bounds the tags shown in the graph pane; the most linked ones are kept
+	maxGraphNodes = 150
+	// graphIterations is the number of steps the force-directed layout takes
+	graphIterations = 200
+	// maxGraphDepth bounds the depth control, since every level can multiply the tags to lay out
+	maxGraphDepth = 4
+)
+
+// uiGraphNode is a tag in the graph pane. x and y are in [0, 1].
+type uiGraphNode struct {
+	uiTagButton
+	x, y float64
+}
+
+// uiGraphEdge links two nodes, by index
+type uiGraphEdge struct {
+	from, to int
+	weight   int
+}
+
+type uiGraph struct {
+	nodes []*uiGraphNode
+	edges []uiGraphEdge
+}
+
+func isDateTag(tag db.Tag) bool {
+	_, err := time.Parse(db.DateTagFormat, tag.Name)
+	return err == nil
+}
+
+// newUIGraph turns the neighborhood of the current tag into a laid out graph, leaving date tags out if hideDates is
+// set
+func newUIGraph(graph db.Graph, current db.Tag, hideDates bool) *uiGraph {
+	var g uiGraph
+
+	// weigh the tags by their links, to keep the most linked ones if there are too many
+	weights := make(map[int64]int)
+	keep := make(map[int64]bool)
+	for _, tag := range graph.Tags {
+		keep[tag.ID] = tag.ID == current.ID || !hideDates || !isDateTag(tag)
+	}
+	for _, edge := range graph.Edges {
+		if keep[edge.From] && keep[edge.To] {
+			weights[edge.From] += edge.Weight
+			weights[edge.To] += edge.Weight
+		}
+	}
+
+	var tags []db.Tag
+	for _, tag := range graph.Tags {
+		// tags only linked through hidden ones would float around unconnected
+		if tag.ID == current.ID || (keep[tag.ID] && weights[tag.ID] > 0) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxGraphNodes {
+		sort.SliceStable(tags, func(i, j int) bool {
+			if tags[i].ID == current.ID || tags[j].ID == current.ID {
+				return tags[i].ID == current.ID
+			}
+			return weights[tags[i].ID] > weights[tags[j].ID]
+		})
+		tags = tags[:maxGraphNodes]
+	}
+
+	index := make(map[int64]int)
+	center := 0
+	for i, tag := range tags {
+		index[tag.ID] = i
+		if tag.ID == current.ID {
+			center = i
+		}
+		g.nodes = append(g.nodes, &uiGraphNode{uiTagButton: uiTagButton{tag: tag}})
+	}
+	for _, edge := range graph.Edges {
+		from, ok := index[edge.From]
+		if !ok {
+			continue
+		}
+		to, ok := index[edge.To]
+		if !ok {
+			continue
+		}
+		g.edges = append(g.edges, uiGraphEdge{from, to, edge.Weight})
+	}
+
+	g.layoutForces(center)
+
+	return &g
+}
+
+// layoutForces places the nodes with a Fruchterman-Reingold force-directed layout: nodes push each other away, and
+// edges pull the nodes they link together. The center node stays in the middle. The starting positions are spread
+// around it deterministically, so the same graph is always laid out the same way.
+func (g *uiGraph) layoutForces(center int) {
+	n := len(g.nodes)
+	if n == 0 {
+		return
+	}
+
+	for i, node := range g.nodes {
+		angle := float64(i) * math.Pi * (3 - math.Sqrt(5))
+		radius := 0.4 * math.Sqrt(float64(i)/float64(n))
+		node.x = 0.5 + radius*math.Cos(angle)
+		node.y = 0.5 + radius*math.Sin(angle)
+	}
+	g.nodes[center].x, g.nodes[center].y = 0.5, 0.5
+
+	k := math.Sqrt(1 / float64(n))
+	temperature := 0.1
+	dx := make([]float64, n)
+	dy := make([]float64, n)
+
+	for iteration := 0; iteration < graphIterations; iteration++ {
+		for i := range dx {
+			dx[i], dy[i] = 0, 0
+		}
+
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				x := g.nodes[i].x - g.nodes[j].x
+				y := g.nodes[i].y - g.nodes[j].y
+				d := math.Max(math.Hypot(x, y), 0.001)
+				force := k * k / d
+				dx[i] += x / d * force
+				dy[i] += y / d * force
+				dx[j] -= x / d * force
+				dy[j] -= y / d * force
+			}
+		}
+
+		for _, edge := range g.edges {
+			x := g.nodes[edge.from].x - g.nodes[edge.to].x
+			y := g.nodes[edge.from].y - g.nodes[edge.to].y
+			d := math.Max(math.Hypot(x, y), 0.001)
+			force := d * d / k
+			dx[edge.from] -= x / d * force
+			dy[edge.from] -= y / d * force
+			dx[edge.to] += x / d * force
+			dy[edge.to] += y / d * force
+		}
+
+		for i, node := range g.nodes {
+			if i == center {
+				continue
+			}
+			d := math.Max(math.Hypot(dx[i], dy[i]), 0.001)
+			step := math.Min(d, temperature)
+			node.x = math.Min(1, math.Max(0, node.x+dx[i]/d*step))
+			node.y = math.Min(1, math.Max(0, node.y+dy[i]/d*step))
+		}
+
+		temperature *= 0.97
+	}
+}
+
+// loadGraph refreshes the graph pane while it's shown
+func (p *state) loadGraph() {
+	p.graph = nil
+
+	if !p.showGraph || p.CurrentDBTag.ID == 0 {
+		return
+	}
+
+	graph, err := p.DB.GetTagNeighborhood(p.CurrentDBTag.ID, p.graphDepth)
+	checkErr(err)
+
+	p.graph = newUIGraph(graph, p.CurrentDBTag, p.hideDatesBox.Value)
+}
+
+func layoutGraph(gtx C, th *material.Theme) D {
+	if !programState.showGraph {
+		return D{}
+	}
+
+	for programState.depthDownButton.Clicked() {
+		if programState.graphDepth > 1 {
+			programState.graphDepth--
+			programState.loadGraph()
+		}
+	}
+	for programState.depthUpButton.Clicked() {
+		if programState.graphDepth < maxGraphDepth {
+			programState.graphDepth++
+			programState.loadGraph()
+		}
+	}
+	if programState.hideDatesBox.Changed() {
+		programState.loadGraph()
+	}
+
+	in := layout.UniformInset(unit.Dp(8))
+	return layout.Flex{Axis: layout.Vertical}.Layout(gtx,
+		layout.Rigid(func(gtx C) D {
+			return layout.Flex{Axis: layout.Horizontal, Alignment: layout.Middle}.Layout(gtx,
+				layout.Rigid(func(gtx C) D {
+					return in.Layout(gtx, func(gtx C) D {
+						return material.H4(th, "Graph").Layout(gtx)
+					})
+				}),
+				layout.Rigid(func(gtx C) D {
+					return in.Layout(gtx, material.Body1(th, fmt.Sprintf("Depth %d", programState.graphDepth)).Layout)
+				}),
+				layout.Rigid(func(gtx C) D {
+					return in.Layout(gtx, material.Button(th, &programState.depthDownButton, "-").Layout)
+				}),
+				layout.Rigid(func(gtx C) D {
+					return in.Layout(gtx, material.Button(th, &programState.depthUpButton, "+").Layout)
+				}),
+				layout.Rigid(func(gtx C) D {
+					return in.Layout(gtx, material.CheckBox(th, &programState.hideDatesBox, "Hide date tags").Layout)
+				}),
+			)
+		}),
+		layout.Rigid(func(gtx C) D {
+			if programState.graph == nil || len(programState.graph.edges) == 0 {
+				return in.Layout(gtx, material.Body1(th, "No links").Layout)
+			}
+			return in.Layout(gtx, func(gtx C) D {
+				return programState.graph.layout(gtx, th)
+			})
+		}),
+	)
+}
+
+// layout draws the edges as lines, thicker for heavier links, and the nodes as tag buttons on top of them
+func (g *uiGraph) layout(gtx C, th *material.Theme) D {
+	size := f32.Point{X: float32(gtx.Constraints.Max.X), Y: float32(gtx.Px(unit.Dp(400)))}
+	margin := f32.Point{X: float32(gtx.Px(unit.Dp(64))), Y: float32(gtx.Px(unit.Dp(16)))}
+	position := func(node *uiGraphNode) f32.Point {
+		return f32.Point{
+			X: margin.X + float32(node.x)*(size.X-2*margin.X),
+			Y: margin.Y + float32(node.y)*(size.Y-2*margin.Y),
+		}
+	}
+
+	for _, edge := range g.edges {
+		var path clip.Path
+		path.Begin(gtx.Ops)
+		path.MoveTo(position(g.nodes[edge.from]))
+		path.LineTo(position(g.nodes[edge.to]))
+		width := float32(gtx.Px(unit.Dp(1))) * (1 + float32(math.Log(float64(edge.weight))))
+		paint.FillShape(gtx.Ops, color.NRGBA{A: 0x60}, clip.Stroke{Path: path.End(), Style: clip.StrokeStyle{Width: width}}.Op())
+	}
+
+	for _, node := range g.nodes {
+		button := node.style(th)
+		button.TextSize = th.TextSize.Scale(0.8)
+		button.Inset = layout.UniformInset(unit.Dp(4))
+		if node.tag.ID != programState.CurrentDBTag.ID {
+			button.Background = color.NRGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}
+		}
+
+		// center the button on its node
+		macro := op.Record(gtx.Ops)
+		nodeGtx := gtx
+		nodeGtx.Constraints.Min = image.Point{}
+		dims := node.uiTagButton.layoutStyle(nodeGtx, button)
+		call := macro.Stop()
+
+		stack := op.Save(gtx.Ops)
+		center := position(node)
+		op.Offset(center.Sub(f32.Point{X: float32(dims.Size.X) / 2, Y: float32(dims.Size.Y) / 2})).Add(gtx.Ops)
+		call.Add(gtx.Ops)
+		stack.Load()
+	}
+
+	return D{Size: image.Point{X: int(size.X), Y: int(size.Y)}}
+}
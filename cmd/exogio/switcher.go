@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"gioui.org/f32"
+	"gioui.org/io/key"
+	"gioui.org/io/pointer"
+	"gioui.org/layout"
+	"gioui.org/op"
+	"gioui.org/op/clip"
+	"gioui.org/op/paint"
+	"gioui.org/unit"
+	"gioui.org/widget"
+	"gioui.org/widget/material"
+	"github.com/neutralinsomniac/exocortex/db"
+)
+
+const (
+	// switcherLines is the number of matches the quick switcher shows at once
+	switcherLines = 12
+	// maxRecentTags bounds the visited tags the quick switcher lists first
+	maxRecentTags = 20
+)
+
+// uiSwitcher is the quick switcher: a box over the window narrowing the tags down to those matching what's typed, for
+// jumping to one without the mouse
+type uiSwitcher struct {
+	editor   widget.Editor
+	counts   map[int64]int
+	matches  []uiTagButton
+	selected int
+}
+
+// openSwitcher shows the quick switcher, with the tags visited last first
+func (p *state) openSwitcher() {
+	var err error
+
+	s := &uiSwitcher{editor: widget.Editor{SingleLine: true, Submit: true}}
+	s.counts, err = p.DB.GetRowCounts()
+	checkErr(err)
+	s.filter()
+	s.editor.Focus()
+
+	unEditAllTheThings()
+	p.switcher = s
+}
+
+func (p *state) closeSwitcher() {
+	p.switcher = nil
+	p.newRowEditor.Focus()
+}
+
+// pushRecentTag moves the tag called name to the front of the visited tags
+func (p *state) pushRecentTag(name string) {
+	recent := []string{name}
+	for _, n := range p.recentTags {
+		if n != name && len(recent) < maxRecentTags {
+			recent = append(recent, n)
+		}
+	}
+	p.recentTags = recent
+}
+
+func (s *uiSwitcher) filter() {
+	// the current tag is first in the visited tags, but there's no point switching to it
+	var recent []string
+	if len(programState.recentTags) > 0 {
+		recent = programState.recentTags[1:]
+	}
+
+	s.matches = nil
+	for _, tag := range db.FilterTags(programState.AllDBTags, s.editor.Text(), recent) {
+		button := uiTagButton{tag: tag}
+		if tag.Kind == db.TagKindNormal {
+			button.label = fmt.Sprintf("%s (%d rows)", tag.Name, s.counts[tag.ID])
+		}
+		s.matches = append(s.matches, button)
+	}
+	s.selected = 0
+}
+
+func (s *uiSwitcher) move(delta int) {
+	s.selected += delta
+	if s.selected >= len(s.matches) {
+		s.selected = len(s.matches) - 1
+	}
+	if s.selected < 0 {
+		s.selected = 0
+	}
+}
+
+func (s *uiSwitcher) switchTo(tag db.Tag) {
+	programState.closeSwitcher()
+	programState.CurrentDBTag = tag
+	programState.Refresh()
+}
+
+// handleSwitcherKey opens or closes the quick switcher on ctrl+k, and moves its selection while it's open. It returns
+// whether the window needs to be drawn again.
+func handleSwitcherKey(e key.Event) bool {
+	p := &programState
+	if e.State != key.Press || p.locked {
+		return false
+	}
+
+	switch {
+	case e.Name == "K" && e.Modifiers.Contain(key.ModShortcut):
+		if p.switcher != nil {
+			p.closeSwitcher()
+		} else {
+			p.openSwitcher()
+		}
+	case p.switcher == nil:
+		return false
+	case e.Name == key.NameEscape:
+		p.closeSwitcher()
+	case e.Name == key.NameUpArrow:
+		p.switcher.move(-1)
+	case e.Name == key.NameDownArrow:
+		p.switcher.move(1)
+	case e.Name == key.NamePageUp:
+		p.switcher.move(-switcherLines)
+	case e.Name == key.NamePageDown:
+		p.switcher.move(switcherLines)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// layoutSwitcher draws the quick switcher over the rest of the window, if it's open. Clicking outside of it closes it.
+func layoutSwitcher(gtx C, th *material.Theme) {
+	s := programState.switcher
+	if s == nil {
+		return
+	}
+
+	for _, e := range gtx.Events(s) {
+		if e, ok := e.(pointer.Event); ok && e.Type == pointer.Press {
+			programState.closeSwitcher()
+			return
+		}
+	}
+	for _, e := range s.editor.Events() {
+		switch e.(type) {
+		case widget.ChangeEvent:
+			s.filter()
+		case widget.SubmitEvent:
+			if len(s.matches) > 0 {
+				s.switchTo(s.matches[s.selected].tag)
+				return
+			}
+		}
+	}
+
+	// scroll so the selection stays visible
+	start := 0
+	if s.selected >= switcherLines {
+		start = s.selected - switcherLines + 1
+	}
+	end := start + switcherLines
+	if end > len(s.matches) {
+		end = len(s.matches)
+	}
+
+	for i := start; i < end; i++ {
+		for s.matches[i].button.Clicked() {
+			s.switchTo(s.matches[i].tag)
+			return
+		}
+	}
+
+	// the scrim keeps clicks from reaching the window below
+	stack := op.Save(gtx.Ops)
+	pointer.Rect(image.Rectangle{Max: gtx.Constraints.Max}).Add(gtx.Ops)
+	pointer.InputOp{Tag: s, Types: pointer.Press}.Add(gtx.Ops)
+	paint.Fill(gtx.Ops, color.NRGBA{A: 0x60})
+	stack.Load()
+
+	in := layout.UniformInset(unit.Dp(8))
+	panelGtx := gtx
+	panelGtx.Constraints.Min = image.Point{}
+	if width := gtx.Px(unit.Dp(600)); panelGtx.Constraints.Max.X > width {
+		panelGtx.Constraints.Max.X = width
+	}
+	panelGtx.Constraints.Min.X = panelGtx.Constraints.Max.X
+
+	macro := op.Record(gtx.Ops)
+	dims := in.Layout(panelGtx, func(gtx C) D {
+		children := []layout.FlexChild{
+			layout.Rigid(func(gtx C) D {
+				editor := material.Editor(th, &s.editor, "Jump to tag")
+				editor.TextSize = material.H5(th, "").TextSize
+				return in.Layout(gtx, editor.Layout)
+			}),
+		}
+		for i := start; i < end; i++ {
+			match := &s.matches[i]
+			selected := i == s.selected
+			children = append(children, layout.Rigid(func(gtx C) D {
+				button := match.style(th)
+				button.Inset = layout.UniformInset(unit.Dp(6))
+				if !selected {
+					button.Background = color.NRGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}
+				}
+				return layout.Inset{Left: unit.Dp(8), Top: unit.Dp(2), Bottom: unit.Dp(2)}.Layout(gtx, button.Layout)
+			}))
+		}
+		children = append(children, layout.Rigid(func(gtx C) D {
+			caption := fmt.Sprintf("%d of %d tags; arrows move, enter switches, esc closes", len(s.matches), len(programState.AllDBTags))
+			return in.Layout(gtx, material.Caption(th, caption).Layout)
+		}))
+
+		return layout.Flex{Axis: layout.Vertical}.Layout(gtx, children...)
+	})
+	call := macro.Stop()
+
+	// centered near the top of the window
+	stack = op.Save(gtx.Ops)
+	op.Offset(f32.Point{X: float32(gtx.Constraints.Max.X-dims.Size.X) / 2, Y: float32(gtx.Px(unit.Dp(64)))}).Add(gtx.Ops)
+	bounds := f32.Rectangle{Max: layout.FPt(dims.Size)}
+	paint.FillShape(gtx.Ops, th.Palette.Bg, clip.UniformRRect(bounds, float32(gtx.Px(unit.Dp(4)))).Op(gtx.Ops))
+	// clicks on the panel itself don't close it
+	pointer.Rect(image.Rectangle{Max: dims.Size}).Add(gtx.Ops)
+	pointer.InputOp{Tag: &s.matches, Types: pointer.Press}.Add(gtx.Ops)
+	call.Add(gtx.Ops)
+	stack.Load()
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"regexp"
 	"time"
 
 	g "github.com/AllenDang/giu"
@@ -19,6 +19,9 @@ type state struct {
 	currentUIRows       []*uiRow
 	currentUIRefRows    map[db.Tag][]*uiRow
 	currentThingEditing *bool
+	lockPassphrase      string
+	lockStatus          string
+	readOnly            bool
 }
 
 func checkErr(err error) {
@@ -35,7 +38,42 @@ type uiRow struct {
 
 var programState state
 
-var tagRe = regexp.MustCompile(`\[\[(.*?)\]\]`)
+// newUIRow lays out the text of row as labels and tag buttons; id keeps the IDs of its buttons unique
+func (p *state) newUIRow(row db.Row, id string) *uiRow {
+	uiRow := &uiRow{row: row}
+	editOnRightClick := g.Custom(func() {
+		if g.IsItemClicked(g.MouseButtonRight) && !p.readOnly {
+			if p.currentThingEditing != nil {
+				*p.currentThingEditing = false
+			}
+			uiRow.editing = true
+			p.currentThingEditing = &uiRow.editing
+		}
+	})
+
+	text := ""
+	for _, node := range db.ParseText(row.Text) {
+		switch node.Kind {
+		case db.NodeRef:
+			// leading text
+			uiRow.content = append(uiRow.content, g.LabelWrapped(text), editOnRightClick)
+			text = ""
+			// tag button
+			tag, err := p.LinkedTag(node.Text)
+			checkErr(err)
+			uiRow.content = append(uiRow.content, g.Button(fmt.Sprintf("%s##%s", tag.Name, id), func() {
+				switchTag(tag)
+			}), editOnRightClick)
+		case db.NodeCode:
+			text += row.Text[node.Start:node.End]
+		default:
+			text += node.Text
+		}
+	}
+	uiRow.content = append(uiRow.content, g.LabelWrapped(text), editOnRightClick)
+
+	return uiRow
+}
 
 func (p *state) Refresh() error {
 	var err error
@@ -49,96 +87,14 @@ func (p *state) Refresh() error {
 
 	p.currentUIRows = make([]*uiRow, 0, len(p.CurrentDBRows))
 	for i, row := range p.CurrentDBRows {
-		row := row
-		uiRow := uiRow{row: row}
-		for tagIndex := tagRe.FindStringIndex(row.Text); tagIndex != nil; tagIndex = tagRe.FindStringIndex(row.Text) {
-			// leading text
-			uiRow.content = append(uiRow.content, g.LabelWrapped(row.Text[:tagIndex[0]]))
-			uiRow.content = append(uiRow.content, g.Custom(func() {
-				if g.IsItemClicked(g.MouseButtonRight) {
-					if p.currentThingEditing != nil {
-						*p.currentThingEditing = false
-					}
-					uiRow.editing = true
-					p.currentThingEditing = &uiRow.editing
-				}
-			}))
-			// tag button
-			tag, err := p.DB.GetTagByName(row.Text[tagIndex[0]+2 : tagIndex[1]-2])
-			checkErr(err)
-			uiRow.content = append(uiRow.content, g.Button(fmt.Sprintf("%s##cur%d", tag.Name, i), func() {
-				switchTag(tag)
-			}))
-			uiRow.content = append(uiRow.content, g.Custom(func() {
-				if g.IsItemClicked(g.MouseButtonRight) {
-					if p.currentThingEditing != nil {
-						*p.currentThingEditing = false
-					}
-					uiRow.editing = true
-					p.currentThingEditing = &uiRow.editing
-				}
-			}))
-			row.Text = row.Text[tagIndex[1]:]
-		}
-		uiRow.content = append(uiRow.content, g.LabelWrapped(row.Text))
-		uiRow.content = append(uiRow.content, g.Custom(func() {
-			if g.IsItemClicked(g.MouseButtonRight) {
-				if p.currentThingEditing != nil {
-					*p.currentThingEditing = false
-				}
-				uiRow.editing = true
-				p.currentThingEditing = &uiRow.editing
-			}
-		}))
-		p.currentUIRows = append(p.currentUIRows, &uiRow)
+		p.currentUIRows = append(p.currentUIRows, p.newUIRow(row, fmt.Sprintf("cur%d", i)))
 	}
 
 	p.currentUIRefRows = make(map[db.Tag][]*uiRow, len(p.CurrentDBRefs))
 	for tag, rows := range p.CurrentDBRefs {
 		p.currentUIRefRows[tag] = make([]*uiRow, 0, len(rows))
 		for i, row := range rows {
-			row := row
-			uiRow := uiRow{row: row}
-			for tagIndex := tagRe.FindStringIndex(row.Text); tagIndex != nil; tagIndex = tagRe.FindStringIndex(row.Text) {
-				// leading text
-				uiRow.content = append(uiRow.content, g.LabelWrapped(row.Text[:tagIndex[0]]))
-				uiRow.content = append(uiRow.content, g.Custom(func() {
-					if g.IsItemClicked(g.MouseButtonRight) {
-						if p.currentThingEditing != nil {
-							*p.currentThingEditing = false
-						}
-						uiRow.editing = true
-						p.currentThingEditing = &uiRow.editing
-					}
-				}))
-				// tag button
-				tag, err := p.DB.GetTagByName(row.Text[tagIndex[0]+2 : tagIndex[1]-2])
-				checkErr(err)
-				uiRow.content = append(uiRow.content, g.Button(fmt.Sprintf("%s##ref%d", tag.Name, i), func() {
-					switchTag(tag)
-				}))
-				uiRow.content = append(uiRow.content, g.Custom(func() {
-					if g.IsItemClicked(g.MouseButtonRight) {
-						if p.currentThingEditing != nil {
-							*p.currentThingEditing = false
-						}
-						uiRow.editing = true
-						p.currentThingEditing = &uiRow.editing
-					}
-				}))
-				row.Text = row.Text[tagIndex[1]:]
-			}
-			uiRow.content = append(uiRow.content, g.LabelWrapped(row.Text))
-			uiRow.content = append(uiRow.content, g.Custom(func() {
-				if g.IsItemClicked(g.MouseButtonRight) {
-					if p.currentThingEditing != nil {
-						*p.currentThingEditing = false
-					}
-					uiRow.editing = true
-					p.currentThingEditing = &uiRow.editing
-				}
-			}))
-			p.currentUIRefRows[tag] = append(p.currentUIRefRows[tag], &uiRow)
+			p.currentUIRefRows[tag] = append(p.currentUIRefRows[tag], p.newUIRow(row, fmt.Sprintf("ref%d", i)))
 		}
 	}
 
@@ -147,7 +103,7 @@ func (p *state) Refresh() error {
 
 func (p *state) GoToToday() {
 	t := time.Now()
-	tag, err := programState.DB.AddTag(t.Format("January 02 2006"))
+	tag, err := p.DateTag(t)
 	checkErr(err)
 
 	p.CurrentDBTag = tag
@@ -160,9 +116,91 @@ func switchTag(tag db.Tag) {
 		checkErr(err)
 	}
 	programState.CurrentDBTag = tag
+	programState.lockStatus = ""
+	programState.Refresh()
+}
+
+// lockOrUnlockTag locks the current tag with the passphrase typed, or unlocks it if it's locked
+func lockOrUnlockTag() {
+	var snapshots []db.Snapshot
+	var err error
+
+	tag := programState.CurrentDBTag
+	passphrase := programState.lockPassphrase
+	if passphrase == "" {
+		return
+	}
+	programState.lockPassphrase = ""
+
+	if tag.Kind == db.TagKindLocked {
+		err = programState.DB.UnlockTag(tag.ID, passphrase)
+	} else {
+		snapshots, err = programState.DB.LockTag(tag.ID, passphrase)
+	}
+	if err == db.ErrPassphrase {
+		programState.lockStatus = err.Error()
+		return
+	}
+	checkErr(err)
+
+	programState.lockStatus = ""
+	if len(snapshots) > 0 {
+		programState.lockStatus = fmt.Sprintf("the %d backups taken before still hold its rows in plaintext", len(snapshots))
+	}
+	programState.CurrentDBTag, err = programState.DB.GetTagByID(tag.ID)
+	checkErr(err)
+	programState.Refresh()
+}
+
+// removeTagLock turns the current locked tag back into a normal one, with the passphrase typed
+func removeTagLock() {
+	tag := programState.CurrentDBTag
+	err := programState.DB.RemoveTagLock(tag.ID, programState.lockPassphrase)
+	programState.lockPassphrase = ""
+	if err == db.ErrPassphrase {
+		programState.lockStatus = err.Error()
+		return
+	}
+	checkErr(err)
+
+	programState.lockStatus = ""
+	programState.CurrentDBTag, err = programState.DB.GetTagByID(tag.ID)
+	checkErr(err)
 	programState.Refresh()
 }
 
+// getTagLockWidget lays out the passphrase field below the tag name, with the buttons locking the tag, or unlocking
+// it, hiding it again and removing its lock
+func getTagLockWidget() g.Widget {
+	tag := programState.CurrentDBTag
+	// a read-only database can only have its locked tags unlocked for the session
+	if tag.ID == 0 || tag.Kind == db.TagKindQuery || (programState.readOnly && tag.Kind != db.TagKindLocked) {
+		return g.Line()
+	}
+
+	widgets := []g.Widget{
+		g.InputTextV("##passphrase", 200, &programState.lockPassphrase, g.InputTextFlagsPassword|g.InputTextFlagsEnterReturnsTrue, nil, lockOrUnlockTag),
+	}
+	switch {
+	case tag.Kind != db.TagKindLocked:
+		widgets = append(widgets, g.Button("Lock", lockOrUnlockTag))
+	case programState.DB.IsTagUnlocked(tag.ID):
+		widgets = append(widgets, g.Button("Hide", func() {
+			programState.DB.RelockTag(tag.ID)
+			programState.lockStatus = ""
+			programState.Refresh()
+		}))
+	default:
+		widgets = append(widgets, g.Button("Unlock", lockOrUnlockTag))
+	}
+	if tag.Kind == db.TagKindLocked && !programState.readOnly {
+		widgets = append(widgets, g.Button("Remove lock", removeTagLock))
+	}
+	widgets = append(widgets, g.Label(programState.lockStatus))
+
+	return g.Line(widgets...)
+}
+
 func getTagNameWidget() g.Layout {
 	layout := make(g.Layout, 0)
 	newTag := programState.CurrentDBTag.Name
@@ -170,7 +208,7 @@ func getTagNameWidget() g.Layout {
 	if !programState.editingTagName {
 		layout = append(layout, g.Label(fmt.Sprintf("%s", programState.CurrentDBTag.Name)))
 		layout = append(layout, g.Custom(func() {
-			if g.IsItemClicked(g.MouseButtonRight) {
+			if g.IsItemClicked(g.MouseButtonRight) && !programState.readOnly {
 				if programState.currentThingEditing != nil {
 					*programState.currentThingEditing = false
 				}
@@ -285,18 +323,19 @@ func loop() {
 	g.SingleWindow("exogiu", g.Layout{
 		g.SplitLayout("tagsplit", g.DirectionHorizontal, true, 200,
 			g.Layout{
-				g.InputTextV("##addtag", -1, &programState.addTagStr, g.InputTextFlagsEnterReturnsTrue, nil, func() {
-					tag, err := programState.DB.AddTag(programState.addTagStr)
-					if err == nil {
-						programState.addTagStr = ""
-						programState.CurrentDBTag = tag
-						programState.Refresh()
-						g.SetKeyboardFocusHere()
-					}
-				}),
+				g.Condition(!programState.readOnly, g.Layout{
+					g.InputTextV("##addtag", -1, &programState.addTagStr, g.InputTextFlagsEnterReturnsTrue, nil, func() {
+						tag, err := programState.DB.AddTag(programState.addTagStr)
+						if err == nil {
+							programState.addTagStr = ""
+							programState.CurrentDBTag = tag
+							programState.Refresh()
+							g.SetKeyboardFocusHere()
+						}
+					}),
+				}, nil),
 				g.DatePicker("##date", &programState.datePicker, 0, func() {
-					tagStr := programState.datePicker.Format("January 02 2006")
-					tag, err := programState.DB.AddTag(tagStr)
+					tag, err := programState.DateTag(programState.datePicker)
 					if err == nil {
 						switchTag(tag)
 					}
@@ -305,14 +344,17 @@ func loop() {
 			},
 			g.Layout{
 				getTagNameWidget(),
-				g.InputTextV("##addrow", -1, &programState.addRowString, g.InputTextFlagsEnterReturnsTrue, nil, func() {
-					if len(programState.addRowString) > 0 {
-						programState.DB.AddRow(programState.CurrentDBTag.ID, programState.addRowString, 0)
-						programState.addRowString = ""
-						programState.Refresh()
-					}
-					g.SetKeyboardFocusHere()
-				}),
+				getTagLockWidget(),
+				g.Condition(!programState.readOnly, g.Layout{
+					g.InputTextV("##addrow", -1, &programState.addRowString, g.InputTextFlagsEnterReturnsTrue, nil, func() {
+						if len(programState.addRowString) > 0 {
+							programState.DB.AddRow(programState.CurrentDBTag.ID, programState.addRowString, 0)
+							programState.addRowString = ""
+							programState.Refresh()
+						}
+						g.SetKeyboardFocusHere()
+					}),
+				}, nil),
 				g.SplitLayout("refsplit", g.DirectionVertical, true, 200,
 					getAllRowWidgets(),
 					getAllRowRefWidgets()),
@@ -323,16 +365,32 @@ func loop() {
 
 func main() {
 	var exoDB db.ExoDB
-	err := exoDB.Open("./exocortex.db")
+	var err error
+
+	flag.BoolVar(&programState.readOnly, "read-only", false, "browse the database without changing it")
+	flag.Parse()
+
+	if programState.readOnly {
+		err = exoDB.OpenReadOnly("./exocortex.db")
+	} else {
+		err = exoDB.Open("./exocortex.db")
+	}
 	checkErr(err)
 	defer exoDB.Close()
 
 	err = exoDB.LoadSchema()
 	checkErr(err)
+	for _, notice := range exoDB.Notices() {
+		fmt.Println(notice)
+	}
 
 	programState.DB = &exoDB
 
-	wnd := g.NewMasterWindow("exogiu", 800, 600, 0, nil)
+	title := "exogiu"
+	if programState.readOnly {
+		title = "exogiu (read-only)"
+	}
+	wnd := g.NewMasterWindow(title, 800, 600, 0, nil)
 
 	programState.GoToToday()
 
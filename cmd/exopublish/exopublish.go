@@ -0,0 +1,361 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neutralinsomniac/exocortex/db"
+	"github.com/neutralinsomniac/exocortex/web"
+)
+
+func checkErr(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "exopublish:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: exopublish [-db file] [-out dir] [-tag name]... [-namespace name]... [-marker name]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Renders the published tags into a static HTML site, one page per tag. A tag is published if it's")
+	fmt.Fprintln(os.Stderr, "named with -tag, is in a namespace named with -namespace, or has a row linking the marker tag.")
+	fmt.Fprintln(os.Stderr, "The passphrase of an encrypted database is read from $EXOCORTEX_PASSPHRASE.")
+	fmt.Fprintln(os.Stderr, "")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// stringList is a flag that can be given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// page is the page of a published tag
+type page struct {
+	Tag       db.Tag
+	Rows      []template.HTML
+	Backlinks []backlink
+}
+
+// backlink holds the rows of a published tag that link the page's tag
+type backlink struct {
+	Tag  db.Tag
+	Rows []template.HTML
+}
+
+// journalMonth holds the published date tags of a month
+type journalMonth struct {
+	Month string
+	Tags  []db.Tag
+}
+
+// site is the set of published tags
+type site struct {
+	exoDB  *db.ExoDB
+	marker string
+	tags   []db.Tag
+	// page file names, by TagKey
+	files map[string]string
+}
+
+// slug turns a tag name into a file name of letters, digits and dashes
+func slug(name string) string {
+	var b strings.Builder
+
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case b.Len() > 0 && !strings.HasSuffix(b.String(), "-"):
+			b.WriteByte('-')
+		}
+	}
+
+	s := strings.TrimSuffix(b.String(), "-")
+	if s == "" {
+		s = "tag"
+	}
+	return s
+}
+
+// selectTags returns the published tags, sorted by name. Query tags, locked tags and the marker itself are never
+// published.
+func selectTags(exoDB *db.ExoDB, names []string, namespaces []string, marker string) ([]db.Tag, error) {
+	var tags, published []db.Tag
+	var marked db.Refs
+	var err error
+
+	tags, err = exoDB.GetAllTags()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range names {
+		selected[db.TagKey(name)] = true
+	}
+
+	if marker != "" {
+		marked, err = exoDB.GetRefsToTagByTagName(marker)
+		if err != nil {
+			return nil, err
+		}
+		for tag := range marked {
+			selected[db.TagKey(tag.Name)] = true
+		}
+	}
+
+	for _, tag := range tags {
+		key := db.TagKey(tag.Name)
+		if tag.Kind != db.TagKindNormal || (marker != "" && key == db.TagKey(marker)) {
+			continue
+		}
+
+		ok := selected[key]
+		for _, namespace := range namespaces {
+			nsKey := db.TagKey(namespace)
+			if key == nsKey || strings.HasPrefix(key, nsKey+db.NamespaceSeparator) {
+				ok = true
+			}
+		}
+		if ok {
+			published = append(published, tag)
+		}
+	}
+
+	sort.Slice(published, func(i, j int) bool {
+		return db.TagKey(published[i].Name) < db.TagKey(published[j].Name)
+	})
+
+	return published, nil
+}
+
+func newSite(exoDB *db.ExoDB, tags []db.Tag, marker string) *site {
+	s := &site{exoDB: exoDB, marker: marker, tags: tags, files: make(map[string]string)}
+
+	// the index pages keep their names, and tags whose names slug the same get numbered
+	used := map[string]bool{"index.html": true, "journal.html": true}
+	for _, tag := range tags {
+		base := slug(tag.Name)
+		file := base + ".html"
+		for i := 2; used[file]; i++ {
+			file = base + "-" + strconv.Itoa(i) + ".html"
+		}
+		used[file] = true
+		s.files[db.TagKey(tag.Name)] = file
+	}
+
+	return s
+}
+
+// linkURL returns the address of a published tag
+func (s *site) linkURL(name string) (string, bool) {
+	file, ok := s.files[db.TagKey(name)]
+	return file, ok
+}
+
+// visibleRows renders the rows, leaving out those holding nothing but the marker
+func (s *site) visibleRows(rows []db.Row) []template.HTML {
+	var rendered []template.HTML
+
+	for _, row := range rows {
+		if s.marker != "" && db.TagKey(strings.TrimSpace(row.Text)) == db.TagKey(db.FormatRef(s.marker)) {
+			continue
+		}
+		rendered = append(rendered, web.RenderRow(row.Text, s.linkURL))
+	}
+
+	return rendered
+}
+
+func (s *site) page(tag db.Tag) (page, error) {
+	var p page
+	var rows []db.Row
+	var refs db.Refs
+	var err error
+
+	p.Tag = tag
+
+	rows, err = s.exoDB.GetRowsForTagID(tag.ID)
+	if err != nil {
+		return p, err
+	}
+	p.Rows = s.visibleRows(rows)
+
+	refs, err = s.exoDB.GetRefsToTagByTagID(tag.ID)
+	if err != nil {
+		return p, err
+	}
+
+	// only rows under published tags can be shown
+	for _, source := range db.SortedRefTags(refs) {
+		if _, ok := s.linkURL(source.Name); !ok {
+			continue
+		}
+		if rows := s.visibleRows(refs[source]); len(rows) > 0 {
+			p.Backlinks = append(p.Backlinks, backlink{source, rows})
+		}
+	}
+
+	return p, nil
+}
+
+// journal groups the published date tags by month, newest first
+func (s *site) journal() []journalMonth {
+	var months []journalMonth
+	var dates []time.Time
+
+	byDate := make(map[time.Time]db.Tag)
+	for _, tag := range s.tags {
+		if t, err := time.Parse(db.DateTagFormat, tag.Name); err == nil {
+			dates = append(dates, t)
+			byDate[t] = tag
+		}
+	}
+
+	sort.Slice(dates, func(i, j int) bool { return dates[i].After(dates[j]) })
+
+	for _, t := range dates {
+		month := t.Format("January 2006")
+		if len(months) == 0 || months[len(months)-1].Month != month {
+			months = append(months, journalMonth{Month: month})
+		}
+		months[len(months)-1].Tags = append(months[len(months)-1].Tags, byDate[t])
+	}
+
+	return months
+}
+
+func (s *site) render(templates *template.Template, dir string, file string, name string, data interface{}) error {
+	f, err := os.Create(filepath.Join(dir, file))
+	if err != nil {
+		return err
+	}
+
+	err = templates.ExecuteTemplate(f, name, data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// removeStalePages removes the pages an earlier run left in dir for tags that aren't published anymore. Files other
+// than pages are left alone.
+func removeStalePages(dir string, pages map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".html" || pages[entry.Name()] {
+			continue
+		}
+		err = os.Remove(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write renders every page of the site into dir, removing the pages of tags that were published before but aren't
+// anymore
+func (s *site) write(dir string) error {
+	templates, err := web.Templates.Clone()
+	if err != nil {
+		return err
+	}
+	templates.Funcs(template.FuncMap{
+		"tagURL": func(tag db.Tag) string {
+			url, _ := s.linkURL(tag.Name)
+			return url
+		},
+	})
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range s.tags {
+		p, err := s.page(tag)
+		if err != nil {
+			return err
+		}
+		err = s.render(templates, dir, s.files[db.TagKey(tag.Name)], "tagPage", p)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.render(templates, dir, "index.html", "tagIndex", s.tags)
+	if err != nil {
+		return err
+	}
+
+	err = s.render(templates, dir, "journal.html", "journal", s.journal())
+	if err != nil {
+		return err
+	}
+
+	pages := map[string]bool{"index.html": true, "journal.html": true}
+	for _, file := range s.files {
+		pages[file] = true
+	}
+
+	return removeStalePages(dir, pages)
+}
+
+func main() {
+	var exoDB db.ExoDB
+	var names, namespaces stringList
+
+	dbFile := flag.String("db", "./exocortex.db", "database `file` to publish from")
+	out := flag.String("out", "./public", "`dir`ectory to write the site to")
+	marker := flag.String("marker", "public", "publish the tags with a row linking this `tag`; empty to turn off")
+	flag.Var(&names, "tag", "publish the `tag`; may be repeated")
+	flag.Var(&namespaces, "namespace", "publish the `tag` and every tag below it; may be repeated")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() > 0 {
+		usage()
+	}
+
+	// publishing never changes the database
+	err := exoDB.OpenReadOnly(*dbFile)
+	if err == db.ErrEncrypted {
+		err = exoDB.OpenEncryptedReadOnly(*dbFile, os.Getenv("EXOCORTEX_PASSPHRASE"))
+	}
+	checkErr(err)
+	defer exoDB.Close()
+
+	err = exoDB.LoadSchema()
+	checkErr(err)
+
+	tags, err := selectTags(&exoDB, names, namespaces, *marker)
+	checkErr(err)
+
+	err = newSite(&exoDB, tags, *marker).write(*out)
+	checkErr(err)
+
+	fmt.Printf("published %d tag(s) to %s\n", len(tags), *out)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/neutralinsomniac/exocortex/db"
+)
+
+func setupDB(t *testing.T) *db.ExoDB {
+	var exoDB db.ExoDB
+
+	err := exoDB.Open(filepath.Join(t.TempDir(), "exocortex.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(exoDB.Close)
+
+	err = exoDB.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &exoDB
+}
+
+// addRows adds rows under the tag called name, creating it
+func addRows(t *testing.T, exoDB *db.ExoDB, name string, texts ...string) db.Tag {
+	tag, err := exoDB.AddTag(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range texts {
+		_, err = exoDB.AddRow(tag.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return tag
+}
+
+func tagNames(tags []db.Tag) string {
+	var names []string
+	for _, tag := range tags {
+		names = append(names, tag.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestSelectTags(t *testing.T) {
+	exoDB := setupDB(t)
+
+	addRows(t, exoDB, "blog", "[[public]]", "first post")
+	addRows(t, exoDB, "named", "picked by name")
+	addRows(t, exoDB, "Projects/alpha", "in a namespace")
+	addRows(t, exoDB, "private", "not published")
+	diary := addRows(t, exoDB, "diary", "[[public]] but locked")
+	_, err := exoDB.LockTag(diary.ID, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = exoDB.AddQueryTag("search", "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := selectTags(exoDB, []string{"named", "diary", "search"}, []string{"projects"}, "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := tagNames(tags); names != "blog,named,Projects,Projects/alpha" {
+		t.Fatalf("unexpected published tags: %s", names)
+	}
+
+	// without a marker, only what's named is published
+	tags, err = selectTags(exoDB, []string{"blog"}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := tagNames(tags); names != "blog" {
+		t.Fatalf("unexpected published tags without a marker: %s", names)
+	}
+}
+
+func TestWriteSite(t *testing.T) {
+	exoDB := setupDB(t)
+	dir := filepath.Join(t.TempDir(), "public")
+
+	addRows(t, exoDB, "blog", "[[public]]", "see [[notes]] and [[private]]")
+	addRows(t, exoDB, "notes", "[[public]]", "back to [[blog]]")
+	addRows(t, exoDB, "private", "[[blog]] from a secret place")
+
+	// leftovers of an earlier run
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"private.html", "style.css"} {
+		err = os.WriteFile(filepath.Join(dir, file), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tags, err := selectTags(exoDB, nil, nil, "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = newSite(exoDB, tags, "public").write(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(dir, "blog.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blog := string(contents)
+
+	if !strings.Contains(blog, `<a href="notes.html">notes</a>`) {
+		t.Errorf("expected a link to the published tag:\n%s", blog)
+	}
+	if strings.Contains(blog, "private.html") || !strings.Contains(blog, "and private") {
+		t.Errorf("expected the unpublished tag as plain text:\n%s", blog)
+	}
+	if strings.Contains(blog, "<li>public</li>") {
+		t.Errorf("expected the marker row to be left out:\n%s", blog)
+	}
+	if !strings.Contains(blog, "back to") {
+		t.Errorf("expected the backlink from the published tag:\n%s", blog)
+	}
+	if strings.Contains(blog, "secret place") {
+		t.Errorf("expected no backlink from the unpublished tag:\n%s", blog)
+	}
+
+	for _, file := range []string{"index.html", "journal.html", "notes.html", "style.css"} {
+		if _, err = os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Errorf("expected %s to be there: %v", file, err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "private.html")); !os.IsNotExist(err) {
+		t.Errorf("expected the stale page to be removed, got %v", err)
+	}
+}
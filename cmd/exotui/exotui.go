@@ -1,12 +1,14 @@
 package main
 
 import (
+	"database/sql"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"os"
 	"os/exec"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -21,7 +23,7 @@ type state struct {
 	rowShortcuts    map[string]db.Row
 	tagShortcuts    map[db.Tag]int
 	tagShortcutsRev map[int]db.Tag
-	snarfedRows     []db.Row
+	register        string // snarf register for the current command
 	allTagNames     map[string]bool
 	tagStack        []string // tag.Name
 	lastError       string
@@ -120,7 +122,11 @@ func (s *state) PopTag() {
 	tagName := s.tagStack[l-1]
 	s.tagStack = s.tagStack[:l-1]
 
-	tag, err := s.DB.AddTag(tagName)
+	tag, err := s.getOrAddTag(tagName)
+	if err == sql.ErrNoRows {
+		// a placeholder date tag of a read-only database
+		tag, err = db.Tag{Name: tagName}, nil
+	}
 	checkErr(err)
 
 	// have to do the manual tag switch dance since SwitchTag() will push onto the tag stack
@@ -160,8 +166,16 @@ func (s *state) GoToToday() {
 	s.GoToDate(t)
 }
 
+// getOrAddTag returns the named tag, creating it unless the database is read-only
+func (s *state) getOrAddTag(name string) (db.Tag, error) {
+	if s.DB.ReadOnly() {
+		return s.DB.GetTagByName(name)
+	}
+	return s.DB.AddTag(name)
+}
+
 func (s *state) GoToDate(t time.Time) {
-	tag, err := s.DB.AddTag(t.Format("January 02 2006"))
+	tag, err := s.DateTag(t)
 	checkErr(err)
 
 	s.lastError = ""
@@ -194,32 +208,111 @@ func (s *state) NewTag(arg string) {
 	s.SwitchTag(tag)
 }
 
-func (s *state) RenderMain() {
-	var tag db.Tag
-	var err error
+// printRowText prints the text of a row with its tags highlighted and property keys in bold
+func (s *state) printRowText(text string) {
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			fmt.Println("")
+		}
+		if _, ok := db.ParseProperty(line); ok {
+			sep := strings.Index(line, "::")
+			fmt.Printf("%s%s%s::", ansiBoldText, line[:sep], ansiClearParams)
+			line = line[sep+2:]
+		}
+		for _, node := range db.ParseText(line) {
+			switch node.Kind {
+			case db.NodeRef:
+				tag, err := s.LinkedTag(node.Text)
+				checkErr(err)
+				fmt.Printf("%s%s(%d)%s", ansiReverseVideo, tag.Name, s.GetShortcutForTag(tag), ansiClearParams)
+			case db.NodeCode:
+				// code spans keep their backticks
+				fmt.Printf("%s", line[node.Start:node.End])
+			default:
+				fmt.Printf("%s", node.Text)
+			}
+		}
+	}
+	fmt.Println("")
+}
 
+// completeLink completes the name of the link being typed at the cursor, for liner. pos is in runes.
+func (s *state) completeLink(line string, pos int) (string, []string, string) {
+	head, tail := string([]rune(line)[:pos]), string([]rune(line)[pos:])
+
+	start, ok := db.OpenLink(head)
+	if !ok {
+		return head, nil, tail
+	}
+
+	tags, err := s.DB.CompleteTags(head[start:], db.MaxCompletions)
+	if err != nil {
+		return head, nil, tail
+	}
+
+	var completions []string
+	for _, tag := range tags {
+		completions = append(completions, tag.Name+"]]")
+	}
+
+	return head[:start], completions, tail
+}
+
+func (s *state) RenderMain() {
 	rowKey := NewIncrementingKey("")
 
 	clearScreen()
-	fmt.Printf("== %s ==\n", s.CurrentDBTag.Name)
+	switch {
+	case s.CurrentDBTag.Kind != db.TagKindLocked:
+		fmt.Printf("== %s ==\n", s.CurrentDBTag.Name)
+	case s.DB.IsTagUnlocked(s.CurrentDBTag.ID):
+		fmt.Printf("== %s (unlocked) ==\n", s.CurrentDBTag.Name)
+	default:
+		fmt.Printf("== %s (locked) ==\n", s.CurrentDBTag.Name)
+	}
+
+	if len(s.CurrentDBAncestors) > 0 {
+		fmt.Printf("in:")
+		for _, tag := range s.CurrentDBAncestors {
+			fmt.Printf(" %s%s(%d)%s", ansiReverseVideo, db.BaseTagName(tag.Name), s.GetShortcutForTag(tag), ansiClearParams)
+		}
+		fmt.Println("")
+	}
+
+	if len(s.CurrentDBChildTags) > 0 {
+		fmt.Printf("children:")
+		for _, tag := range s.CurrentDBChildTags {
+			fmt.Printf(" %s%s(%d)%s", ansiReverseVideo, db.BaseTagName(tag.Name), s.GetShortcutForTag(tag), ansiClearParams)
+		}
+		fmt.Println("")
+	}
+
+	if len(s.CurrentDBRelatedTags) > 0 {
+		fmt.Printf("related:")
+		for _, tag := range s.CurrentDBRelatedTags {
+			fmt.Printf(" %s%s(%d)%s", ansiReverseVideo, tag.Name, s.GetShortcutForTag(tag), ansiClearParams)
+		}
+		fmt.Println("")
+	}
 
 	s.rowShortcuts = make(map[string]db.Row)
 
-	re := regexp.MustCompile(`\[\[(.*?)\]\]`)
+	if s.CurrentDBTag.Kind == db.TagKindQuery {
+		// query tag rows belong to their source tags, so they don't get row shortcuts
+		fmt.Printf("query: %s\n", s.CurrentDBQuery)
+		for _, tag := range s.SortedQueryTagsKeys {
+			fmt.Printf("\n %s%s(%d)%s\n", ansiReverseVideo, tag.Name, s.GetShortcutForTag(tag), ansiClearParams)
+			for _, row := range s.CurrentDBQueryResults[tag] {
+				fmt.Printf("   ")
+				s.printRowText(row.Text)
+			}
+		}
+	}
 
 	for _, row := range s.CurrentDBRows {
 		s.rowShortcuts[rowKey.String()] = row
 		fmt.Printf(" %s: ", rowKey)
-		for tagIndex := re.FindStringIndex(row.Text); tagIndex != nil; tagIndex = re.FindStringIndex(row.Text) {
-			// leading text
-			fmt.Printf("%s", row.Text[:tagIndex[0]])
-			// tag
-			tag, err = s.DB.GetTagByName(row.Text[tagIndex[0]+2 : tagIndex[1]-2])
-			checkErr(err)
-			fmt.Printf("%s%s(%d)%s", ansiReverseVideo, tag.Name, s.GetShortcutForTag(tag), ansiClearParams)
-			row.Text = row.Text[tagIndex[1]:]
-		}
-		fmt.Printf("%s\n", row.Text)
+		s.printRowText(row.Text)
 		rowKey.Increment()
 	}
 
@@ -230,16 +323,20 @@ func (s *state) RenderMain() {
 			for _, row := range s.CurrentDBRefs[tag] {
 				s.rowShortcuts[rowKey.String()] = row
 				fmt.Printf("  %s: ", rowKey)
-				for tagIndex := re.FindStringIndex(row.Text); tagIndex != nil; tagIndex = re.FindStringIndex(row.Text) {
-					// leading text
-					fmt.Printf("%s", row.Text[:tagIndex[0]])
-					// tag
-					tag, err = s.DB.GetTagByName(row.Text[tagIndex[0]+2 : tagIndex[1]-2])
-					checkErr(err)
-					fmt.Printf("%s%s(%d)%s", ansiReverseVideo, tag.Name, s.GetShortcutForTag(tag), ansiClearParams)
-					row.Text = row.Text[tagIndex[1]:]
-				}
-				fmt.Printf("%s\n", row.Text)
+				s.printRowText(row.Text)
+				rowKey.Increment()
+			}
+		}
+	}
+
+	if len(s.CurrentDBUnlinkedRefs) > 0 {
+		fmt.Println("\nUnlinked references")
+		for _, tag := range s.SortedUnlinkedRefTagsKeys {
+			fmt.Printf("\n %s%s(%d)%s\n", ansiReverseVideo, tag.Name, s.GetShortcutForTag(tag), ansiClearParams)
+			for _, row := range s.CurrentDBUnlinkedRefs[tag] {
+				s.rowShortcuts[rowKey.String()] = row
+				fmt.Printf("  %s: ", rowKey)
+				s.printRowText(row.Text)
 				rowKey.Increment()
 			}
 		}
@@ -269,11 +366,10 @@ func (s *state) RenameTag(arg string) {
 		}
 
 		tag, err = s.DB.RenameTag(s.CurrentDBTag.Name, string(newTagName))
-		checkErr(err)
 	} else {
 		tag, err = s.DB.RenameTag(s.CurrentDBTag.Name, arg)
-		checkErr(err)
 	}
+	checkErr(err)
 
 	s.lastError = ""
 	s.SwitchTag(tag)
@@ -283,8 +379,6 @@ func (s *state) SelectTag(arg string) {
 	var search string
 	var filteredTags []db.Tag
 
-	clearScreen()
-
 	arg = strings.TrimSpace(arg)
 
 	if len(arg) > 0 {
@@ -297,12 +391,13 @@ func (s *state) SelectTag(arg string) {
 		}
 	}
 
-	keys := make(map[string]db.Tag)
-	key := NewIncrementingKey("")
-
 	// jump to tag
 	if search == "" && len(arg) > 0 {
-		tag, err := s.DB.AddTag(arg)
+		tag, err := s.getOrAddTag(arg)
+		if err == sql.ErrNoRows {
+			s.lastError = fmt.Sprintf("no tag named \"%s\"", arg)
+			return
+		}
 		checkErr(err)
 
 		s.SwitchTag(tag)
@@ -313,12 +408,7 @@ func (s *state) SelectTag(arg string) {
 
 	// fuzzy match attempt
 	if len(search) > 0 {
-		filteredTags = make([]db.Tag, 0)
-		for _, v := range s.AllDBTags {
-			if strings.Contains(strings.ToLower(v.Name), strings.ToLower(search)) {
-				filteredTags = append(filteredTags, v)
-			}
-		}
+		filteredTags = db.FilterTags(s.AllDBTags, search, nil)
 		switch len(filteredTags) {
 		case 0:
 			s.lastError = fmt.Sprintf("search for \"%s\" returned no tags", search)
@@ -328,21 +418,59 @@ func (s *state) SelectTag(arg string) {
 			s.SwitchTag(filteredTags[0])
 			return
 		default:
-			// move on to tag selection menu
+			// move on to tag selection
 		}
 	} else {
 		// no args were passed; all tags
 		filteredTags = s.AllDBTags
 	}
 
+	counts, err := s.DB.GetRowCounts()
+	checkErr(err)
+
+	// the tags we came from most recently are listed first
+	recent := make([]string, 0, len(s.tagStack))
+	for i := len(s.tagStack) - 1; i >= 0; i-- {
+		recent = append(recent, s.tagStack[i])
+	}
+
+	picker := tagPicker{tags: s.AllDBTags, recent: recent, counts: counts, query: []rune(search)}
+	tag, ok, err := picker.run()
+	if err != nil {
+		// no raw mode on this terminal
+		s.selectTagFromMenu(search, filteredTags)
+		return
+	}
+
+	s.lastError = ""
+	if ok {
+		s.SwitchTag(tag)
+	}
+}
+
+// selectTagFromMenu lists tags under letter keys and switches to the one whose key is entered
+func (s *state) selectTagFromMenu(search string, tags []db.Tag) {
+	keys := make(map[string]db.Tag)
+	key := NewIncrementingKey("")
+
+	clearScreen()
+
 	if len(search) > 0 {
 		fmt.Printf("== Tags matching \"%s\" ==\n", search)
 	} else {
 		fmt.Println("== All Tags ==")
 	}
-	for _, v := range filteredTags {
-		fmt.Printf(" %s: %s\n", key.String(), v.Name)
-		keys[key.String()] = v
+	// namespaced tags are listed under their parents
+	for _, node := range db.TagTree(tags) {
+		indent := strings.Repeat("  ", node.Depth)
+		if node.Tag.Kind == db.TagKindQuery {
+			fmt.Printf(" %s: %s%s (query)\n", key.String(), indent, node.Label)
+		} else if node.Tag.Kind == db.TagKindLocked {
+			fmt.Printf(" %s: %s%s (locked)\n", key.String(), indent, node.Label)
+		} else {
+			fmt.Printf(" %s: %s%s\n", key.String(), indent, node.Label)
+		}
+		keys[key.String()] = node.Tag
 		key.Increment()
 	}
 	fmt.Printf("\n[selection]: ")
@@ -361,6 +489,66 @@ func (s *state) SelectTag(arg string) {
 	}
 }
 
+func (s *state) Query(arg string) {
+	arg = strings.TrimSpace(arg)
+	if len(arg) == 0 {
+		s.lastError = "f <query>"
+		return
+	}
+
+	refs, err := s.DB.RunQuery(arg)
+	if _, ok := err.(*db.QueryError); ok {
+		s.lastError = err.Error()
+		return
+	}
+	checkErr(err)
+
+	if len(refs) == 0 {
+		s.lastError = fmt.Sprintf("query \"%s\" returned no rows", arg)
+		return
+	}
+
+	clearScreen()
+	fmt.Printf("== Query: %s ==\n", arg)
+
+	keys := make(map[string]db.Tag)
+	key := NewIncrementingKey("")
+	for _, tag := range db.SortedRefTags(refs) {
+		fmt.Printf("\n %s: %s%s%s\n", key, ansiReverseVideo, tag.Name, ansiClearParams)
+		keys[key.String()] = tag
+		key.Increment()
+		for _, row := range refs[tag] {
+			fmt.Printf("   ")
+			s.printRowText(row.Text)
+		}
+	}
+	fmt.Printf("\n[selection]: ")
+	selection, _ := s.scanner.Prompt("")
+	selection = strings.TrimSpace(selection)
+
+	if len(selection) == 0 {
+		s.lastError = ""
+		return
+	}
+
+	if tag, ok := keys[selection]; ok {
+		s.lastError = ""
+		s.SwitchTag(tag)
+		return
+	}
+
+	// tags referenced by the result rows can be jumped to by number, just like on the main screen
+	if i, err := strconv.Atoi(selection); err == nil {
+		if tag, ok := s.tagShortcutsRev[i]; ok {
+			s.lastError = ""
+			s.SwitchTag(tag)
+			return
+		}
+	}
+
+	s.lastError = "invalid input"
+}
+
 func GetTextFromEditor(initialText []byte) ([]byte, bool) {
 	var text []byte
 	editorCommand := "vi"
@@ -386,6 +574,121 @@ func GetTextFromEditor(initialText []byte) ([]byte, bool) {
 	return text, true
 }
 
+// SaveQuery creates a query tag from "<name> = <query>", or edits the query of the current query tag if no args are given
+func (s *state) SaveQuery(arg string) {
+	arg = strings.TrimSpace(arg)
+
+	if len(arg) == 0 {
+		if s.CurrentDBTag.Kind != db.TagKindQuery {
+			s.lastError = "s <name> = <query>"
+			return
+		}
+		newQuery, ok := GetTextFromEditor([]byte(s.CurrentDBQuery))
+		if !ok {
+			s.lastError = "editor exited abnormally"
+			return
+		}
+		err := s.DB.UpdateQueryTag(s.CurrentDBTag.ID, strings.TrimSpace(string(newQuery)))
+		if _, ok := err.(*db.QueryError); ok {
+			s.lastError = err.Error()
+			return
+		}
+		checkErr(err)
+
+		s.lastError = ""
+		s.Refresh()
+		return
+	}
+
+	parts := strings.SplitN(arg, "=", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		s.lastError = "s <name> = <query>"
+		return
+	}
+
+	tag, err := s.DB.AddQueryTag(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	if err != nil {
+		s.lastError = err.Error()
+		return
+	}
+
+	s.lastError = ""
+	s.SwitchTag(tag)
+}
+
+// Trash lists the deleted tags and rows, and restores the one selected
+func (s *state) Trash() {
+	trashedTags, err := s.DB.GetTrashedTags()
+	checkErr(err)
+	trashedRows, err := s.DB.GetTrashedRows()
+	checkErr(err)
+
+	if len(trashedTags)+len(trashedRows) == 0 {
+		s.lastError = "trash is empty"
+		return
+	}
+
+	clearScreen()
+	fmt.Println("== Trash ==")
+
+	keys := make(map[string]interface{})
+	key := NewIncrementingKey("")
+	if len(trashedTags) > 0 {
+		fmt.Println("\nTags")
+		for _, t := range trashedTags {
+			fmt.Printf(" %s: %s%s%s (%d rows, deleted %s)\n", key, ansiReverseVideo, t.Name, ansiClearParams, t.RowCount, time.Unix(0, t.DeletedTS).Format("2006-01-02 15:04"))
+			keys[key.String()] = t
+			key.Increment()
+		}
+	}
+	if len(trashedRows) > 0 {
+		fmt.Println("\nRows")
+		for _, t := range trashedRows {
+			fmt.Printf(" %s: %s%s%s ", key, ansiReverseVideo, t.TagName, ansiClearParams)
+			s.printRowText(t.Row.Text)
+			keys[key.String()] = t
+			key.Increment()
+		}
+	}
+	fmt.Printf("\n[selection, ! to empty trash]: ")
+	selection, _ := s.scanner.Prompt("")
+	selection = strings.TrimSpace(selection)
+
+	switch v := keys[selection].(type) {
+	case db.TrashedTag:
+		tag, err := s.DB.RestoreTag(v.ID)
+		checkErr(err)
+		s.lastError = ""
+		s.SwitchTag(tag)
+	case db.TrashedRow:
+		row, err := s.DB.RestoreRow(v.ID)
+		if err == db.ErrQueryTag {
+			s.lastError = fmt.Sprintf("can't restore row to query tag \"%s\"", v.TagName)
+			return
+		}
+		if err == db.ErrTagLocked {
+			s.lastError = fmt.Sprintf("can't restore row to locked tag \"%s\"", v.TagName)
+			return
+		}
+		checkErr(err)
+		s.lastError = fmt.Sprintf("restored row to \"%s\"", v.TagName)
+		if row.TagID == s.CurrentDBTag.ID {
+			s.Refresh()
+		}
+	default:
+		switch selection {
+		case "":
+			s.lastError = ""
+		case "!":
+			err := s.DB.PurgeTrash()
+			checkErr(err)
+			s.lastError = "emptied trash"
+		default:
+			s.lastError = "invalid input"
+		}
+	}
+}
+
 func (s *state) printMonthCalendar(t time.Time) {
 	today := time.Now()
 	year, month, _ := t.Date()
@@ -408,7 +711,7 @@ func (s *state) printMonthCalendar(t time.Time) {
 		if d.Day() == today.Day() && d.Month() == today.Month() && d.Year() == today.Year() {
 			isToday = true
 		}
-		tagStr := d.Format("January 02 2006")
+		tagStr := d.Format(db.DateTagFormat)
 		if _, ok := s.allTagNames[tagStr]; ok {
 			tagExists = true
 		}
@@ -439,7 +742,7 @@ func (s *state) printMonthCalendar(t time.Time) {
 
 func (s *state) StartCalendar() {
 	var currentDate time.Time
-	curTagDate, err := time.Parse("January 02 2006", s.CurrentDBTag.Name)
+	curTagDate, err := time.Parse(db.DateTagFormat, s.CurrentDBTag.Name)
 	if err != nil {
 		currentDate = time.Now()
 	} else {
@@ -499,7 +802,7 @@ func (s *state) StartCalendar() {
 }
 
 func (s *state) MoveDays(num int) {
-	curDate, err := time.Parse("January 02 2006", s.CurrentDBTag.Name)
+	curDate, err := time.Parse(db.DateTagFormat, s.CurrentDBTag.Name)
 	if err != nil {
 		s.lastError = "not currently on date tag"
 		return
@@ -529,6 +832,10 @@ func (s *state) NewRow(arg string) (db.Row, bool) {
 	}
 
 	row, err := s.DB.AddRow(s.CurrentDBTag.ID, string(newRowText), 0)
+	if err == db.ErrQueryTag || err == db.ErrTagLocked {
+		s.lastError = err.Error()
+		return row, false
+	}
 	checkErr(err)
 
 	s.lastError = ""
@@ -554,18 +861,18 @@ func (s *state) DeleteRows(arg string) {
 		return
 	}
 
-	ok := s.CopyRows(arg)
+	rows, ok := s.CopyRows(arg)
 	if !ok {
 		// CopyRows will have set lastError
 		return
 	}
 
-	for _, row := range s.snarfedRows {
+	for _, row := range rows {
 		err := s.DB.DeleteRowByID(row.ID)
 		checkErr(err)
 	}
 
-	s.lastError = fmt.Sprintf("cut %d rows", len(s.snarfedRows))
+	s.lastError = fmt.Sprintf("cut %d rows", len(rows))
 	s.Refresh()
 }
 
@@ -590,6 +897,28 @@ func (s *state) EditRow(arg string) {
 	}
 }
 
+// LinkRow turns the first plain text mention of the current tag in a row into a link
+func (s *state) LinkRow(arg string) {
+	arg = strings.TrimSpace(arg)
+	row, ok := s.rowShortcuts[arg]
+	if !ok {
+		s.lastError = "l <row>"
+		return
+	}
+
+	text, ok := db.LinkMention(row.Text, s.CurrentDBTag.Name)
+	if !ok {
+		s.lastError = fmt.Sprintf("row doesn't mention \"%s\"", s.CurrentDBTag.Name)
+		return
+	}
+
+	err := s.DB.UpdateRowText(row.ID, text)
+	checkErr(err)
+
+	s.lastError = ""
+	s.Refresh()
+}
+
 func (s *state) MoveRow(arg string) {
 	arg = strings.TrimSpace(arg)
 
@@ -670,51 +999,71 @@ func (s *state) SelectRowRange(arg string) ([]db.Row, bool) {
 	return selectedRows, true
 }
 
-func (s *state) PasteRowsEnd() {
-	resnarf := make([]db.Row, 0, len(s.snarfedRows))
-
-	if len(s.snarfedRows) == 0 {
-		s.lastError = "empty snarf buffer"
+func (s *state) pasteRows(rank int) {
+	rows, err := s.DB.PasteSnarf(s.register, s.CurrentDBTag.ID, rank)
+	if err == db.ErrEmptyRegister || err == db.ErrQueryTag || err == db.ErrTagLocked {
+		s.lastError = err.Error()
 		return
 	}
+	checkErr(err)
 
-	for _, row := range s.snarfedRows {
-		newRow, err := s.DB.AddRow(s.CurrentDBTag.ID, row.Text, 0)
-		checkErr(err)
-		resnarf = append(resnarf, newRow)
-	}
-
-	// have to update our snarf buffer since these pasted rows are technically new
-	s.snarfedRows = resnarf
-
-	s.lastError = ""
+	s.lastError = fmt.Sprintf("pasted %d rows", len(rows))
 	s.Refresh()
 }
 
+func (s *state) PasteRowsEnd() {
+	s.pasteRows(-1)
+}
+
 func (s *state) PasteRowsStart() {
-	s.PasteRowsEnd()
+	s.pasteRows(0)
+}
 
-	for i := len(s.snarfedRows) - 1; i >= 0; i-- {
-		err := s.DB.UpdateRowRank(s.snarfedRows[i].ID, 0)
-		checkErr(err)
+// ShowRegisters lists the rows held by each snarf register
+func (s *state) ShowRegisters() {
+	registers, err := s.DB.GetSnarfRegisters()
+	checkErr(err)
+
+	if len(registers) == 0 {
+		s.lastError = "all snarf registers are empty"
+		return
 	}
 
-	s.Refresh()
+	names := make([]string, 0, len(registers))
+	for name := range registers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	clearScreen()
+	fmt.Println("== Registers ==")
+	for _, name := range names {
+		fmt.Printf("\n \"%s\n", name)
+		for _, row := range registers[name] {
+			fmt.Printf("   ")
+			s.printRowText(row.Text)
+		}
+	}
+	fmt.Println("\npress [enter] to continue...")
+	s.scanner.Prompt("")
+
+	s.lastError = ""
 }
 
-func (s *state) CopyRows(arg string) bool {
+func (s *state) CopyRows(arg string) ([]db.Row, bool) {
 	arg = strings.TrimSpace(arg)
 	if len(arg) == 0 {
 		s.lastError = "[y]ank <*|row|row-range>[,<row|row-range>,...]"
-		return false
+		return nil, false
 	}
 
 	if arg == "*" {
 		// copy ALL THE THINGS
-		s.snarfedRows = append([]db.Row(nil), s.CurrentDBRows...)
+		err := s.DB.PushSnarf(s.register, s.CurrentDBRows)
+		checkErr(err)
 
-		s.lastError = fmt.Sprintf("snarfed %d rows", len(s.snarfedRows))
-		return true
+		s.lastError = fmt.Sprintf("snarfed %d rows", len(s.CurrentDBRows))
+		return s.CurrentDBRows, true
 	}
 
 	args := strings.Split(arg, ",")
@@ -727,7 +1076,7 @@ func (s *state) CopyRows(arg string) bool {
 			rows, ok := s.SelectRowRange(r)
 			if !ok {
 				// SelectRowRange() should have already set lastError
-				return false
+				return nil, false
 			}
 			for _, row := range rows {
 				if !alreadySnarfedRows[row] {
@@ -745,15 +1094,97 @@ func (s *state) CopyRows(arg string) bool {
 				}
 			} else {
 				s.lastError = fmt.Sprintf("invalid row: %s", rowShortcut)
-				return false
+				return nil, false
 			}
 		}
 	}
 
-	s.snarfedRows = snarfedRows
+	err := s.DB.PushSnarf(s.register, snarfedRows)
+	checkErr(err)
+
+	s.lastError = fmt.Sprintf("snarfed %d rows", len(snarfedRows))
+	return snarfedRows, true
+}
+
+// Lock locks the current tag with a new passphrase, unlocks it if it's locked, or hides its rows again if it's unlocked
+func (s *state) Lock() {
+	tag := s.CurrentDBTag
+
+	switch {
+	case tag.Kind == db.TagKindQuery:
+		s.lastError = db.ErrQueryTag.Error()
+		return
+	case tag.Kind == db.TagKindLocked && s.DB.IsTagUnlocked(tag.ID):
+		s.DB.RelockTag(tag.ID)
+		s.lastError = fmt.Sprintf("relocked \"%s\"", tag.Name)
+	case tag.Kind == db.TagKindLocked:
+		passphrase, err := s.scanner.PasswordPrompt("passphrase: ")
+		if err != nil {
+			s.lastError = ""
+			return
+		}
+		err = s.DB.UnlockTag(tag.ID, passphrase)
+		if err == db.ErrPassphrase {
+			s.lastError = err.Error()
+			return
+		}
+		checkErr(err)
+		s.lastError = fmt.Sprintf("unlocked \"%s\"", tag.Name)
+	default:
+		passphrase, err := s.scanner.PasswordPrompt("new passphrase: ")
+		if err != nil {
+			s.lastError = ""
+			return
+		}
+		again, err := s.scanner.PasswordPrompt("new passphrase again: ")
+		if err != nil {
+			s.lastError = ""
+			return
+		}
+		if again != passphrase {
+			s.lastError = "passphrases don't match"
+			return
+		}
+		snapshots, err := s.DB.LockTag(tag.ID, passphrase)
+		if err == db.ErrReadOnly {
+			s.lastError = err.Error()
+			return
+		}
+		checkErr(err)
+		s.CurrentDBTag, err = s.DB.GetTagByID(tag.ID)
+		checkErr(err)
+		s.lastError = fmt.Sprintf("locked \"%s\"", tag.Name)
+		if len(snapshots) > 0 {
+			s.lastError += fmt.Sprintf("; the %d backups taken before still hold its rows in plaintext", len(snapshots))
+		}
+	}
+
+	s.Refresh()
+}
 
-	s.lastError = fmt.Sprintf("snarfed %d rows", len(s.snarfedRows))
-	return true
+// RemoveLock turns the current locked tag back into a normal one
+func (s *state) RemoveLock() {
+	if s.CurrentDBTag.Kind != db.TagKindLocked {
+		s.lastError = db.ErrTagNotLocked.Error()
+		return
+	}
+
+	passphrase, err := s.scanner.PasswordPrompt("passphrase: ")
+	if err != nil {
+		s.lastError = ""
+		return
+	}
+	err = s.DB.RemoveTagLock(s.CurrentDBTag.ID, passphrase)
+	if err == db.ErrPassphrase {
+		s.lastError = err.Error()
+		return
+	}
+	checkErr(err)
+	s.CurrentDBTag, err = s.DB.GetTagByID(s.CurrentDBTag.ID)
+	checkErr(err)
+
+	s.lastError = fmt.Sprintf("removed the lock from \"%s\"", s.CurrentDBTag.Name)
+	s.Refresh()
 }
 
 func (s *state) printHelp() {
@@ -761,14 +1192,18 @@ func (s *state) printHelp() {
 	fmt.Println("[Tags]")
 	fmt.Println("g: jump to today tag ('g'oto)")
 	fmt.Println("n: create new tag ('n'ew)")
-	fmt.Println("t: open all tags menu ('t'ags)")
-	fmt.Println("t/<text>: search tag names for <text>")
+	fmt.Println("t: pick a tag, narrowing the list as you type; arrows move, [enter] picks, [esc] cancels ('t'ags)")
+	fmt.Println("t/<text>: pick a tag starting from <text>, or jump straight to the only match")
 	fmt.Println("t <text>: jump to or create to exact tag <text>")
-	fmt.Println("r [text]: rename current tag with text <text> ('r'ename)")
+	fmt.Println("r [text]: rename current tag with text <text>, along with the tags below it ('r'ename)")
 	fmt.Println("c: open calendar ('c'alendar)")
 	fmt.Println("<: go back one day (left)")
 	fmt.Println(">: go forward one day (right)")
 	fmt.Println("b: jump backwards in tag stack ('b'ack)")
+	fmt.Println("s <name> = <query>: save query as a read-only query tag ('s'ave)")
+	fmt.Println("s: edit the query of the current query tag; an empty query turns it back into a normal tag ('s'ave)")
+	fmt.Println("k: lock current tag with a passphrase, unlock it for the session, or lock it again if it's unlocked (loc'k')")
+	fmt.Println("K: remove the lock from current tag, turning it back into a normal tag (loc'K')")
 	fmt.Println("")
 	fmt.Println("[Rows]")
 	fmt.Println("[num]: jump to row-referenced tag")
@@ -776,37 +1211,87 @@ func (s *state) printHelp() {
 	fmt.Println("A [text]: add new row in first row slot with text [text] or fire up editor if [text] is not present ('A'dd)")
 	fmt.Println("d <*|row|row-range>[,<row|row-range>,...]: cut row(s) to snarf buffer ('d'elete)")
 	fmt.Println("e <row>: edit row ('e'dit)")
+	fmt.Println("u: open trash to restore deleted tags and rows ('u'ndelete)")
+	fmt.Println("f <query>: find rows across all tags, e.g. f [[todo]] -[[done]] updated:7d ('f'ind)")
+	fmt.Println("U: show or hide the rows mentioning current tag without linking to it, which searches every row ('U'nlinked)")
+	fmt.Println("l <row>: link the first plain mention of the current tag in row ('l'ink)")
 	fmt.Println("m <row1> <row2>: move row1 to row2 ('m'ove)")
 	fmt.Println("y <*|row|row-range>[,<row|row-range>,...]: yank row(s) to snarf buffer ('y'ank)")
-	fmt.Println("p: paste snarfed rows to end of current tag ('p'aste)")
+	fmt.Println("p: paste snarfed rows to end of current tag; cut rows are moved rather than copied ('p'aste)")
 	fmt.Println("P: paste snarfed rows to beginning of current tag ('P'aste)")
+	fmt.Println("\"<r>: prefix d, y, p or P to use snarf register <r> instead of the default one, e.g. \"ay 1-3")
+	fmt.Println("\": list the contents of all snarf registers")
 	fmt.Println("?: print help")
 	fmt.Println("")
+	fmt.Println("[tab] inside [[ completes the tag name; press it again for the next match")
+	fmt.Println("")
 	fmt.Println("press [enter] to continue...")
 
 	s.scanner.Prompt("")
 }
 
+// readOnlyCommands are the commands that work on a read-only database
+const readOnlyCommands = "bcfgkqtU<>?0123456789"
+
 func main() {
 	var err error
 	var programState state
 
+	readOnly := flag.Bool("read-only", false, "browse the database without changing it")
+	flag.Parse()
+
 	programState.DB = &db.ExoDB{}
+	open, openEncrypted := programState.DB.Open, programState.DB.OpenEncrypted
+	if *readOnly {
+		open, openEncrypted = programState.DB.OpenReadOnly, programState.DB.OpenEncryptedReadOnly
+	}
 
-	err = programState.DB.Open("./exocortex.db")
+	scanner := liner.NewLiner()
+	defer scanner.Close()
+
+	err = open("./exocortex.db")
+	for err == db.ErrEncrypted || err == db.ErrPassphrase {
+		if err == db.ErrPassphrase {
+			fmt.Println(err)
+		}
+		var passphrase string
+		passphrase, err = scanner.PasswordPrompt("passphrase: ")
+		if err != nil {
+			return
+		}
+		err = openEncrypted("./exocortex.db", passphrase)
+	}
 	checkErr(err)
 
 	err = programState.DB.LoadSchema()
 	checkErr(err)
+	if notices := programState.DB.Notices(); len(notices) > 0 {
+		fmt.Println("Upgrading the database changed some tags:")
+		for _, notice := range notices {
+			fmt.Println(" " + notice)
+		}
+		fmt.Println("")
+		fmt.Println("press [enter] to continue...")
+		scanner.Prompt("")
+	}
+
+	if !*readOnly {
+		_, err = programState.DB.ExpireTrash()
+		checkErr(err)
+	}
 
 	programState.GoToToday()
 	programState.Refresh()
 
-	scanner := liner.NewLiner()
-	defer scanner.Close()
-
 	programState.scanner = scanner
+	// tab completes tag names inside [[
+	scanner.SetWordCompleter(programState.completeLink)
 	programState.lastError = "enter '?' for help"
+	if *readOnly {
+		programState.lastError = "read-only; enter '?' for help"
+	} else if err = programState.DB.StartBackups(); err != nil {
+		programState.lastError = fmt.Sprintf("backups are off: %s", err)
+	}
 	programState.RenderMain()
 
 	for {
@@ -830,36 +1315,74 @@ func main() {
 			continue
 		}
 
-		switch line[0] {
+		programState.register = db.SnarfDefaultRegister
+		cmd := line
+		if line[0] == '"' {
+			if len(line) == 1 {
+				programState.ShowRegisters()
+				programState.RenderMain()
+				continue
+			}
+			programState.register = line[1:2]
+			cmd = line[2:]
+			if len(cmd) == 0 || strings.IndexByte("dypP", cmd[0]) < 0 {
+				programState.lastError = "\"<register> must be followed by d, y, p or P"
+				programState.RenderMain()
+				continue
+			}
+		}
+
+		if *readOnly && strings.IndexByte(readOnlyCommands, cmd[0]) < 0 {
+			programState.lastError = db.ErrReadOnly.Error()
+			programState.RenderMain()
+			continue
+		}
+
+		switch cmd[0] {
 		case 'g':
 			programState.lastError = ""
 			programState.GoToToday()
 		case 'a':
-			programState.NewRow(line[1:])
+			programState.NewRow(cmd[1:])
 		case 'A':
-			programState.InsertRow(line[1:])
+			programState.InsertRow(cmd[1:])
 		case 'b':
 			programState.PopTag()
 		case 'd':
-			programState.DeleteRows(line[1:])
+			programState.DeleteRows(cmd[1:])
 		case 'e':
-			programState.EditRow(line[1:])
+			programState.EditRow(cmd[1:])
+		case 'f':
+			programState.Query(cmd[1:])
 		case 'c':
 			programState.StartCalendar()
+		case 'k':
+			programState.Lock()
+		case 'K':
+			programState.RemoveLock()
+		case 'l':
+			programState.LinkRow(cmd[1:])
 		case 'm':
-			programState.MoveRow(line[1:])
+			programState.MoveRow(cmd[1:])
 		case 'n':
-			programState.NewTag(line[1:])
+			programState.NewTag(cmd[1:])
 		case 't':
-			programState.SelectTag(line[1:])
+			programState.SelectTag(cmd[1:])
 		case 'p':
 			programState.PasteRowsEnd()
 		case 'P':
 			programState.PasteRowsStart()
 		case 'r':
-			programState.RenameTag(line[1:])
+			programState.RenameTag(cmd[1:])
+		case 's':
+			programState.SaveQuery(cmd[1:])
+		case 'u':
+			programState.Trash()
+		case 'U':
+			programState.ShowUnlinkedRefs = !programState.ShowUnlinkedRefs
+			programState.Refresh()
 		case 'y':
-			programState.CopyRows(line[1:])
+			programState.CopyRows(cmd[1:])
 		case '<':
 			programState.MoveDays(-1)
 		case '>':
@@ -869,11 +1392,11 @@ func main() {
 		case 'q':
 			goto End
 		default:
-			if line[0] <= '9' && line[0] >= '0' {
+			if cmd[0] <= '9' && cmd[0] >= '0' {
 				// try to parse as int
-				i, err := strconv.Atoi(line)
+				i, err := strconv.Atoi(cmd)
 				if err != nil {
-					programState.lastError = fmt.Sprintf("failed to parse tag ref: %s", line)
+					programState.lastError = fmt.Sprintf("failed to parse tag ref: %s", cmd)
 					break
 				}
 				// looks like an int; do a lookup
@@ -885,7 +1408,7 @@ func main() {
 				}
 			} else {
 				// some random non-numeric command was entered
-				programState.lastError = fmt.Sprintf("invalid command: %c", line[0])
+				programState.lastError = fmt.Sprintf("invalid command: %c", cmd[0])
 			}
 		}
 		scanner.AppendHistory(line)
@@ -893,5 +1416,6 @@ func main() {
 	}
 End:
 	programState.DeleteTagIfEmpty(programState.CurrentDBTag.ID)
+	programState.DB.Close()
 	fmt.Println("bye!")
 }
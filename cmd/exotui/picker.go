@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode"
+
+	"github.com/neutralinsomniac/exocortex/db"
+)
+
+// tagPicker is an interactive fuzzy finder over tag names: the list narrows as the query is typed and the arrow keys
+// move the selection
+type tagPicker struct {
+	tags     []db.Tag
+	recent   []string // tag.Name, most recent first
+	counts   map[int64]int
+	query    []rune
+	matches  []db.Tag
+	selected int
+}
+
+// pickerLines is the number of lines the picker uses around its list of matches
+const pickerLines = 3
+
+// stty runs stty against the terminal and returns its output
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// terminalHeight returns the number of lines in the terminal, or 24 if it can't be found
+func terminalHeight() int {
+	var rows, cols int
+
+	size, err := stty("size")
+	if err == nil {
+		_, err = fmt.Sscan(size, &rows, &cols)
+	}
+	if err != nil || rows <= pickerLines {
+		return 24
+	}
+
+	return rows
+}
+
+func (p *tagPicker) filter() {
+	p.matches = db.FilterTags(p.tags, string(p.query), p.recent)
+	p.selected = 0
+}
+
+func (p *tagPicker) move(delta int) {
+	p.selected += delta
+	if p.selected >= len(p.matches) {
+		p.selected = len(p.matches) - 1
+	}
+	if p.selected < 0 {
+		p.selected = 0
+	}
+}
+
+func (p *tagPicker) render(height int) {
+	clearScreen()
+	fmt.Printf("== Tags (%d of %d) ==\n", len(p.matches), len(p.tags))
+	fmt.Printf("> %s\n", string(p.query))
+
+	// scroll so the selection stays on screen
+	lines := height - pickerLines
+	start := 0
+	if p.selected >= lines {
+		start = p.selected - lines + 1
+	}
+
+	for i := start; i < len(p.matches) && i < start+lines; i++ {
+		tag := p.matches[i]
+		var label string
+		switch tag.Kind {
+		case db.TagKindQuery:
+			label = fmt.Sprintf("%s (query)", tag.Name)
+		case db.TagKindLocked:
+			label = fmt.Sprintf("%s (locked)", tag.Name)
+		default:
+			label = fmt.Sprintf("%s (%d rows)", tag.Name, p.counts[tag.ID])
+		}
+		if i == p.selected {
+			fmt.Printf("%s> %s%s\n", ansiReverseVideo, label, ansiClearParams)
+		} else {
+			fmt.Printf("  %s\n", label)
+		}
+	}
+
+	// leave the cursor at the end of the query
+	fmt.Printf("\033[2;%dH", len(p.query)+3)
+}
+
+// run shows the picker until a tag is picked or it's cancelled. It fails if the terminal can't be put in raw mode, so
+// callers can fall back to something that reads whole lines.
+func (p *tagPicker) run() (db.Tag, bool, error) {
+	var tag db.Tag
+	var picked bool
+	var buf [64]byte
+
+	saved, err := stty("-g")
+	if err != nil {
+		return tag, false, err
+	}
+	_, err = stty("-icanon", "-echo", "-isig", "min", "1")
+	if err != nil {
+		stty(saved)
+		return tag, false, err
+	}
+	defer stty(saved)
+
+	height := terminalHeight()
+	p.filter()
+
+	for {
+		p.render(height)
+
+		n, err := os.Stdin.Read(buf[:])
+		if err != nil {
+			return tag, false, err
+		}
+		input := string(buf[:n])
+
+		switch input {
+		case "\x1b", "\x03", "\x07": // escape, ctrl-c, ctrl-g
+			goto End
+		case "\r", "\n":
+			if len(p.matches) > 0 {
+				tag, picked = p.matches[p.selected], true
+				goto End
+			}
+		case "\x1b[A", "\x1bOA", "\x10": // up, ctrl-p
+			p.move(-1)
+		case "\x1b[B", "\x1bOB", "\x0e": // down, ctrl-n
+			p.move(1)
+		case "\x1b[5~": // page up
+			p.move(-(height - pickerLines))
+		case "\x1b[6~": // page down
+			p.move(height - pickerLines)
+		case "\x7f", "\x08": // backspace
+			if len(p.query) > 0 {
+				p.query = p.query[:len(p.query)-1]
+				p.filter()
+			}
+		case "\x15": // ctrl-u
+			p.query = nil
+			p.filter()
+		default:
+			if input[0] == '\x1b' {
+				// some other escape sequence
+				break
+			}
+			for _, r := range input {
+				if unicode.IsPrint(r) {
+					p.query = append(p.query, r)
+				}
+			}
+			p.filter()
+		}
+	}
+
+End:
+	clearScreen()
+	return tag, picked, nil
+}
@@ -1,16 +1,18 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"html/template"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 
 	"github.com/neutralinsomniac/exocortex/db"
+	"github.com/neutralinsomniac/exocortex/web"
 )
 
-var templates = template.Must(template.ParseGlob("templates/*"))
+var templates = web.Templates
 
 var exoDB db.ExoDB
 var page Page
@@ -91,11 +93,33 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 func main() {
 	var err error
 
-	err = exoDB.Open("./exocortex.db")
+	readOnly := flag.Bool("read-only", false, "serve the database without changing it")
+	flag.Parse()
+
+	open, openEncrypted := exoDB.Open, exoDB.OpenEncrypted
+	if *readOnly {
+		open, openEncrypted = exoDB.OpenReadOnly, exoDB.OpenEncryptedReadOnly
+	}
+
+	err = open("./exocortex.db")
+	if err == db.ErrEncrypted {
+		// there's nobody to prompt
+		err = openEncrypted("./exocortex.db", os.Getenv("EXOCORTEX_PASSPHRASE"))
+	}
 	checkErr(err)
 
 	err = exoDB.LoadSchema()
 	checkErr(err)
+	for _, notice := range exoDB.Notices() {
+		log.Println(notice)
+	}
+
+	if !*readOnly {
+		err = exoDB.StartBackups()
+		if err != nil {
+			log.Println("backups are off:", err)
+		}
+	}
 
 	err = page.updatePage()
 	checkErr(err)
@@ -0,0 +1,397 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Backups are snapshots of the whole database, taken with SQLite's online backup API so that they only ever hold
+// committed changes, and kept in a directory next to the database file named after it, e.g. exocortex.db.backups.
+// Snapshots of an encrypted database are encrypted with the same passphrase.
+//
+// Old snapshots are rotated out: the newest snapshot of each of the last backup.hourly hours, backup.daily days and
+// backup.weekly weeks is kept, along with the newest snapshot overall.
+
+const (
+	// SettingBackupHourly is the setting holding how many hourly snapshots are kept
+	SettingBackupHourly = "backup.hourly"
+	// SettingBackupDaily is the setting holding how many daily snapshots are kept
+	SettingBackupDaily = "backup.daily"
+	// SettingBackupWeekly is the setting holding how many weekly snapshots are kept
+	SettingBackupWeekly = "backup.weekly"
+	// SettingBackupIntervalMinutes is the setting holding how often a frontend takes a snapshot while it's running.
+	// 0 only takes them when the database is opened and closed.
+	SettingBackupIntervalMinutes = "backup.interval_minutes"
+)
+
+const (
+	defaultBackupHourly          = "24"
+	defaultBackupDaily           = "7"
+	defaultBackupWeekly          = "4"
+	defaultBackupIntervalMinutes = "60"
+)
+
+// backupTimeFormat names snapshots after the time they were taken, in an order that sorts
+const backupTimeFormat = "2006-01-02T15-04-05"
+
+// ErrNoBackup is returned when restoring a snapshot that doesn't exist
+var ErrNoBackup = errors.New("no such backup")
+
+// Snapshot is a backup of the database
+type Snapshot struct {
+	Name string
+	Path string
+	Time time.Time
+	Size int64
+}
+
+// BackupDir returns the directory holding the snapshots of the database in filename
+func BackupDir(filename string) string {
+	return filename + ".backups"
+}
+
+// ListBackups returns the snapshots of the database in filename, newest first
+func ListBackups(filename string) ([]Snapshot, error) {
+	var snapshots []Snapshot
+	var entries []os.DirEntry
+	var err error
+
+	entries, err = os.ReadDir(BackupDir(filename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		goto End
+	}
+
+	for _, entry := range entries {
+		var t time.Time
+		var info os.FileInfo
+
+		name := strings.TrimSuffix(entry.Name(), ".db")
+		if name == entry.Name() || entry.IsDir() {
+			continue
+		}
+		t, err = time.ParseInLocation(backupTimeFormat, name, time.Local)
+		if err != nil {
+			// not one of ours
+			err = nil
+			continue
+		}
+		info, err = entry.Info()
+		if err != nil {
+			goto End
+		}
+
+		snapshots = append(snapshots, Snapshot{name, filepath.Join(BackupDir(filename), entry.Name()), t, info.Size()})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Time.After(snapshots[j].Time)
+	})
+
+End:
+	return snapshots, err
+}
+
+// expiredBackups returns the snapshots, sorted newest first, that fall outside the rotation
+func expiredBackups(snapshots []Snapshot, hourly int, daily int, weekly int) []Snapshot {
+	var expired []Snapshot
+
+	keep := make(map[string]bool)
+	if len(snapshots) > 0 {
+		keep[snapshots[0].Name] = true
+	}
+
+	periods := []struct {
+		count  int
+		period func(t time.Time) string
+	}{
+		{hourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+	}
+
+	for _, p := range periods {
+		seen := make(map[string]bool)
+		for _, s := range snapshots {
+			if len(seen) == p.count {
+				break
+			}
+			period := p.period(s.Time)
+			if !seen[period] {
+				seen[period] = true
+				keep[s.Name] = true
+			}
+		}
+	}
+
+	for _, s := range snapshots {
+		if !keep[s.Name] {
+			expired = append(expired, s)
+		}
+	}
+
+	return expired
+}
+
+func (e *ExoDB) getBackupSetting(key string, def string) (int, error) {
+	value, err := e.GetSetting(key, def)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s setting: %s", key, value)
+	}
+
+	return n, nil
+}
+
+// writeSnapshot writes the database open on conn to path
+func writeSnapshot(conn *sql.Conn, path string) error {
+	return conn.Raw(func(driverConn interface{}) error {
+		var dest driver.Conn
+		var backup *sqlite3.SQLiteBackup
+		var plaintext, sealed []byte
+		var err error
+
+		// the in-memory copy of an encrypted database is sealed like the database itself
+		if c, ok := driverConn.(*encryptedConn); ok {
+			plaintext, err = c.Serialize("main")
+			if err != nil {
+				return err
+			}
+			sealed, err = c.connector.sealer.seal(plaintext)
+			if err != nil {
+				return err
+			}
+			return writeFileAtomic(path, sealed)
+		}
+
+		// back up to a temporary file, so that a failed backup doesn't leave a partial snapshot behind
+		tmp := path + ".tmp"
+		os.Remove(tmp)
+		defer os.Remove(tmp)
+
+		dest, err = (&sqlite3.SQLiteDriver{}).Open(tmp)
+		if err != nil {
+			return err
+		}
+
+		backup, err = dest.(*sqlite3.SQLiteConn).Backup("main", driverConn.(*sqlite3.SQLiteConn), "main")
+		if err == nil {
+			_, err = backup.Step(-1)
+			if finishErr := backup.Finish(); err == nil {
+				err = finishErr
+			}
+		}
+		if closeErr := dest.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+
+		return os.Rename(tmp, path)
+	})
+}
+
+// Backup takes a snapshot of the database and rotates out old ones. Setting backup.hourly, backup.daily and
+// backup.weekly all to 0 turns backups off.
+func (e *ExoDB) Backup() (Snapshot, error) {
+	var snapshot Snapshot
+	var conn *sql.Conn
+	var hourly, daily, weekly int
+	var snapshots []Snapshot
+	var info os.FileInfo
+	var err error
+
+	if e.readOnly {
+		err = ErrReadOnly
+		goto End
+	}
+
+	if e.filename == "" || e.filename == ":memory:" {
+		err = fmt.Errorf("in-memory databases can't be backed up")
+		goto End
+	}
+
+	hourly, err = e.getBackupSetting(SettingBackupHourly, defaultBackupHourly)
+	if err != nil {
+		goto End
+	}
+	daily, err = e.getBackupSetting(SettingBackupDaily, defaultBackupDaily)
+	if err != nil {
+		goto End
+	}
+	weekly, err = e.getBackupSetting(SettingBackupWeekly, defaultBackupWeekly)
+	if err != nil {
+		goto End
+	}
+	if hourly == 0 && daily == 0 && weekly == 0 {
+		goto End
+	}
+
+	err = os.MkdirAll(BackupDir(e.filename), 0700)
+	if err != nil {
+		goto End
+	}
+
+	snapshot.Time = time.Now()
+	snapshot.Name = snapshot.Time.Format(backupTimeFormat)
+	snapshot.Path = filepath.Join(BackupDir(e.filename), snapshot.Name+".db")
+
+	conn, err = e.conn.Conn(context.Background())
+	if err != nil {
+		goto End
+	}
+	err = writeSnapshot(conn, snapshot.Path)
+	conn.Close()
+	if err != nil {
+		goto End
+	}
+
+	info, err = os.Stat(snapshot.Path)
+	if err != nil {
+		goto End
+	}
+	snapshot.Size = info.Size()
+
+	snapshots, err = ListBackups(e.filename)
+	if err != nil {
+		goto End
+	}
+
+	for _, s := range expiredBackups(snapshots, hourly, daily, weekly) {
+		err = os.Remove(s.Path)
+		if err != nil {
+			goto End
+		}
+	}
+
+End:
+	return snapshot, err
+}
+
+// StartBackups takes a snapshot now, then every backup.interval_minutes until the database is closed, which takes a
+// last one. A failed periodic snapshot is retried at the next interval.
+func (e *ExoDB) StartBackups() error {
+	var minutes int
+	var err error
+
+	_, err = e.Backup()
+	if err != nil {
+		goto End
+	}
+
+	minutes, err = e.getBackupSetting(SettingBackupIntervalMinutes, defaultBackupIntervalMinutes)
+	if err != nil {
+		goto End
+	}
+
+	e.stopBackups = make(chan struct{})
+	e.backupsStopped = make(chan struct{})
+
+	go func() {
+		defer close(e.backupsStopped)
+
+		var tick <-chan time.Time
+		if minutes > 0 {
+			ticker := time.NewTicker(time.Duration(minutes) * time.Minute)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-tick:
+				e.Backup()
+			case <-e.stopBackups:
+				return
+			}
+		}
+	}()
+
+End:
+	return err
+}
+
+// RestoreBackup replaces the database in filename with one of its snapshots. The database is snapshotted first, so
+// the restore can be undone. It's best done while no frontend has the database open.
+func RestoreBackup(filename string, name string) error {
+	var snapshots []Snapshot
+	var snapshot *Snapshot
+	var contents []byte
+	var err error
+
+	snapshots, err = ListBackups(filename)
+	if err != nil {
+		goto End
+	}
+
+	for i := range snapshots {
+		if snapshots[i].Name == name {
+			snapshot = &snapshots[i]
+		}
+	}
+	if snapshot == nil {
+		err = ErrNoBackup
+		goto End
+	}
+
+	contents, err = os.ReadFile(snapshot.Path)
+	if err != nil {
+		goto End
+	}
+
+	// keep the current database as a snapshot of its own
+	err = copyFile(filename, filepath.Join(BackupDir(filename), time.Now().Format(backupTimeFormat)+".db"))
+	if err != nil {
+		goto End
+	}
+
+	err = writeFileAtomic(filename, contents)
+	if err != nil {
+		goto End
+	}
+
+	// a leftover journal belongs to the replaced database
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		err = os.Remove(filename + suffix)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		if err != nil {
+			goto End
+		}
+	}
+
+End:
+	return err
+}
+
+// copyFile copies src to dest, if src exists
+func copyFile(src string, dest string) error {
+	contents, err := readDatabaseFile(src)
+	if err != nil || contents == nil {
+		return err
+	}
+
+	return writeFileAtomic(dest, contents)
+}
@@ -0,0 +1,150 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackup(t *testing.T) {
+	var db ExoDB
+	var snapshot Snapshot
+	var snapshots []Snapshot
+	var err error
+
+	filename := filepath.Join(t.TempDir(), "exocortex.db")
+
+	err = db.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AddTag("before")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err = db.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AddTag("after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	snapshots, err = ListBackups(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Name != snapshot.Name {
+		t.Fatalf("expected one snapshot named %s, got %v", snapshot.Name, snapshots)
+	}
+
+	if err = RestoreBackup(filename, "2001-01-01T00-00-00"); err != ErrNoBackup {
+		t.Fatalf("expected ErrNoBackup, got %v", err)
+	}
+
+	// the restore itself is undoable
+	time.Sleep(time.Second)
+	err = RestoreBackup(filename, snapshot.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err = ListBackups(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("expected the replaced database to be kept, got %v", snapshots)
+	}
+
+	err = db.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.GetTagByName("before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.GetTagByName("after"); err == nil {
+		t.Fatal("expected the tag added after the snapshot to be gone")
+	}
+}
+
+func TestExpiredBackups(t *testing.T) {
+	var snapshots []Snapshot
+
+	// a snapshot every 20 minutes for ten days
+	now := time.Date(2021, 3, 10, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 10*24*3; i++ {
+		ts := now.Add(-time.Duration(i) * 20 * time.Minute)
+		snapshots = append(snapshots, Snapshot{Name: ts.Format(backupTimeFormat), Time: ts})
+	}
+
+	expired := expiredBackups(snapshots, 3, 2, 1)
+	expiredNames := make(map[string]bool)
+	for _, s := range expired {
+		expiredNames[s.Name] = true
+	}
+
+	var kept []string
+	for _, s := range snapshots {
+		if !expiredNames[s.Name] {
+			kept = append(kept, s.Name)
+		}
+	}
+
+	// the last three hours, the last two days and the last week overlap at the newest snapshot
+	expected := []string{"2021-03-10T12-00-00", "2021-03-10T11-40-00", "2021-03-10T10-40-00", "2021-03-09T23-40-00"}
+	if len(kept) != len(expected) {
+		t.Fatalf("expected %v to be kept, got %v", expected, kept)
+	}
+	for i := range expected {
+		if kept[i] != expected[i] {
+			t.Fatalf("expected %v to be kept, got %v", expected, kept)
+		}
+	}
+
+	if expired = expiredBackups(snapshots, 0, 0, 0); len(expired) != len(snapshots)-1 {
+		t.Fatalf("expected only the newest snapshot to be kept, got %d expired", len(expired))
+	}
+}
+
+func TestBackupEncrypted(t *testing.T) {
+	encryptionIterations = 1000
+	filename := filepath.Join(t.TempDir(), "exocortex.db")
+
+	db := openEncrypted(t, filename, "secret")
+	defer db.Close()
+
+	_, err := db.AddTag("clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := db.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if encrypted, err := IsEncrypted(snapshot.Path); err != nil || !encrypted {
+		t.Fatalf("expected the snapshot to be encrypted: %v", err)
+	}
+
+	restored := openEncrypted(t, snapshot.Path, "secret")
+	defer restored.Close()
+	_, err = restored.GetTagByName("clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,203 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxCompletions is the number of tag names frontends offer while a link is being typed
+const MaxCompletions = 8
+
+// TagMatch is how closely a query matches a tag name. Closer matches are smaller.
+type TagMatch int
+
+const (
+	// TagMatchPrefix names start with the query
+	TagMatchPrefix TagMatch = iota
+	// TagMatchWord names have a word or namespace level starting with the query
+	TagMatchWord
+	// TagMatchFuzzy names hold the letters of the query in order
+	TagMatchFuzzy
+)
+
+// MatchTagName returns how closely query matches the tag called name, or false if it doesn't. Both are compared by
+// TagKey, so case and whitespace don't matter. An empty query matches every name.
+func MatchTagName(query string, name string) (TagMatch, bool) {
+	query = TagKey(query)
+	key := TagKey(name)
+
+	if strings.HasPrefix(key, query) {
+		return TagMatchPrefix, true
+	}
+
+	// the width of a rune is taken from the text, since an invalid byte decodes to a wider utf8.RuneError
+	for i, r := range key {
+		_, size := utf8.DecodeRuneInString(key[i:])
+		if i > 0 && !unicode.IsLetter(r) && !unicode.IsDigit(r) && strings.HasPrefix(key[i+size:], query) {
+			return TagMatchWord, true
+		}
+	}
+
+	rest := key
+	for _, r := range query {
+		i := strings.IndexRune(rest, r)
+		if i < 0 {
+			return 0, false
+		}
+		_, size := utf8.DecodeRuneInString(rest[i:])
+		rest = rest[i+size:]
+	}
+
+	return TagMatchFuzzy, true
+}
+
+// FilterTags returns the tags whose names match query, closest matches first. Within each kind of match, the tags
+// named in recent come first, in its order, then the most recently changed tags.
+func FilterTags(tags []Tag, query string, recent []string) []Tag {
+	type candidate struct {
+		Tag
+		match  TagMatch
+		recent int
+	}
+	var candidates []candidate
+	var filtered []Tag
+
+	recentRank := make(map[string]int)
+	for i, name := range recent {
+		if _, ok := recentRank[TagKey(name)]; !ok {
+			recentRank[TagKey(name)] = i
+		}
+	}
+
+	for _, tag := range tags {
+		if match, ok := MatchTagName(query, tag.Name); ok {
+			rank, ok := recentRank[TagKey(tag.Name)]
+			if !ok {
+				rank = len(recent)
+			}
+			candidates = append(candidates, candidate{tag, match, rank})
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.match != b.match {
+			return a.match < b.match
+		}
+		if a.recent != b.recent {
+			return a.recent < b.recent
+		}
+		return a.UpdatedTS > b.UpdatedTS
+	})
+
+	for _, c := range candidates {
+		filtered = append(filtered, c.Tag)
+	}
+
+	return filtered
+}
+
+// OpenLink returns the offset in text of the name of the link that's still open at its end, and false if there's no
+// open link: "see [[work/pro" is completing "work/pro", and "see [[work]] and" isn't completing anything.
+func OpenLink(text string) (int, bool) {
+	i := strings.LastIndex(text, "[[")
+	if i < 0 || strings.Contains(text[i:], "]]") || strings.Contains(text[i:], "\n") {
+		return 0, false
+	}
+
+	return i + len("[["), true
+}
+
+// CompleteLink finishes the open link at the end of text with the tag called name
+func CompleteLink(text string, name string) string {
+	start, ok := OpenLink(text)
+	if !ok {
+		return text
+	}
+
+	return text[:start] + name + "]]"
+}
+
+// completion is a tag matching a completion query
+type completion struct {
+	Tag
+	match    TagMatch
+	refcount int
+}
+
+func sqlCompleteTags(tx *sql.Tx, query string, limit int) ([]Tag, error) {
+	var sqlRows *sql.Rows
+	var completions []completion
+	var tags []Tag
+	var err error
+
+	sqlRows, err = tx.Query("SELECT id, name, updated_ts, " + tagKindColumn + ", refcount FROM tag")
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	for sqlRows.Next() {
+		var c completion
+		err = sqlRows.Scan(&c.ID, &c.Name, &c.UpdatedTS, &c.Kind, &c.refcount)
+		if err != nil {
+			goto End
+		}
+		if match, ok := MatchTagName(query, c.Name); ok {
+			c.match = match
+			completions = append(completions, c)
+		}
+	}
+
+	// closer matches first, then the most linked tags, then the most recently changed
+	sort.Slice(completions, func(i, j int) bool {
+		a, b := completions[i], completions[j]
+		if a.match != b.match {
+			return a.match < b.match
+		}
+		if a.refcount != b.refcount {
+			return a.refcount > b.refcount
+		}
+		if a.UpdatedTS != b.UpdatedTS {
+			return a.UpdatedTS > b.UpdatedTS
+		}
+		return TagKey(a.Name) < TagKey(b.Name)
+	})
+
+	for i, c := range completions {
+		if i == limit {
+			break
+		}
+		tags = append(tags, c.Tag)
+	}
+
+End:
+	return tags, err
+}
+
+// CompleteTags returns up to limit tags whose names match query, best first. Names starting with the query come
+// first, then names with a word starting with it, then names holding its letters in order; within each, the tags
+// linked from the most rows, then the most recently changed.
+func (e *ExoDB) CompleteTags(query string, limit int) ([]Tag, error) {
+	var tx *sql.Tx
+	var tags []Tag
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	tags, err = sqlCompleteTags(tx, query, limit)
+	if err != nil {
+		goto End
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return tags, err
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestMatchTagName(t *testing.T) {
+	tests := []struct {
+		query, name string
+		match       TagMatch
+		ok          bool
+	}{
+		{"", "anything", TagMatchPrefix, true},
+		{"Pro", "project x", TagMatchPrefix, true},
+		{"x", "project x", TagMatchWord, true},
+		{"des", "work/projectX/design", TagMatchWord, true},
+		{"wpd", "work/projectX/design", TagMatchFuzzy, true},
+		{"dw", "work/projectX/design", 0, false},
+		// invalid UTF-8 mustn't throw the offsets off
+		{"x", "a\xff", 0, false},
+		{"b", "a\xffb", TagMatchWord, true},
+		{"a\xffb", "xa\xffyb", TagMatchFuzzy, true},
+	}
+
+	for _, test := range tests {
+		match, ok := MatchTagName(test.query, test.name)
+		if match != test.match || ok != test.ok {
+			t.Error(fmt.Sprintf("MatchTagName(%q, %q): expected %d %t, got %d %t", test.query, test.name, test.match, test.ok, match, ok))
+		}
+	}
+}
+
+func TestCompleteLink(t *testing.T) {
+	tests := []struct {
+		text, name, expected string
+		ok                   bool
+	}{
+		{"see [[wo", "work", "see [[work]]", true},
+		{"see [[", "work", "see [[work]]", true},
+		{"see [[work]] and", "home", "see [[work]] and", false},
+		{"[[a]] and [[b", "bob", "[[a]] and [[bob]]", true},
+		{"no link", "work", "no link", false},
+	}
+
+	for _, test := range tests {
+		_, ok := OpenLink(test.text)
+		text := CompleteLink(test.text, test.name)
+		if text != test.expected || ok != test.ok {
+			t.Error(fmt.Sprintf("CompleteLink(%q, %q): expected %q %t, got %q %t", test.text, test.name, test.expected, test.ok, text, ok))
+		}
+	}
+}
+
+func TestCompleteTags(t *testing.T) {
+	db := setupDB(t)
+
+	addLinkedRows(t, &db, "notes", "[[project]] [[work/projects]] [[work/projects]]", "[[work/projects]] [[tax prep]]", "[[pet rock]]")
+
+	tags, err := db.CompleteTags("pro", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, tag := range tags {
+		names = append(names, tag.Name)
+	}
+	// prefix matches, then word matches ranked by refs, then fuzzy ones
+	expected := "project,work/projects,pet rock"
+	if strings.Join(names, ",") != expected {
+		t.Fatalf("expected %s, got %v", expected, names)
+	}
+
+	tags, err = db.CompleteTags("", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 || tags[0].Name != "work/projects" {
+		t.Fatalf("expected the most linked tags first, got %v", tags)
+	}
+}
+
+func TestFilterTags(t *testing.T) {
+	tags := []Tag{
+		{ID: 1, Name: "project", UpdatedTS: 1},
+		{ID: 2, Name: "work/projects", UpdatedTS: 3},
+		{ID: 3, Name: "pet rock", UpdatedTS: 2},
+		{ID: 4, Name: "proposal", UpdatedTS: 4},
+		{ID: 5, Name: "home", UpdatedTS: 5},
+	}
+
+	tests := []struct {
+		query    string
+		recent   []string
+		expected string
+	}{
+		{"pro", nil, "proposal,project,work/projects,pet rock"},
+		{"pro", []string{"Project"}, "project,proposal,work/projects,pet rock"},
+		{"", []string{"pet rock", "home"}, "pet rock,home,proposal,work/projects,project"},
+		{"zzz", nil, ""},
+	}
+
+	for _, test := range tests {
+		var names []string
+		for _, tag := range FilterTags(tags, test.query, test.recent) {
+			names = append(names, tag.Name)
+		}
+		if strings.Join(names, ",") != test.expected {
+			t.Errorf("FilterTags(%q, %v): expected %s, got %v", test.query, test.recent, test.expected, names)
+		}
+	}
+}
@@ -1,51 +1,148 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 type ExoDB struct {
-	conn  *sql.DB
-	debug bool
+	conn     *sql.DB
+	debug    bool
+	filename string
+	readOnly bool
+	// keys of the tags unlocked for the session
+	keys *keyring
+	// set while snapshots are taken periodically
+	stopBackups    chan struct{}
+	backupsStopped chan struct{}
+	// what LoadSchema changed that the user should hear about
+	notices []string
 }
 
-func (e *ExoDB) LoadSchema() error {
-	_, err := e.conn.Exec(schema)
-	return err
+// connector opens connections to a database with the SQL functions exocortex needs
+type connector struct {
+	driver *sqlite3.SQLiteDriver
+	dsn    string
 }
 
-func (e *ExoDB) Open(filename string) error {
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// newDriver returns a driver whose connections register the SQL functions of the database's tag locks and exo_fold,
+// enforce foreign keys, overwrite deleted content, and refuse changes if the database is read-only. PRAGMAs only
+// apply to the connection they're run on, so they have to be set on every connection the pool opens. secure_delete
+// keeps the plaintext of rows sealed by LockTag out of the free pages.
+func (e *ExoDB) newDriver() *sqlite3.SQLiteDriver {
+	e.keys = newKeyring()
+	return &sqlite3.SQLiteDriver{ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+		err := e.keys.register(conn)
+		if err == nil {
+			err = conn.RegisterFunc("exo_fold", foldText, true)
+		}
+		if err == nil {
+			_, err = conn.Exec("PRAGMA foreign_keys = ON", nil)
+		}
+		if err == nil {
+			_, err = conn.Exec("PRAGMA secure_delete = ON", nil)
+		}
+		if err == nil && e.readOnly {
+			_, err = conn.Exec("PRAGMA query_only = ON", nil)
+		}
+		return err
+	}}
+}
+
+// LoadSchema creates the tables of a new database, and brings an older one up to date. An older read-only database
+// is brought up to date in a copy in memory.
+func (e *ExoDB) LoadSchema() error {
+	var tx *sql.Tx
 	var err error
 
-	e.conn, err = sql.Open("sqlite3", filename)
+	if e.readOnly {
+		return e.loadSchemaReadOnly()
+	}
+
+	_, err = e.conn.Exec(schema)
 	if err != nil {
 		goto End
 	}
 
-	err = e.enableForeignKeys()
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	e.notices, err = sqlMigrate(tx)
+	err = sqlCommitOrRollback(tx, err)
 
 End:
 	return err
 }
 
-func (e *ExoDB) Close() {
-	e.conn.Close()
+// Notices returns what LoadSchema changed in an older database that the user should hear about, like tag names it
+// reinterpreted
+func (e *ExoDB) Notices() []string {
+	return e.notices
 }
 
-func (e *ExoDB) enableForeignKeys() error {
+// Open opens the database in filename, creating it if needed. Encrypted databases have to be opened with
+// OpenEncrypted instead.
+func (e *ExoDB) Open(filename string) error {
+	var encrypted bool
 	var err error
 
-	_, err = e.conn.Exec("PRAGMA foreign_keys = ON")
+	encrypted, err = IsEncrypted(filename)
+	if err != nil {
+		goto End
+	}
+	if encrypted {
+		err = ErrEncrypted
+		goto End
+	}
+
+	if e.readOnly {
+		e.conn = sql.OpenDB(&connector{e.newDriver(), readOnlyDSN(filename)})
+	} else {
+		e.conn = sql.OpenDB(&connector{e.newDriver(), filename})
+	}
+	e.filename = filename
+
+	// connect now, so a database that can't be opened fails here rather than in LoadSchema
+	err = e.conn.Ping()
 
+End:
 	return err
 }
 
-func sqlCommitOrRollback(tx *sql.Tx, err error) {
+// Close closes the database, taking a last snapshot if backups were started
+func (e *ExoDB) Close() {
+	if e.stopBackups != nil {
+		close(e.stopBackups)
+		<-e.backupsStopped
+		e.stopBackups = nil
+		e.Backup()
+	}
+
+	e.conn.Close()
+}
+
+// sqlCommitOrRollback ends tx, rolling it back if err is set. It returns err, or the error committing, as
+// ErrReadOnly if it came from a change to a read-only database.
+func sqlCommitOrRollback(tx *sql.Tx, err error) error {
 	if err != nil {
-		tx.Rollback()
-	} else {
-		tx.Commit()
+		if tx != nil {
+			tx.Rollback()
+		}
+		return readOnlyError(err)
 	}
+
+	return readOnlyError(tx.Commit())
 }
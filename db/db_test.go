@@ -1,6 +1,9 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"path/filepath"
 	"testing"
 )
 
@@ -10,7 +13,7 @@ func checkError(err error) {
 	}
 }
 
-func setupDB(t *testing.T) ExoDB {
+func setupDB(t testing.TB) ExoDB {
 	var db ExoDB
 	var err error
 
@@ -28,3 +31,37 @@ func setupDB(t *testing.T) ExoDB {
 
 	return db
 }
+
+func TestForeignKeysOnEveryConnection(t *testing.T) {
+	var db ExoDB
+	var err error
+
+	err = db.Open(filepath.Join(t.TempDir(), "exocortex.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// hold a connection, so the pool has to open another
+	first, err := db.conn.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := db.conn.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	for i, conn := range []*sql.Conn{first, second} {
+		var enabled bool
+		err = conn.QueryRowContext(context.Background(), "PRAGMA foreign_keys").Scan(&enabled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !enabled {
+			t.Errorf("foreign keys off on connection %d", i)
+		}
+	}
+}
@@ -0,0 +1,646 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// An encrypted database is stored as a header followed by the whole SQLite database, sealed with AES-256-GCM under
+// a key derived from the passphrase with PBKDF2-HMAC-SHA256:
+//
+//	magic      8 bytes   "EXOCRYPT"
+//	version    1 byte    1
+//	iterations 4 bytes   big endian PBKDF2 iteration count
+//	salt       16 bytes
+//	nonce      12 bytes
+//	ciphertext           the serialized database and the GCM tag; the header up to the nonce is authenticated too
+//
+// While open, the database lives in memory, and it is sealed again and written over the file whenever a write
+// transaction commits. The plaintext never touches the disk. Since every instance works on its own copy, only one
+// instance at a time can write to an encrypted database.
+
+const (
+	encryptionMagic   = "EXOCRYPT"
+	encryptionVersion = 1
+	saltSize          = 16
+	keySize           = 32
+	headerSize        = len(encryptionMagic) + 1 + 4 + saltSize
+)
+
+// encryptionIterations is the PBKDF2 iteration count used for new encrypted databases. Existing ones keep the count
+// they were written with.
+var encryptionIterations uint32 = 600000
+
+var (
+	// ErrEncrypted is returned by Open for an encrypted database, which has to be opened with OpenEncrypted
+	ErrEncrypted = errors.New("database is encrypted")
+	// ErrNotEncrypted is returned when a passphrase is given for a database that isn't encrypted
+	ErrNotEncrypted = errors.New("database isn't encrypted")
+	// ErrPassphrase is returned when an encrypted database can't be unlocked
+	ErrPassphrase = errors.New("wrong passphrase, or the database is corrupt")
+	// ErrChangedOnDisk is returned when committing to an encrypted database whose file was replaced while the
+	// transaction ran, most likely by another instance. The change isn't saved, since that would lose the other
+	// instance's; the database is reloaded from the file instead, so the change can be made again.
+	ErrChangedOnDisk = errors.New("encrypted database was changed by another instance")
+)
+
+// sealer encrypts database contents under a passphrase-derived key
+type sealer struct {
+	header []byte
+	aead   cipher.AEAD
+}
+
+func newSealer(passphrase string, iterations uint32, salt []byte) (*sealer, error) {
+	key := pbkdf2.Key([]byte(passphrase), salt, int(iterations), keySize, sha256.New)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, encryptionVersion)
+	header = binary.BigEndian.AppendUint32(header, iterations)
+	header = append(header, salt...)
+
+	return &sealer{header, aead}, nil
+}
+
+// newSealerForFile returns a sealer with a fresh salt, or the one the encrypted contents were sealed with
+func newSealerForFile(contents []byte, passphrase string) (*sealer, error) {
+	if contents == nil {
+		salt := make([]byte, saltSize)
+		_, err := io.ReadFull(rand.Reader, salt)
+		if err != nil {
+			return nil, err
+		}
+		return newSealer(passphrase, encryptionIterations, salt)
+	}
+
+	if len(contents) < headerSize || !isEncrypted(contents) {
+		return nil, ErrNotEncrypted
+	}
+	if contents[len(encryptionMagic)] != encryptionVersion {
+		return nil, fmt.Errorf("unsupported encrypted database version %d", contents[len(encryptionMagic)])
+	}
+
+	iterations := binary.BigEndian.Uint32(contents[len(encryptionMagic)+1:])
+	return newSealer(passphrase, iterations, contents[headerSize-saltSize:headerSize])
+}
+
+func (s *sealer) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := append(append([]byte(nil), s.header...), nonce...)
+	return s.aead.Seal(sealed, nonce, plaintext, s.header), nil
+}
+
+func (s *sealer) open(contents []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+	if len(contents) < headerSize+nonceSize || !bytes.Equal(contents[:headerSize], s.header) {
+		return nil, ErrPassphrase
+	}
+
+	plaintext, err := s.aead.Open(nil, contents[headerSize:headerSize+nonceSize], contents[headerSize+nonceSize:], s.header)
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+
+	return plaintext, nil
+}
+
+func isEncrypted(contents []byte) bool {
+	return bytes.HasPrefix(contents, []byte(encryptionMagic))
+}
+
+// IsEncrypted reports whether the database file is encrypted. A file that doesn't exist isn't.
+func IsEncrypted(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(encryptionMagic))
+	_, err = io.ReadFull(f, magic)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	}
+
+	return isEncrypted(magic), err
+}
+
+// readDatabaseFile returns the contents of a database file, or nil if it doesn't exist
+func readDatabaseFile(filename string) ([]byte, error) {
+	contents, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return contents, err
+}
+
+// writeFileAtomic replaces the contents of filename, so that a crash leaves either the old or the new contents
+func writeFileAtomic(filename string, contents []byte) error {
+	var f *os.File
+	var mode os.FileMode = 0600
+	var err error
+
+	if info, statErr := os.Stat(filename); statErr == nil {
+		mode = info.Mode().Perm()
+	}
+
+	f, err = os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		goto End
+	}
+
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+End:
+	return err
+}
+
+// serializeConn returns the contents of the database open on conn
+func serializeConn(conn *sql.Conn) ([]byte, error) {
+	var contents []byte
+
+	err := conn.Raw(func(driverConn interface{}) error {
+		var err error
+		switch conn := driverConn.(type) {
+		case *encryptedConn:
+			contents, err = conn.Serialize("main")
+		default:
+			contents, err = conn.(*sqlite3.SQLiteConn).Serialize("main")
+		}
+		return err
+	})
+
+	return contents, err
+}
+
+// encryptedConnector opens connections to an in-memory copy of an encrypted database, and writes the database back
+// to its file after every write
+type encryptedConnector struct {
+	driver   *sqlite3.SQLiteDriver
+	filename string
+	sealer   *sealer
+	// the file as last read or written, or nil if it didn't exist
+	file os.FileInfo
+}
+
+func (c *encryptedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var contents []byte
+	var plaintext []byte
+	var conn *encryptedConn
+	var sqliteConn driver.Conn
+	var err error
+
+	c.file, err = os.Stat(c.filename)
+	if os.IsNotExist(err) {
+		c.file, err = nil, nil
+	}
+	if err != nil {
+		goto End
+	}
+
+	contents, err = readDatabaseFile(c.filename)
+	if err != nil {
+		goto End
+	}
+	if contents != nil {
+		plaintext, err = c.sealer.open(contents)
+		if err != nil {
+			goto End
+		}
+	}
+
+	sqliteConn, err = c.driver.Open(":memory:")
+	if err != nil {
+		goto End
+	}
+	conn = &encryptedConn{SQLiteConn: sqliteConn.(*sqlite3.SQLiteConn), connector: c}
+
+	// keep temporary tables and indexes off the disk too
+	_, err = conn.SQLiteConn.Exec("PRAGMA temp_store = MEMORY", nil)
+	if err != nil {
+		goto End
+	}
+
+	if plaintext != nil {
+		err = conn.load(plaintext)
+		if err != nil {
+			goto End
+		}
+	}
+
+	conn.RegisterCommitHook(func() int {
+		conn.dirty = true
+		return 0
+	})
+
+End:
+	if err != nil && conn != nil {
+		conn.SQLiteConn.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *encryptedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// encryptedConn is a connection to the in-memory copy of an encrypted database
+type encryptedConn struct {
+	*sqlite3.SQLiteConn
+	connector *encryptedConnector
+	// set when a write has committed since the database was last written
+	dirty bool
+}
+
+// load copies the database serialized in plaintext into the connection's database
+func (c *encryptedConn) load(plaintext []byte) error {
+	return loadConn(c.connector.driver, c.SQLiteConn, plaintext)
+}
+
+// loadConn copies the database serialized in contents into conn's database. A deserialized database can't grow, so
+// it's only used as the source of a backup.
+func loadConn(d *sqlite3.SQLiteDriver, conn *sqlite3.SQLiteConn, contents []byte) error {
+	var src driver.Conn
+	var backup *sqlite3.SQLiteBackup
+	var err error
+
+	src, err = d.Open(":memory:")
+	if err != nil {
+		goto End
+	}
+	defer src.Close()
+
+	err = src.(*sqlite3.SQLiteConn).Deserialize(contents, "main")
+	if err != nil {
+		goto End
+	}
+
+	backup, err = conn.Backup("main", src.(*sqlite3.SQLiteConn), "main")
+	if err != nil {
+		goto End
+	}
+
+	_, err = backup.Step(-1)
+	if finishErr := backup.Finish(); err == nil {
+		err = finishErr
+	}
+
+End:
+	return err
+}
+
+// changedOnDisk reports whether the database's file was replaced since it was last read or written, and returns the
+// file as it is now, or nil if it doesn't exist
+func (c *encryptedConn) changedOnDisk() (os.FileInfo, bool, error) {
+	file, err := os.Stat(c.connector.filename)
+	if os.IsNotExist(err) {
+		file, err = nil, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return file, (file == nil) != (c.connector.file == nil) || (file != nil && !os.SameFile(file, c.connector.file)), nil
+}
+
+// reload replaces the connection's database with the contents of its file, if another instance replaced the file.
+// Changes that weren't written yet are dropped.
+func (c *encryptedConn) reload() error {
+	var file os.FileInfo
+	var changed bool
+	var contents, plaintext []byte
+	var err error
+
+	file, changed, err = c.changedOnDisk()
+	if err != nil || !changed {
+		goto End
+	}
+
+	// the file was removed, rather than replaced: there's nothing to reload, and nothing to lose by writing it again
+	if file == nil {
+		c.connector.file = nil
+		goto End
+	}
+
+	contents, err = readDatabaseFile(c.connector.filename)
+	if err != nil {
+		goto End
+	}
+
+	plaintext, err = c.connector.sealer.open(contents)
+	if err != nil {
+		goto End
+	}
+
+	err = c.load(plaintext)
+	if err != nil {
+		goto End
+	}
+
+	c.connector.file = file
+	c.dirty = false
+
+End:
+	return err
+}
+
+// save writes the database to its file if it changed. If another instance replaced the file in the meantime, the
+// database is reloaded from it and ErrChangedOnDisk is returned. Any other failed save is retried after the next
+// write.
+func (c *encryptedConn) save() error {
+	var file os.FileInfo
+	var changed bool
+	var plaintext, sealed []byte
+	var err error
+
+	if !c.dirty {
+		goto End
+	}
+
+	file, changed, err = c.changedOnDisk()
+	if err != nil {
+		goto End
+	}
+	// a removed file is simply written again
+	if changed && file != nil {
+		err = c.reload()
+		if err == nil {
+			err = ErrChangedOnDisk
+		}
+		goto End
+	}
+
+	plaintext, err = c.Serialize("main")
+	if err != nil {
+		goto End
+	}
+
+	sealed, err = c.connector.sealer.seal(plaintext)
+	if err != nil {
+		goto End
+	}
+
+	err = writeFileAtomic(c.connector.filename, sealed)
+	if err != nil {
+		goto End
+	}
+
+	c.connector.file, err = os.Stat(c.connector.filename)
+	if err != nil {
+		goto End
+	}
+
+	c.dirty = false
+
+End:
+	return err
+}
+
+func (c *encryptedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// catchUp reloads the database if another instance changed it, so a transaction starts from its changes rather than
+// failing to save over them. A change that failed to save is kept, and left for save to sort out.
+func (c *encryptedConn) catchUp() error {
+	if c.dirty {
+		return nil
+	}
+	return c.reload()
+}
+
+func (c *encryptedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	err := c.catchUp()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := c.SQLiteConn.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedTx{tx, c}, nil
+}
+
+func (c *encryptedConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	if c.AutoCommit() {
+		err := c.catchUp()
+		if err != nil {
+			return nil, err
+		}
+	}
+	result, err := c.SQLiteConn.Exec(query, args)
+	if err == nil && c.AutoCommit() {
+		err = c.save()
+	}
+	return result, err
+}
+
+func (c *encryptedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if c.AutoCommit() {
+		err := c.catchUp()
+		if err != nil {
+			return nil, err
+		}
+	}
+	result, err := c.SQLiteConn.ExecContext(ctx, query, args)
+	if err == nil && c.AutoCommit() {
+		err = c.save()
+	}
+	return result, err
+}
+
+func (c *encryptedConn) Close() error {
+	err := c.save()
+	if closeErr := c.SQLiteConn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type encryptedTx struct {
+	driver.Tx
+	conn *encryptedConn
+}
+
+func (tx *encryptedTx) Commit() error {
+	err := tx.Tx.Commit()
+	if err != nil {
+		return err
+	}
+	return tx.conn.save()
+}
+
+// OpenEncrypted opens the encrypted database in filename with its passphrase, or creates a new encrypted database if
+// the file doesn't exist
+func (e *ExoDB) OpenEncrypted(filename string, passphrase string) error {
+	var contents []byte
+	var s *sealer
+	var err error
+
+	contents, err = readDatabaseFile(filename)
+	if err != nil {
+		goto End
+	}
+	if contents == nil && e.readOnly {
+		err = &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+		goto End
+	}
+
+	s, err = newSealerForFile(contents, passphrase)
+	if err != nil {
+		goto End
+	}
+
+	e.conn = sql.OpenDB(&encryptedConnector{driver: e.newDriver(), filename: filename, sealer: s})
+	e.filename = filename
+	// every connection would get its own copy of the database
+	e.conn.SetMaxOpenConns(1)
+
+	err = e.conn.Ping()
+	if err != nil {
+		e.conn.Close()
+	}
+
+End:
+	return err
+}
+
+// EncryptDatabase encrypts the database in filename with passphrase, in place. Snapshots taken before are left
+// alone, but they're still in plaintext: they're returned so the user can be told.
+func EncryptDatabase(filename string, passphrase string) ([]Snapshot, error) {
+	var plain *sql.DB
+	var conn *sql.Conn
+	var encrypted bool
+	var plaintext, sealed []byte
+	var s *sealer
+	var snapshots []Snapshot
+	var err error
+
+	encrypted, err = IsEncrypted(filename)
+	if err != nil {
+		goto End
+	}
+	if encrypted {
+		err = ErrEncrypted
+		goto End
+	}
+
+	// read the database through SQLite rather than copying the file, so that only committed changes are kept
+	plain, err = sql.Open("sqlite3", readOnlyDSN(filename))
+	if err != nil {
+		goto End
+	}
+	defer plain.Close()
+
+	conn, err = plain.Conn(context.Background())
+	if err != nil {
+		goto End
+	}
+	defer conn.Close()
+
+	plaintext, err = serializeConn(conn)
+	if err != nil {
+		goto End
+	}
+
+	s, err = newSealerForFile(nil, passphrase)
+	if err != nil {
+		goto End
+	}
+
+	sealed, err = s.seal(plaintext)
+	if err != nil {
+		goto End
+	}
+
+	err = writeFileAtomic(filename, sealed)
+	if err != nil {
+		goto End
+	}
+
+	snapshots, err = ListBackups(filename)
+
+End:
+	return snapshots, err
+}
+
+// DecryptDatabase turns the encrypted database in filename back into a plain SQLite database, in place
+func DecryptDatabase(filename string, passphrase string) error {
+	var contents, plaintext []byte
+	var s *sealer
+	var err error
+
+	contents, err = readDatabaseFile(filename)
+	if err != nil {
+		goto End
+	}
+	if contents == nil {
+		err = os.ErrNotExist
+		goto End
+	}
+
+	s, err = newSealerForFile(contents, passphrase)
+	if err != nil {
+		goto End
+	}
+
+	plaintext, err = s.open(contents)
+	if err != nil {
+		goto End
+	}
+
+	err = writeFileAtomic(filename, plaintext)
+
+End:
+	return err
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openEncrypted(t *testing.T, filename string, passphrase string) ExoDB {
+	var db ExoDB
+
+	err := db.OpenEncrypted(filename, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestEncryptedDatabase(t *testing.T) {
+	encryptionIterations = 1000
+	filename := filepath.Join(t.TempDir(), "exocortex.db")
+
+	db := openEncrypted(t, filename, "secret")
+	tag, err := db.AddTag("clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddRow(tag.ID, "the [[vault]] code is 1234", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writes reach the file as soon as they commit
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(contents, []byte("vault")) || bytes.Contains(contents, []byte("clients")) {
+		t.Fatal("plaintext found in the encrypted file")
+	}
+	db.Close()
+
+	var plain ExoDB
+	if err = plain.Open(filename); err != ErrEncrypted {
+		t.Fatalf("expected ErrEncrypted, got %v", err)
+	}
+
+	var wrong ExoDB
+	if err = wrong.OpenEncrypted(filename, "guess"); err != ErrPassphrase {
+		t.Fatalf("expected ErrPassphrase, got %v", err)
+	}
+
+	db = openEncrypted(t, filename, "secret")
+	defer db.Close()
+	refs, err := db.GetRefsToTagByTagName("vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 {
+		t.Fatalf("expected the row to survive reopening, got %v", refs)
+	}
+}
+
+func TestEncryptDatabase(t *testing.T) {
+	encryptionIterations = 1000
+	// a # would end the path of an unescaped URI
+	filename := filepath.Join(t.TempDir(), "exo#cortex.db")
+
+	var db ExoDB
+	err := db.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddTag("clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	snapshots, err := EncryptDatabase(filename, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted, err := IsEncrypted(filename); err != nil || !encrypted {
+		t.Fatalf("expected the database to be encrypted: %v", err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("expected the plaintext snapshot to be returned, got %v", snapshots)
+	}
+	if _, err = EncryptDatabase(filename, "secret"); err != ErrEncrypted {
+		t.Fatalf("expected ErrEncrypted, got %v", err)
+	}
+
+	db = openEncrypted(t, filename, "secret")
+	_, err = db.GetTagByName("clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if err = DecryptDatabase(filename, "guess"); err != ErrPassphrase {
+		t.Fatalf("expected ErrPassphrase, got %v", err)
+	}
+	err = DecryptDatabase(filename, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.GetTagByName("clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedDatabaseChangedOnDisk(t *testing.T) {
+	encryptionIterations = 1000
+	filename := filepath.Join(t.TempDir(), "exocortex.db")
+
+	first := openEncrypted(t, filename, "secret")
+	defer first.Close()
+	second := openEncrypted(t, filename, "secret")
+	defer second.Close()
+
+	_, err := second.AddTag("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first instance's copy is out of date, so it's reloaded before its change is made
+	if _, err = first.AddTag("first"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"first", "second"} {
+		if _, err = second.GetTagByName(name); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	// a change made while the other instance writes isn't saved, since that would lose the other instance's
+	tx, err := first.conn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sqlAddTag(tx, "lost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = second.AddTag("third")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Commit(); err != ErrChangedOnDisk {
+		t.Fatalf("expected ErrChangedOnDisk, got %v", err)
+	}
+
+	// but the first instance has the other's changes now, and can make its own again
+	_, err = first.GetTagByName("third")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = first.GetTagByName("lost"); err == nil {
+		t.Fatal("expected the unsaved tag to be gone")
+	}
+	if _, err = first.AddTag("again"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = second.GetTagByName("again"); err != nil {
+		t.Fatal(err)
+	}
+}
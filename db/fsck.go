@@ -0,0 +1,366 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+type ProblemKind int
+
+const (
+	ProblemOrphanRow     ProblemKind = iota // row under a tag that doesn't exist
+	ProblemOrphanRef                        // ref to a row or tag that doesn't exist
+	ProblemMissingRef                       // row links a tag, but has no ref to it
+	ProblemStaleRef                         // ref to a tag the row doesn't link
+	ProblemEmptyTag                         // tag with no rows, refs or query
+	ProblemRefcount                         // tag.refcount doesn't match its refs
+	ProblemRankDuplicate                    // two rows of a tag share a rank
+)
+
+var problemKindNames = map[ProblemKind]string{
+	ProblemOrphanRow:     "orphan row",
+	ProblemOrphanRef:     "orphan ref",
+	ProblemMissingRef:    "missing ref",
+	ProblemStaleRef:      "stale ref",
+	ProblemEmptyTag:      "empty tag",
+	ProblemRefcount:      "refcount",
+	ProblemRankDuplicate: "duplicate rank",
+}
+
+func (k ProblemKind) String() string {
+	return problemKindNames[k]
+}
+
+// Problem is a single discrepancy found by CheckIntegrity
+type Problem struct {
+	Kind  ProblemKind
+	TagID int64
+	RowID int64
+	Msg   string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Kind, p.Msg)
+}
+
+func sqlCheckOrphans(tx *sql.Tx) ([]Problem, error) {
+	var problems []Problem
+	var sqlRows *sql.Rows
+	var tagID, rowID int64
+	var err error
+
+	sqlRows, err = tx.Query("SELECT id, tag_id FROM row WHERE tag_id NOT IN (SELECT id FROM tag) ORDER BY id")
+	if err != nil {
+		goto End
+	}
+
+	for sqlRows.Next() {
+		err = sqlRows.Scan(&rowID, &tagID)
+		if err != nil {
+			sqlRows.Close()
+			goto End
+		}
+		problems = append(problems, Problem{ProblemOrphanRow, tagID, rowID, fmt.Sprintf("row %d belongs to missing tag %d", rowID, tagID)})
+	}
+	sqlRows.Close()
+
+	sqlRows, err = tx.Query(`SELECT tag_id, row_id FROM ref
+							 WHERE tag_id NOT IN (SELECT id FROM tag)
+							 OR row_id NOT IN (SELECT id FROM row)
+							 ORDER BY tag_id, row_id`)
+	if err != nil {
+		goto End
+	}
+
+	for sqlRows.Next() {
+		err = sqlRows.Scan(&tagID, &rowID)
+		if err != nil {
+			sqlRows.Close()
+			goto End
+		}
+		problems = append(problems, Problem{ProblemOrphanRef, tagID, rowID, fmt.Sprintf("ref from row %d to tag %d points at a missing row or tag", rowID, tagID)})
+	}
+	sqlRows.Close()
+
+End:
+	return problems, err
+}
+
+// sqlCheckRefs re-derives the refs of every row from its text and compares them to the ref table
+func sqlCheckRefs(tx *sql.Tx) ([]Problem, error) {
+	var problems []Problem
+	var sqlRows *sql.Rows
+	var rowID int64
+	var locked bool
+	var text, name string
+	var linked map[int64]map[string]bool
+	var actual map[int64]map[string]bool
+	var rowIDs []int64
+	var err error
+
+	linked = make(map[int64]map[string]bool)
+	actual = make(map[int64]map[string]bool)
+
+	// the rows of locked tags have no refs, so their sealed text isn't looked at
+	sqlRows, err = tx.Query("SELECT id, tag_id IN (SELECT tag_id FROM tag_lock), text FROM row ORDER BY id")
+	if err != nil {
+		goto End
+	}
+
+	for sqlRows.Next() {
+		err = sqlRows.Scan(&rowID, &locked, &text)
+		if err != nil {
+			sqlRows.Close()
+			goto End
+		}
+		rowIDs = append(rowIDs, rowID)
+		linked[rowID] = make(map[string]bool)
+		if locked {
+			continue
+		}
+		for _, name = range RefNames(text) {
+			linked[rowID][TagKey(name)] = true
+		}
+	}
+	sqlRows.Close()
+
+	sqlRows, err = tx.Query("SELECT ref.row_id, tag.key FROM ref, tag WHERE ref.tag_id = tag.id")
+	if err != nil {
+		goto End
+	}
+
+	for sqlRows.Next() {
+		err = sqlRows.Scan(&rowID, &name)
+		if err != nil {
+			sqlRows.Close()
+			goto End
+		}
+		if actual[rowID] == nil {
+			actual[rowID] = make(map[string]bool)
+		}
+		actual[rowID][name] = true
+	}
+	sqlRows.Close()
+
+	for _, rowID = range rowIDs {
+		for _, name = range sortedKeys(linked[rowID]) {
+			if !actual[rowID][name] {
+				problems = append(problems, Problem{ProblemMissingRef, 0, rowID, fmt.Sprintf("row %d links [[%s]] but has no ref to it", rowID, name)})
+			}
+		}
+		for _, name = range sortedKeys(actual[rowID]) {
+			if !linked[rowID][name] {
+				problems = append(problems, Problem{ProblemStaleRef, 0, rowID, fmt.Sprintf("row %d has a ref to %s but doesn't link it", rowID, name)})
+			}
+		}
+	}
+
+End:
+	return problems, err
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sqlCheckTags(tx *sql.Tx) ([]Problem, error) {
+	var problems, empty []Problem
+	var sqlRows *sql.Rows
+	var tagID int64
+	var name string
+	var refcount, refs int
+	var err error
+
+	sqlRows, err = tx.Query(`SELECT id, name, refcount, (SELECT COUNT(*) FROM ref WHERE ref.tag_id = tag.id)
+							 FROM tag ORDER BY id`)
+	if err != nil {
+		goto End
+	}
+
+	for sqlRows.Next() {
+		err = sqlRows.Scan(&tagID, &name, &refcount, &refs)
+		if err != nil {
+			sqlRows.Close()
+			goto End
+		}
+		if refcount != refs {
+			problems = append(problems, Problem{ProblemRefcount, tagID, 0, fmt.Sprintf("tag %s has refcount %d but %d refs", name, refcount, refs)})
+		}
+	}
+	sqlRows.Close()
+
+	sqlRows, err = tx.Query(`SELECT id, name FROM tag
+							 WHERE id NOT IN (SELECT tag_id FROM row)
+							 AND id NOT IN (SELECT tag_id FROM ref)
+							 AND id NOT IN (SELECT tag_id FROM saved_query)
+							 AND id NOT IN (SELECT tag_id FROM tag_lock)
+							 ORDER BY id`)
+	if err != nil {
+		goto End
+	}
+
+	for sqlRows.Next() {
+		err = sqlRows.Scan(&tagID, &name)
+		if err != nil {
+			sqlRows.Close()
+			goto End
+		}
+		empty = append(empty, Problem{ProblemEmptyTag, tagID, 0, fmt.Sprintf("tag %s has no rows and isn't referenced", name)})
+	}
+	sqlRows.Close()
+
+	// namespaces are kept for their child tags
+	for _, p := range empty {
+		var hasChildren bool
+		hasChildren, err = sqlHasChildTags(tx, p.TagID)
+		if err != nil {
+			goto End
+		}
+		if !hasChildren {
+			problems = append(problems, p)
+		}
+	}
+
+End:
+	return problems, err
+}
+
+// sqlCheckRanks checks that no two rows of a tag share a rank, which would leave their order up to their IDs. Gaps
+// between ranks are expected.
+func sqlCheckRanks(tx *sql.Tx) ([]Problem, error) {
+	var problems []Problem
+	var sqlRows *sql.Rows
+	var tagID, rowID int64
+	var rank float64
+	var err error
+
+	sqlRows, err = tx.Query(`SELECT r.tag_id, r.id, r.rank FROM row AS r
+							 WHERE EXISTS (SELECT 1 FROM row AS o WHERE o.tag_id = r.tag_id AND o.rank = r.rank AND o.id < r.id)
+							 ORDER BY r.tag_id, r.rank, r.id`)
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	for sqlRows.Next() {
+		err = sqlRows.Scan(&tagID, &rowID, &rank)
+		if err != nil {
+			goto End
+		}
+		problems = append(problems, Problem{ProblemRankDuplicate, tagID, rowID, fmt.Sprintf("row %d of tag %d has duplicate rank %g", rowID, tagID, rank)})
+	}
+
+End:
+	return problems, err
+}
+
+func sqlCheckIntegrity(tx *sql.Tx) ([]Problem, error) {
+	var problems []Problem
+	var err error
+
+	for _, check := range []func(*sql.Tx) ([]Problem, error){sqlCheckOrphans, sqlCheckRefs, sqlCheckTags, sqlCheckRanks} {
+		var found []Problem
+		found, err = check(tx)
+		if err != nil {
+			goto End
+		}
+		problems = append(problems, found...)
+	}
+
+End:
+	return problems, err
+}
+
+// CheckIntegrity reports every discrepancy between the rows, refs and tags of the database without changing anything
+func (e *ExoDB) CheckIntegrity() ([]Problem, error) {
+	var tx *sql.Tx
+	var problems []Problem
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	problems, err = sqlCheckIntegrity(tx)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return problems, err
+}
+
+// Repair fixes the problems found by CheckIntegrity and returns them. Refs and properties are re-derived from row
+// text, orphans and empty tags are deleted, tags with duplicate ranks are rebalanced, locked ones included, and
+// refcounts are recomputed.
+func (e *ExoDB) Repair() ([]Problem, error) {
+	var tx *sql.Tx
+	var problems, empty []Problem
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	problems, err = sqlCheckIntegrity(tx)
+	if err != nil {
+		goto End
+	}
+
+	for _, p := range problems {
+		switch p.Kind {
+		case ProblemOrphanRow:
+			err = sqlDeleteRowByID(tx, p.RowID)
+		case ProblemOrphanRef:
+			_, err = tx.Exec("DELETE FROM ref WHERE tag_id = $1 AND row_id = $2", p.TagID, p.RowID)
+		case ProblemMissingRef, ProblemStaleRef:
+			err = sqlUpdateRefsForRowID(tx, p.RowID)
+		case ProblemRankDuplicate:
+			err = sqlRebalanceRanks(tx, p.TagID)
+		}
+		if err != nil {
+			goto End
+		}
+	}
+
+	// fixing refs can empty out tags, so look for empty ones again
+	empty, err = sqlCheckTags(tx)
+	if err != nil {
+		goto End
+	}
+
+	for _, p := range empty {
+		if p.Kind == ProblemEmptyTag {
+			err = sqlDeleteTagByID(tx, p.TagID)
+			if err != nil {
+				goto End
+			}
+		}
+	}
+
+	err = sqlRecountRefs(tx)
+	if err != nil {
+		goto End
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return problems, err
+}
+
+// sqlRecountRefs sets the refcount of every tag to the number of its refs
+func sqlRecountRefs(tx *sql.Tx) error {
+	var err error
+
+	_, err = tx.Exec("UPDATE tag SET refcount = (SELECT COUNT(*) FROM ref WHERE ref.tag_id = tag.id)")
+
+	return err
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCheckIntegrity(t *testing.T) {
+	var db ExoDB
+	var tag, empty Tag
+	var rows []Row
+	var problems []Problem
+	var err error
+
+	db = setupDB(t)
+
+	tag, err = db.AddTag("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"[[a]] [[a]] one", "[[b]] two", "three"} {
+		var row Row
+		row, err = db.AddRow(tag.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+
+	problems, err = db.CheckIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(problems) != 0 {
+		t.Fatal(fmt.Sprintf("unexpected problems in a clean database: %v", problems))
+	}
+
+	empty, err = db.AddTag("empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// break things behind the db layer's back
+	for _, statement := range []string{
+		fmt.Sprintf("DELETE FROM ref WHERE row_id = %d", rows[1].ID),
+		fmt.Sprintf("INSERT INTO ref (tag_id, row_id) VALUES (%d, %d)", empty.ID, rows[2].ID),
+		fmt.Sprintf("UPDATE row SET rank = 0 WHERE id = %d", rows[1].ID),
+		fmt.Sprintf("UPDATE row SET rank = 5 WHERE id = %d", rows[2].ID),
+		fmt.Sprintf("UPDATE tag SET refcount = 7 WHERE id = %d", tag.ID),
+		"INSERT INTO tag (name) VALUES ('unused')",
+	} {
+		_, err = db.conn.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err = db.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[ProblemKind]bool)
+	for _, p := range problems {
+		found[p.Kind] = true
+	}
+
+	for _, kind := range []ProblemKind{ProblemMissingRef, ProblemStaleRef, ProblemRefcount, ProblemEmptyTag, ProblemRankDuplicate} {
+		if !found[kind] {
+			t.Error(fmt.Sprintf("expected a %s problem, got %v", kind, problems))
+		}
+	}
+
+	problems, err = db.CheckIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(problems) != 0 {
+		t.Fatal(fmt.Sprintf("problems left after repair: %v", problems))
+	}
+
+	_, err = db.GetTagByName("unused")
+	if err == nil {
+		t.Fatal("Repair didn't delete an empty tag")
+	}
+}
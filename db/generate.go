@@ -0,0 +1,183 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// GenerateOptions describes the synthetic database built by Generate
+type GenerateOptions struct {
+	// Days is the number of daily notes, one date tag per day, ending yesterday
+	Days int
+	// RowsPerDay is the average number of rows under each date tag
+	RowsPerDay int
+	// Topics is the number of non-date tags. Some topics are linked far more often than others.
+	Topics int
+	// RowsPerTopic is the average number of rows under each topic tag
+	RowsPerTopic int
+	// LongRowRatio is the fraction of rows that are several sentences long
+	LongRowRatio float64
+	// Seed makes the generated contents reproducible
+	Seed int64
+}
+
+// DefaultGenerateOptions resemble a few years of daily notes
+var DefaultGenerateOptions = GenerateOptions{
+	Days:         2000,
+	RowsPerDay:   15,
+	Topics:       500,
+	RowsPerTopic: 10,
+	LongRowRatio: 0.1,
+	Seed:         1,
+}
+
+var generatorWords = strings.Fields(`the a of to and in is it for on with as was at by an be this that from or have
+	meeting call notes idea project review draft plan fix bug release email follow up read write think ask about
+	tomorrow today later maybe should could need want check send finish start update again because before after`)
+
+type generator struct {
+	opts   GenerateOptions
+	rand   *rand.Rand
+	topics []string
+	days   []string
+}
+
+// words returns n random words
+func (g *generator) words(n int) string {
+	words := make([]string, n)
+	for i := range words {
+		words[i] = generatorWords[g.rand.Intn(len(generatorWords))]
+	}
+	return strings.Join(words, " ")
+}
+
+// topic returns a random topic name, favouring the first ones
+func (g *generator) topic() string {
+	// squaring a uniform variable skews it towards 0
+	f := g.rand.Float64()
+	return g.topics[int(f*f*float64(len(g.topics)))]
+}
+
+// text returns the text of a random row. day is the index of the current date tag, or -1 for topic rows.
+func (g *generator) text(day int) string {
+	var b strings.Builder
+
+	switch n := g.rand.Intn(20); {
+	case n == 0:
+		fmt.Fprintf(&b, "status:: %s", []string{"todo", "doing", "done"}[g.rand.Intn(3)])
+		return b.String()
+	case n == 1:
+		fmt.Fprintf(&b, "priority:: %d", g.rand.Intn(5))
+		return b.String()
+	}
+
+	b.WriteString(g.words(3 + g.rand.Intn(8)))
+	for links := g.rand.Intn(3); links > 0; links-- {
+		fmt.Fprintf(&b, " [[%s]] %s", g.topic(), g.words(1+g.rand.Intn(4)))
+	}
+	if day > 0 && g.rand.Intn(10) == 0 {
+		// refer back to an earlier day
+		fmt.Fprintf(&b, " see [[%s]]", g.days[g.rand.Intn(day)])
+	}
+	if g.rand.Float64() < g.opts.LongRowRatio {
+		for sentences := 3 + g.rand.Intn(10); sentences > 0; sentences-- {
+			fmt.Fprintf(&b, ". %s", g.words(5+g.rand.Intn(15)))
+		}
+	}
+
+	return b.String()
+}
+
+// rowCount returns a random row count averaging n
+func (g *generator) rowCount(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	return 1 + g.rand.Intn(2*n-1)
+}
+
+// sqlAddGeneratedRows adds count rows under tagID
+func (g *generator) sqlAddGeneratedRows(tx *sql.Tx, tagID int64, count int, day int) error {
+	var rowID int64
+	var err error
+
+	for i := 0; i < count; i++ {
+		rowID, err = sqlAddRow(tx, tagID, g.text(day), 0, float64(i))
+		if err != nil {
+			break
+		}
+		err = sqlUpdateRefsForRowID(tx, rowID)
+		if err != nil {
+			break
+		}
+	}
+
+	return err
+}
+
+// Generate fills the database with synthetic daily notes and topics for testing and benchmarking. It's meant to
+// be run on an empty database.
+func (e *ExoDB) Generate(opts GenerateOptions) error {
+	var tx *sql.Tx
+	var g generator
+	var tagID int64
+	var day time.Time
+	var err error
+
+	g = generator{opts: opts, rand: rand.New(rand.NewSource(opts.Seed))}
+
+	for i := 0; i < opts.Topics; i++ {
+		g.topics = append(g.topics, fmt.Sprintf("%s %d", g.words(1+g.rand.Intn(2)), i))
+	}
+	if len(g.topics) == 0 {
+		g.topics = []string{"topic"}
+	}
+
+	day = time.Now().AddDate(0, 0, -opts.Days)
+	for i := 0; i < opts.Days; i++ {
+		g.days = append(g.days, day.AddDate(0, 0, i).Format(DateTagFormat))
+	}
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	for _, name := range g.topics[:opts.Topics] {
+		tagID, err = sqlAddTag(tx, name)
+		if err != nil {
+			goto End
+		}
+
+		err = g.sqlAddGeneratedRows(tx, tagID, g.rowCount(opts.RowsPerTopic), -1)
+		if err != nil {
+			goto End
+		}
+	}
+
+	for i, name := range g.days {
+		tagID, err = sqlAddTag(tx, name)
+		if err != nil {
+			goto End
+		}
+
+		err = g.sqlAddGeneratedRows(tx, tagID, g.rowCount(opts.RowsPerDay), i)
+		if err != nil {
+			goto End
+		}
+
+		// date tags were last touched on their day
+		_, err = tx.Exec("UPDATE tag SET updated_ts = $1 WHERE id = $2", day.AddDate(0, 0, i).UnixNano(), tagID)
+		if err != nil {
+			goto End
+		}
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return err
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGenerate(t *testing.T) {
+	db := setupDB(t)
+
+	opts := GenerateOptions{Days: 30, RowsPerDay: 5, Topics: 20, RowsPerTopic: 3, LongRowRatio: 0.2, Seed: 1}
+	err := db.Generate(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yesterday, err := db.GetTagByName(time.Now().AddDate(0, 0, -1).Format(DateTagFormat))
+	if err != nil {
+		t.Fatal("no date tag for yesterday: ", err)
+	}
+	rows, err := db.GetRowsForTagID(yesterday.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) == 0 {
+		t.Fatal("yesterday has no rows")
+	}
+
+	tags, err := db.GetAllTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != opts.Days+opts.Topics {
+		t.Fatalf("expected %d tags, got %d", opts.Days+opts.Topics, len(tags))
+	}
+
+	problems, err := db.CheckIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Fatalf("generated database has problems: %v", problems)
+	}
+
+	// the same seed generates the same rows
+	other := setupDB(t)
+	err = other.Generate(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherYesterday, err := other.GetTagByName(yesterday.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if texts, otherTexts := rowTexts(t, db, yesterday.ID), rowTexts(t, other, otherYesterday.ID); texts != otherTexts {
+		t.Fatalf("generated rows differ: %q != %q", texts, otherTexts)
+	}
+}
+
+// mostReferencedTag returns the tag with the most refs
+func mostReferencedTag(b *testing.B, db ExoDB) Tag {
+	var name string
+
+	err := db.conn.QueryRow("SELECT name FROM tag ORDER BY refcount DESC LIMIT 1").Scan(&name)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	tag, err := db.GetTagByName(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return tag
+}
+
+// setupGeneratedBenchmark generates a database for benchmarks and returns it with its most referenced tag
+func setupGeneratedBenchmark(b *testing.B, opts GenerateOptions) (ExoDB, Tag) {
+	db := setupDB(b)
+
+	err := db.Generate(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return db, mostReferencedTag(b, db)
+}
+
+// BenchmarkGenerated measures common operations on a database generated with DefaultGenerateOptions. The database
+// is shared between the sub-benchmarks, so the ones that write keep it close to its original state.
+func BenchmarkGenerated(b *testing.B) {
+	db, topic := setupGeneratedBenchmark(b, DefaultGenerateOptions)
+	day, err := db.GetTagByName(time.Now().AddDate(0, 0, -1).Format(DateTagFormat))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, tag := range []Tag{topic, day} {
+		tag := tag
+		b.Run(fmt.Sprintf("Refresh/%s", tag.Name), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s := State{DB: &db, CurrentDBTag: tag}
+				err := s.Refresh()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	b.Run("GetAllTags", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := db.GetAllTags()
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("GetRefsToTagByTagID", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := db.GetRefsToTagByTagID(topic.ID)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("AddRow", func(b *testing.B) {
+		var ids []int64
+		for i := 0; i < b.N; i++ {
+			row, err := db.AddRow(day.ID, fmt.Sprintf("new row for [[%s]]", topic.Name), 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			ids = append(ids, row.ID)
+		}
+
+		b.StopTimer()
+		for _, id := range ids {
+			err := db.DeleteRowByID(id)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		err := db.PurgeTrash()
+		if err != nil {
+			b.Fatal(err)
+		}
+	})
+
+	b.Run("UpdateRowRank", func(b *testing.B) {
+		rows, err := db.GetRowsForTagID(day.ID)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			// cycle the last row to the top
+			err := db.UpdateRowRank(rows[len(rows)-1-i%len(rows)].ID, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("RenameTag", func(b *testing.B) {
+		names := []string{topic.Name, topic.Name + " renamed"}
+		for i := 0; i < b.N; i++ {
+			_, err := db.RenameTag(names[i%2], names[(i+1)%2])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		b.StopTimer()
+		if b.N%2 == 1 {
+			_, err := db.RenameTag(names[1], names[0])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,428 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The tag graph has a node for every tag, and an edge from tag A to tag B for the rows under A that link B, weighted
+// by the number of such rows. A row linking its own tag adds no edge, and the rows of locked tags only count while the
+// tag is unlocked.
+
+// GraphEdge is the link from one tag to another
+type GraphEdge struct {
+	From   int64
+	To     int64
+	Weight int
+}
+
+// Graph is a part of the tag graph. Tags are sorted by key, and edges by tag.
+type Graph struct {
+	Tags  []Tag
+	Edges []GraphEdge
+}
+
+// GraphFilter narrows the tag graph down. Zero values don't filter.
+type GraphFilter struct {
+	// Since and Until only count the rows last changed in [Since, Until)
+	Since time.Time
+	Until time.Time
+	// Namespace only keeps the edges between tags in the namespace, the namespace tag included
+	Namespace string
+}
+
+// inNamespace reports whether the tag with the given key is the namespace with key ns or below it
+func inNamespace(key string, ns string) bool {
+	return key == ns || (strings.HasPrefix(key, ns+NamespaceSeparator) && namespaceSegments(key) != nil)
+}
+
+// sqlGetGraphEdges returns the edges of the rows matching condition, which refers to the row table as r and the ref
+// table as ref
+func sqlGetGraphEdges(tx *sql.Tx, condition string, args ...interface{}) ([]GraphEdge, error) {
+	var sqlRows *sql.Rows
+	var edges []GraphEdge
+	var err error
+
+	sqlRows, err = tx.Query(`SELECT r.tag_id, ref.tag_id, COUNT(*)
+							 FROM row AS r, ref
+							 WHERE ref.row_id = r.id
+							 AND ref.tag_id != r.tag_id
+							 AND `+visibleRow("r")+`
+							 AND (`+condition+`)
+							 GROUP BY r.tag_id, ref.tag_id
+							 ORDER BY r.tag_id, ref.tag_id`, args...)
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	for sqlRows.Next() {
+		var edge GraphEdge
+		err = sqlRows.Scan(&edge.From, &edge.To, &edge.Weight)
+		if err != nil {
+			goto End
+		}
+		edges = append(edges, edge)
+	}
+
+End:
+	return edges, err
+}
+
+// sqlGetGraphTags returns the tags with the given IDs, sorted by key
+func sqlGetGraphTags(tx *sql.Tx, ids map[int64]bool) ([]Tag, error) {
+	var tags []Tag
+	var tag Tag
+	var err error
+
+	for id := range ids {
+		tag, err = sqlGetTagByID(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		return TagKey(tags[i].Name) < TagKey(tags[j].Name)
+	})
+
+	return tags, nil
+}
+
+func sqlGetGraph(tx *sql.Tx, filter GraphFilter) (Graph, error) {
+	var graph Graph
+	var edges []GraphEdge
+	var conditions []string
+	var args []interface{}
+	var err error
+
+	ids := make(map[int64]bool)
+	ns := TagKey(filter.Namespace)
+
+	conditions = []string{"1"}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "r.updated_ts >= ?")
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "r.updated_ts < ?")
+		args = append(args, filter.Until.UnixNano())
+	}
+	if ns != "" {
+		conditions = append(conditions, `r.tag_id IN (SELECT id FROM tag WHERE key = ? OR key LIKE ? ESCAPE '\')`,
+			`ref.tag_id IN (SELECT id FROM tag WHERE key = ? OR key LIKE ? ESCAPE '\')`)
+		args = append(args, ns, escapeLike(ns+NamespaceSeparator)+"%", ns, escapeLike(ns+NamespaceSeparator)+"%")
+	}
+
+	edges, err = sqlGetGraphEdges(tx, strings.Join(conditions, " AND "), args...)
+	if err != nil {
+		goto End
+	}
+
+	graph.Edges = edges
+	for _, edge := range edges {
+		ids[edge.From] = true
+		ids[edge.To] = true
+	}
+
+	graph.Tags, err = sqlGetGraphTags(tx, ids)
+	if err != nil {
+		goto End
+	}
+
+	// LIKE also matches names with empty levels, which aren't namespaced
+	if ns != "" {
+		for _, tag := range graph.Tags {
+			if !inNamespace(TagKey(tag.Name), ns) {
+				delete(ids, tag.ID)
+			}
+		}
+		graph = graph.subgraph(ids)
+	}
+
+End:
+	return graph, err
+}
+
+// GetGraph returns the tags linked to each other, and their links. Tags without links are left out.
+func (e *ExoDB) GetGraph(filter GraphFilter) (Graph, error) {
+	var tx *sql.Tx
+	var graph Graph
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	graph, err = sqlGetGraph(tx, filter)
+	if err != nil {
+		goto End
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return graph, err
+}
+
+// subgraph returns the tags of the graph with the given IDs, and the edges between them
+func (g Graph) subgraph(ids map[int64]bool) Graph {
+	var sub Graph
+
+	for _, tag := range g.Tags {
+		if ids[tag.ID] {
+			sub.Tags = append(sub.Tags, tag)
+		}
+	}
+	for _, edge := range g.Edges {
+		if ids[edge.From] && ids[edge.To] {
+			sub.Edges = append(sub.Edges, edge)
+		}
+	}
+
+	return sub
+}
+
+// sqlGetEdgesOfTags returns the edges from or to any of the given tags
+func sqlGetEdgesOfTags(tx *sql.Tx, ids []int64) ([]GraphEdge, error) {
+	var edges, batchEdges []GraphEdge
+	var batch []int64
+	var args []interface{}
+	var err error
+
+	for len(ids) > 0 {
+		batch = ids
+		if len(batch) > maxLinkedTagsBatch {
+			batch = batch[:maxLinkedTagsBatch]
+		}
+		ids = ids[len(batch):]
+
+		args = args[:0]
+		for _, id := range batch {
+			args = append(args, id)
+		}
+		list := "?" + strings.Repeat(", ?", len(batch)-1)
+
+		batchEdges, err = sqlGetGraphEdges(tx, "r.tag_id IN ("+list+") OR ref.tag_id IN ("+list+")", append(args, args...)...)
+		if err != nil {
+			break
+		}
+		edges = append(edges, batchEdges...)
+	}
+
+	return edges, err
+}
+
+func sqlGetTagNeighborhood(tx *sql.Tx, tagID int64, depth int) (Graph, error) {
+	var graph Graph
+	var edges []GraphEdge
+	var frontier []int64
+	var err error
+
+	ids := map[int64]bool{tagID: true}
+	seen := make(map[GraphEdge]bool)
+
+	_, err = sqlGetTagByID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	// the last round only looks for edges between the tags already found
+	frontier = []int64{tagID}
+	for level := 0; level <= depth && len(frontier) > 0; level++ {
+		edges, err = sqlGetEdgesOfTags(tx, frontier)
+		if err != nil {
+			goto End
+		}
+
+		frontier = nil
+		for _, edge := range edges {
+			if seen[edge] {
+				continue
+			}
+			seen[edge] = true
+			graph.Edges = append(graph.Edges, edge)
+
+			if level == depth {
+				continue
+			}
+			for _, id := range []int64{edge.From, edge.To} {
+				if !ids[id] {
+					ids[id] = true
+					frontier = append(frontier, id)
+				}
+			}
+		}
+	}
+
+	graph.Tags, err = sqlGetGraphTags(tx, ids)
+	if err != nil {
+		goto End
+	}
+
+	graph = graph.subgraph(ids)
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].From != graph.Edges[j].From {
+			return graph.Edges[i].From < graph.Edges[j].From
+		}
+		return graph.Edges[i].To < graph.Edges[j].To
+	})
+
+End:
+	return graph, err
+}
+
+// GetTagNeighborhood returns the tags within depth links of a tag, following links both ways, and the links between
+// them. A depth of 0 only returns the tag.
+func (e *ExoDB) GetTagNeighborhood(tagID int64, depth int) (Graph, error) {
+	var tx *sql.Tx
+	var graph Graph
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	graph, err = sqlGetTagNeighborhood(tx, tagID, depth)
+	if err != nil {
+		goto End
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return graph, err
+}
+
+// dotQuote quotes s as a DOT ID
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+// WriteDOT writes the graph in Graphviz's DOT language, with tag names as labels and weights as edge labels
+func (g Graph) WriteDOT(w io.Writer) error {
+	var b strings.Builder
+
+	b.WriteString("digraph exocortex {\n")
+	for _, tag := range g.Tags {
+		fmt.Fprintf(&b, "\t%d [label=%s];\n", tag.ID, dotQuote(tag.Name))
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(&b, "\t%d -> %d [weight=%d, label=\"%d\"];\n", edge.From, edge.To, edge.Weight, edge.Weight)
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type graphMLKey struct {
+	ID       string `xml:"id,attr"`
+	For      string `xml:"for,attr"`
+	AttrName string `xml:"attr.name,attr"`
+	AttrType string `xml:"attr.type,attr"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphML struct {
+	XMLName xml.Name     `xml:"graphml"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   struct {
+		EdgeDefault string        `xml:"edgedefault,attr"`
+		Nodes       []graphMLNode `xml:"node"`
+		Edges       []graphMLEdge `xml:"edge"`
+	} `xml:"graph"`
+}
+
+// WriteGraphML writes the graph as GraphML, with the tag names and edge weights as data
+func (g Graph) WriteGraphML(w io.Writer) error {
+	var doc graphML
+
+	doc.XMLNS = "http://graphml.graphdrawing.org/xmlns"
+	doc.Keys = []graphMLKey{
+		{"name", "node", "name", "string"},
+		{"weight", "edge", "weight", "int"},
+	}
+	doc.Graph.EdgeDefault = "directed"
+
+	for _, tag := range g.Tags {
+		doc.Graph.Nodes = append(doc.Graph.Nodes, graphMLNode{"n" + strconv.FormatInt(tag.ID, 10), []graphMLData{{"name", tag.Name}}})
+	}
+	for _, edge := range g.Edges {
+		doc.Graph.Edges = append(doc.Graph.Edges, graphMLEdge{
+			"n" + strconv.FormatInt(edge.From, 10),
+			"n" + strconv.FormatInt(edge.To, 10),
+			[]graphMLData{{"weight", strconv.Itoa(edge.Weight)}},
+		})
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(doc)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// WriteJSON writes the graph as a JSON object with a nodes list of {id, name} and an edges list of
+// {source, target, weight}
+func (g Graph) WriteJSON(w io.Writer) error {
+	type node struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	}
+	type edge struct {
+		Source int64 `json:"source"`
+		Target int64 `json:"target"`
+		Weight int   `json:"weight"`
+	}
+	doc := struct {
+		Nodes []node `json:"nodes"`
+		Edges []edge `json:"edges"`
+	}{[]node{}, []edge{}}
+
+	for _, tag := range g.Tags {
+		doc.Nodes = append(doc.Nodes, node{tag.ID, tag.Name})
+	}
+	for _, e := range g.Edges {
+		doc.Edges = append(doc.Edges, edge{e.From, e.To, e.Weight})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
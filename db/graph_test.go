@@ -0,0 +1,177 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addLinkedRows adds a row under the tag called from for each of the texts
+func addLinkedRows(t *testing.T, db *ExoDB, from string, texts ...string) Tag {
+	tag, err := db.AddTag(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range texts {
+		_, err = db.AddRow(tag.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return tag
+}
+
+func TestGetGraph(t *testing.T) {
+	db := setupDB(t)
+
+	alice := addLinkedRows(t, &db, "alice", "met [[bob]]", "called [[bob]] about [[work/acme]]", "I'm [[alice]]")
+	bob, err := db.GetTagByName("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme, err := db.GetTagByName("work/acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addLinkedRows(t, &db, "work/beta", "spun off from [[work/acme]]")
+	addLinkedRows(t, &db, "lonely", "no links here")
+
+	graph, err := db.GetGraph(GraphFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, tag := range graph.Tags {
+		names = append(names, tag.Name)
+	}
+	if strings.Join(names, ",") != "alice,bob,work/acme,work/beta" {
+		t.Fatalf("unexpected tags %v", names)
+	}
+
+	weights := make(map[[2]int64]int)
+	for _, edge := range graph.Edges {
+		weights[[2]int64{edge.From, edge.To}] = edge.Weight
+	}
+	if len(weights) != 3 || weights[[2]int64{alice.ID, bob.ID}] != 2 || weights[[2]int64{alice.ID, acme.ID}] != 1 {
+		t.Fatalf("unexpected edges %v", graph.Edges)
+	}
+
+	graph, err = db.GetGraph(GraphFilter{Namespace: "Work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Tags) != 2 || len(graph.Edges) != 1 || graph.Edges[0].To != acme.ID {
+		t.Fatalf("unexpected namespace graph %v", graph)
+	}
+
+	graph, err = db.GetGraph(GraphFilter{Since: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(graph.Tags) != 0 || len(graph.Edges) != 0 {
+		t.Fatalf("expected no links changed in the future, got %v", graph)
+	}
+}
+
+func TestGetTagNeighborhood(t *testing.T) {
+	db := setupDB(t)
+
+	// a -> b -> c -> d, and e -> b
+	a := addLinkedRows(t, &db, "a", "[[b]]")
+	b := addLinkedRows(t, &db, "b", "[[c]]")
+	c := addLinkedRows(t, &db, "c", "[[d]]")
+	e := addLinkedRows(t, &db, "e", "[[b]]")
+	d, err := db.GetTagByName("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		depth int
+		tags  []int64
+		edges int
+	}{
+		{0, []int64{b.ID}, 0},
+		{1, []int64{a.ID, b.ID, c.ID, e.ID}, 3},
+		{2, []int64{a.ID, b.ID, c.ID, d.ID, e.ID}, 4},
+	}
+
+	for _, test := range tests {
+		graph, err := db.GetTagNeighborhood(b.ID, test.depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids := make(map[int64]bool)
+		for _, tag := range graph.Tags {
+			ids[tag.ID] = true
+		}
+		if len(ids) != len(test.tags) || len(graph.Edges) != test.edges {
+			t.Fatalf("depth %d: unexpected neighborhood %v", test.depth, graph)
+		}
+		for _, id := range test.tags {
+			if !ids[id] {
+				t.Fatalf("depth %d: expected tag %d in %v", test.depth, id, graph.Tags)
+			}
+		}
+	}
+
+	_, err = db.GetTagNeighborhood(-1, 1)
+	if err == nil {
+		t.Fatal("expected an error for a missing tag")
+	}
+}
+
+func TestGraphWriters(t *testing.T) {
+	var out bytes.Buffer
+
+	graph := Graph{
+		Tags:  []Tag{{ID: 1, Name: `say "hi"`}, {ID: 2, Name: "b & c"}},
+		Edges: []GraphEdge{{From: 1, To: 2, Weight: 3}},
+	}
+
+	err := graph.WriteDOT(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `1 [label="say \"hi\""];`) || !strings.Contains(out.String(), "1 -> 2 [weight=3") {
+		t.Fatalf("unexpected DOT:\n%s", out.String())
+	}
+
+	out.Reset()
+	err = graph.WriteGraphML(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc graphML
+	err = xml.Unmarshal(out.Bytes(), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Graph.Nodes) != 2 || doc.Graph.Nodes[1].Data[0].Value != "b & c" || doc.Graph.Edges[0].Data[0].Value != "3" {
+		t.Fatalf("unexpected GraphML:\n%s", out.String())
+	}
+
+	out.Reset()
+	err = graph.WriteJSON(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Nodes []struct{ ID int64 }
+		Edges []struct{ Source, Target int64 }
+	}
+	err = json.Unmarshal(out.Bytes(), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Nodes) != 2 || decoded.Edges[0].Target != 2 {
+		t.Fatalf("unexpected JSON:\n%s", out.String())
+	}
+}
@@ -0,0 +1,433 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// The rows of a locked tag are stored sealed with AES-256-GCM, under a key derived from the tag's own passphrase.
+// Until the tag is unlocked for the session, its rows are hidden: they aren't returned as the tag's rows, as refs,
+// by queries or in the trash and snarf registers, and they can't be changed. Unlocking keeps the key in memory only.
+//
+// Sealing and unsealing happen in SQL, through functions every connection registers, so that queries can search
+// the rows of unlocked tags like any other:
+//
+//	exo_seal(tag_id, text)    the text sealed under the tag's key; fails if the tag isn't unlocked
+//	exo_open(tag_id, text)    the text unsealed, or NULL if the tag isn't unlocked
+//	exo_unlocked(tag_id)      whether the tag is unlocked for the session
+//
+// The rows of locked tags have no refs and no properties, which would give them away; they're rebuilt when the lock is
+// removed. Until then, the tags they link aren't kept around for them, and renaming those tags doesn't rewrite the
+// links.
+
+var (
+	// ErrTagLocked is returned when changing a locked tag, or its rows, while it isn't unlocked
+	ErrTagLocked = errors.New("tag is locked")
+	// ErrTagNotLocked is returned when unlocking a tag that isn't locked
+	ErrTagNotLocked = errors.New("tag isn't locked")
+)
+
+// lockVerifier is sealed under a tag's key when it's locked, so that passphrases can be checked
+const lockVerifier = "exocortex"
+
+// keyring holds the keys of the tags unlocked for the session
+type keyring struct {
+	mu   sync.Mutex
+	keys map[int64]cipher.AEAD
+}
+
+func newKeyring() *keyring {
+	return &keyring{keys: make(map[int64]cipher.AEAD)}
+}
+
+func (k *keyring) get(tagID int64) (cipher.AEAD, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, ok := k.keys[tagID]
+	return key, ok
+}
+
+func (k *keyring) set(tagID int64, key cipher.AEAD) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if key == nil {
+		delete(k.keys, tagID)
+	} else {
+		k.keys[tagID] = key
+	}
+}
+
+func (k *keyring) clear() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys = make(map[int64]cipher.AEAD)
+}
+
+// tagAAD binds sealed text to the tag it belongs to
+func tagAAD(tagID int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(tagID))
+}
+
+func sealText(key cipher.AEAD, tagID int64, text string) (string, error) {
+	nonce := make([]byte, key.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(key.Seal(nonce, nonce, []byte(text), tagAAD(tagID))), nil
+}
+
+func openText(key cipher.AEAD, tagID int64, sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < key.NonceSize() {
+		return "", fmt.Errorf("row of tag %d isn't sealed", tagID)
+	}
+
+	text, err := key.Open(nil, data[:key.NonceSize()], data[key.NonceSize():], tagAAD(tagID))
+	if err != nil {
+		return "", ErrPassphrase
+	}
+
+	return string(text), nil
+}
+
+// register adds the lock functions to a connection
+func (k *keyring) register(conn *sqlite3.SQLiteConn) error {
+	err := conn.RegisterFunc("exo_unlocked", func(tagID int64) bool {
+		_, ok := k.get(tagID)
+		return ok
+	}, false)
+	if err != nil {
+		return err
+	}
+
+	err = conn.RegisterFunc("exo_seal", func(tagID int64, text string) (string, error) {
+		key, ok := k.get(tagID)
+		if !ok {
+			return "", ErrTagLocked
+		}
+		return sealText(key, tagID, text)
+	}, false)
+	if err != nil {
+		return err
+	}
+
+	return conn.RegisterFunc("exo_open", func(tagID int64, sealed string) (interface{}, error) {
+		key, ok := k.get(tagID)
+		if !ok {
+			return nil, nil
+		}
+		return openText(key, tagID, sealed)
+	}, false)
+}
+
+// openedText selects the unsealed text of table's current row, for tables with tag_id and text columns
+func openedText(table string) string {
+	return "CASE WHEN " + table + ".tag_id IN (SELECT tag_id FROM tag_lock) THEN exo_open(" + table + ".tag_id, " + table + ".text) ELSE " + table + ".text END"
+}
+
+// sealedText seals the text expression if the tag expression is a locked tag
+func sealedText(tagID string, text string) string {
+	return "CASE WHEN " + tagID + " IN (SELECT tag_id FROM tag_lock) THEN exo_seal(" + tagID + ", " + text + ") ELSE " + text + " END"
+}
+
+// visibleRow is a condition excluding the rows of table that belong to locked tags that aren't unlocked
+func visibleRow(table string) string {
+	return table + ".tag_id NOT IN (SELECT tag_id FROM tag_lock WHERE NOT exo_unlocked(tag_id))"
+}
+
+func sqlIsTagLocked(tx *sql.Tx, tagID int64) (bool, error) {
+	var locked bool
+	var err error
+
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM tag_lock WHERE tag_id = $1)", tagID).Scan(&locked)
+
+	return locked, err
+}
+
+// sqlCheckTagUnlocked returns ErrTagLocked if a tag is locked and isn't unlocked
+func sqlCheckTagUnlocked(tx *sql.Tx, tagID int64) error {
+	var hidden bool
+	var err error
+
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM tag_lock WHERE tag_id = $1 AND NOT exo_unlocked(tag_id))", tagID).Scan(&hidden)
+	if err == nil && hidden {
+		err = ErrTagLocked
+	}
+
+	return err
+}
+
+// sqlClearRefsOfTag removes the refs of a tag's rows, trashing the tags they linked if that leaves them empty
+func sqlClearRefsOfTag(tx *sql.Tx, tagID int64) error {
+	var sqlRows *sql.Rows
+	var linkedIDs []int64
+	var err error
+
+	sqlRows, err = tx.Query("SELECT DISTINCT tag_id FROM ref WHERE row_id IN (SELECT id FROM row WHERE tag_id = $1)", tagID)
+	if err != nil {
+		goto End
+	}
+
+	for sqlRows.Next() {
+		var linkedID int64
+		err = sqlRows.Scan(&linkedID)
+		if err != nil {
+			sqlRows.Close()
+			goto End
+		}
+		linkedIDs = append(linkedIDs, linkedID)
+	}
+	sqlRows.Close()
+
+	_, err = tx.Exec("DELETE FROM ref WHERE row_id IN (SELECT id FROM row WHERE tag_id = $1)", tagID)
+	if err != nil {
+		goto End
+	}
+
+	for _, linkedID := range linkedIDs {
+		err = sqlTrashTagIfEmpty(tx, linkedID)
+		if err != nil {
+			goto End
+		}
+	}
+
+End:
+	return err
+}
+
+// sqlClearLockedRefs removes the refs of the rows of every locked tag. The tags they linked are left for Repair.
+func sqlClearLockedRefs(tx *sql.Tx) error {
+	_, err := tx.Exec("DELETE FROM ref WHERE row_id IN (SELECT id FROM row WHERE tag_id IN (SELECT tag_id FROM tag_lock))")
+	return err
+}
+
+// tagKey derives a tag's key from its passphrase
+func tagKey(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), salt, iterations, keySize, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sqlUnlockKey returns the key of a locked tag, if passphrase is the right one
+func sqlUnlockKey(tx *sql.Tx, tagID int64, passphrase string) (cipher.AEAD, error) {
+	var salt []byte
+	var iterations int
+	var verifier string
+	var key cipher.AEAD
+	var err error
+
+	err = tx.QueryRow("SELECT salt, iterations, verifier FROM tag_lock WHERE tag_id = $1", tagID).Scan(&salt, &iterations, &verifier)
+	if err == sql.ErrNoRows {
+		err = ErrTagNotLocked
+	}
+	if err != nil {
+		goto End
+	}
+
+	key, err = tagKey(passphrase, salt, iterations)
+	if err != nil {
+		goto End
+	}
+
+	_, err = openText(key, tagID, verifier)
+
+End:
+	return key, err
+}
+
+// LockTag locks a tag with a passphrase, sealing its rows, including those in the trash and in snarf registers. The
+// tag stays locked for the session. Query tags can't be locked.
+//
+// The database is vacuumed afterwards, so the plaintext doesn't linger in its free pages. Snapshots taken before are
+// left alone, since they're the only copies of everything else they hold, but they still hold the rows unsealed:
+// they're returned so the user can be told.
+func (e *ExoDB) LockTag(tagID int64, passphrase string) ([]Snapshot, error) {
+	var tx *sql.Tx
+	var tag Tag
+	var salt []byte
+	var key cipher.AEAD
+	var verifier string
+	var err error
+
+	salt = make([]byte, saltSize)
+	_, err = io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err = tagKey(passphrase, salt, int(encryptionIterations))
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, err = sealText(key, tagID, lockVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	tag, err = sqlGetTagByID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	switch tag.Kind {
+	case TagKindQuery:
+		err = ErrQueryTag
+		goto End
+	case TagKindLocked:
+		err = ErrTagLocked
+		goto End
+	}
+
+	_, err = tx.Exec("INSERT INTO tag_lock (tag_id, salt, iterations, verifier) VALUES ($1, $2, $3, $4)", tagID, salt, encryptionIterations, verifier)
+	if err != nil {
+		goto End
+	}
+
+	// the key is only needed while sealing
+	e.keys.set(tagID, key)
+	defer e.keys.set(tagID, nil)
+
+	for _, table := range []string{"row", "trash_row", "snarf"} {
+		_, err = tx.Exec("UPDATE "+table+" SET text = exo_seal(tag_id, text) WHERE tag_id = $1", tagID)
+		if err != nil {
+			goto End
+		}
+	}
+
+	// refs and properties would give the rows away
+	_, err = tx.Exec("DELETE FROM property WHERE row_id IN (SELECT id FROM row WHERE tag_id = $1)", tagID)
+	if err != nil {
+		goto End
+	}
+
+	err = sqlClearRefsOfTag(tx, tagID)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = e.conn.Exec("VACUUM")
+	if err != nil {
+		return nil, err
+	}
+
+	return ListBackups(e.filename)
+}
+
+// UnlockTag unlocks a locked tag for the session, showing its rows until it's relocked
+func (e *ExoDB) UnlockTag(tagID int64, passphrase string) error {
+	var tx *sql.Tx
+	var key cipher.AEAD
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	key, err = sqlUnlockKey(tx, tagID, passphrase)
+	if err != nil {
+		goto End
+	}
+
+	e.keys.set(tagID, key)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return err
+}
+
+// RelockTag hides the rows of an unlocked tag again
+func (e *ExoDB) RelockTag(tagID int64) {
+	e.keys.set(tagID, nil)
+}
+
+// RelockAllTags hides the rows of every unlocked tag again
+func (e *ExoDB) RelockAllTags() {
+	e.keys.clear()
+}
+
+// IsTagUnlocked reports whether a locked tag is unlocked for the session
+func (e *ExoDB) IsTagUnlocked(tagID int64) bool {
+	_, ok := e.keys.get(tagID)
+	return ok
+}
+
+// RemoveTagLock turns a locked tag back into a normal one, unsealing its rows and rebuilding their refs and properties
+func (e *ExoDB) RemoveTagLock(tagID int64, passphrase string) error {
+	var tx *sql.Tx
+	var key cipher.AEAD
+	var rows []Row
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	key, err = sqlUnlockKey(tx, tagID, passphrase)
+	if err != nil {
+		goto End
+	}
+
+	e.keys.set(tagID, key)
+	defer e.keys.set(tagID, nil)
+
+	for _, table := range []string{"row", "trash_row", "snarf"} {
+		_, err = tx.Exec("UPDATE "+table+" SET text = exo_open(tag_id, text) WHERE tag_id = $1", tagID)
+		if err != nil {
+			goto End
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM tag_lock WHERE tag_id = $1", tagID)
+	if err != nil {
+		goto End
+	}
+
+	rows, err = sqlGetRowsForTagID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	for _, row := range rows {
+		err = sqlUpdateRefsForRowID(tx, row.ID)
+		if err != nil {
+			goto End
+		}
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return err
+}
@@ -0,0 +1,464 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockTag(t *testing.T) {
+	var db ExoDB
+	var tag, other Tag
+	var rows []Row
+	var refs Refs
+	var err error
+
+	encryptionIterations = 1000
+	db = setupDB(t)
+
+	tag, err = db.AddTag("diary")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err = db.AddTag("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"met [[alice]] today", "status:: private", "and [[carol]]"} {
+		_, err = db.AddRow(tag.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.AddRow(other.ID, "[[carol]] is around", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.LockTag(tag.ID, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.LockTag(tag.ID, "secret"); err != ErrTagLocked {
+		t.Fatalf("expected ErrTagLocked, got %v", err)
+	}
+
+	tag, err = db.GetTagByID(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Kind != TagKindLocked {
+		t.Fatalf("expected a locked tag, got %d", tag.Kind)
+	}
+
+	// the text is stored sealed
+	var stored string
+	err = db.conn.QueryRow("SELECT text FROM row WHERE tag_id = $1 ORDER BY rank", tag.ID).Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == "met [[alice]] today" {
+		t.Fatal("row text wasn't sealed")
+	}
+
+	rows, err = db.GetRowsForTagID(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 0 {
+		t.Fatalf("expected the rows to be hidden, got %v", rows)
+	}
+
+	// the rows' links would give them away
+	if _, err = db.GetTagByName("alice"); err != sql.ErrNoRows {
+		t.Fatalf("expected the tag only locked rows link to be gone, got %v", err)
+	}
+	refs, err = db.GetRefsToTagByTagName("carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 {
+		t.Fatalf("expected only the unlocked ref, got %v", refs)
+	}
+	for refTag := range refs {
+		if refTag.ID != other.ID {
+			t.Fatalf("expected only the unlocked ref, got %v", refs)
+		}
+	}
+
+	refs, err = db.RunQuery("today")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 0 {
+		t.Fatalf("expected the rows not to be searched, got %v", refs)
+	}
+
+	if _, err = db.AddRow(tag.ID, "hidden", 0); err != ErrTagLocked {
+		t.Fatalf("expected ErrTagLocked, got %v", err)
+	}
+	if err = db.DeleteTagByID(tag.ID); err != ErrTagLocked {
+		t.Fatalf("expected ErrTagLocked, got %v", err)
+	}
+	// locked rows don't hold up renaming the tags they link
+	if _, err = db.RenameTag("carol", "dave"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.UnlockTag(tag.ID, "guess"); err != ErrPassphrase {
+		t.Fatalf("expected ErrPassphrase, got %v", err)
+	}
+	if err = db.UnlockTag(other.ID, "secret"); err != ErrTagNotLocked {
+		t.Fatalf("expected ErrTagNotLocked, got %v", err)
+	}
+
+	err = db.UnlockTag(tag.ID, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.IsTagUnlocked(tag.ID) {
+		t.Fatal("expected the tag to be unlocked")
+	}
+
+	rows, err = db.GetRowsForTagID(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 || rows[0].Text != "met [[alice]] today" {
+		t.Fatalf("expected the rows to be shown, got %v", rows)
+	}
+
+	refs, err = db.RunQuery("today")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs[tag]) != 1 {
+		t.Fatalf("expected the unlocked rows to be searched, got %v", refs)
+	}
+
+	// editing an unlocked row doesn't give its links away either
+	err = db.UpdateRowText(rows[0].ID, "met [[alice]] today, again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.GetTagByName("alice"); err != sql.ErrNoRows {
+		t.Fatalf("expected the edited row not to link alice, got %v", err)
+	}
+
+	// rows stay sealed while being edited
+	err = db.UpdateRowText(rows[0].ID, "met [[alice]] yesterday")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.conn.QueryRow("SELECT text FROM row WHERE id = $1", rows[0].ID).Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == "met [[alice]] yesterday" {
+		t.Fatal("edited row text wasn't sealed")
+	}
+
+	// moving a row out of the tag unseals it
+	err = db.MoveRowsToTag([]int64{rows[1].ID}, other.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.conn.QueryRow("SELECT text FROM row WHERE id = $1", rows[1].ID).Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != "status:: private" {
+		t.Fatalf("expected the moved row to be unsealed, got %s", stored)
+	}
+
+	db.RelockTag(tag.ID)
+
+	rows, err = db.GetRowsForTagID(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 0 {
+		t.Fatalf("expected the rows to be hidden again, got %v", rows)
+	}
+}
+
+func TestLockedTagTrashAndSnarf(t *testing.T) {
+	var db ExoDB
+	var tag Tag
+	var row Row
+	var rows []Row
+	var trashedRows []TrashedRow
+	var err error
+
+	encryptionIterations = 1000
+	db = setupDB(t)
+
+	tag, err = db.AddTag("diary")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"one", "two"} {
+		row, err = db.AddRow(tag.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+
+	err = db.DeleteRowByID(rows[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.PushSnarf("a", rows[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.LockTag(tag.ID, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trashedRows, err = db.GetTrashedRows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trashedRows) != 0 {
+		t.Fatalf("expected the trashed row to be hidden, got %v", trashedRows)
+	}
+
+	rows, err = db.GetSnarf("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 0 {
+		t.Fatalf("expected the snarfed row to be hidden, got %v", rows)
+	}
+
+	err = db.UnlockTag(tag.ID, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trashedRows, err = db.GetTrashedRows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trashedRows) != 1 || trashedRows[0].Row.Text != "one" {
+		t.Fatalf("expected the trashed row to be shown, got %v", trashedRows)
+	}
+
+	rows, err = db.GetSnarf("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Text != "two" {
+		t.Fatalf("expected the snarfed row to be shown, got %v", rows)
+	}
+}
+
+func TestRemoveTagLock(t *testing.T) {
+	var db ExoDB
+	var tag Tag
+	var rows []Row
+	var refs Refs
+	var err error
+
+	encryptionIterations = 1000
+	db = setupDB(t)
+
+	tag, err = db.AddTag("diary")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AddRow(tag.ID, "status:: done", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddRow(tag.ID, "met [[alice]]", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.LockTag(tag.ID, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.RemoveTagLock(tag.ID, "guess"); err != ErrPassphrase {
+		t.Fatalf("expected ErrPassphrase, got %v", err)
+	}
+
+	err = db.RemoveTagLock(tag.ID, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err = db.GetTagByID(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Kind != TagKindNormal {
+		t.Fatalf("expected a normal tag, got %d", tag.Kind)
+	}
+
+	rows, err = db.GetRowsForTagID(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Text != "status:: done" {
+		t.Fatalf("expected the rows to be unsealed, got %v", rows)
+	}
+
+	// the links are back
+	refs, err = db.GetRefsToTagByTagName("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs[tag]) != 1 {
+		t.Fatalf("expected the ref to be rebuilt, got %v", refs)
+	}
+}
+
+func TestLockedTagIntegrity(t *testing.T) {
+	var db ExoDB
+	var tag, other Tag
+	var row Row
+	var problems []Problem
+	var err error
+
+	encryptionIterations = 1000
+	db = setupDB(t)
+
+	tag, err = db.AddTag("diary")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err = db.AddRow(tag.ID, "met [[alice]]", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddRow(tag.ID, "saw [[bob]]", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.LockTag(tag.ID, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// locked rows aren't expected to have refs, whether or not the tag is unlocked
+	for _, unlocked := range []bool{false, true} {
+		if unlocked {
+			err = db.UnlockTag(tag.ID, "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		problems, err = db.CheckIntegrity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(problems) != 0 {
+			t.Fatalf("unexpected problems: %v", problems)
+		}
+	}
+	db.RelockTag(tag.ID)
+
+	other, err = db.AddTag("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.conn.Exec("INSERT INTO ref (tag_id, row_id) VALUES ($1, $2)", other.ID, row.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.conn.Exec("UPDATE row SET rank = 0 WHERE tag_id = $1", tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the locked rows are repaired without being unlocked
+	problems, err = db.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[ProblemKind]bool)
+	for _, p := range problems {
+		found[p.Kind] = true
+	}
+	if !found[ProblemStaleRef] || !found[ProblemRankDuplicate] {
+		t.Fatalf("expected a stale ref and a duplicate rank, got %v", problems)
+	}
+
+	problems, err = db.CheckIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems after repair: %v", problems)
+	}
+}
+
+func TestLockTagScrubsPlaintext(t *testing.T) {
+	var db ExoDB
+	var tag Tag
+	var snapshots []Snapshot
+	var err error
+
+	encryptionIterations = 1000
+	filename := filepath.Join(t.TempDir(), "exocortex.db")
+
+	err = db.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err = db.AddTag("diary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		_, err = db.AddRow(tag.ID, fmt.Sprintf("dear diary, entry %d", i), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = db.Backup()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err = db.LockTag(tag.ID, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("expected the snapshot holding the plaintext, got %v", snapshots)
+	}
+
+	contents, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(contents, []byte("dear diary")) {
+		t.Fatal("the plaintext is still in the database file")
+	}
+}
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"strings"
+)
+
+// Row text supports a small amount of markup:
+//
+//	[[name]]      link to the tag called name
+//	\[ \] \\ \`   a literal bracket, backslash or backtick
+//	`code`        a code span, shown as is; brackets inside it never link. A span opened by several backticks is
+//	              closed by the same number of them, so ``a ` b`` holds a backtick. A backslash right before a
+//	              backtick always escapes it, even inside a span.
+//
+// A linked tag name can't be empty or only whitespace and can't span lines. Single brackets inside it must balance,
+// so [[a [b]]] links "a [b]"; unbalanced ones can be escaped. A link starts at the last two of a run of opening
+// brackets, so [[[a]]] is a link to "a" in brackets. A [[ that doesn't start a link is plain text, as is a backslash
+// that doesn't escape anything.
+
+// NodeKind is the kind of a piece of parsed row text
+type NodeKind int
+
+const (
+	NodeText   NodeKind = iota // plain text
+	NodeRef                    // [[link]] to a tag
+	NodeEscape                 // backslash-escaped character
+	NodeCode                   // `code` span
+)
+
+// Node is a piece of parsed row text
+type Node struct {
+	Kind NodeKind
+	// Text is what the node shows: the text itself, the linked tag's name, the escaped character or the contents of
+	// the code span
+	Text string
+	// Start and End are the byte offsets of the node's source in the parsed text
+	Start int
+	End   int
+}
+
+func isEscapable(c byte) bool {
+	return c == '[' || c == ']' || c == '\\' || c == '`'
+}
+
+// ParseText splits row text into its plain text, links, escapes and code spans. Joining the sources of the nodes
+// gives back text.
+func ParseText(text string) []Node {
+	var nodes []Node
+	var textStart int
+
+	// flush ends the plain text pending since textStart
+	flush := func(end int) {
+		if end > textStart {
+			nodes = append(nodes, Node{NodeText, text[textStart:end], textStart, end})
+		}
+	}
+
+	for i := 0; i < len(text); {
+		switch {
+		case text[i] == '\\' && i+1 < len(text) && isEscapable(text[i+1]):
+			flush(i)
+			nodes = append(nodes, Node{NodeEscape, text[i+1 : i+2], i, i + 2})
+			i += 2
+			textStart = i
+		case text[i] == '`':
+			n := backtickRun(text, i)
+			end := findCodeEnd(text, i+n, n)
+			if end < 0 {
+				// unterminated backticks are plain text
+				i += n
+				continue
+			}
+			flush(i)
+			nodes = append(nodes, Node{NodeCode, text[i+n : end], i, end + n})
+			i = end + n
+			textStart = i
+		case strings.HasPrefix(text[i:], "[[["):
+			// a link starts at the last two of a run of brackets
+			i++
+		case strings.HasPrefix(text[i:], "[["):
+			name, end, ok := parseRef(text, i)
+			if !ok {
+				i++
+				continue
+			}
+			flush(i)
+			nodes = append(nodes, Node{NodeRef, name, i, end})
+			i = end
+			textStart = i
+		default:
+			i++
+		}
+	}
+	flush(len(text))
+
+	return nodes
+}
+
+// backtickRun returns the number of backticks starting at i
+func backtickRun(text string, i int) int {
+	n := 0
+	for i+n < len(text) && text[i+n] == '`' {
+		n++
+	}
+	return n
+}
+
+// findCodeEnd returns the index of the first run of exactly n backticks at or after from, or -1. A backtick right
+// after a backslash doesn't count, so an escaped backtick in a later link can't end the span.
+func findCodeEnd(text string, from int, n int) int {
+	for i := from; i < len(text); {
+		if text[i] != '`' || text[i-1] == '\\' {
+			i++
+			continue
+		}
+		run := backtickRun(text, i)
+		if run == n {
+			return i
+		}
+		i += run
+	}
+	return -1
+}
+
+// parseRef parses the link starting with the [[ at start, returning the linked name and the offset just past the
+// closing ]]. ok is false if no valid link starts there.
+func parseRef(text string, start int) (name string, end int, ok bool) {
+	var b strings.Builder
+	var depth int
+
+	for i := start + 2; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\n':
+			return "", 0, false
+		case c == '\\' && i+1 < len(text) && isEscapable(text[i+1]):
+			b.WriteByte(text[i+1])
+			i += 2
+			continue
+		case strings.HasPrefix(text[i:], "[["):
+			// the innermost [[ starts the link
+			return "", 0, false
+		case c == '[':
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		case strings.HasPrefix(text[i:], "]]"):
+			if strings.TrimSpace(b.String()) == "" {
+				return "", 0, false
+			}
+			return b.String(), i + 2, true
+		}
+		b.WriteByte(c)
+		i++
+	}
+
+	return "", 0, false
+}
+
+// RefNames returns the names of the tags linked from text, in order
+func RefNames(text string) []string {
+	var names []string
+
+	for _, node := range ParseText(text) {
+		if node.Kind == NodeRef {
+			names = append(names, node.Text)
+		}
+	}
+
+	return names
+}
+
+// FormatRef returns a link to the named tag, escaping the characters of name that would otherwise be markup
+func FormatRef(name string) string {
+	var b strings.Builder
+
+	b.WriteString("[[")
+	for i := 0; i < len(name); i++ {
+		if isEscapable(name[i]) {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(name[i])
+	}
+	b.WriteString("]]")
+
+	return b.String()
+}
+
+// renameRefs rewrites the links in text to the tags keyed in renames into links to their new names
+func renameRefs(text string, renames map[string]string) string {
+	var b strings.Builder
+
+	for _, node := range ParseText(text) {
+		if newname, ok := renames[TagKey(node.Text)]; node.Kind == NodeRef && ok {
+			b.WriteString(FormatRef(newname))
+		} else {
+			b.WriteString(text[node.Start:node.End])
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseText(t *testing.T) {
+	tests := []struct {
+		text  string
+		nodes []Node
+	}{
+		{"plain", []Node{{NodeText, "plain", 0, 5}}},
+		{"a [[b]] c", []Node{{NodeText, "a ", 0, 2}, {NodeRef, "b", 2, 7}, {NodeText, " c", 7, 9}}},
+		{"[[]] [[ ]]", []Node{{NodeText, "[[]] [[ ]]", 0, 10}}},
+		{"[[a\nb]]", []Node{{NodeText, "[[a\nb]]", 0, 7}}},
+		{"[[a [[b]] c]]", []Node{{NodeText, "[[a ", 0, 4}, {NodeRef, "b", 4, 9}, {NodeText, " c]]", 9, 13}}},
+		{"[[[a]]", []Node{{NodeText, "[", 0, 1}, {NodeRef, "a", 1, 6}}},
+		{"[[[[]]]]", []Node{{NodeText, "[[[[]]]]", 0, 8}}},
+		{"[[[a]]]", []Node{{NodeText, "[", 0, 1}, {NodeRef, "a", 1, 6}, {NodeText, "]", 6, 7}}},
+		{"[[a [b]]]", []Node{{NodeRef, "a [b]", 0, 9}}},
+		{"[[a]]]", []Node{{NodeRef, "a", 0, 5}, {NodeText, "]", 5, 6}}},
+		{`\[[a]]`, []Node{{NodeEscape, "[", 0, 2}, {NodeText, "[a]]", 2, 6}}},
+		{`[[a\]]b]]`, []Node{{NodeRef, "a]]b", 0, 9}}},
+		{`\\[[a]]`, []Node{{NodeEscape, `\`, 0, 2}, {NodeRef, "a", 2, 7}}},
+		{`C:\dir`, []Node{{NodeText, `C:\dir`, 0, 6}}},
+		{"`[[a]]` [[b]]", []Node{{NodeCode, "[[a]]", 0, 7}, {NodeText, " ", 7, 8}, {NodeRef, "b", 8, 13}}},
+		{"``a ` b`` `c", []Node{{NodeCode, "a ` b", 0, 9}, {NodeText, " `c", 9, 12}}},
+		{"[[a `b]] c`", []Node{{NodeRef, "a `b", 0, 8}, {NodeText, " c`", 8, 11}}},
+	}
+
+	for _, test := range tests {
+		nodes := ParseText(test.text)
+		if !reflect.DeepEqual(nodes, test.nodes) {
+			t.Errorf("ParseText(%q) = %v, expected %v", test.text, nodes, test.nodes)
+		}
+	}
+}
+
+func TestRenameRefs(t *testing.T) {
+	text := "[[a]] `[[a]]` \\[[a]] [[ab]] [[a]]"
+	expected := "[[b\\]]] `[[a]]` \\[[a]] [[ab]] [[b\\]]]"
+	if renamed := renameRefs(text, map[string]string{"a": "b]"}); renamed != expected {
+		t.Fatalf("expected %q, got %q", expected, renamed)
+	}
+}
+
+func TestRenameTagEscapes(t *testing.T) {
+	db := setupDB(t)
+
+	tag, err := db.AddTag("notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, err := db.AddRow(tag.ID, "see [[old]] but not `[[old]]`", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.RenameTag("old", "new [draft]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err = db.GetRowByID(row.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `see [[new \[draft\]]] but not ` + "`[[old]]`"; row.Text != expected {
+		t.Fatalf("expected %q, got %q", expected, row.Text)
+	}
+
+	refs, err := db.GetRefsToTagByTagName("new [draft]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 {
+		t.Fatalf("expected the renamed tag to be referenced once, got %v", refs)
+	}
+}
+
+func FuzzParseText(f *testing.F) {
+	for _, seed := range []string{"a [[b]] c", "[[a [[b]] c]]", "[[a [b]]]", `\[[a\]]`, "``a ` b`` [[c]]", "[[\n]]", "[[ ]]"} {
+		f.Add(seed, "new")
+	}
+
+	f.Fuzz(func(t *testing.T, text string, newname string) {
+		var source strings.Builder
+
+		nodes := ParseText(text)
+		end := 0
+		for _, node := range nodes {
+			if node.Start != end || node.End <= node.Start {
+				t.Fatalf("nodes of %q aren't contiguous: %v", text, nodes)
+			}
+			end = node.End
+			source.WriteString(text[node.Start:node.End])
+
+			if node.Kind == NodeRef && (strings.TrimSpace(node.Text) == "" || strings.Contains(node.Text, "\n")) {
+				t.Fatalf("invalid tag name %q in %q", node.Text, text)
+			}
+		}
+		if source.String() != text {
+			t.Fatalf("sources of %q join to %q", text, source.String())
+		}
+
+		if strings.TrimSpace(newname) == "" || strings.Contains(newname, "\n") {
+			return
+		}
+
+		// links round trip
+		if names := RefNames(FormatRef(newname)); len(names) != 1 || names[0] != newname {
+			t.Fatalf("FormatRef(%q) links %q", newname, names)
+		}
+
+		// renaming a tag only renames its links
+		names := RefNames(text)
+		if len(names) == 0 {
+			return
+		}
+		expected := make([]string, len(names))
+		for i, name := range names {
+			expected[i] = name
+			if TagKey(name) == TagKey(names[0]) {
+				expected[i] = newname
+			}
+		}
+		if renamed := RefNames(renameRefs(text, map[string]string{TagKey(names[0]): newname})); !reflect.DeepEqual(renamed, expected) {
+			t.Fatalf("renaming %q to %q in %q links %q", names[0], newname, text, renamed)
+		}
+	})
+}
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations bring databases created by older versions up to date. They run once each, in order, after the schema
+// is loaded, and the database's user_version counts the ones that have run. Since the schema creates missing
+// tables in their latest form, migrations must also cope with a brand new database.
+var migrations = []func(*sql.Tx) error{
+	sqlMigrateTagKeys,
+	// TagKey started ignoring the whitespace around namespace separators; see namespaceMigration
+	sqlMigrateTagKeys,
+	// properties used to be parsed only from rows edited since they were added
+	sqlMigrateProperties,
+	// refcounts used to be left at 0 before the ref triggers kept them up to date
+	sqlRecountRefs,
+	// locked tags used to keep the refs of their rows
+	sqlClearLockedRefs,
+}
+
+// namespaceMigration is the index of the migration after which names with a NamespaceSeparator are namespaced
+const namespaceMigration = 1
+
+// sqlMigrate runs the migrations the database hasn't had yet. It returns notices about what they changed that the
+// user should hear about.
+func sqlMigrate(tx *sql.Tx) ([]string, error) {
+	var version int
+	var notices []string
+	var err error
+
+	err = tx.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		goto End
+	}
+
+	if version >= len(migrations) {
+		goto End
+	}
+
+	for ; version < len(migrations); version++ {
+		if version == namespaceMigration {
+			notices, err = sqlReportNamespacedTags(tx)
+			if err != nil {
+				goto End
+			}
+		}
+		err = migrations[version](tx)
+		if err != nil {
+			err = fmt.Errorf("migration %d: %w", version+1, err)
+			goto End
+		}
+	}
+
+	// pragmas can't take parameters
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+
+End:
+	return notices, err
+}
+
+// sqlReportNamespacedTags describes what namespaceMigration does to the existing tags: names with a separator are
+// put under their namespace, and tags whose names then only differ in the whitespace around separators are merged
+func sqlReportNamespacedTags(tx *sql.Tx) ([]string, error) {
+	var sqlRows *sql.Rows
+	var notices []string
+	var keep map[string]string
+	var err error
+
+	sqlRows, err = tx.Query("SELECT name FROM tag ORDER BY id")
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	// as in sqlMigrateTagKeys, the oldest tag sharing a key is kept
+	keep = make(map[string]string)
+	for sqlRows.Next() {
+		var name string
+		err = sqlRows.Scan(&name)
+		if err != nil {
+			goto End
+		}
+
+		parent, ok := ParentTagName(name)
+		if !ok {
+			continue
+		}
+
+		key := TagKey(name)
+		if kept, ok := keep[key]; ok {
+			notices = append(notices, fmt.Sprintf("tag %q was merged into %q", name, kept))
+			continue
+		}
+		keep[key] = name
+		notices = append(notices, fmt.Sprintf("tag %q is now %q in the namespace %q", name, BaseTagName(name), parent))
+	}
+
+End:
+	return notices, err
+}
+
+// sqlMigrateTagKeys adds the key column to the tag table if needed and recomputes every key, merging tags whose
+// names turn out to share one. It has to run again whenever TagKey changes.
+func sqlMigrateTagKeys(tx *sql.Tx) error {
+	var sqlRows *sql.Rows
+	var hasKey bool
+	var tags []Tag
+	var keep map[string]int64
+	var err error
+
+	err = tx.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info('tag') WHERE name = 'key'").Scan(&hasKey)
+	if err != nil {
+		goto End
+	}
+
+	if !hasKey {
+		_, err = tx.Exec(`ALTER TABLE "tag" ADD COLUMN "key" TEXT NOT NULL DEFAULT ''`)
+		if err != nil {
+			goto End
+		}
+	}
+
+	// keys are unique again once the duplicates are merged
+	_, err = tx.Exec(`DROP INDEX IF EXISTS "tag_key"`)
+	if err != nil {
+		goto End
+	}
+
+	sqlRows, err = tx.Query("SELECT id, name FROM tag ORDER BY id")
+	if err != nil {
+		goto End
+	}
+
+	for sqlRows.Next() {
+		var tag Tag
+		err = sqlRows.Scan(&tag.ID, &tag.Name)
+		if err != nil {
+			sqlRows.Close()
+			goto End
+		}
+		tags = append(tags, tag)
+	}
+	sqlRows.Close()
+
+	// the oldest of the tags sharing a key keeps its name, and the others are merged into it
+	keep = make(map[string]int64)
+	for _, tag := range tags {
+		key := TagKey(tag.Name)
+		if id, ok := keep[key]; ok {
+			err = sqlMergeTags(tx, id, tag.ID)
+		} else {
+			keep[key] = tag.ID
+			_, err = tx.Exec("UPDATE tag SET key = $1 WHERE id = $2", key, tag.ID)
+		}
+		if err != nil {
+			goto End
+		}
+	}
+
+	_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS "tag_key" ON "tag" ("key")`)
+
+End:
+	return err
+}
+
+// sqlMergeTags moves the rows, refs and saved query of the tag fromID to the tag intoID, after intoID's own, and
+// deletes fromID
+func sqlMergeTags(tx *sql.Tx, intoID int64, fromID int64) error {
+	var offset float64
+	var err error
+
+	// place the moved rows after the existing ones, in their old order
+	err = tx.QueryRow(`SELECT COALESCE((SELECT MAX(rank) + 1 FROM row WHERE tag_id = $1), 0)
+					   - COALESCE((SELECT MIN(rank) FROM row WHERE tag_id = $2), 0)`, intoID, fromID).Scan(&offset)
+	if err != nil {
+		goto End
+	}
+
+	_, err = tx.Exec("UPDATE row SET tag_id = $1, rank = rank + $2 WHERE tag_id = $3", intoID, offset, fromID)
+	if err != nil {
+		goto End
+	}
+
+	_, err = tx.Exec("INSERT OR IGNORE INTO ref (tag_id, row_id) SELECT $1, row_id FROM ref WHERE tag_id = $2", intoID, fromID)
+	if err != nil {
+		goto End
+	}
+
+	// a tag that already has a query keeps it
+	_, err = tx.Exec("UPDATE OR IGNORE saved_query SET tag_id = $1 WHERE tag_id = $2", intoID, fromID)
+	if err != nil {
+		goto End
+	}
+
+	_, err = tx.Exec("UPDATE snarf SET tag_id = $1 WHERE tag_id = $2", intoID, fromID)
+	if err != nil {
+		goto End
+	}
+
+	_, err = tx.Exec("UPDATE trash_row SET tag_id = $1 WHERE tag_id = $2", intoID, fromID)
+	if err != nil {
+		goto End
+	}
+
+	_, err = tx.Exec(`UPDATE tag SET updated_ts = MAX(COALESCE(updated_ts, 0), COALESCE((SELECT updated_ts FROM tag WHERE id = $1), 0))
+					  WHERE id = $2`, fromID, intoID)
+	if err != nil {
+		goto End
+	}
+
+	// deleting the tag deletes its remaining refs and query
+	_, err = tx.Exec("DELETE FROM tag WHERE id = $1", fromID)
+
+End:
+	return err
+}
@@ -0,0 +1,223 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestMigrateTagKeys(t *testing.T) {
+	db := setupDB(t)
+
+	// turn the database back into one from before tag keys
+	_, err := db.conn.Exec(`DROP INDEX tag_key;
+							UPDATE tag SET key = '';
+							PRAGMA user_version = 0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]int64)
+	for _, name := range []string{"Todo", "notes", "todo", " TODO "} {
+		res, err := db.conn.Exec("INSERT INTO tag (name, updated_ts) VALUES ($1, $2)", name, len(ids))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[name], _ = res.LastInsertId()
+	}
+	for i, row := range []struct {
+		tag  string
+		text string
+		ref  string
+	}{
+		{"Todo", "first", ""},
+		{"todo", "second", ""},
+		{" TODO ", "third", ""},
+		{"notes", "see [[todo]]", "todo"},
+		{"notes", "see [[Todo]]", "Todo"},
+	} {
+		res, err := db.conn.Exec("INSERT INTO row (tag_id, rank, text, parent_row_id, updated_ts) VALUES ($1, $2, $3, 0, 0)", ids[row.tag], i%2, row.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rowID, _ := res.LastInsertId()
+		if row.ref != "" {
+			_, err = db.conn.Exec("INSERT INTO ref (tag_id, row_id) VALUES ($1, $2)", ids[row.ref], rowID)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = db.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := db.GetAllTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 {
+		t.Fatalf("expected the duplicates to be merged, got %v", tags)
+	}
+
+	tag, err := db.GetTagByName("todo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.ID != ids["Todo"] || tag.Name != "Todo" {
+		t.Fatalf("expected the oldest tag to be kept, got %v", tag)
+	}
+	if texts := rowTexts(t, db, tag.ID); texts != "first,second,third," {
+		t.Fatalf("unexpected rows after merging: %s", texts)
+	}
+
+	problems, err := db.CheckIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Fatalf("merged database has problems: %v", problems)
+	}
+
+	// the unique key is enforced again, and migrations don't run twice
+	_, err = db.conn.Exec("INSERT INTO tag (name, key) VALUES ('TODO', 'todo')")
+	if err == nil {
+		t.Fatal("expected a duplicate key to be rejected")
+	}
+	err = db.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateProperties(t *testing.T) {
+	db := setupDB(t)
+
+	tag, err := db.AddTag("books")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a row from before properties were parsed
+	_, err = db.conn.Exec("INSERT INTO row (tag_id, rank, text, parent_row_id, updated_ts) VALUES ($1, 0, 'rating:: 5', 0, 0)", tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.conn.Exec("PRAGMA user_version = 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.FindRowsByProperty("rating", PropertyGe, "4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("expected the existing row's property to be found, got %v", rows)
+	}
+}
+
+func TestMigrateRefcounts(t *testing.T) {
+	db := setupDB(t)
+
+	addLinkedRows(t, &db, "notes", "[[todo]] first", "[[todo]] second")
+
+	// refcounts from before the ref triggers
+	_, err := db.conn.Exec("UPDATE tag SET refcount = 0; PRAGMA user_version = 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := db.CheckIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) > 0 {
+		t.Fatalf("expected the refcounts to be recounted, got %v", problems)
+	}
+}
+
+func TestMigrateLockedRefs(t *testing.T) {
+	encryptionIterations = 1000
+	db := setupDB(t)
+
+	addLinkedRows(t, &db, "diary", "met [[alice]]")
+	tag, err := db.GetTagByName("diary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.LockTag(tag.ID, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a ref from before locked tags dropped them
+	_, err = db.conn.Exec(`INSERT INTO tag (name, key) VALUES ('alice', 'alice');
+						   INSERT INTO ref (tag_id, row_id) SELECT (SELECT id FROM tag WHERE name = 'alice'), id FROM row;
+						   PRAGMA user_version = 4`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := db.GetRefsToTagByTagName("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 0 {
+		t.Fatalf("expected the locked row's ref to be gone, got %v", refs)
+	}
+	problems, err := db.CheckIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || problems[0].Kind != ProblemEmptyTag {
+		t.Fatalf("expected only alice to be left empty, got %v", problems)
+	}
+}
+
+func TestMigrateNamespacesNotices(t *testing.T) {
+	db := setupDB(t)
+
+	// tags from before namespaces, with keys that kept the whitespace
+	_, err := db.conn.Exec(`DROP INDEX tag_key;
+							INSERT INTO tag (name, key) VALUES ('work/x', 'work/x'), ('work / x', 'work / x'), ('plain', 'plain');
+							PRAGMA user_version = 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notices := db.Notices()
+	expected := []string{`tag "work/x" is now "x" in the namespace "work"`, `tag "work / x" was merged into "work/x"`}
+	if len(notices) != len(expected) || notices[0] != expected[0] || notices[1] != expected[1] {
+		t.Fatalf("expected notices %q, got %q", expected, notices)
+	}
+
+	// they're only given once
+	err = db.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db.Notices()) != 0 {
+		t.Fatalf("expected no notices the second time, got %q", db.Notices())
+	}
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"database/sql"
+)
+
+// sqlTrashTagIfEmpty moves a tag into the trash if it has no rows or child tags, isn't referenced and isn't a query
+// or locked tag. Its parent is trashed too if that leaves it empty.
+func sqlTrashTagIfEmpty(tx *sql.Tx, tagID int64) error {
+	var tag, parent Tag
+	var empty, hasChildren bool
+	var err error
+
+	err = tx.QueryRow(`SELECT NOT EXISTS (SELECT 1 FROM row WHERE tag_id = $1)
+					   AND NOT EXISTS (SELECT 1 FROM ref WHERE tag_id = $1)
+					   AND NOT EXISTS (SELECT 1 FROM saved_query WHERE tag_id = $1)
+					   AND NOT EXISTS (SELECT 1 FROM tag_lock WHERE tag_id = $1)`, tagID).Scan(&empty)
+	if err != nil || !empty {
+		goto End
+	}
+
+	hasChildren, err = sqlHasChildTags(tx, tagID)
+	if err != nil || hasChildren {
+		goto End
+	}
+
+	tag, err = sqlGetTagByID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	err = sqlTrashTag(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	if name, ok := ParentTagName(tag.Name); ok {
+		parent, err = sqlGetTagByName(tx, name)
+		if err == sql.ErrNoRows {
+			err = nil
+			goto End
+		}
+		if err != nil {
+			goto End
+		}
+		err = sqlTrashTagIfEmpty(tx, parent.ID)
+	}
+
+End:
+	return err
+}
+
+// sqlMoveRowsToTag moves rows, in the given order, under a tag starting at position. A negative position appends
+// them.
+func sqlMoveRowsToTag(tx *sql.Tx, rowIDs []int64, tagID int64, position int) error {
+	var isQueryTag bool
+	var sourceTagIDs map[int64]bool
+	var ranks []float64
+	var rows []Row
+	var row Row
+	var err error
+
+	if len(rowIDs) == 0 {
+		return nil
+	}
+
+	isQueryTag, err = sqlIsQueryTag(tx, tagID)
+	if err != nil {
+		goto End
+	}
+	if isQueryTag {
+		err = ErrQueryTag
+		goto End
+	}
+
+	err = sqlCheckTagUnlocked(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	sourceTagIDs = make(map[int64]bool)
+	for _, rowID := range rowIDs {
+		row, err = sqlGetRowByID(tx, rowID)
+		if err != nil {
+			goto End
+		}
+		sourceTagIDs[row.TagID] = true
+		rows = append(rows, row)
+	}
+
+	ranks, err = sqlRanksAt(tx, tagID, position, len(rowIDs), rowIDs)
+	if err != nil {
+		goto End
+	}
+
+	// the text is sealed again for its new tag
+	for i, row := range rows {
+		_, err = tx.Exec("UPDATE row SET tag_id = $1, rank = $2, text = "+sealedText("$1", "$3")+" WHERE id = $4", tagID, ranks[i], row.Text, row.ID)
+		if err != nil {
+			goto End
+		}
+
+		// locked tags' rows have no refs or properties
+		err = sqlUpdateRefsForRowID(tx, row.ID)
+		if err != nil {
+			goto End
+		}
+	}
+
+	err = sqlUpdateTagTS(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	for sourceTagID := range sourceTagIDs {
+		if sourceTagID == tagID {
+			continue
+		}
+
+		err = sqlUpdateTagTS(tx, sourceTagID)
+		if err != nil {
+			goto End
+		}
+
+		err = sqlTrashTagIfEmpty(tx, sourceTagID)
+		if err != nil {
+			goto End
+		}
+	}
+
+End:
+	return err
+}
+
+// MoveRowsToTag moves rows, in the given order, under a tag starting at the given 0-indexed position, keeping their
+// IDs. A negative position appends them. Tags left empty by the move are cleaned up.
+func (e *ExoDB) MoveRowsToTag(rowIDs []int64, targetTagID int64, position int) error {
+	var tx *sql.Tx
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	err = sqlMoveRowsToTag(tx, rowIDs, targetTagID, position)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return err
+}
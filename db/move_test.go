@@ -0,0 +1,150 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+func rowTexts(t *testing.T, db ExoDB, tagID int64) string {
+	rows, err := db.GetRowsForTagID(tagID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	texts := ""
+	for _, row := range rows {
+		texts += row.Text + ","
+	}
+	return texts
+}
+
+func TestMoveRowsToTag(t *testing.T) {
+	var db ExoDB
+	var src, dst Tag
+	var rows []Row
+	var moved Row
+	var err error
+
+	db = setupDB(t)
+
+	src, err = db.AddTag("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err = db.AddTag("dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"one", "two"} {
+		var row Row
+		row, err = db.AddRow(src.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+
+	for _, text := range []string{"first", "last"} {
+		_, err = db.AddRow(dst.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.MoveRowsToTag([]int64{rows[1].ID, rows[0].ID}, dst.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if texts := rowTexts(t, db, dst.ID); texts != "first,two,one,last," {
+		t.Fatal("rows weren't moved to the given rank: " + texts)
+	}
+
+	moved, err = db.GetRowByID(rows[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if moved.TagID != dst.ID || moved.UpdatedTS != rows[0].UpdatedTS {
+		t.Fatal(fmt.Sprintf("moved row lost its identity: %+v", moved))
+	}
+
+	_, err = db.GetTagByID(src.ID)
+	if err == nil {
+		t.Fatal("emptied source tag wasn't cleaned up")
+	}
+
+	err = db.MoveRowsToTag([]int64{rows[0].ID}, dst.ID, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if texts := rowTexts(t, db, dst.ID); texts != "first,two,last,one," {
+		t.Fatal("row wasn't moved to the end: " + texts)
+	}
+}
+
+func TestPasteCutRows(t *testing.T) {
+	var db ExoDB
+	var src, dst Tag
+	var row Row
+	var pasted []Row
+	var err error
+
+	db = setupDB(t)
+
+	src, err = db.AddTag("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err = db.AddTag("dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AddRow(src.ID, "stays", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err = db.AddRow(src.ID, "moves [[elsewhere]]", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.PushSnarf(SnarfDefaultRegister, []Row{row})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.DeleteRowByID(row.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pasted, err = db.PasteSnarf(SnarfDefaultRegister, dst.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pasted) != 1 || pasted[0].ID != row.ID || pasted[0].TagID != dst.ID {
+		t.Fatal(fmt.Sprintf("cut row wasn't moved: %+v", pasted))
+	}
+
+	// the row is live again, so pasting again copies it
+	pasted, err = db.PasteSnarf(SnarfDefaultRegister, dst.ID, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pasted) != 1 || pasted[0].ID == row.ID {
+		t.Fatal(fmt.Sprintf("second paste didn't copy the row: %+v", pasted))
+	}
+
+	if texts := rowTexts(t, db, src.ID); texts != "stays," {
+		t.Fatal("unexpected source rows: " + texts)
+	}
+}
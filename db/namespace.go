@@ -0,0 +1,292 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// NamespaceSeparator separates the levels of a namespaced tag name. work/projectX/design is a child of
+// work/projectX, which is a child of work. Creating a namespaced tag creates its ancestors too.
+const NamespaceSeparator = "/"
+
+// namespaceSegments splits a tag name into its namespace levels, or returns nil if the name isn't namespaced. Names
+// with an empty level, like a/ or http://x, aren't.
+func namespaceSegments(name string) []string {
+	segments := strings.Split(name, NamespaceSeparator)
+	if len(segments) < 2 {
+		return nil
+	}
+	for _, segment := range segments {
+		if strings.TrimSpace(segment) == "" {
+			return nil
+		}
+	}
+	return segments
+}
+
+// ParentTagName returns the name of the parent of the tag called name, or false if the name isn't namespaced
+func ParentTagName(name string) (string, bool) {
+	segments := namespaceSegments(name)
+	if segments == nil {
+		return "", false
+	}
+	return strings.TrimSpace(strings.Join(segments[:len(segments)-1], NamespaceSeparator)), true
+}
+
+// BaseTagName returns the last level of a tag name: design for work/projectX/design
+func BaseTagName(name string) string {
+	segments := namespaceSegments(name)
+	if segments == nil {
+		return name
+	}
+	return strings.TrimSpace(segments[len(segments)-1])
+}
+
+// sqlAddParentTags makes sure the ancestors of the tag called name exist
+func sqlAddParentTags(tx *sql.Tx, name string) error {
+	parent, ok := ParentTagName(name)
+	if !ok {
+		return nil
+	}
+
+	// adding the parent adds its own parents
+	_, err := sqlAddTag(tx, parent)
+	return err
+}
+
+// sqlGetDescendantTags returns every tag below the tag with the given key, ordered by key
+func sqlGetDescendantTags(tx *sql.Tx, key string) ([]Tag, error) {
+	var sqlRows *sql.Rows
+	var tags []Tag
+	var err error
+
+	sqlRows, err = tx.Query(`SELECT id, name, key, updated_ts, `+tagKindColumn+` FROM tag
+							 WHERE key LIKE $1 ESCAPE '\'
+							 ORDER BY key`, escapeLike(key+NamespaceSeparator)+"%")
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	for sqlRows.Next() {
+		var tag Tag
+		var tagKey string
+		err = sqlRows.Scan(&tag.ID, &tag.Name, &tagKey, &tag.UpdatedTS, &tag.Kind)
+		if err != nil {
+			goto End
+		}
+		// names with empty levels share the prefix without being namespaced
+		if namespaceSegments(tagKey) != nil {
+			tags = append(tags, tag)
+		}
+	}
+
+End:
+	return tags, err
+}
+
+// sqlGetChildTags returns the tags one level below a tag
+func sqlGetChildTags(tx *sql.Tx, tagID int64) ([]Tag, error) {
+	var tag Tag
+	var descendants, children []Tag
+	var key string
+	var err error
+
+	tag, err = sqlGetTagByID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	key = TagKey(tag.Name)
+	descendants, err = sqlGetDescendantTags(tx, key)
+	if err != nil {
+		goto End
+	}
+
+	for _, descendant := range descendants {
+		if !strings.Contains(TagKey(descendant.Name)[len(key)+len(NamespaceSeparator):], NamespaceSeparator) {
+			children = append(children, descendant)
+		}
+	}
+
+End:
+	return children, err
+}
+
+// GetChildTags returns the tags one level below a tag, ordered by name
+func (e *ExoDB) GetChildTags(tagID int64) ([]Tag, error) {
+	var tx *sql.Tx
+	var tags []Tag
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	tags, err = sqlGetChildTags(tx, tagID)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return tags, err
+}
+
+func sqlGetTagAncestors(tx *sql.Tx, tagID int64) ([]Tag, error) {
+	var tag, ancestor Tag
+	var ancestors []Tag
+	var name string
+	var ok bool
+	var err error
+
+	tag, err = sqlGetTagByID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	for name, ok = ParentTagName(tag.Name); ok; name, ok = ParentTagName(name) {
+		ancestor, err = sqlGetTagByName(tx, name)
+		if err == sql.ErrNoRows {
+			// the ancestor was deleted
+			err = nil
+			continue
+		}
+		if err != nil {
+			goto End
+		}
+		ancestors = append([]Tag{ancestor}, ancestors...)
+	}
+
+End:
+	return ancestors, err
+}
+
+// GetTagAncestors returns the existing ancestors of a tag, outermost first
+func (e *ExoDB) GetTagAncestors(tagID int64) ([]Tag, error) {
+	var tx *sql.Tx
+	var tags []Tag
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	tags, err = sqlGetTagAncestors(tx, tagID)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return tags, err
+}
+
+// sqlHasChildTags reports whether any tag is namespaced below a tag
+func sqlHasChildTags(tx *sql.Tx, tagID int64) (bool, error) {
+	var tag Tag
+	var descendants []Tag
+	var err error
+
+	tag, err = sqlGetTagByID(tx, tagID)
+	if err != nil {
+		return false, err
+	}
+
+	descendants, err = sqlGetDescendantTags(tx, TagKey(tag.Name))
+
+	return len(descendants) > 0, err
+}
+
+// sqlGetRefsToTagAndDescendants returns the rows referencing a tag or any tag below it
+func sqlGetRefsToTagAndDescendants(tx *sql.Tx, tagID int64) (Refs, error) {
+	var tag Tag
+	var descendants []Tag
+	var args []interface{}
+	var refs Refs
+	var err error
+
+	tag, err = sqlGetTagByID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	descendants, err = sqlGetDescendantTags(tx, TagKey(tag.Name))
+	if err != nil {
+		goto End
+	}
+
+	args = []interface{}{tagID}
+	for _, descendant := range descendants {
+		args = append(args, descendant.ID)
+	}
+
+	refs, err = sqlGetRefs(tx, "r.id IN (SELECT row_id FROM ref WHERE tag_id IN (?"+strings.Repeat(", ?", len(args)-1)+"))", args...)
+
+End:
+	return refs, err
+}
+
+// GetRefsToTagAndDescendants returns the rows referencing a tag or any tag below it, so that a parent tag's page
+// rolls up the references to its children
+func (e *ExoDB) GetRefsToTagAndDescendants(tagID int64) (Refs, error) {
+	var tx *sql.Tx
+	var refs Refs
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	refs, err = sqlGetRefsToTagAndDescendants(tx, tagID)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return refs, err
+}
+
+// TagTreeNode is a tag placed in a namespace tree by TagTree
+type TagTreeNode struct {
+	Tag Tag
+	// Depth is the number of the tag's ancestors in the tree
+	Depth int
+	// Label is the tag's base name, or its full name at the top of the tree
+	Label string
+	// HasChildren is set when the nodes following this one are its children
+	HasChildren bool
+}
+
+// TagTree orders tags depth-first by namespace, so that every tag is followed by its children. Tags keep their
+// relative order within a level. Tags whose parent isn't among tags are placed at the top.
+func TagTree(tags []Tag) []TagTreeNode {
+	var nodes []TagTreeNode
+	var walk func(parentKey string, depth int)
+
+	children := make(map[string][]Tag)
+	inTree := make(map[string]bool)
+	for _, tag := range tags {
+		inTree[TagKey(tag.Name)] = true
+	}
+	for _, tag := range tags {
+		parentKey := ""
+		if parent, ok := ParentTagName(tag.Name); ok && inTree[TagKey(parent)] {
+			parentKey = TagKey(parent)
+		}
+		children[parentKey] = append(children[parentKey], tag)
+	}
+
+	walk = func(parentKey string, depth int) {
+		for _, tag := range children[parentKey] {
+			key := TagKey(tag.Name)
+			label := tag.Name
+			if depth > 0 {
+				label = BaseTagName(tag.Name)
+			}
+			nodes = append(nodes, TagTreeNode{tag, depth, label, len(children[key]) > 0})
+			walk(key, depth+1)
+		}
+	}
+	walk("", 0)
+
+	return nodes
+}
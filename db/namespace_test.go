@@ -0,0 +1,177 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParentTagName(t *testing.T) {
+	tests := []struct {
+		name   string
+		parent string
+		ok     bool
+	}{
+		{"work", "", false},
+		{"work/projectX", "work", true},
+		{"work / projectX / design", "work / projectX", true},
+		{"a/", "", false},
+		{"http://x", "", false},
+	}
+
+	for _, test := range tests {
+		parent, ok := ParentTagName(test.name)
+		if parent != test.parent || ok != test.ok {
+			t.Errorf("ParentTagName(%q) = %q, %v; expected %q, %v", test.name, parent, ok, test.parent, test.ok)
+		}
+	}
+
+	if TagKey("Work / ProjectX") != TagKey("work/projectx") {
+		t.Error("expected whitespace around separators to be ignored")
+	}
+}
+
+func tagNames(tags []Tag) string {
+	names := ""
+	for _, tag := range tags {
+		names += tag.Name + ","
+	}
+	return names
+}
+
+func TestNamespaces(t *testing.T) {
+	db := setupDB(t)
+
+	notes, err := db.AddTag("notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddRow(notes.ID, "see [[work/projectX/design]]", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddRow(notes.ID, "and [[work/projectX/build]]", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ancestors are created along with their children
+	work, err := db.GetTagByName("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	projectX, err := db.GetTagByName("work/projectX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	design, err := db.GetTagByName("work/projectX/design")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ancestors, err := db.GetTagAncestors(design.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := tagNames(ancestors); names != "work,work/projectX," {
+		t.Fatalf("unexpected ancestors: %s", names)
+	}
+
+	children, err := db.GetChildTags(projectX.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := tagNames(children); names != "work/projectX/build,work/projectX/design," {
+		t.Fatalf("unexpected children: %s", names)
+	}
+	children, err = db.GetChildTags(work.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := tagNames(children); names != "work/projectX," {
+		t.Fatalf("unexpected children: %s", names)
+	}
+
+	// the parent rolls up the references to its children
+	s := State{DB: &db, CurrentDBTag: work}
+	err = s.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.CurrentDBRefs) != 1 || len(s.CurrentDBRefs[s.SortedRefTagsKeys[0]]) != 2 {
+		t.Fatalf("expected both rows to be rolled up, got %v", s.CurrentDBRefs)
+	}
+
+	// renaming the namespace renames the tags below it
+	_, err = db.RenameTag("work/projectX", "job/projectY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if texts := rowTexts(t, db, notes.ID); texts != "see [[job/projectY/design]],and [[job/projectY/build]]," {
+		t.Fatalf("unexpected texts after rename: %s", texts)
+	}
+	_, err = db.GetTagByName("job")
+	if err != nil {
+		t.Fatal("the new parent wasn't created: ", err)
+	}
+	_, err = db.GetTagByName("work/projectX/design")
+	if err == nil {
+		t.Fatal("the old child tag still exists")
+	}
+
+	problems, err := db.CheckIntegrity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// work lost its only child
+	if len(problems) != 1 || problems[0].Kind != ProblemEmptyTag || problems[0].TagID != work.ID {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+}
+
+func TestNamespaceCleanup(t *testing.T) {
+	db := setupDB(t)
+
+	notes, err := db.AddTag("notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, err := db.AddRow(notes.ID, "[[a/b/c]]", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.UpdateRowText(row.ID, "nothing")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := State{DB: &db, CurrentDBTag: notes}
+	c, err := db.GetTagByName("a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DeleteTagIfEmpty(c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := db.GetAllTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := tagNames(tags); names != "notes," {
+		t.Fatalf("expected the emptied namespace to be deleted, got %s", names)
+	}
+}
+
+func TestTagTree(t *testing.T) {
+	tags := []Tag{{Name: "b/x"}, {Name: "a"}, {Name: "b"}, {Name: "a/y/z"}, {Name: "b/w"}}
+
+	var got string
+	for _, node := range TagTree(tags) {
+		got += fmt.Sprintf("%d:%s:%v,", node.Depth, node.Label, node.HasChildren)
+	}
+	if expected := "0:a:false,0:b:true,1:x:false,1:w:false,0:a/y/z:false,"; got != expected {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
@@ -0,0 +1,368 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PropertyKind describes how a property value is interpreted when comparing it
+type PropertyKind int
+
+const (
+	PropertyText PropertyKind = iota
+	PropertyNumber
+	PropertyDate
+)
+
+// PropertyOp is a comparison operator for FindRowsByProperty
+type PropertyOp string
+
+const (
+	PropertyEq       PropertyOp = "="
+	PropertyNe       PropertyOp = "!="
+	PropertyLt       PropertyOp = "<"
+	PropertyLe       PropertyOp = "<="
+	PropertyGt       PropertyOp = ">"
+	PropertyGe       PropertyOp = ">="
+	PropertyContains PropertyOp = "~"
+)
+
+// Property is a "key:: value" line found in a row's text. Keys are case-insensitive and stored lowercased.
+type Property struct {
+	RowID int64
+	Key   string
+	Value string
+	Kind  PropertyKind
+	// Number holds the numeric value of number properties, and the unix time of date properties
+	Number float64
+}
+
+var propertyRe = regexp.MustCompile(`^\s*([\w-]+)::\s*(.*?)\s*$`)
+
+// property dates are either ISO dates or references to a date tag
+const propertyDateFormat = "2006-01-02"
+
+var dateTagRe = regexp.MustCompile(`^\[\[(.*)\]\]$`)
+
+func newProperty(key string, value string) Property {
+	var p Property
+
+	p.Key = strings.ToLower(key)
+	p.Value = value
+	p.Kind, p.Number = classifyPropertyValue(value)
+
+	return p
+}
+
+func classifyPropertyValue(value string) (PropertyKind, float64) {
+	if n, err := strconv.ParseFloat(value, 64); err == nil {
+		return PropertyNumber, n
+	}
+
+	if t, err := time.Parse(propertyDateFormat, value); err == nil {
+		return PropertyDate, float64(t.Unix())
+	}
+
+	if m := dateTagRe.FindStringSubmatch(value); m != nil {
+		if t, err := time.Parse(DateTagFormat, m[1]); err == nil {
+			return PropertyDate, float64(t.Unix())
+		}
+	}
+
+	return PropertyText, 0
+}
+
+// ParseProperty reports whether a single line of row text is a property line, and returns the property if so
+func ParseProperty(line string) (Property, bool) {
+	var m []string
+
+	m = propertyRe.FindStringSubmatch(line)
+	if m == nil || m[2] == "" {
+		return Property{}, false
+	}
+
+	return newProperty(m[1], m[2]), true
+}
+
+// ParseProperties returns every property line in text
+func ParseProperties(text string) []Property {
+	var properties []Property
+
+	for _, line := range strings.Split(text, "\n") {
+		if p, ok := ParseProperty(line); ok {
+			properties = append(properties, p)
+		}
+	}
+
+	return properties
+}
+
+func sqlClearPropertiesForRow(tx *sql.Tx, rowID int64) error {
+	var err error
+
+	_, err = tx.Exec("DELETE FROM property WHERE row_id = $1", rowID)
+
+	return err
+}
+
+func sqlAddProperty(tx *sql.Tx, rowID int64, p Property) error {
+	var statement *sql.Stmt
+	var number interface{}
+	var err error
+
+	statement, err = tx.Prepare("INSERT INTO property (row_id, key, value, num) VALUES ($1, $2, $3, $4)")
+	if err != nil {
+		goto End
+	}
+
+	if p.Kind != PropertyText {
+		number = p.Number
+	}
+
+	_, err = statement.Exec(rowID, p.Key, p.Value, number)
+	if err != nil {
+		goto End
+	}
+
+End:
+	return err
+}
+
+func sqlUpdatePropertiesForRow(tx *sql.Tx, row Row) error {
+	var locked bool
+	var err error
+
+	err = sqlClearPropertiesForRow(tx, row.ID)
+	if err != nil {
+		goto End
+	}
+
+	// properties would give the rows of locked tags away
+	locked, err = sqlIsTagLocked(tx, row.TagID)
+	if err != nil || locked {
+		goto End
+	}
+
+	for _, p := range ParseProperties(row.Text) {
+		err = sqlAddProperty(tx, row.ID, p)
+		if err != nil {
+			goto End
+		}
+	}
+
+End:
+	return err
+}
+
+// sqlMigrateProperties parses the properties of every row
+func sqlMigrateProperties(tx *sql.Tx) error {
+	var sqlRows *sql.Rows
+	var rows []Row
+	var err error
+
+	sqlRows, err = tx.Query("SELECT id, tag_id, text FROM row")
+	if err != nil {
+		goto End
+	}
+
+	for sqlRows.Next() {
+		var row Row
+		err = sqlRows.Scan(&row.ID, &row.TagID, &row.Text)
+		if err != nil {
+			sqlRows.Close()
+			goto End
+		}
+		rows = append(rows, row)
+	}
+	sqlRows.Close()
+
+	for _, row := range rows {
+		err = sqlUpdatePropertiesForRow(tx, row)
+		if err != nil {
+			goto End
+		}
+	}
+
+End:
+	return err
+}
+
+func scanProperties(sqlRows *sql.Rows) ([]Property, error) {
+	var properties []Property
+	var err error
+
+	for sqlRows.Next() {
+		var p Property
+		err = sqlRows.Scan(&p.RowID, &p.Key, &p.Value)
+		if err != nil {
+			break
+		}
+		p.Kind, p.Number = classifyPropertyValue(p.Value)
+		properties = append(properties, p)
+	}
+
+	return properties, err
+}
+
+func sqlGetPropertiesForRow(tx *sql.Tx, rowID int64) ([]Property, error) {
+	var properties []Property
+	var sqlRows *sql.Rows
+	var err error
+
+	sqlRows, err = tx.Query("SELECT row_id, key, value FROM property WHERE row_id = $1 ORDER BY rowid", rowID)
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	properties, err = scanProperties(sqlRows)
+
+End:
+	return properties, err
+}
+
+func sqlGetPropertiesForTag(tx *sql.Tx, tagID int64) ([]Property, error) {
+	var properties []Property
+	var sqlRows *sql.Rows
+	var err error
+
+	sqlRows, err = tx.Query(`SELECT p.row_id, p.key, p.value
+							 FROM property AS p, row AS r
+							 WHERE r.id = p.row_id
+							 AND r.tag_id = $1
+							 ORDER BY r.rank, r.id, p.rowid`, tagID)
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	properties, err = scanProperties(sqlRows)
+
+End:
+	return properties, err
+}
+
+// propertyCondition returns an SQL condition (and its arguments) comparing the property aliased as p
+// against value. Numbers and dates compare numerically, everything else compares as case-insensitive text.
+func propertyCondition(op PropertyOp, value string) (string, []interface{}, error) {
+	var kind PropertyKind
+	var number float64
+
+	kind, number = classifyPropertyValue(value)
+
+	switch op {
+	case PropertyEq, PropertyNe, PropertyLt, PropertyLe, PropertyGt, PropertyGe:
+		sqlOp := string(op)
+		if op == PropertyNe {
+			sqlOp = "<>"
+		}
+		if kind != PropertyText {
+			return fmt.Sprintf("p.num %s ?", sqlOp), []interface{}{number}, nil
+		}
+		return fmt.Sprintf("p.value %s ? COLLATE NOCASE", sqlOp), []interface{}{value}, nil
+	case PropertyContains:
+		return `p.value LIKE ? ESCAPE '\'`, []interface{}{"%" + escapeLike(value) + "%"}, nil
+	}
+
+	return "", nil, fmt.Errorf("unknown property operator: %s", op)
+}
+
+// escapeLike escapes the LIKE wildcards in s, for use with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func sqlFindRowsByProperty(tx *sql.Tx, key string, op PropertyOp, value string) ([]Row, error) {
+	var rows []Row
+	var condition string
+	var args []interface{}
+	var sqlRows *sql.Rows
+	var err error
+
+	condition, args, err = propertyCondition(op, value)
+	if err != nil {
+		goto End
+	}
+
+	sqlRows, err = tx.Query(`SELECT r.id, r.tag_id, r.rank, `+openedText("r")+`, r.parent_row_id, r.updated_ts
+							 FROM row AS r
+							 WHERE `+visibleRow("r")+`
+							 AND EXISTS (SELECT 1 FROM property AS p WHERE p.row_id = r.id AND p.key = ? AND `+condition+`)
+							 ORDER BY r.updated_ts DESC`, append([]interface{}{strings.ToLower(key)}, args...)...)
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	for sqlRows.Next() {
+		var row Row
+		err = sqlRows.Scan(&row.ID, &row.TagID, &row.Rank, &row.Text, &row.ParentRowID, &row.UpdatedTS)
+		if err != nil {
+			goto End
+		}
+		rows = append(rows, row)
+	}
+
+End:
+	return rows, err
+}
+
+func (e *ExoDB) GetPropertiesForRow(rowID int64) ([]Property, error) {
+	var tx *sql.Tx
+	var properties []Property
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	properties, err = sqlGetPropertiesForRow(tx, rowID)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return properties, err
+}
+
+// GetPropertiesForTag returns the properties of every row under the given tag, in row order
+func (e *ExoDB) GetPropertiesForTag(tagID int64) ([]Property, error) {
+	var tx *sql.Tx
+	var properties []Property
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	properties, err = sqlGetPropertiesForTag(tx, tagID)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return properties, err
+}
+
+// FindRowsByProperty returns all rows with a property key matching value under op, most recently updated first
+func (e *ExoDB) FindRowsByProperty(key string, op PropertyOp, value string) ([]Row, error) {
+	var tx *sql.Tx
+	var rows []Row
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	rows, err = sqlFindRowsByProperty(tx, key, op, value)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return rows, err
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseProperties(t *testing.T) {
+	properties := ParseProperties("some notes\nOwner:: alice\nestimate::  3.5 \nnot:a property\ndue:: [[March 02 2021]]\nempty::")
+
+	if len(properties) != 3 {
+		t.Fatal(fmt.Sprintf("expected 3 properties, got %d", len(properties)))
+	}
+
+	if properties[0].Key != "owner" || properties[0].Value != "alice" || properties[0].Kind != PropertyText {
+		t.Error(fmt.Sprintf("unexpected first property: %+v", properties[0]))
+	}
+
+	if properties[1].Key != "estimate" || properties[1].Kind != PropertyNumber || properties[1].Number != 3.5 {
+		t.Error(fmt.Sprintf("unexpected second property: %+v", properties[1]))
+	}
+
+	if properties[2].Key != "due" || properties[2].Kind != PropertyDate {
+		t.Error(fmt.Sprintf("unexpected third property: %+v", properties[2]))
+	}
+}
+
+func TestPropertiesFollowRowText(t *testing.T) {
+	var db ExoDB
+	var tag Tag
+	var row Row
+	var properties []Property
+	var err error
+
+	db = setupDB(t)
+
+	tag, err = db.AddTag("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err = db.AddRow(tag.ID, "status:: blocked", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AddRow(tag.ID, "owner:: alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	properties, err = db.GetPropertiesForRow(row.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(properties) != 1 || properties[0].Value != "blocked" {
+		t.Fatal(fmt.Sprintf("unexpected row properties: %+v", properties))
+	}
+
+	err = db.UpdateRowText(row.ID, "status:: done")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	properties, err = db.GetPropertiesForTag(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(properties) != 2 || properties[0].Value != "done" || properties[1].Key != "owner" {
+		t.Fatal(fmt.Sprintf("unexpected tag properties: %+v", properties))
+	}
+}
+
+func TestFindRowsByProperty(t *testing.T) {
+	var db ExoDB
+	var tag Tag
+	var rows []Row
+	var err error
+
+	db = setupDB(t)
+
+	tag, err = db.AddTag("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"estimate:: 2", "estimate:: 10", "estimate:: lots", "owner:: Alice"} {
+		_, err = db.AddRow(tag.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		key      string
+		op       PropertyOp
+		value    string
+		expected int
+	}{
+		{"estimate", PropertyGt, "3", 1},
+		{"estimate", PropertyLe, "10", 2},
+		{"estimate", PropertyEq, "lots", 1},
+		{"owner", PropertyEq, "alice", 1},
+		{"OWNER", PropertyContains, "lic", 1},
+		{"owner", PropertyNe, "alice", 0},
+	}
+
+	for _, test := range tests {
+		rows, err = db.FindRowsByProperty(test.key, test.op, test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != test.expected {
+			t.Error(fmt.Sprintf("%s %s %s: expected %d rows, got %d", test.key, test.op, test.value, test.expected, len(rows)))
+		}
+	}
+
+	_, err = db.FindRowsByProperty("estimate", PropertyOp("=~"), "2")
+	if err == nil {
+		t.Error("expected an error for an unknown operator")
+	}
+}
@@ -0,0 +1,588 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A query selects rows across all tags. Terms are combined with "and" (implied between adjacent terms),
+// "or" and "not" (or a leading "-"), and may be grouped with parentheses, so -(a or b) leaves out both. Terms are:
+//
+//	[[name]]                  rows referencing the tag; the name is written the way it is in row text
+//	in:[[name]] / in:name     rows under the tag
+//	updated:7d                rows updated in the last 7 days (h, d and w units are understood)
+//	updated:today, updated:yesterday
+//	updated:2021-03-01        rows updated on that day; <, <=, > and >= prefixes are understood
+//	updated:2021-03-01..2021-03-31
+//	key::value                rows with a matching property; the value may be prefixed by a comparison
+//	                          operator (key::>3) or ~ for a substring match
+//	word / "some phrase"      rows containing the text
+//
+// For example: [[projectX]] [[todo]] -[[done]] updated:7d
+type Query struct {
+	Source string
+	root   queryNode
+}
+
+// QueryError describes a syntax error in a query
+type QueryError struct {
+	Offset int
+	Msg    string
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query error at offset %d: %s", e.Offset, e.Msg)
+}
+
+type queryNode interface {
+	// where returns an SQL condition over the row aliased as r
+	where(args []interface{}) (string, []interface{})
+}
+
+type queryAnd struct {
+	left, right queryNode
+}
+
+type queryOr struct {
+	left, right queryNode
+}
+
+type queryNot struct {
+	node queryNode
+}
+
+type queryTagRef struct {
+	name string
+}
+
+type queryInTag struct {
+	name string
+}
+
+type queryText struct {
+	text string
+}
+
+// queryUpdated matches rows updated in [from, to); a zero bound is open
+type queryUpdated struct {
+	from, to int64
+}
+
+type queryProperty struct {
+	key   string
+	op    PropertyOp
+	value string
+}
+
+func (n queryAnd) where(args []interface{}) (string, []interface{}) {
+	var left, right string
+
+	left, args = n.left.where(args)
+	right, args = n.right.where(args)
+
+	return "(" + left + " AND " + right + ")", args
+}
+
+func (n queryOr) where(args []interface{}) (string, []interface{}) {
+	var left, right string
+
+	left, args = n.left.where(args)
+	right, args = n.right.where(args)
+
+	return "(" + left + " OR " + right + ")", args
+}
+
+func (n queryNot) where(args []interface{}) (string, []interface{}) {
+	var inner string
+
+	inner, args = n.node.where(args)
+
+	return "NOT " + inner, args
+}
+
+func (n queryTagRef) where(args []interface{}) (string, []interface{}) {
+	return "EXISTS (SELECT 1 FROM ref, tag WHERE ref.row_id = r.id AND ref.tag_id = tag.id AND tag.key = ?)", append(args, TagKey(n.name))
+}
+
+func (n queryInTag) where(args []interface{}) (string, []interface{}) {
+	return "r.tag_id IN (SELECT id FROM tag WHERE key = ?)", append(args, TagKey(n.name))
+}
+
+func (n queryText) where(args []interface{}) (string, []interface{}) {
+	return openedText("r") + ` LIKE ? ESCAPE '\'`, append(args, "%"+escapeLike(n.text)+"%")
+}
+
+func (n queryUpdated) where(args []interface{}) (string, []interface{}) {
+	var conditions []string
+
+	if n.from != 0 {
+		conditions = append(conditions, "r.updated_ts >= ?")
+		args = append(args, n.from)
+	}
+	if n.to != 0 {
+		conditions = append(conditions, "r.updated_ts < ?")
+		args = append(args, n.to)
+	}
+	if len(conditions) == 0 {
+		return "1", args
+	}
+
+	return "(" + strings.Join(conditions, " AND ") + ")", args
+}
+
+func (n queryProperty) where(args []interface{}) (string, []interface{}) {
+	// the operator was validated while parsing
+	condition, conditionArgs, _ := propertyCondition(n.op, n.value)
+
+	args = append(args, n.key)
+
+	return "EXISTS (SELECT 1 FROM property AS p WHERE p.row_id = r.id AND p.key = ? AND " + condition + ")", append(args, conditionArgs...)
+}
+
+type queryTokenKind int
+
+const (
+	queryTokenEOF queryTokenKind = iota
+	queryTokenLParen
+	queryTokenRParen
+	queryTokenTagRef
+	queryTokenString
+	queryTokenWord
+)
+
+type queryToken struct {
+	kind   queryTokenKind
+	text   string
+	offset int
+}
+
+// lexRef parses the tag link starting with the [[ at i the way row text is parsed, so escaped and nested brackets
+// mean the same in both. It returns the linked name and the offset just past the link.
+func lexRef(s string, i int) (string, int, error) {
+	name, end, ok := parseRef(s, i)
+	if !ok {
+		if !strings.Contains(s[i+2:], "]]") {
+			return "", 0, &QueryError{i, "unterminated [["}
+		}
+		return "", 0, &QueryError{i, "invalid tag link"}
+	}
+
+	return name, end, nil
+}
+
+// lexQuery splits a query into tokens. Inside a word, "quoted" and [[bracketed]] sections may contain spaces.
+func lexQuery(s string) ([]queryToken, error) {
+	var tokens []queryToken
+
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case c == '(':
+			tokens = append(tokens, queryToken{queryTokenLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, queryToken{queryTokenRParen, ")", i})
+			i++
+		case strings.HasPrefix(s[i:], "[["):
+			name, end, err := lexRef(s, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, queryToken{queryTokenTagRef, name, i})
+			i = end
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, &QueryError{i, "unterminated quote"}
+			}
+			tokens = append(tokens, queryToken{queryTokenString, s[i+1 : i+1+end], i})
+			i += end + 2
+		default:
+			var word strings.Builder
+			start := i
+			for i < len(s) && s[i] != '(' && s[i] != ')' {
+				r, size := utf8.DecodeRuneInString(s[i:])
+				if unicode.IsSpace(r) {
+					break
+				}
+				switch {
+				case s[i] == '"':
+					end := strings.IndexByte(s[i+1:], '"')
+					if end < 0 {
+						return nil, &QueryError{i, "unterminated quote"}
+					}
+					word.WriteString(s[i+1 : i+1+end])
+					i += end + 2
+				case strings.HasPrefix(s[i:], "[["):
+					// kept as written, to be parsed again with the rest of the word
+					_, end, err := lexRef(s, i)
+					if err != nil {
+						return nil, err
+					}
+					word.WriteString(s[i:end])
+					i = end
+				default:
+					word.WriteString(s[i : i+size])
+					i += size
+				}
+			}
+			tokens = append(tokens, queryToken{queryTokenWord, word.String(), start})
+		}
+	}
+
+	return append(tokens, queryToken{queryTokenEOF, "", len(s)}), nil
+}
+
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+	now    time.Time
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() queryToken {
+	t := p.tokens[p.pos]
+	if t.kind != queryTokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func isQueryKeyword(t queryToken, keyword string) bool {
+	return t.kind == queryTokenWord && strings.EqualFold(t.text, keyword)
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for isQueryKeyword(p.peek(), "or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = queryOr{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind == queryTokenEOF || t.kind == queryTokenRParen || isQueryKeyword(t, "or") {
+			return left, nil
+		}
+		if isQueryKeyword(t, "and") {
+			p.next()
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = queryAnd{left, right}
+	}
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	t := p.peek()
+
+	if isQueryKeyword(t, "not") {
+		p.next()
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return queryNot{node}, nil
+	}
+
+	// "-(" negates the group
+	if t.kind == queryTokenWord && t.text == "-" {
+		if next := p.tokens[p.pos+1]; next.kind == queryTokenLParen && next.offset == t.offset+1 {
+			p.next()
+			node, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return queryNot{node}, nil
+		}
+	}
+
+	// "-term" negates the term
+	if t.kind == queryTokenWord && strings.HasPrefix(t.text, "-") && len(t.text) > 1 {
+		p.tokens[p.pos].text = t.text[1:]
+		p.tokens[p.pos].offset++
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return queryNot{node}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	t := p.next()
+
+	switch t.kind {
+	case queryTokenLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != queryTokenRParen {
+			return nil, &QueryError{p.peek().offset, "expected )"}
+		}
+		p.next()
+		return node, nil
+	case queryTokenTagRef:
+		return parseTagRefTerm(t)
+	case queryTokenString:
+		return queryText{t.text}, nil
+	case queryTokenWord:
+		return p.parseWord(t)
+	case queryTokenRParen:
+		return nil, &QueryError{t.offset, "unexpected )"}
+	}
+
+	return nil, &QueryError{t.offset, "unexpected end of query"}
+}
+
+func parseTagRefTerm(t queryToken) (queryNode, error) {
+	name := strings.TrimSpace(t.text)
+	if name == "" {
+		return nil, &QueryError{t.offset, "empty tag name"}
+	}
+
+	return queryTagRef{name}, nil
+}
+
+func (p *queryParser) parseWord(t queryToken) (queryNode, error) {
+	if sep := strings.Index(t.text, "::"); sep > 0 {
+		return parsePropertyTerm(t, t.text[:sep], t.text[sep+2:])
+	}
+
+	// a negated tag ref is lexed as a word
+	if name, end, ok := parseRef(t.text, 0); strings.HasPrefix(t.text, "[[") && ok && end == len(t.text) {
+		return parseTagRefTerm(queryToken{queryTokenTagRef, name, t.offset})
+	}
+
+	lower := strings.ToLower(t.text)
+	switch {
+	case strings.HasPrefix(lower, "in:"):
+		name := t.text[len("in:"):]
+		if ref, end, ok := parseRef(name, 0); strings.HasPrefix(name, "[[") && ok && end == len(name) {
+			name = ref
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, &QueryError{t.offset, "in: requires a tag name"}
+		}
+		return queryInTag{name}, nil
+	case strings.HasPrefix(lower, "updated:"):
+		return parseUpdatedTerm(t, lower[len("updated:"):], p.now)
+	}
+
+	return queryText{t.text}, nil
+}
+
+func parsePropertyTerm(t queryToken, key string, value string) (queryNode, error) {
+	op := PropertyEq
+
+	// longest operators first
+	for _, candidate := range []PropertyOp{PropertyNe, PropertyLe, PropertyGe, PropertyLt, PropertyGt, PropertyEq, PropertyContains} {
+		if strings.HasPrefix(value, string(candidate)) {
+			op = candidate
+			value = value[len(candidate):]
+			break
+		}
+	}
+
+	if value == "" {
+		return nil, &QueryError{t.offset, fmt.Sprintf("property %s requires a value", key)}
+	}
+
+	return queryProperty{strings.ToLower(key), op, value}, nil
+}
+
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+func parseQueryDate(t queryToken, s string, now time.Time) (time.Time, error) {
+	d, err := time.ParseInLocation(propertyDateFormat, s, now.Location())
+	if err != nil {
+		return d, &QueryError{t.offset, fmt.Sprintf("invalid date: %s", s)}
+	}
+	return d, nil
+}
+
+func parseUpdatedTerm(t queryToken, spec string, now time.Time) (queryNode, error) {
+	var from, to time.Time
+	var err error
+
+	today := startOfDay(now)
+
+	switch {
+	case spec == "today":
+		from = today
+	case spec == "yesterday":
+		from, to = today.AddDate(0, 0, -1), today
+	case strings.Contains(spec, ".."):
+		bounds := strings.SplitN(spec, "..", 2)
+		if bounds[0] != "" {
+			from, err = parseQueryDate(t, bounds[0], now)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if bounds[1] != "" {
+			to, err = parseQueryDate(t, bounds[1], now)
+			if err != nil {
+				return nil, err
+			}
+			to = to.AddDate(0, 0, 1)
+		}
+	case strings.HasPrefix(spec, ">") || strings.HasPrefix(spec, "<"):
+		op := spec[:1]
+		if strings.HasPrefix(spec[1:], "=") {
+			op = spec[:2]
+		}
+		var d time.Time
+		d, err = parseQueryDate(t, spec[len(op):], now)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case ">":
+			from = d.AddDate(0, 0, 1)
+		case ">=":
+			from = d
+		case "<":
+			to = d
+		case "<=":
+			to = d.AddDate(0, 0, 1)
+		}
+	case len(spec) > 1 && strings.ContainsRune("hdw", rune(spec[len(spec)-1])):
+		var n int
+		n, err = strconv.Atoi(spec[:len(spec)-1])
+		if err != nil || n < 0 {
+			return nil, &QueryError{t.offset, fmt.Sprintf("invalid duration: %s", spec)}
+		}
+		switch spec[len(spec)-1] {
+		case 'h':
+			from = now.Add(-time.Duration(n) * time.Hour)
+		case 'd':
+			from = now.AddDate(0, 0, -n)
+		case 'w':
+			from = now.AddDate(0, 0, -7*n)
+		}
+	default:
+		from, err = parseQueryDate(t, spec, now)
+		if err != nil {
+			return nil, err
+		}
+		to = from.AddDate(0, 0, 1)
+	}
+
+	var node queryUpdated
+	if !from.IsZero() {
+		node.from = from.UnixNano()
+	}
+	if !to.IsZero() {
+		node.to = to.UnixNano()
+	}
+
+	return node, nil
+}
+
+func parseQuery(s string, now time.Time) (*Query, error) {
+	var parser queryParser
+	var root queryNode
+	var err error
+
+	parser.now = now
+
+	parser.tokens, err = lexQuery(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.peek().kind == queryTokenEOF {
+		return nil, &QueryError{0, "empty query"}
+	}
+
+	root, err = parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if parser.peek().kind != queryTokenEOF {
+		return nil, &QueryError{parser.peek().offset, fmt.Sprintf("unexpected %q", parser.peek().text)}
+	}
+
+	return &Query{Source: s, root: root}, nil
+}
+
+// ParseQuery parses a query; relative dates are resolved against the current time
+func ParseQuery(s string) (*Query, error) {
+	return parseQuery(s, time.Now())
+}
+
+// where returns the SQL condition selecting the query's rows from the row table aliased as r
+func (q *Query) where() (string, []interface{}) {
+	return q.root.where(nil)
+}
+
+func sqlRunQuery(tx *sql.Tx, q *Query) (Refs, error) {
+	condition, args := q.where()
+
+	return sqlGetRefs(tx, condition, args...)
+}
+
+// RunQuery returns the rows matching query, keyed by the tag each row is under
+func (e *ExoDB) RunQuery(query string) (Refs, error) {
+	var tx *sql.Tx
+	var q *Query
+	var refs Refs
+	var err error
+
+	q, err = ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	refs, err = sqlRunQuery(tx, q)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return refs, err
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, q := range []string{"", "(", "[[todo", "a )", "\"open", "[[]]", "updated:sometime", "in:", "status::", "not"} {
+		_, err := ParseQuery(q)
+		if err == nil {
+			t.Error(fmt.Sprintf("expected an error parsing %q", q))
+		}
+	}
+}
+
+func TestParseQueryLinks(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected queryNode
+	}{
+		{`[[a [b]]]`, queryTagRef{"a [b]"}},
+		{`[[a\]]]`, queryTagRef{"a]"}},
+		{`-[[a\]]]`, queryNot{queryTagRef{"a]"}}},
+		{`in:[[x\]y]]`, queryInTag{"x]y"}},
+		{`-(a)`, queryNot{queryText{"a"}}},
+	}
+
+	for _, test := range tests {
+		q, err := ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(test.query + ": " + err.Error())
+		}
+		if q.root != test.expected {
+			t.Error(fmt.Sprintf("%s: expected %#v, got %#v", test.query, test.expected, q.root))
+		}
+	}
+}
+
+func TestLexQueryUnicode(t *testing.T) {
+	tokens, err := lexQuery("voilà Åsa\u00a0(x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var words []string
+	for _, token := range tokens {
+		if token.kind != queryTokenEOF {
+			words = append(words, token.text)
+		}
+	}
+	if fmt.Sprint(words) != "[voilà Åsa ( x )]" {
+		t.Error(fmt.Sprintf("unexpected tokens: %q", words))
+	}
+}
+
+func TestParseQueryUpdated(t *testing.T) {
+	now := time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC)
+	day := func(d int) int64 { return time.Date(2021, time.March, d, 0, 0, 0, 0, time.UTC).UnixNano() }
+
+	tests := []struct {
+		query    string
+		from, to int64
+	}{
+		{"updated:7d", now.AddDate(0, 0, -7).UnixNano(), 0},
+		{"updated:today", day(10), 0},
+		{"updated:yesterday", day(9), day(10)},
+		{"updated:2021-03-02", day(2), day(3)},
+		{"updated:>2021-03-02", day(3), 0},
+		{"updated:<=2021-03-02", 0, day(3)},
+		{"updated:2021-03-01..2021-03-04", day(1), day(5)},
+	}
+
+	for _, test := range tests {
+		q, err := parseQuery(test.query, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, ok := q.root.(queryUpdated)
+		if !ok {
+			t.Fatal(fmt.Sprintf("%s: unexpected node %#v", test.query, q.root))
+		}
+		if node.from != test.from || node.to != test.to {
+			t.Error(fmt.Sprintf("%s: expected [%d, %d), got [%d, %d)", test.query, test.from, test.to, node.from, node.to))
+		}
+	}
+}
+
+func TestRunQuery(t *testing.T) {
+	var db ExoDB
+	var projectX, other Tag
+	var old Row
+	var refs Refs
+	var err error
+
+	db = setupDB(t)
+
+	projectX, err = db.AddTag("projectX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err = db.AddTag("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"[[todo]] write the spec", "[[todo]] [[done]] kickoff", "estimate:: 5", "plain note"} {
+		_, err = db.AddRow(projectX.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = db.AddRow(other.ID, "[[projectX]] [[todo]] review the spec", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old, err = db.AddRow(other.ID, "[[projectX]] [[todo]] ancient history", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.conn.Exec("UPDATE row SET updated_ts = ? WHERE id = ?", time.Now().AddDate(0, 0, -30).UnixNano(), old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query    string
+		expected int
+	}{
+		{"[[todo]]", 4},
+		{"[[todo]] -[[done]]", 3},
+		{"[[todo]] and not [[done]] and in:projectX", 1},
+		{"([[projectX]] or in:[[projectX]]) [[todo]] -[[done]] updated:7d", 2},
+		{"spec", 2},
+		{"\"the spec\" in:other", 1},
+		{"estimate::>=5", 1},
+		{"estimate::<5", 0},
+		{"[[todo]] OR estimate::5", 5},
+		{"[[todo]] -([[done]] or in:other)", 1},
+	}
+
+	for _, test := range tests {
+		refs, err = db.RunQuery(test.query)
+		if err != nil {
+			t.Fatal(test.query + ": " + err.Error())
+		}
+		count := 0
+		for _, rows := range refs {
+			count += len(rows)
+		}
+		if count != test.expected {
+			t.Error(fmt.Sprintf("%s: expected %d rows, got %d", test.query, test.expected, count))
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Rows are ordered within their tag by fractional ranks. Inserting or moving a row picks a rank between its new
+// neighbours, so only that row is written. Once neighbouring ranks get too close to split, the tag is rebalanced
+// back to whole-numbered ranks.
+
+// minRankGap is the smallest gap rows are still placed into without rebalancing the tag first
+const minRankGap = 1e-6
+
+// sqlNeighbourRanks returns the ranks of the rows that would surround a row placed at position among the rows of
+// a tag, ignoring the rows in excludeIDs. A negative position is past the last row.
+func sqlNeighbourRanks(tx *sql.Tx, tagID int64, position int, excludeIDs []int64) (prev, next sql.NullFloat64, err error) {
+	var sqlRows *sql.Rows
+	var exclude string
+	var args []interface{}
+	var ranks []float64
+
+	args = []interface{}{tagID}
+	if len(excludeIDs) > 0 {
+		exclude = " AND id NOT IN (?" + strings.Repeat(", ?", len(excludeIDs)-1) + ")"
+		for _, id := range excludeIDs {
+			args = append(args, id)
+		}
+	}
+
+	if position < 0 {
+		err = tx.QueryRow("SELECT MAX(rank) FROM row WHERE tag_id = ?"+exclude, args...).Scan(&prev)
+		return prev, next, err
+	}
+
+	// fetch the row before position (if any) and the row at it
+	limit, offset := 2, position-1
+	if position == 0 {
+		limit, offset = 1, 0
+	}
+
+	sqlRows, err = tx.Query("SELECT rank FROM row WHERE tag_id = ?"+exclude+" ORDER BY rank, id LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		return prev, next, err
+	}
+	defer sqlRows.Close()
+
+	for sqlRows.Next() {
+		var rank float64
+		err = sqlRows.Scan(&rank)
+		if err != nil {
+			return prev, next, err
+		}
+		ranks = append(ranks, rank)
+	}
+
+	switch {
+	case position == 0 && len(ranks) == 1:
+		next = sql.NullFloat64{Float64: ranks[0], Valid: true}
+	case position > 0 && len(ranks) == 2:
+		prev = sql.NullFloat64{Float64: ranks[0], Valid: true}
+		next = sql.NullFloat64{Float64: ranks[1], Valid: true}
+	case position > 0:
+		// position is past the end of the tag
+		return sqlNeighbourRanks(tx, tagID, -1, excludeIDs)
+	}
+
+	return prev, next, sqlRows.Err()
+}
+
+// sqlRanksAt returns n ascending ranks that place rows at position among the rows of a tag, ignoring the rows in
+// excludeIDs. A negative position appends them.
+func sqlRanksAt(tx *sql.Tx, tagID int64, position int, n int, excludeIDs []int64) ([]float64, error) {
+	var prev, next sql.NullFloat64
+	var ranks []float64
+	var step float64
+	var err error
+
+	prev, next, err = sqlNeighbourRanks(tx, tagID, position, excludeIDs)
+	if err != nil {
+		goto End
+	}
+
+	if prev.Valid && next.Valid {
+		step = (next.Float64 - prev.Float64) / float64(n+1)
+		if step < minRankGap {
+			err = sqlRebalanceRanks(tx, tagID)
+			if err != nil {
+				goto End
+			}
+			prev, next, err = sqlNeighbourRanks(tx, tagID, position, excludeIDs)
+			if err != nil {
+				goto End
+			}
+			step = (next.Float64 - prev.Float64) / float64(n+1)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		switch {
+		case prev.Valid && next.Valid:
+			ranks = append(ranks, prev.Float64+step*float64(i+1))
+		case prev.Valid:
+			ranks = append(ranks, prev.Float64+float64(i+1))
+		case next.Valid:
+			ranks = append(ranks, next.Float64-float64(n-i))
+		default:
+			ranks = append(ranks, float64(i))
+		}
+	}
+
+End:
+	return ranks, err
+}
+
+// sqlRebalanceRanks renumbers the rows of a tag 0..n-1, keeping their order. It reads the row table directly, since
+// only ranks are rewritten, so the rows of a locked tag are renumbered too.
+func sqlRebalanceRanks(tx *sql.Tx, tagID int64) error {
+	var sqlRows *sql.Rows
+	var ids []int64
+	var ranks []float64
+	var statement *sql.Stmt
+	var err error
+
+	sqlRows, err = tx.Query("SELECT id, rank FROM row WHERE tag_id = ? ORDER BY rank, id", tagID)
+	if err != nil {
+		goto End
+	}
+
+	for sqlRows.Next() {
+		var id int64
+		var rank float64
+		err = sqlRows.Scan(&id, &rank)
+		if err != nil {
+			sqlRows.Close()
+			goto End
+		}
+		ids = append(ids, id)
+		ranks = append(ranks, rank)
+	}
+	sqlRows.Close()
+	err = sqlRows.Err()
+	if err != nil {
+		goto End
+	}
+
+	statement, err = tx.Prepare("UPDATE row SET rank = $1 WHERE id = $2")
+	if err != nil {
+		goto End
+	}
+
+	for i, id := range ids {
+		if ranks[i] == float64(i) {
+			continue
+		}
+		_, err = statement.Exec(i, id)
+		if err != nil {
+			goto End
+		}
+	}
+
+End:
+	return err
+}
+
+// RebalanceRanks renumbers the rows of a tag 0..n-1, keeping their order. It's never required, since ranks are
+// rebalanced when needed, but it makes room between every pair of rows again.
+func (e *ExoDB) RebalanceRanks(tagID int64) error {
+	var tx *sql.Tx
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	err = sqlRebalanceRanks(tx, tagID)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return err
+}
@@ -0,0 +1,164 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+)
+
+func TestUpdateRowRank(t *testing.T) {
+	var db ExoDB
+	var tag Tag
+	var rows []Row
+	var err error
+
+	db = setupDB(t)
+
+	tag, err = db.AddTag("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"a", "b", "c", "d"} {
+		var row Row
+		row, err = db.AddRow(tag.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+
+	tests := []struct {
+		row      int
+		position int
+		expected string
+	}{
+		{3, 0, "d,a,b,c,"},
+		{3, 2, "a,b,d,c,"},
+		{0, 1, "b,a,d,c,"},
+		// past the end is a no-op
+		{1, 4, "b,a,d,c,"},
+		{1, 10, "b,a,d,c,"},
+		{1, 3, "a,d,c,b,"},
+	}
+
+	for _, test := range tests {
+		err = db.UpdateRowRank(rows[test.row].ID, test.position)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if texts := rowTexts(t, db, tag.ID); texts != test.expected {
+			t.Fatal(fmt.Sprintf("moving %s to %d: expected %s, got %s", rows[test.row].Text, test.position, test.expected, texts))
+		}
+	}
+
+	// keep splitting the same gap until the tag has to be rebalanced
+	for i := 0; i < 100; i++ {
+		err = db.UpdateRowRank(rows[i%2].ID, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if texts := rowTexts(t, db, tag.ID); texts != "d,b,a,c," {
+		t.Fatal("unexpected order after repeated moves: " + texts)
+	}
+}
+
+// legacyUpdateRowRank is the old way of reordering rows, which rewrote the rank of every row in the tag. It's kept
+// for comparison in benchmarks.
+func legacyUpdateRowRank(tx *sql.Tx, rowID int64, rank int) error {
+	row, err := sqlGetRowByID(tx, rowID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := sqlGetRowsForTagID(tx, row.TagID)
+	if err != nil {
+		return err
+	}
+
+	newRank := 0
+	for _, row := range rows {
+		if row.ID == rowID {
+			err = sqlUpdateRowRank(tx, row.ID, float64(rank))
+		} else if newRank >= rank {
+			err = sqlUpdateRowRank(tx, row.ID, float64(newRank+1))
+			newRank++
+		} else {
+			err = sqlUpdateRowRank(tx, row.ID, float64(newRank))
+			newRank++
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func setupRankBenchmark(b *testing.B, n int) (ExoDB, []Row) {
+	db := setupDB(b)
+
+	tag, err := db.AddTag("bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	rows := make([]Row, 0, n)
+	for i := 0; i < n; i++ {
+		row, err := db.AddRow(tag.ID, fmt.Sprintf("row %d", i), 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+
+	return db, rows
+}
+
+func BenchmarkMoveRow(b *testing.B) {
+	for _, n := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("fractional/%d", n), func(b *testing.B) {
+			db, rows := setupRankBenchmark(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// move a row from the bottom of the tag to its middle
+				err := db.UpdateRowRank(rows[n-1-i%(n/2)].ID, n/2)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("legacy/%d", n), func(b *testing.B) {
+			db, rows := setupRankBenchmark(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tx, err := db.conn.Begin()
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = legacyUpdateRowRank(tx, rows[n-1-i%(n/2)].ID, n/2)
+				err = sqlCommitOrRollback(tx, err)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAppendRow(b *testing.B) {
+	for _, n := range []int{100, 1000} {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			db, rows := setupRankBenchmark(b, n)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := db.AddRow(rows[0].TagID, "appended", 0)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
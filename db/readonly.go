@@ -0,0 +1,163 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// A database opened read-only is opened with mode=ro, and every connection sets PRAGMA query_only, which covers the
+// in-memory copy of an encrypted database too. Changes are rejected by SQLite, and surface as ErrReadOnly. Nothing is
+// created, cleaned up or backed up. A database made by an older version is migrated in a copy held in memory, which
+// is read from then on, so the file stays as it was.
+
+// ErrReadOnly is returned when changing a database that was opened read-only
+var ErrReadOnly = errors.New("database is open read-only")
+
+// OpenReadOnly opens the existing database in filename read-only
+func (e *ExoDB) OpenReadOnly(filename string) error {
+	e.readOnly = true
+	return e.Open(filename)
+}
+
+// OpenEncryptedReadOnly opens the existing encrypted database in filename read-only
+func (e *ExoDB) OpenEncryptedReadOnly(filename string, passphrase string) error {
+	e.readOnly = true
+	return e.OpenEncrypted(filename, passphrase)
+}
+
+// ReadOnly reports whether the database was opened read-only
+func (e *ExoDB) ReadOnly() bool {
+	return e.readOnly
+}
+
+// readOnlyDSN returns the URI opening filename read-only
+func readOnlyDSN(filename string) string {
+	return "file:" + strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(filename) + "?mode=ro"
+}
+
+// readOnlyError turns SQLite's error for a write to a read-only database into ErrReadOnly
+func readOnlyError(err error) error {
+	var sqliteErr sqlite3.Error
+
+	if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrReadonly {
+		return ErrReadOnly
+	}
+
+	return err
+}
+
+var schemaTable = regexp.MustCompile(`CREATE TABLE IF NOT EXISTS "(\w+)"`)
+
+// sqlSchemaOutdated reports whether the schema is missing tables or migrations
+func sqlSchemaOutdated(tx *sql.Tx) (bool, error) {
+	var outdated bool
+	var version int
+	var exists bool
+	var err error
+
+	for _, match := range schemaTable.FindAllStringSubmatch(schema, -1) {
+		err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = $1)", match[1]).Scan(&exists)
+		if err != nil {
+			goto End
+		}
+		if !exists {
+			outdated = true
+			goto End
+		}
+	}
+
+	err = tx.QueryRow("PRAGMA user_version").Scan(&version)
+	outdated = version < len(migrations)
+
+End:
+	return outdated, err
+}
+
+// loadSchemaReadOnly checks that a read-only database is up to date. One that isn't is copied into memory and
+// migrated there, and the copy is what's read from then on.
+func (e *ExoDB) loadSchemaReadOnly() error {
+	var tx *sql.Tx
+	var outdated bool
+	var contents []byte
+	var scratch ExoDB
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+	outdated, err = sqlSchemaOutdated(tx)
+	err = sqlCommitOrRollback(tx, err)
+	if err != nil || !outdated {
+		goto End
+	}
+
+	contents, err = serializeDB(e.conn)
+	if err != nil {
+		goto End
+	}
+
+	// every connection gets a copy of its own, so the copy being migrated has to stay on the one
+	scratch.conn = sql.OpenDB(&memoryConnector{scratch.newDriver(), contents})
+	scratch.conn.SetMaxOpenConns(1)
+	err = scratch.LoadSchema()
+	if err == nil {
+		contents, err = serializeDB(scratch.conn)
+	}
+	scratch.Close()
+	if err != nil {
+		goto End
+	}
+
+	e.notices = scratch.notices
+	e.conn.Close()
+	e.conn = sql.OpenDB(&memoryConnector{e.newDriver(), contents})
+
+	// connect now, so a copy that can't be loaded fails here rather than in the first query
+	err = e.conn.Ping()
+
+End:
+	return err
+}
+
+// serializeDB returns the contents of the database open in db
+func serializeDB(db *sql.DB) ([]byte, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return serializeConn(conn)
+}
+
+// memoryConnector opens connections to copies of a serialized database, each held in memory
+type memoryConnector struct {
+	driver   *sqlite3.SQLiteDriver
+	contents []byte
+}
+
+func (c *memoryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(":memory:")
+	if err != nil {
+		return nil, err
+	}
+
+	err = loadConn(c.driver, conn.(*sqlite3.SQLiteConn), c.contents)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (c *memoryConnector) Driver() driver.Driver {
+	return c.driver
+}
@@ -0,0 +1,211 @@
+package db
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadOnly(t *testing.T) {
+	var db ExoDB
+	var tag Tag
+	var err error
+
+	filename := filepath.Join(t.TempDir(), "exocortex.db")
+
+	err = db.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err = db.AddTag("empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	before, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ro ExoDB
+	err = ro.OpenReadOnly(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	err = ro.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ro.AddTag("new"); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if _, err = ro.Backup(); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+
+	// browsing doesn't clean up or create tags
+	state := State{DB: &ro}
+	err = state.DeleteTagIfEmpty(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ro.GetTagByID(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	today, err := state.DateTag(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if today.ID != 0 || today.Name != time.Now().Format(DateTagFormat) {
+		t.Fatalf("expected a placeholder tag for today, got %v", today)
+	}
+	state.CurrentDBTag = today
+	err = state.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Fatal("read-only database was changed")
+	}
+
+	var missing ExoDB
+	if err = missing.OpenReadOnly(filepath.Join(t.TempDir(), "missing.db")); err == nil {
+		if err = missing.LoadSchema(); err == nil {
+			t.Fatal("expected a missing database not to be created")
+		}
+	}
+}
+
+// the schema of a database made before tag keys, settings and the rest
+const baselineSchema = `
+CREATE TABLE "ref" (
+	"tag_id"	INTEGER NOT NULL,
+	"row_id"	INTEGER NOT NULL,
+	FOREIGN KEY("row_id") REFERENCES "row"("id") ON DELETE CASCADE,
+	PRIMARY KEY("tag_id","row_id"),
+	FOREIGN KEY("tag_id") REFERENCES "tag"("id") ON DELETE CASCADE
+);
+CREATE TABLE "tag" (
+	"id"	INTEGER,
+	"name"	TEXT NOT NULL UNIQUE,
+	"refcount"	INTEGER NOT NULL DEFAULT 0,
+	"updated_ts"	INTEGER DEFAULT 0,
+	PRIMARY KEY("id")
+);
+CREATE TABLE "row" (
+	"id"	INTEGER,
+	"tag_id"	INTEGER NOT NULL,
+	"rank"	INTEGER,
+	"text"	BLOB,
+	"parent_row_id"	INTEGER,
+	"updated_ts"	INTEGER,
+	FOREIGN KEY("tag_id") REFERENCES "tag"("id") ON DELETE CASCADE,
+	PRIMARY KEY("id")
+);
+INSERT INTO tag (id, name, refcount, updated_ts) VALUES (1, 'notes', 0, 1), (2, 'todo', 1, 1);
+INSERT INTO row (id, tag_id, rank, text, parent_row_id, updated_ts) VALUES (1, 1, 0, 'see [[todo]]', 0, 1);
+INSERT INTO ref (tag_id, row_id) VALUES (2, 1);
+`
+
+func TestReadOnlyBaselineSchema(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "exocortex.db")
+
+	old, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(baselineSchema)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ro ExoDB
+	err = ro.OpenReadOnly(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	err = ro.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err := ro.GetTagByName("Notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if texts := rowTexts(t, ro, tag.ID); texts != "see [[todo]]," {
+		t.Fatalf("unexpected rows: %s", texts)
+	}
+	refs, err := ro.GetRefsToTagByTagID(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 {
+		t.Fatalf("expected the ref from notes, got %v", refs)
+	}
+	if _, err = ro.AddTag("new"); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+
+	after, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before) != string(after) {
+		t.Fatal("read-only database was changed")
+	}
+}
+
+func TestReadOnlyEncrypted(t *testing.T) {
+	encryptionIterations = 1000
+	filename := filepath.Join(t.TempDir(), "exocortex.db")
+
+	db := openEncrypted(t, filename, "secret")
+	_, err := db.AddTag("clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	var ro ExoDB
+	err = ro.OpenEncryptedReadOnly(filename, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	err = ro.LoadSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ro.GetTagByName("clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ro.AddTag("new"); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+}
@@ -2,6 +2,10 @@ package db
 
 import (
 	"database/sql"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Refs represents all refs to a given tag, where the key is the tag the row(s) came from
@@ -11,7 +15,8 @@ func sqlAddRef(tx *sql.Tx, tagID int64, rowID int64) error {
 	var statement *sql.Stmt
 	var err error
 
-	statement, err = tx.Prepare("INSERT INTO ref (tag_id, row_id) VALUES ($1, $2)")
+	// a row may link the same tag more than once
+	statement, err = tx.Prepare("INSERT OR IGNORE INTO ref (tag_id, row_id) VALUES ($1, $2)")
 	if err != nil {
 		goto End
 	}
@@ -43,25 +48,19 @@ End:
 	return err
 }
 
-func sqlGetRefsToTagByTagID(tx *sql.Tx, tagID int64) (Refs, error) {
-	var statement *sql.Stmt
+// sqlGetRefs returns the rows matching condition, keyed by the tag each row is under. condition refers to the row
+// table as r. Rows and their tags are loaded with a single query.
+func sqlGetRefs(tx *sql.Tx, condition string, args ...interface{}) (Refs, error) {
 	var sqlRows *sql.Rows
 	var refs Refs
-	var tag Tag
-	var row Row
 	var err error
 
-	statement, err = tx.Prepare(`SELECT r.id, r.tag_id, r.parent_row_id, r.text, r.rank, r.updated_ts
-								   FROM row as r, tag, ref
-								   WHERE tag.id = $1
-								   AND tag.id = ref.tag_id
-								   AND r.id = ref.row_id
-								   ORDER BY r.tag_id asc, r.rank asc`)
-	if err != nil {
-		goto End
-	}
-
-	sqlRows, err = statement.Query(tagID)
+	sqlRows, err = tx.Query(`SELECT r.id, r.tag_id, r.parent_row_id, `+openedText("r")+`, r.rank, r.updated_ts, t.id, t.name, t.updated_ts, `+tagKind("t")+`
+							 FROM row AS r, tag AS t
+							 WHERE t.id = r.tag_id
+							 AND `+visibleRow("r")+`
+							 AND (`+condition+`)
+							 ORDER BY r.tag_id asc, r.rank asc, r.id asc`, args...)
 	if err != nil {
 		goto End
 	}
@@ -69,21 +68,90 @@ func sqlGetRefsToTagByTagID(tx *sql.Tx, tagID int64) (Refs, error) {
 
 	refs = make(Refs)
 	for sqlRows.Next() {
-		err = sqlRows.Scan(&row.ID, &row.TagID, &row.ParentRowID, &row.Text, &row.Rank, &row.UpdatedTS)
+		var row Row
+		var tag Tag
+		err = sqlRows.Scan(&row.ID, &row.TagID, &row.ParentRowID, &row.Text, &row.Rank, &row.UpdatedTS, &tag.ID, &tag.Name, &tag.UpdatedTS, &tag.Kind)
 		if err != nil {
 			goto End
 		}
+		refs[tag] = append(refs[tag], row)
+	}
 
-		tag, err = sqlGetTagByID(tx, row.TagID)
+End:
+	return refs, err
+}
+
+func sqlGetRefsToTagByTagID(tx *sql.Tx, tagID int64) (Refs, error) {
+	return sqlGetRefs(tx, "r.id IN (SELECT row_id FROM ref WHERE tag_id = ?)", tagID)
+}
+
+// maxLinkedTagsBatch bounds the number of row IDs bound to a single query by sqlGetLinkedTags
+const maxLinkedTagsBatch = 500
+
+// sqlGetLinkedTags returns the tags linked from the given rows, by key
+func sqlGetLinkedTags(tx *sql.Tx, rowIDs []int64) (map[string]Tag, error) {
+	var tags map[string]Tag
+	var sqlRows *sql.Rows
+	var batch []int64
+	var args []interface{}
+	var err error
+
+	tags = make(map[string]Tag)
+	for len(rowIDs) > 0 {
+		batch = rowIDs
+		if len(batch) > maxLinkedTagsBatch {
+			batch = batch[:maxLinkedTagsBatch]
+		}
+		rowIDs = rowIDs[len(batch):]
+
+		args = args[:0]
+		for _, id := range batch {
+			args = append(args, id)
+		}
+
+		sqlRows, err = tx.Query(`SELECT DISTINCT tag.id, tag.name, tag.key, tag.updated_ts, `+tagKindColumn+`
+								 FROM ref, tag
+								 WHERE tag.id = ref.tag_id
+								 AND ref.row_id IN (?`+strings.Repeat(", ?", len(batch)-1)+`)`, args...)
 		if err != nil {
 			goto End
 		}
 
-		refs[tag] = append(refs[tag], row)
+		for sqlRows.Next() {
+			var tag Tag
+			var key string
+			err = sqlRows.Scan(&tag.ID, &tag.Name, &key, &tag.UpdatedTS, &tag.Kind)
+			if err != nil {
+				sqlRows.Close()
+				goto End
+			}
+			tags[key] = tag
+		}
+		sqlRows.Close()
 	}
 
 End:
-	return refs, err
+	return tags, err
+}
+
+// GetLinkedTags returns the tags linked from the given rows, by TagKey, so that [[links]] in row text can be
+// resolved without a query per link
+func (e *ExoDB) GetLinkedTags(rowIDs []int64) (map[string]Tag, error) {
+	var tx *sql.Tx
+	var tags map[string]Tag
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	tags, err = sqlGetLinkedTags(tx, rowIDs)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return tags, err
 }
 
 func sqlGetRefsToTagByTagName(tx *sql.Tx, name string) (Refs, error) {
@@ -121,7 +189,7 @@ func (e *ExoDB) GetRefsToTagByTagName(name string) (Refs, error) {
 	}
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
 
 	return refs, err
 }
@@ -142,7 +210,132 @@ func (e *ExoDB) GetRefsToTagByTagID(tagID int64) (Refs, error) {
 	}
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
+
+	return refs, err
+}
+
+// mentionPattern returns the pattern findMentions looks for mentions of name with, or nil if name is blank
+func mentionPattern(name string) *regexp.Regexp {
+	if strings.TrimSpace(name) == "" {
+		return nil
+	}
+
+	return regexp.MustCompile(`(?i)` + regexp.QuoteMeta(name))
+}
+
+// findMentions returns the index pairs of every plain text mention matching re, from mentionPattern, in text.
+// Mentions must be whole words and aren't matched case-sensitively. Mentions inside existing [[links]] or code spans
+// are skipped.
+func findMentions(text string, re *regexp.Regexp) [][]int {
+	var mentions [][]int
+	var nodes []Node
+
+	if re == nil {
+		return nil
+	}
+
+	nodes = ParseText(text)
+
+Mentions:
+	for _, m := range re.FindAllStringIndex(text, -1) {
+		for _, node := range nodes {
+			if node.Kind != NodeText && m[0] < node.End && m[1] > node.Start {
+				continue Mentions
+			}
+		}
+
+		if r, _ := utf8.DecodeLastRuneInString(text[:m[0]]); m[0] > 0 && isWordRune(r) {
+			continue
+		}
+		if r, _ := utf8.DecodeRuneInString(text[m[1]:]); m[1] < len(text) && isWordRune(r) {
+			continue
+		}
+
+		mentions = append(mentions, m)
+	}
+
+	return mentions
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// LinkMention turns the first plain text mention of name in text into a [[name]] link. It returns false if text
+// doesn't mention name.
+func LinkMention(text string, name string) (string, bool) {
+	var mentions [][]int
+
+	mentions = findMentions(text, mentionPattern(name))
+	if len(mentions) == 0 {
+		return text, false
+	}
+
+	return text[:mentions[0][0]] + FormatRef(name) + text[mentions[0][1]:], true
+}
+
+func sqlGetUnlinkedRefsToTagByTagID(tx *sql.Tx, tagID int64) (Refs, error) {
+	var refs Refs
+	var tag Tag
+	var re *regexp.Regexp
+	var err error
+
+	tag, err = sqlGetTagByID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	re = mentionPattern(tag.Name)
+	if re == nil {
+		goto End
+	}
+
+	// the folded text narrows the candidates down, the way TagKey compares names; the word and link checks are done
+	// by findMentions
+	refs, err = sqlGetRefs(tx, `instr(exo_fold(`+openedText("r")+`), ?) > 0
+							    AND r.tag_id != ?
+							    AND r.id NOT IN (SELECT row_id FROM ref WHERE tag_id = ?)`, foldText(tag.Name), tagID, tagID)
+	if err != nil {
+		goto End
+	}
+
+	for rowTag, rows := range refs {
+		mentions := rows[:0]
+		for _, row := range rows {
+			if len(findMentions(row.Text, re)) > 0 {
+				mentions = append(mentions, row)
+			}
+		}
+		if len(mentions) == 0 {
+			delete(refs, rowTag)
+		} else {
+			refs[rowTag] = mentions
+		}
+	}
+
+End:
+	return refs, err
+}
+
+// GetUnlinkedRefsToTagByTagID returns the rows that mention the tag's name in plain text without linking to it
+func (e *ExoDB) GetUnlinkedRefsToTagByTagID(tagID int64) (Refs, error) {
+	var tx *sql.Tx
+	var refs Refs
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	refs, err = sqlGetUnlinkedRefsToTagByTagID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
 
 	return refs, err
 }
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLinkMention(t *testing.T) {
+	tests := []struct {
+		text, name, expected string
+		ok                   bool
+	}{
+		{"talk to alice about it", "alice", "talk to [[alice]] about it", true},
+		{"Alice said so", "alice", "[[alice]] said so", true},
+		{"[[alice]] and alice", "alice", "[[alice]] and [[alice]]", true},
+		{"malice aforethought", "alice", "malice aforethought", false},
+		{"[[alice's notes]]", "alice", "[[alice's notes]]", false},
+		{"see project x.", "project x", "see [[project x]].", true},
+	}
+
+	for _, test := range tests {
+		text, ok := LinkMention(test.text, test.name)
+		if text != test.expected || ok != test.ok {
+			t.Error(fmt.Sprintf("LinkMention(%q, %q): expected %q %t, got %q %t", test.text, test.name, test.expected, test.ok, text, ok))
+		}
+	}
+}
+
+func TestGetUnlinkedRefs(t *testing.T) {
+	var db ExoDB
+	var alice, notes Tag
+	var mention Row
+	var refs Refs
+	var err error
+
+	db = setupDB(t)
+
+	alice, err = db.AddTag("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notes, err = db.AddTag("notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mention, err = db.AddRow(notes.ID, "lunch with Alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"[[alice]] owes me lunch", "malice", "nothing here"} {
+		_, err = db.AddRow(notes.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = db.AddRow(alice.ID, "alice's own row", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err = db.GetUnlinkedRefsToTagByTagID(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := SortedRefTags(refs)
+	if len(tags) != 1 || tags[0].ID != notes.ID || len(refs[tags[0]]) != 1 || refs[tags[0]][0].ID != mention.ID {
+		t.Fatal(fmt.Sprintf("unexpected unlinked refs: %+v", refs))
+	}
+
+	text, _ := LinkMention(mention.Text, alice.Name)
+	err = db.UpdateRowText(mention.ID, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err = db.GetUnlinkedRefsToTagByTagID(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(refs) != 0 {
+		t.Fatal("linked mention is still listed as an unlinked ref")
+	}
+}
+
+func TestGetUnlinkedRefsFoldsCase(t *testing.T) {
+	db := setupDB(t)
+
+	addLinkedRows(t, &db, "notes", "met ÅSA for coffee", "nothing here")
+
+	asa, err := db.AddTag("åsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := db.GetUnlinkedRefsToTagByTagID(asa.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := SortedRefTags(refs)
+	if len(tags) != 1 || len(refs[tags[0]]) != 1 || refs[tags[0]][0].Text != "met ÅSA for coffee" {
+		t.Fatal(fmt.Sprintf("expected the mention in another case to be found, got %+v", refs))
+	}
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"database/sql"
+)
+
+// maxRelatedTags bounds the number of tags SuggestRelatedTags returns
+const maxRelatedTags = 10
+
+// Tags are related to a tag when they're used alongside it. Linked from the same row as the tag, they count twice as
+// much as linked from the rows of a tag that also links it elsewhere.
+const (
+	relatedRowWeight   = 2
+	relatedOwnerWeight = 1
+)
+
+// RelatedTag is a tag used alongside another one. Score is higher the more they're used together.
+type RelatedTag struct {
+	Tag
+	Score int
+}
+
+func sqlSuggestRelatedTags(tx *sql.Tx, tagID int64) ([]RelatedTag, error) {
+	var sqlRows *sql.Rows
+	var related []RelatedTag
+	var err error
+
+	// rows linking the tag, and the tags owning them
+	sqlRows, err = tx.Query(`WITH linking AS (SELECT r.id, r.tag_id FROM ref, row AS r
+											  WHERE ref.tag_id = $1 AND r.id = ref.row_id AND `+visibleRow("r")+`),
+							 scores AS (SELECT other.tag_id AS tag_id, COUNT(*) * $2 AS score
+										FROM linking, ref AS other
+										WHERE other.row_id = linking.id
+										GROUP BY other.tag_id
+										UNION ALL
+										SELECT ref.tag_id, COUNT(DISTINCT r.tag_id) * $3
+										FROM row AS r, ref
+										WHERE r.tag_id IN (SELECT tag_id FROM linking)
+										AND ref.row_id = r.id
+										AND ref.tag_id != r.tag_id
+										AND `+visibleRow("r")+`
+										GROUP BY ref.tag_id)
+							 SELECT tag.id, tag.name, tag.updated_ts, `+tagKindColumn+`, SUM(scores.score) AS total
+							 FROM scores, tag
+							 WHERE tag.id = scores.tag_id
+							 AND tag.id != $1
+							 GROUP BY tag.id
+							 ORDER BY total DESC, tag.updated_ts DESC
+							 LIMIT $4`, tagID, relatedRowWeight, relatedOwnerWeight, maxRelatedTags)
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	for sqlRows.Next() {
+		var r RelatedTag
+		err = sqlRows.Scan(&r.ID, &r.Name, &r.UpdatedTS, &r.Kind, &r.Score)
+		if err != nil {
+			goto End
+		}
+		related = append(related, r)
+	}
+
+End:
+	return related, err
+}
+
+// SuggestRelatedTags returns the tags most used alongside a tag, best first: tags linked from the same rows as it, and
+// from the rows of the tags that link it
+func (e *ExoDB) SuggestRelatedTags(tagID int64) ([]RelatedTag, error) {
+	var tx *sql.Tx
+	var related []RelatedTag
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	related, err = sqlSuggestRelatedTags(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return related, err
+}
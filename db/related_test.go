@@ -0,0 +1,62 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestSuggestRelatedTags(t *testing.T) {
+	db := setupDB(t)
+
+	addLinkedRows(t, &db, "monday", "[[coffee]] with [[alice]]", "[[coffee]] with [[alice]] again", "walked to [[work]]")
+	addLinkedRows(t, &db, "tuesday", "[[coffee]] alone", "read [[books]]")
+	addLinkedRows(t, &db, "wednesday", "nothing linked")
+
+	coffee, err := db.GetTagByName("coffee")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	related, err := db.SuggestRelatedTags(coffee.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scores := make(map[string]int)
+	for _, r := range related {
+		scores[r.Name] = r.Score
+	}
+
+	// alice shares two rows and an owner, work and books only an owner each
+	expected := map[string]int{"alice": 2*relatedRowWeight + relatedOwnerWeight, "work": relatedOwnerWeight, "books": relatedOwnerWeight}
+	if len(scores) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, scores)
+	}
+	for name, score := range expected {
+		if scores[name] != score {
+			t.Fatalf("expected %v, got %v", expected, scores)
+		}
+	}
+	if related[0].Name != "alice" {
+		t.Fatalf("expected alice first, got %v", related)
+	}
+
+	// locked rows don't count
+	encryptionIterations = 1000
+	monday, err := db.GetTagByName("monday")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.LockTag(monday.ID, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.RelockTag(monday.ID)
+
+	related, err = db.SuggestRelatedTags(coffee.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(related) != 1 || related[0].Name != "books" {
+		t.Fatalf("expected only books once monday is locked, got %v", related)
+	}
+}
@@ -2,14 +2,13 @@ package db
 
 import (
 	"database/sql"
-	"regexp"
 	"time"
 )
 
 type Row struct {
 	ID          int64
 	TagID       int64
-	Rank        int
+	Rank        float64
 	Text        string
 	ParentRowID int64
 	UpdatedTS   int64
@@ -20,7 +19,7 @@ func sqlGetRowByID(tx *sql.Tx, id int64) (Row, error) {
 	var sqlRow *sql.Row
 	var err error
 
-	sqlRow = tx.QueryRow("SELECT id, tag_id, text, rank, parent_row_id, updated_ts FROM row WHERE id = $1", id)
+	sqlRow = tx.QueryRow("SELECT id, tag_id, "+openedText("row")+", rank, parent_row_id, updated_ts FROM row WHERE id = $1 AND "+visibleRow("row"), id)
 
 	err = sqlRow.Scan(&row.ID, &row.TagID, &row.Text, &row.Rank, &row.ParentRowID, &row.UpdatedTS)
 	if err != nil {
@@ -47,7 +46,7 @@ func (e *ExoDB) GetRowByID(id int64) (Row, error) {
 	}
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
 	return row, err
 }
 
@@ -69,6 +68,7 @@ End:
 	return err
 }
 
+// DeleteRowByID moves a row into the trash
 func (e *ExoDB) DeleteRowByID(id int64) error {
 	var tx *sql.Tx
 	var err error
@@ -78,13 +78,13 @@ func (e *ExoDB) DeleteRowByID(id int64) error {
 		goto End
 	}
 
-	err = sqlDeleteRowByID(tx, id)
+	err = sqlTrashRow(tx, id, 0)
 	if err != nil {
 		goto End
 	}
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
 	return err
 }
 
@@ -93,7 +93,7 @@ func sqlGetRowsForTagID(tx *sql.Tx, tagID int64) ([]Row, error) {
 	var sqlRows *sql.Rows
 	var err error
 
-	sqlRows, err = tx.Query("SELECT id, tag_id, rank, text, parent_row_id, updated_ts FROM row WHERE tag_id = $1 ORDER BY rank, id", tagID)
+	sqlRows, err = tx.Query("SELECT id, tag_id, rank, "+openedText("row")+", parent_row_id, updated_ts FROM row WHERE tag_id = $1 AND "+visibleRow("row")+" ORDER BY rank, id", tagID)
 	if err != nil {
 		goto End
 	}
@@ -128,17 +128,69 @@ func (e *ExoDB) GetRowsForTagID(tagID int64) ([]Row, error) {
 	}
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
 	return rows, err
 }
 
-func sqlAddRow(tx *sql.Tx, tagID int64, text string, parentRowID int64, rank int) (int64, error) {
+func sqlGetRowCounts(tx *sql.Tx) (map[int64]int, error) {
+	var counts map[int64]int
+	var sqlRows *sql.Rows
+	var err error
+
+	sqlRows, err = tx.Query("SELECT tag_id, COUNT(*) FROM row WHERE " + visibleRow("row") + " GROUP BY tag_id")
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	counts = make(map[int64]int)
+	for sqlRows.Next() {
+		var tagID int64
+		var count int
+		err = sqlRows.Scan(&tagID, &count)
+		if err != nil {
+			goto End
+		}
+		counts[tagID] = count
+	}
+
+End:
+	return counts, err
+}
+
+// GetRowCounts returns the number of rows each tag holds, by tag ID. Tags without rows are left out.
+func (e *ExoDB) GetRowCounts() (map[int64]int, error) {
+	var tx *sql.Tx
+	var counts map[int64]int
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	counts, err = sqlGetRowCounts(tx)
+	if err != nil {
+		goto End
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+	return counts, err
+}
+
+func sqlAddRow(tx *sql.Tx, tagID int64, text string, parentRowID int64, rank float64) (int64, error) {
 	var statement *sql.Stmt
 	var res sql.Result
 	var rowID int64
 	var err error
 
-	statement, err = tx.Prepare("INSERT INTO row (tag_id, text, parent_row_id, rank, updated_ts) VALUES ($1, $2, $3, $4, $5)")
+	err = sqlCheckTagUnlocked(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	statement, err = tx.Prepare("INSERT INTO row (tag_id, text, parent_row_id, rank, updated_ts) VALUES ($1, " + sealedText("$1", "$2") + ", $3, $4, $5)")
 	if err != nil {
 		goto End
 	}
@@ -162,28 +214,28 @@ End:
 	return rowID, err
 }
 
-func (e *ExoDB) AddRow(tagID int64, text string, parentRowID int64) (Row, error) {
-	var tx *sql.Tx
-	var sqlRow *sql.Row
-	var row Row
-	var rank int
+// sqlAppendRow adds a row to the end of the given tag and creates its refs
+func sqlAppendRow(tx *sql.Tx, tagID int64, text string, parentRowID int64) (int64, error) {
+	var ranks []float64
 	var rowID int64
+	var isQueryTag bool
 	var err error
 
-	tx, err = e.conn.Begin()
+	isQueryTag, err = sqlIsQueryTag(tx, tagID)
 	if err != nil {
 		goto End
 	}
+	if isQueryTag {
+		err = ErrQueryTag
+		goto End
+	}
 
-	// first get the max rank for this tag
-	sqlRow = tx.QueryRow("SELECT MAX(rank) FROM row WHERE tag_id = $1", tagID)
-
-	err = sqlRow.Scan(&rank)
-	if err == nil {
-		rank++
+	ranks, err = sqlRanksAt(tx, tagID, -1, 1, nil)
+	if err != nil {
+		goto End
 	}
 
-	rowID, err = sqlAddRow(tx, tagID, text, parentRowID, rank)
+	rowID, err = sqlAddRow(tx, tagID, text, parentRowID, ranks[0])
 	if err != nil {
 		goto End
 	}
@@ -193,13 +245,33 @@ func (e *ExoDB) AddRow(tagID int64, text string, parentRowID int64) (Row, error)
 		goto End
 	}
 
+End:
+	return rowID, err
+}
+
+func (e *ExoDB) AddRow(tagID int64, text string, parentRowID int64) (Row, error) {
+	var tx *sql.Tx
+	var row Row
+	var rowID int64
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	rowID, err = sqlAppendRow(tx, tagID, text, parentRowID)
+	if err != nil {
+		goto End
+	}
+
 	row, err = sqlGetRowByID(tx, rowID)
 	if err != nil {
 		goto End
 	}
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
 	return row, err
 }
 
@@ -208,17 +280,18 @@ func sqlUpdateRowText(tx *sql.Tx, rowID int64, text string) error {
 	var row Row
 	var err error
 
-	statement, err = tx.Prepare("UPDATE row SET text = ? WHERE id = ?")
+	// the rows of hidden tags aren't found
+	row, err = sqlGetRowByID(tx, rowID)
 	if err != nil {
 		goto End
 	}
 
-	_, err = statement.Exec(text, rowID)
+	statement, err = tx.Prepare("UPDATE row SET text = " + sealedText("tag_id", "$1") + " WHERE id = $2")
 	if err != nil {
 		goto End
 	}
 
-	row, err = sqlGetRowByID(tx, rowID)
+	_, err = statement.Exec(text, rowID)
 	if err != nil {
 		goto End
 	}
@@ -234,8 +307,8 @@ End:
 func sqlUpdateRefsForRowID(tx *sql.Tx, rowID int64) error {
 	var tagID int64
 	var row Row
-	var newTags [][]string
-	var re *regexp.Regexp
+	var locked bool
+	var newTags []string
 	var err error
 
 	// update all old refs to this row
@@ -245,21 +318,39 @@ func sqlUpdateRefsForRowID(tx *sql.Tx, rowID int64) error {
 		goto End
 	}
 
+	// the rows of locked tags have no refs or properties, since they would give the rows away
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM tag_lock WHERE tag_id = (SELECT tag_id FROM row WHERE id = $1))", rowID).Scan(&locked)
+	if err != nil {
+		goto End
+	}
+	if locked {
+		err = sqlClearPropertiesForRow(tx, rowID)
+		goto End
+	}
+
 	row, err = sqlGetRowByID(tx, rowID)
 	if err != nil {
 		goto End
 	}
 
 	// now find new refs and create them
-	re = regexp.MustCompile(`\[\[(.*?)\]\]`)
-	newTags = re.FindAllStringSubmatch(row.Text, -1)
+	newTags = RefNames(row.Text)
 
 	for _, newTag := range newTags {
-		tagID, err = sqlAddTag(tx, newTag[1])
+		tagID, err = sqlAddTag(tx, newTag)
 		if err != nil {
 			goto End
 		}
-		sqlAddRef(tx, tagID, rowID)
+		err = sqlAddRef(tx, tagID, rowID)
+		if err != nil {
+			goto End
+		}
+	}
+
+	// properties are derived from the row text just like refs
+	err = sqlUpdatePropertiesForRow(tx, row)
+	if err != nil {
+		goto End
 	}
 
 End:
@@ -287,11 +378,11 @@ func (e *ExoDB) UpdateRowText(rowID int64, text string) error {
 	}
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
 	return err
 }
 
-func (e *ExoDB) sqlUpdateRowRank(tx *sql.Tx, rowID int64, rank int) error {
+func sqlUpdateRowRank(tx *sql.Tx, rowID int64, rank float64) error {
 	var statement *sql.Stmt
 	var row Row
 	var err error
@@ -319,11 +410,13 @@ End:
 	return err
 }
 
-func (e *ExoDB) UpdateRowRank(rowID int64, rank int) error {
+// UpdateRowRank moves a row to the given 0-indexed position within its tag. Only the moved row is written. A position
+// past the last row leaves the row where it is.
+func (e *ExoDB) UpdateRowRank(rowID int64, position int) error {
 	var tx *sql.Tx
 	var row Row
-	var rows []Row
-	var newRank int
+	var count int
+	var ranks []float64
 	var err error
 
 	tx, err = e.conn.Begin()
@@ -337,37 +430,25 @@ func (e *ExoDB) UpdateRowRank(rowID int64, rank int) error {
 		goto End
 	}
 
-	// now get all rows for this tag
-	rows, err = sqlGetRowsForTagID(tx, row.TagID)
+	err = tx.QueryRow("SELECT COUNT(*) FROM row WHERE tag_id = ?", row.TagID).Scan(&count)
 	if err != nil {
 		goto End
 	}
-
-	if rank >= len(rows) {
+	if position >= count {
 		goto End
 	}
 
-	newRank = 0
-	for _, row := range rows {
-		if row.ID == rowID {
-			// this is our row; set the rank explicitly
-			err = e.sqlUpdateRowRank(tx, row.ID, rank)
-			if err != nil {
-				goto End
-			}
-		} else if newRank >= rank {
-			// this is not our row, and it's "below" the rank we want, so push it down
-			err = e.sqlUpdateRowRank(tx, row.ID, newRank+1)
-			newRank++
-		} else {
-			// normal ranking
-			err = e.sqlUpdateRowRank(tx, row.ID, newRank)
-			newRank++
-		}
+	ranks, err = sqlRanksAt(tx, row.TagID, position, 1, []int64{rowID})
+	if err != nil {
+		goto End
+	}
 
+	err = sqlUpdateRowRank(tx, rowID, ranks[0])
+	if err != nil {
+		goto End
 	}
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
 	return err
 }
@@ -77,3 +77,25 @@ func TestGetRowsForTagID(t *testing.T) {
 		t.Fatal("GetRowsForTagID row 1 text does not match expected")
 	}
 }
+
+func TestGetRowCounts(t *testing.T) {
+	db := setupDB(t)
+
+	addLinkedRows(t, &db, "monday", "[[coffee]]", "[[work]]")
+	addLinkedRows(t, &db, "tuesday", "nothing linked")
+
+	counts, err := db.GetRowCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]int{"monday": 2, "tuesday": 1, "coffee": 0} {
+		tag, err := db.GetTagByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counts[tag.ID] != expected {
+			t.Errorf("expected %d rows for %s, got %d", expected, name, counts[tag.ID])
+		}
+	}
+}
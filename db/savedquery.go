@@ -0,0 +1,166 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrQueryTag is returned when trying to add rows to a query tag
+var ErrQueryTag = errors.New("query tags can't hold rows")
+
+func sqlGetQueryForTag(tx *sql.Tx, tagID int64) (string, error) {
+	var query string
+	var sqlRow *sql.Row
+	var err error
+
+	sqlRow = tx.QueryRow("SELECT query FROM saved_query WHERE tag_id = $1", tagID)
+
+	err = sqlRow.Scan(&query)
+	if err != nil {
+		goto End
+	}
+
+End:
+	return query, err
+}
+
+func sqlIsQueryTag(tx *sql.Tx, tagID int64) (bool, error) {
+	var count int
+	var err error
+
+	err = tx.QueryRow("SELECT COUNT(*) FROM saved_query WHERE tag_id = $1", tagID).Scan(&count)
+
+	return count > 0, err
+}
+
+func sqlSetQueryForTag(tx *sql.Tx, tagID int64, query string) error {
+	var statement *sql.Stmt
+	var err error
+
+	statement, err = tx.Prepare("INSERT OR REPLACE INTO saved_query (tag_id, query) VALUES ($1, $2)")
+	if err != nil {
+		goto End
+	}
+
+	_, err = statement.Exec(tagID, query)
+	if err != nil {
+		goto End
+	}
+
+	err = sqlUpdateTagTS(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+End:
+	return err
+}
+
+// AddQueryTag saves query as a tag named name. An existing tag can only become a query tag if it has no rows.
+func (e *ExoDB) AddQueryTag(name string, query string) (Tag, error) {
+	var tx *sql.Tx
+	var tag Tag
+	var tagID int64
+	var rows []Row
+	var locked bool
+	var err error
+
+	_, err = ParseQuery(query)
+	if err != nil {
+		return tag, err
+	}
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	tagID, err = sqlAddTag(tx, name)
+	if err != nil {
+		goto End
+	}
+
+	locked, err = sqlIsTagLocked(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	if locked {
+		err = ErrTagLocked
+		goto End
+	}
+
+	rows, err = sqlGetRowsForTagID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	if len(rows) > 0 {
+		err = fmt.Errorf("tag %s already has rows", name)
+		goto End
+	}
+
+	err = sqlSetQueryForTag(tx, tagID, query)
+	if err != nil {
+		goto End
+	}
+
+	tag, err = sqlGetTagByID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return tag, err
+}
+
+// UpdateQueryTag replaces the query saved in a query tag. An empty query turns it back into an ordinary tag.
+func (e *ExoDB) UpdateQueryTag(tagID int64, query string) error {
+	var tx *sql.Tx
+	var err error
+
+	if query != "" {
+		_, err = ParseQuery(query)
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	if query == "" {
+		_, err = tx.Exec("DELETE FROM saved_query WHERE tag_id = $1", tagID)
+		goto End
+	}
+
+	err = sqlSetQueryForTag(tx, tagID, query)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return err
+}
+
+func (e *ExoDB) GetQueryForTag(tagID int64) (string, error) {
+	var tx *sql.Tx
+	var query string
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	query, err = sqlGetQueryForTag(tx, tagID)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return query, err
+}
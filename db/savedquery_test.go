@@ -0,0 +1,93 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestQueryTag(t *testing.T) {
+	var db ExoDB
+	var state State
+	var tag, queryTag Tag
+	var tags []Tag
+	var err error
+
+	db = setupDB(t)
+
+	tag, err = db.AddTag("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"[[todo]] one", "[[todo]] [[done]] two", "[[todo]] three"} {
+		_, err = db.AddRow(tag.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = db.AddQueryTag("open todos", "[[todo]] (")
+	if err == nil {
+		t.Fatal("AddQueryTag accepted an invalid query")
+	}
+
+	queryTag, err = db.AddQueryTag("open todos", "[[todo]] -[[done]]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if queryTag.Kind != TagKindQuery {
+		t.Fatal("AddQueryTag did not return a query tag")
+	}
+
+	tags, err = db.GetAllTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tag := range tags {
+		if (tag.Name == "open todos") != (tag.Kind == TagKindQuery) {
+			t.Error(fmt.Sprintf("unexpected kind %d for tag %s", tag.Kind, tag.Name))
+		}
+	}
+
+	_, err = db.AddRow(queryTag.ID, "a row", 0)
+	if err != ErrQueryTag {
+		t.Fatal(fmt.Sprintf("expected ErrQueryTag adding a row to a query tag, got %v", err))
+	}
+
+	state.DB = &db
+	state.CurrentDBTag = queryTag
+	err = state.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(state.CurrentDBRows) != 0 || len(state.SortedQueryTagsKeys) != 1 || len(state.CurrentDBQueryResults[state.SortedQueryTagsKeys[0]]) != 2 {
+		t.Fatal(fmt.Sprintf("unexpected query tag contents: %+v", state.CurrentDBQueryResults))
+	}
+
+	err = state.DeleteTagIfEmpty(queryTag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.GetTagByID(queryTag.ID)
+	if err != nil {
+		t.Fatal("DeleteTagIfEmpty deleted a query tag")
+	}
+
+	err = db.UpdateQueryTag(queryTag.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queryTag, err = db.GetTagByID(queryTag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if queryTag.Kind != TagKindNormal {
+		t.Fatal("clearing the query did not turn the tag back into a normal tag")
+	}
+}
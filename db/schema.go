@@ -11,6 +11,7 @@ CREATE TABLE IF NOT EXISTS "ref" (
 CREATE TABLE IF NOT EXISTS "tag" (
 	"id"	INTEGER,
 	"name"	TEXT NOT NULL UNIQUE,
+	"key"	TEXT NOT NULL DEFAULT '',
 	"refcount"	INTEGER NOT NULL DEFAULT 0,
 	"updated_ts"	INTEGER DEFAULT 0,
 	PRIMARY KEY("id")
@@ -25,4 +26,70 @@ CREATE TABLE IF NOT EXISTS "row" (
 	FOREIGN KEY("tag_id") REFERENCES "tag"("id") ON DELETE CASCADE,
 	PRIMARY KEY("id")
 );
+CREATE INDEX IF NOT EXISTS "row_tag_id_rank" ON "row" ("tag_id", "rank");
+CREATE INDEX IF NOT EXISTS "ref_row_id" ON "ref" ("row_id");
+CREATE TABLE IF NOT EXISTS "setting" (
+	"key"	TEXT NOT NULL,
+	"value"	TEXT NOT NULL,
+	PRIMARY KEY("key")
+);
+CREATE TABLE IF NOT EXISTS "property" (
+	"row_id"	INTEGER NOT NULL,
+	"key"	TEXT NOT NULL,
+	"value"	TEXT NOT NULL,
+	"num"	REAL,
+	FOREIGN KEY("row_id") REFERENCES "row"("id") ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "property_row_id" ON "property" ("row_id");
+CREATE INDEX IF NOT EXISTS "property_key" ON "property" ("key");
+CREATE TABLE IF NOT EXISTS "saved_query" (
+	"tag_id"	INTEGER NOT NULL,
+	"query"	TEXT NOT NULL,
+	FOREIGN KEY("tag_id") REFERENCES "tag"("id") ON DELETE CASCADE,
+	PRIMARY KEY("tag_id")
+);
+CREATE TRIGGER IF NOT EXISTS "ref_insert_refcount" AFTER INSERT ON "ref" BEGIN
+	UPDATE "tag" SET "refcount" = "refcount" + 1 WHERE "id" = NEW."tag_id";
+END;
+CREATE TRIGGER IF NOT EXISTS "ref_delete_refcount" AFTER DELETE ON "ref" BEGIN
+	UPDATE "tag" SET "refcount" = "refcount" - 1 WHERE "id" = OLD."tag_id";
+END;
+CREATE TABLE IF NOT EXISTS "trash_tag" (
+	"id"	INTEGER,
+	"tag_id"	INTEGER NOT NULL,
+	"name"	TEXT NOT NULL,
+	"query"	TEXT,
+	"deleted_ts"	INTEGER NOT NULL,
+	PRIMARY KEY("id")
+);
+CREATE TABLE IF NOT EXISTS "trash_row" (
+	"id"	INTEGER,
+	"row_id"	INTEGER NOT NULL,
+	"tag_id"	INTEGER NOT NULL,
+	"tag_name"	TEXT NOT NULL,
+	"rank"	INTEGER,
+	"text"	BLOB,
+	"parent_row_id"	INTEGER,
+	"updated_ts"	INTEGER,
+	"deleted_ts"	INTEGER NOT NULL,
+	"trash_tag_id"	INTEGER,
+	FOREIGN KEY("trash_tag_id") REFERENCES "trash_tag"("id") ON DELETE CASCADE,
+	PRIMARY KEY("id")
+);
+CREATE TABLE IF NOT EXISTS "snarf" (
+	"register"	TEXT NOT NULL,
+	"position"	INTEGER NOT NULL,
+	"row_id"	INTEGER,
+	"tag_id"	INTEGER,
+	"text"	BLOB,
+	PRIMARY KEY("register","position")
+);
+CREATE TABLE IF NOT EXISTS "tag_lock" (
+	"tag_id"	INTEGER NOT NULL,
+	"salt"	BLOB NOT NULL,
+	"iterations"	INTEGER NOT NULL,
+	"verifier"	TEXT NOT NULL,
+	FOREIGN KEY("tag_id") REFERENCES "tag"("id") ON DELETE CASCADE,
+	PRIMARY KEY("tag_id")
+);
 `
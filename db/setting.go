@@ -0,0 +1,121 @@
+package db
+
+import (
+	"database/sql"
+)
+
+// sqlGetSetting returns the value stored for key, or def if the key has never been set
+func sqlGetSetting(tx *sql.Tx, key string, def string) (string, error) {
+	var value string
+	var sqlRow *sql.Row
+	var err error
+
+	sqlRow = tx.QueryRow("SELECT value FROM setting WHERE key = $1", key)
+
+	err = sqlRow.Scan(&value)
+	if err == sql.ErrNoRows {
+		value = def
+		err = nil
+	}
+
+	return value, err
+}
+
+func sqlSetSetting(tx *sql.Tx, key string, value string) error {
+	var statement *sql.Stmt
+	var err error
+
+	statement, err = tx.Prepare("INSERT OR REPLACE INTO setting (key, value) VALUES ($1, $2)")
+	if err != nil {
+		goto End
+	}
+
+	_, err = statement.Exec(key, value)
+	if err != nil {
+		goto End
+	}
+
+End:
+	return err
+}
+
+func sqlGetAllSettings(tx *sql.Tx) (map[string]string, error) {
+	var settings map[string]string
+	var sqlRows *sql.Rows
+	var err error
+
+	sqlRows, err = tx.Query("SELECT key, value FROM setting ORDER BY key")
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	settings = make(map[string]string)
+	for sqlRows.Next() {
+		var key, value string
+		err = sqlRows.Scan(&key, &value)
+		if err != nil {
+			goto End
+		}
+		settings[key] = value
+	}
+
+End:
+	return settings, err
+}
+
+// GetSetting returns the workspace setting stored under key, or def if it has never been set
+func (e *ExoDB) GetSetting(key string, def string) (string, error) {
+	var tx *sql.Tx
+	var value string
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	value, err = sqlGetSetting(tx, key, def)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return value, err
+}
+
+// SetSetting stores a workspace setting. Settings live in the database itself, so each database
+// carries its own configuration.
+func (e *ExoDB) SetSetting(key string, value string) error {
+	var tx *sql.Tx
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	err = sqlSetSetting(tx, key, value)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return err
+}
+
+func (e *ExoDB) GetAllSettings() (map[string]string, error) {
+	var tx *sql.Tx
+	var settings map[string]string
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	settings, err = sqlGetAllSettings(tx)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return settings, err
+}
@@ -0,0 +1,225 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// SnarfDefaultRegister is the register used when no register is given
+const SnarfDefaultRegister = "\""
+
+// ErrEmptyRegister is returned when pasting from a register that holds no rows
+var ErrEmptyRegister = errors.New("empty snarf register")
+
+// sqlPushSnarf replaces the contents of a register with rows
+func sqlPushSnarf(tx *sql.Tx, register string, rows []Row) error {
+	var statement *sql.Stmt
+	var err error
+
+	_, err = tx.Exec("DELETE FROM snarf WHERE register = $1", register)
+	if err != nil {
+		goto End
+	}
+
+	// the rows of locked tags stay sealed
+	statement, err = tx.Prepare("INSERT INTO snarf (register, position, row_id, tag_id, text) VALUES ($1, $2, $3, $4, " + sealedText("$4", "$5") + ")")
+	if err != nil {
+		goto End
+	}
+
+	for i, row := range rows {
+		_, err = statement.Exec(register, i, row.ID, row.TagID, row.Text)
+		if err != nil {
+			goto End
+		}
+	}
+
+End:
+	return err
+}
+
+// sqlGetSnarf returns the rows held by a register. The rows keep the ID and tag they were snarfed from, which may no
+// longer exist.
+func sqlGetSnarf(tx *sql.Tx, register string) ([]Row, error) {
+	var rows []Row
+	var sqlRows *sql.Rows
+	var err error
+
+	sqlRows, err = tx.Query("SELECT row_id, tag_id, "+openedText("snarf")+" FROM snarf WHERE register = $1 AND "+visibleRow("snarf")+" ORDER BY position", register)
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	for sqlRows.Next() {
+		var row Row
+		err = sqlRows.Scan(&row.ID, &row.TagID, &row.Text)
+		if err != nil {
+			goto End
+		}
+		rows = append(rows, row)
+	}
+
+End:
+	return rows, err
+}
+
+// sqlGetCutRow returns the trashed copy of a snarfed row, if the row was deleted without being changed and is
+// still in the trash
+func sqlGetCutRow(tx *sql.Tx, row Row) (TrashedRow, bool, error) {
+	var sqlRows *sql.Rows
+	var trashedRows []TrashedRow
+	var err error
+
+	sqlRows, err = tx.Query("SELECT "+trashRowColumns+` FROM trash_row
+							 WHERE row_id = $1 AND `+openedText("trash_row")+` = $2 AND trash_tag_id IS NULL
+							 AND NOT EXISTS (SELECT 1 FROM row WHERE id = $1)
+							 ORDER BY deleted_ts desc LIMIT 1`, row.ID, row.Text)
+	if err != nil {
+		return TrashedRow{}, false, err
+	}
+
+	trashedRows, err = scanTrashedRows(sqlRows)
+	if err != nil || len(trashedRows) == 0 {
+		return TrashedRow{}, false, err
+	}
+
+	return trashedRows[0], true, nil
+}
+
+// PushSnarf replaces the contents of a register with rows
+func (e *ExoDB) PushSnarf(register string, rows []Row) error {
+	var tx *sql.Tx
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	err = sqlPushSnarf(tx, register, rows)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return err
+}
+
+func (e *ExoDB) GetSnarf(register string) ([]Row, error) {
+	var tx *sql.Tx
+	var rows []Row
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	rows, err = sqlGetSnarf(tx, register)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return rows, err
+}
+
+// GetSnarfRegisters returns the contents of every register that holds rows
+func (e *ExoDB) GetSnarfRegisters() (map[string][]Row, error) {
+	var tx *sql.Tx
+	var registers map[string][]Row
+	var sqlRows *sql.Rows
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	sqlRows, err = tx.Query("SELECT register, row_id, tag_id, " + openedText("snarf") + " FROM snarf WHERE " + visibleRow("snarf") + " ORDER BY register, position")
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	registers = make(map[string][]Row)
+	for sqlRows.Next() {
+		var register string
+		var row Row
+		err = sqlRows.Scan(&register, &row.ID, &row.TagID, &row.Text)
+		if err != nil {
+			goto End
+		}
+		registers[register] = append(registers[register], row)
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return registers, err
+}
+
+// PasteSnarf adds the rows held by a register to a tag, starting at the given 0-indexed position. A negative
+// position appends them. Rows that were cut (deleted after being snarfed) are moved out of the trash, keeping their
+// identity; the rest are copied.
+func (e *ExoDB) PasteSnarf(register string, tagID int64, position int) ([]Row, error) {
+	var tx *sql.Tx
+	var snarfed, rows []Row
+	var rowIDs []int64
+	var rowID int64
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	snarfed, err = sqlGetSnarf(tx, register)
+	if err != nil {
+		goto End
+	}
+
+	if len(snarfed) == 0 {
+		err = ErrEmptyRegister
+		goto End
+	}
+
+	for _, row := range snarfed {
+		var cut TrashedRow
+		var ok bool
+		cut, ok, err = sqlGetCutRow(tx, row)
+		if err != nil {
+			goto End
+		}
+
+		// either put the cut row back where it was or copy it to the end of the tag; the move below puts it in place
+		if ok {
+			rowID, err = sqlRestoreRow(tx, cut)
+		} else {
+			rowID, err = sqlAppendRow(tx, tagID, row.Text, 0)
+		}
+		if err != nil {
+			goto End
+		}
+
+		rowIDs = append(rowIDs, rowID)
+	}
+
+	err = sqlMoveRowsToTag(tx, rowIDs, tagID, position)
+	if err != nil {
+		goto End
+	}
+
+	for _, rowID = range rowIDs {
+		var row Row
+		row, err = sqlGetRowByID(tx, rowID)
+		if err != nil {
+			goto End
+		}
+		rows = append(rows, row)
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return rows, err
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSnarf(t *testing.T) {
+	var db ExoDB
+	var src, dst Tag
+	var rows, snarfed, pasted []Row
+	var registers map[string][]Row
+	var err error
+
+	db = setupDB(t)
+
+	src, err = db.AddTag("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err = db.AddTag("dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"one", "two [[other]]"} {
+		_, err = db.AddRow(src.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, text := range []string{"first", "last"} {
+		_, err = db.AddRow(dst.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err = db.GetRowsForTagID(src.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.PushSnarf("a", rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.PushSnarf(SnarfDefaultRegister, rows[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// snarfed rows outlive the rows they came from
+	err = db.DeleteRowByID(rows[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snarfed, err = db.GetSnarf("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(snarfed) != 2 || snarfed[0].Text != "one" || snarfed[1].ID != rows[1].ID {
+		t.Fatal(fmt.Sprintf("unexpected register contents: %+v", snarfed))
+	}
+
+	registers, err = db.GetSnarfRegisters()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(registers) != 2 || len(registers[SnarfDefaultRegister]) != 1 {
+		t.Fatal(fmt.Sprintf("unexpected registers: %+v", registers))
+	}
+
+	pasted, err = db.PasteSnarf("a", dst.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pasted) != 2 {
+		t.Fatal(fmt.Sprintf("expected 2 pasted rows, got %d", len(pasted)))
+	}
+
+	rows, err = db.GetRowsForTagID(dst.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	texts := ""
+	for _, row := range rows {
+		texts += row.Text + ","
+	}
+
+	if texts != "first,one,two [[other]],last," {
+		t.Fatal("rows weren't pasted at the given rank: " + texts)
+	}
+
+	_, err = db.PasteSnarf("empty", dst.ID, -1)
+	if err != ErrEmptyRegister {
+		t.Fatal(fmt.Sprintf("expected ErrEmptyRegister, got %v", err))
+	}
+}
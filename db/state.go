@@ -1,54 +1,182 @@
 package db
 
 import (
+	"database/sql"
 	"sort"
+	"time"
 )
 
 type State struct {
-	DB                *ExoDB
-	AllDBTags         []Tag
-	CurrentDBTag      Tag
-	CurrentDBRows     []Row
+	DB            *ExoDB
+	AllDBTags     []Tag
+	CurrentDBTag  Tag
+	CurrentDBRows []Row
+	// rows referencing CurrentDBTag or any tag namespaced below it
 	CurrentDBRefs     Refs
 	SortedRefTagsKeys []Tag
+	// the namespaces CurrentDBTag is in, outermost first, and the tags one level below it
+	CurrentDBAncestors []Tag
+	CurrentDBChildTags []Tag
+	// the tags most used alongside CurrentDBTag, best first
+	CurrentDBRelatedTags []Tag
+	// rows mentioning CurrentDBTag's name without linking to it, only found while ShowUnlinkedRefs is set, since it
+	// takes reading every row
+	ShowUnlinkedRefs          bool
+	CurrentDBUnlinkedRefs     Refs
+	SortedUnlinkedRefTagsKeys []Tag
+	// set when CurrentDBTag is a query tag
+	CurrentDBQuery        string
+	CurrentDBQueryResults Refs
+	SortedQueryTagsKeys   []Tag
+	// tags linked from any of the rows above, by TagKey
+	LinkedTags map[string]Tag
 }
 
 func (s *State) Refresh() error {
+	var related []RelatedTag
 	var err error
-	var i int
 
 	s.AllDBTags, err = s.DB.GetAllTags()
 	if err != nil {
 		goto End
 	}
 
+	// the placeholder tag of a read-only database isn't in it, and has nothing to show
+	if s.CurrentDBTag.ID == 0 {
+		*s = State{DB: s.DB, AllDBTags: s.AllDBTags, CurrentDBTag: s.CurrentDBTag, ShowUnlinkedRefs: s.ShowUnlinkedRefs}
+		goto End
+	}
+
 	s.CurrentDBRows, err = s.DB.GetRowsForTagID(s.CurrentDBTag.ID)
 	if err != nil {
 		goto End
 	}
 
 	// refs
-	s.CurrentDBRefs, err = s.DB.GetRefsToTagByTagID(s.CurrentDBTag.ID)
+	s.CurrentDBRefs, err = s.DB.GetRefsToTagAndDescendants(s.CurrentDBTag.ID)
+	if err != nil {
+		goto End
+	}
 
 	// sorted ref keys
-	s.SortedRefTagsKeys = make([]Tag, len(s.CurrentDBRefs))
-	i = 0
-	for k := range s.CurrentDBRefs {
-		s.SortedRefTagsKeys[i] = k
-		i++
+	s.SortedRefTagsKeys = SortedRefTags(s.CurrentDBRefs)
+
+	s.CurrentDBAncestors, err = s.DB.GetTagAncestors(s.CurrentDBTag.ID)
+	if err != nil {
+		goto End
 	}
 
-	sort.Slice(s.SortedRefTagsKeys, func(i, j int) bool { return s.SortedRefTagsKeys[i].UpdatedTS > s.SortedRefTagsKeys[j].UpdatedTS })
+	s.CurrentDBChildTags, err = s.DB.GetChildTags(s.CurrentDBTag.ID)
+	if err != nil {
+		goto End
+	}
+
+	related, err = s.DB.SuggestRelatedTags(s.CurrentDBTag.ID)
+	if err != nil {
+		goto End
+	}
+	s.CurrentDBRelatedTags = nil
+	for _, r := range related {
+		s.CurrentDBRelatedTags = append(s.CurrentDBRelatedTags, r.Tag)
+	}
+
+	s.CurrentDBUnlinkedRefs = nil
+	if s.ShowUnlinkedRefs {
+		s.CurrentDBUnlinkedRefs, err = s.DB.GetUnlinkedRefsToTagByTagID(s.CurrentDBTag.ID)
+		if err != nil {
+			goto End
+		}
+	}
+
+	s.SortedUnlinkedRefTagsKeys = SortedRefTags(s.CurrentDBUnlinkedRefs)
+
+	s.CurrentDBQuery = ""
+	s.CurrentDBQueryResults = nil
+	s.SortedQueryTagsKeys = nil
+	if s.CurrentDBTag.Kind == TagKindQuery {
+		s.CurrentDBQuery, err = s.DB.GetQueryForTag(s.CurrentDBTag.ID)
+		if err != nil {
+			goto End
+		}
+
+		s.CurrentDBQueryResults, err = s.DB.RunQuery(s.CurrentDBQuery)
+		if err != nil {
+			goto End
+		}
+
+		s.SortedQueryTagsKeys = SortedRefTags(s.CurrentDBQueryResults)
+	}
+
+	s.LinkedTags, err = s.DB.GetLinkedTags(s.rowIDs())
 
 End:
 	return err
 }
 
+// rowIDs returns the IDs of every row the state holds
+func (s *State) rowIDs() []int64 {
+	var ids []int64
+
+	for _, row := range s.CurrentDBRows {
+		ids = append(ids, row.ID)
+	}
+	for _, refs := range []Refs{s.CurrentDBRefs, s.CurrentDBUnlinkedRefs, s.CurrentDBQueryResults} {
+		for _, rows := range refs {
+			for _, row := range rows {
+				ids = append(ids, row.ID)
+			}
+		}
+	}
+
+	return ids
+}
+
+// LinkedTag returns the named tag linked from a row of the state, falling back to the database for rows the state
+// doesn't hold
+func (s *State) LinkedTag(name string) (Tag, error) {
+	if tag, ok := s.LinkedTags[TagKey(name)]; ok {
+		return tag, nil
+	}
+
+	return s.DB.GetTagByName(name)
+}
+
+// DateTag returns the tag for the given day, creating it unless the database is read-only. A read-only database
+// without a tag for the day gets an empty placeholder tag, with no ID.
+func (s *State) DateTag(t time.Time) (Tag, error) {
+	if !s.DB.ReadOnly() {
+		return s.DB.AddDateTag(t)
+	}
+
+	tag, err := s.DB.GetTagByName(t.Format(DateTagFormat))
+	if err == sql.ErrNoRows {
+		return Tag{Name: t.Format(DateTagFormat)}, nil
+	}
+
+	return tag, err
+}
+
 func (s *State) DeleteTagIfEmpty(id int64) error {
+	var tag Tag
 	var rows []Row
 	var refs Refs
+	var children []Tag
 	var err error
 
+	// nothing is cleaned up in a read-only database
+	if s.DB.ReadOnly() {
+		goto End
+	}
+
+	// query tags never own rows, and locked tags may only seem not to, but neither is empty
+	tag, err = s.DB.GetTagByID(id)
+	if err != nil || tag.Kind == TagKindQuery || tag.Kind == TagKindLocked {
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		goto End
+	}
+
 	rows, err = s.DB.GetRowsForTagID(id)
 	if err != nil {
 		goto End
@@ -59,10 +187,43 @@ func (s *State) DeleteTagIfEmpty(id int64) error {
 		goto End
 	}
 
-	if len(rows)+len(refs) == 0 {
+	children, err = s.DB.GetChildTags(id)
+	if err != nil {
+		goto End
+	}
+
+	if len(rows)+len(refs)+len(children) == 0 {
 		err = s.DB.DeleteTagByID(id)
+		if err != nil {
+			goto End
+		}
+
+		// the parent may have been kept around only for this tag
+		if name, ok := ParentTagName(tag.Name); ok {
+			tag, err = s.DB.GetTagByName(name)
+			if err == sql.ErrNoRows {
+				err = nil
+				goto End
+			}
+			if err != nil {
+				goto End
+			}
+			err = s.DeleteTagIfEmpty(tag.ID)
+		}
 	}
 
 End:
 	return err
 }
+
+// SortedRefTags returns the tags of refs, most recently updated first
+func SortedRefTags(refs Refs) []Tag {
+	tags := make([]Tag, 0, len(refs))
+	for k := range refs {
+		tags = append(tags, k)
+	}
+
+	sort.Slice(tags, func(i, j int) bool { return tags[i].UpdatedTS > tags[j].UpdatedTS })
+
+	return tags
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+)
+
+func TestRefreshLinkedTags(t *testing.T) {
+	db := setupDB(t)
+
+	tag, err := db.AddTag("home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddRow(tag.ID, "see [[a]] and [[b]]", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.AddTag("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddRow(other.ID, "back to [[home]] via [[c]]", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := State{DB: &db, CurrentDBTag: tag}
+	err = s.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "b", "c", "home"} {
+		if s.LinkedTags[name].Name != name {
+			t.Fatalf("%s wasn't loaded: %v", name, s.LinkedTags)
+		}
+	}
+	if len(s.LinkedTags) != 4 {
+		t.Fatalf("expected 4 linked tags, got %v", s.LinkedTags)
+	}
+
+	refTags := SortedRefTags(s.CurrentDBRefs)
+	if len(refTags) != 1 || refTags[0].ID != other.ID || refTags[0].Name != "other" {
+		t.Fatalf("unexpected refs: %v", s.CurrentDBRefs)
+	}
+
+	// tags not linked from the state's rows still resolve
+	linked, err := s.LinkedTag("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked.ID != other.ID {
+		t.Fatalf("expected tag %d, got %d", other.ID, linked.ID)
+	}
+}
+
+func TestRefreshUnlinkedRefs(t *testing.T) {
+	db := setupDB(t)
+
+	tag, err := db.AddTag("home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.AddTag("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddRow(other.ID, "went home early", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := State{DB: &db, CurrentDBTag: tag}
+	err = s.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.CurrentDBUnlinkedRefs) != 0 {
+		t.Fatalf("expected no unlinked refs until they're asked for, got %v", s.CurrentDBUnlinkedRefs)
+	}
+
+	s.ShowUnlinkedRefs = true
+	err = s.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.SortedUnlinkedRefTagsKeys) != 1 || s.SortedUnlinkedRefTagsKeys[0].ID != other.ID {
+		t.Fatalf("unexpected unlinked refs: %v", s.CurrentDBUnlinkedRefs)
+	}
+}
+
+func TestGetLinkedTagsBatches(t *testing.T) {
+	db := setupDB(t)
+
+	tag, err := db.AddTag("many")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rowIDs []int64
+	for i := 0; i < maxLinkedTagsBatch*2+1; i++ {
+		row, err := db.AddRow(tag.ID, fmt.Sprintf("[[t%d]]", i), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rowIDs = append(rowIDs, row.ID)
+	}
+
+	tags, err := db.GetLinkedTags(rowIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != len(rowIDs) {
+		t.Fatalf("expected %d linked tags, got %d", len(rowIDs), len(tags))
+	}
+}
+
+// legacyGetRefsToTagByTagID is the old way of loading refs, which looked up the tag of every row separately. It's
+// kept for comparison in benchmarks.
+func legacyGetRefsToTagByTagID(tx *sql.Tx, tagID int64) (Refs, error) {
+	rows, err := tx.Query(`SELECT r.id, r.tag_id, r.parent_row_id, r.text, r.rank, r.updated_ts
+						   FROM row as r, ref
+						   WHERE ref.tag_id = $1
+						   AND r.id = ref.row_id
+						   ORDER BY r.tag_id asc, r.rank asc`, tagID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := make(Refs)
+	for rows.Next() {
+		var row Row
+		err = rows.Scan(&row.ID, &row.TagID, &row.ParentRowID, &row.Text, &row.Rank, &row.UpdatedTS)
+		if err != nil {
+			return nil, err
+		}
+		tag, err := sqlGetTagByID(tx, row.TagID)
+		if err != nil {
+			return nil, err
+		}
+		refs[tag] = append(refs[tag], row)
+	}
+
+	return refs, rows.Err()
+}
+
+// resolveLinks looks up the tag of every link in refs, the way the frontends do when rendering rows
+func resolveLinks(b *testing.B, refs Refs, lookup func(string) (Tag, error)) {
+	for _, rows := range refs {
+		for _, row := range rows {
+			for _, name := range RefNames(row.Text) {
+				_, err := lookup(name)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkRefresh times loading a tag's refs and the tags their rows link to, the part of Refresh that used to look
+// up tags row by row, against the old lookups doing the same work
+func BenchmarkRefresh(b *testing.B) {
+	// about 100k rows, thousands of which refer to the most linked topic
+	db, hub := setupGeneratedBenchmark(b, GenerateOptions{Days: 5000, RowsPerDay: 15, Topics: 1000, RowsPerTopic: 25, LongRowRatio: 0.1, Seed: 1})
+
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			refs, err := db.GetRefsToTagByTagID(hub.ID)
+			if err != nil {
+				b.Fatal(err)
+			}
+			s := State{DB: &db, CurrentDBRefs: refs}
+			s.LinkedTags, err = db.GetLinkedTags(s.rowIDs())
+			if err != nil {
+				b.Fatal(err)
+			}
+			resolveLinks(b, refs, s.LinkedTag)
+		}
+	})
+	b.Run("legacy", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tx, err := db.conn.Begin()
+			if err != nil {
+				b.Fatal(err)
+			}
+			refs, err := legacyGetRefsToTagByTagID(tx, hub.ID)
+			err = sqlCommitOrRollback(tx, err)
+			if err != nil {
+				b.Fatal(err)
+			}
+			resolveLinks(b, refs, db.GetTagByName)
+		}
+	})
+}
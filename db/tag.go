@@ -7,15 +7,71 @@ import (
 	"time"
 
 	"github.com/mattn/go-sqlite3"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// TagKind distinguishes ordinary tags from virtual ones
+type TagKind int
+
+const (
+	// TagKindNormal tags own rows
+	TagKindNormal TagKind = iota
+	// TagKindQuery tags own no rows; their contents are the live results of a saved query
+	TagKindQuery
+	// TagKindLocked tags own rows that are hidden until the tag is unlocked
+	TagKindLocked
 )
 
 type Tag struct {
 	ID        int64
 	Name      string
 	UpdatedTS int64
+	Kind      TagKind
+}
+
+// tagKind selects the Kind of table's current row, for tables holding tags
+func tagKind(table string) string {
+	return fmt.Sprintf(`CASE WHEN EXISTS (SELECT 1 FROM saved_query WHERE saved_query.tag_id = %[1]s.id) THEN %[2]d
+						WHEN EXISTS (SELECT 1 FROM tag_lock WHERE tag_lock.tag_id = %[1]s.id) THEN %[3]d
+						ELSE %[4]d END`, table, TagKindQuery, TagKindLocked, TagKindNormal)
+}
+
+// tagKindColumn selects the Kind of the tag table's current row
+var tagKindColumn = tagKind("tag")
+
+// TagKey returns the key identifying the tag called name. Names that only differ in case, Unicode normalization or
+// whitespace have the same key, so they refer to the same tag.
+func TagKey(name string) string {
+	key := strings.Join(strings.Fields(foldText(name)), " ")
+
+	// namespace levels are compared without the whitespace around them
+	if segments := namespaceSegments(key); segments != nil {
+		for i := range segments {
+			segments[i] = strings.TrimSpace(segments[i])
+		}
+		key = strings.Join(segments, NamespaceSeparator)
+	}
+
+	return key
+}
+
+// foldText folds the case and Unicode normalization of text the way TagKey does, leaving its whitespace alone
+func foldText(text string) string {
+	return norm.NFKC.String(cases.Fold().String(norm.NFKC.String(text)))
 }
 
 func sqlAddTag(tx *sql.Tx, name string) (int64, error) {
+	var tagID int64
+	var err error
+
+	tagID, _, err = sqlInsertTag(tx, name)
+
+	return tagID, err
+}
+
+// sqlInsertTag adds the named tag if no tag with the same key exists yet, and reports whether it was newly created
+func sqlInsertTag(tx *sql.Tx, name string) (int64, bool, error) {
 	var statement *sql.Stmt
 	var res sql.Result
 	var tagID int64
@@ -23,12 +79,12 @@ func sqlAddTag(tx *sql.Tx, name string) (int64, error) {
 	var duplicateEntry bool
 	var err error
 
-	statement, err = tx.Prepare("INSERT INTO tag (name, updated_ts) VALUES (?, ?)")
+	statement, err = tx.Prepare("INSERT INTO tag (name, key, updated_ts) VALUES (?, ?, ?)")
 	if err != nil {
 		goto End
 	}
 
-	res, err = statement.Exec(name, time.Now().UnixNano())
+	res, err = statement.Exec(name, TagKey(name), time.Now().UnixNano())
 	// it's not an error if this tag name already exists
 	if sqliteErr, ok := err.(sqlite3.Error); ok {
 		if sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
@@ -44,6 +100,11 @@ func sqlAddTag(tx *sql.Tx, name string) (int64, error) {
 		if err != nil {
 			goto End
 		}
+
+		err = sqlAddParentTags(tx, name)
+		if err != nil {
+			goto End
+		}
 	} else {
 		tag, err = sqlGetTagByName(tx, name)
 		if err != nil {
@@ -53,17 +114,18 @@ func sqlAddTag(tx *sql.Tx, name string) (int64, error) {
 	}
 
 End:
-	return tagID, err
+	return tagID, !duplicateEntry, err
 }
 
+// sqlGetTagByName returns the tag with the same key as name
 func sqlGetTagByName(tx *sql.Tx, name string) (Tag, error) {
 	var tag Tag
 	var sqlRow *sql.Row
 	var err error
 
-	sqlRow = tx.QueryRow("SELECT id, name, updated_ts FROM tag WHERE name = $1", name)
+	sqlRow = tx.QueryRow("SELECT id, name, updated_ts, "+tagKindColumn+" FROM tag WHERE key = $1", TagKey(name))
 
-	err = sqlRow.Scan(&tag.ID, &tag.Name, &tag.UpdatedTS)
+	err = sqlRow.Scan(&tag.ID, &tag.Name, &tag.UpdatedTS, &tag.Kind)
 	if err != nil {
 		goto End
 	}
@@ -94,7 +156,7 @@ func (e *ExoDB) AddTag(name string) (Tag, error) {
 	}
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
 
 	return tag, err
 }
@@ -105,14 +167,14 @@ func sqlGetAllTags(tx *sql.Tx) ([]Tag, error) {
 	var sqlRows *sql.Rows
 	var err error
 
-	sqlRows, err = tx.Query("SELECT id, name, updated_ts FROM tag ORDER BY updated_ts desc")
+	sqlRows, err = tx.Query("SELECT id, name, updated_ts, " + tagKindColumn + " FROM tag ORDER BY updated_ts desc")
 	if err != nil {
 		goto End
 	}
 	defer sqlRows.Close()
 
 	for sqlRows.Next() {
-		err = sqlRows.Scan(&tag.ID, &tag.Name, &tag.UpdatedTS)
+		err = sqlRows.Scan(&tag.ID, &tag.Name, &tag.UpdatedTS, &tag.Kind)
 		if err != nil {
 			goto End
 		}
@@ -136,7 +198,7 @@ func (e *ExoDB) GetAllTags() ([]Tag, error) {
 	tags, err = sqlGetAllTags(tx)
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
 
 	return tags, err
 }
@@ -163,9 +225,9 @@ func sqlGetTagByID(tx *sql.Tx, id int64) (Tag, error) {
 	var err error
 	var sqlRow *sql.Row
 
-	sqlRow = tx.QueryRow("SELECT id, name, updated_ts FROM tag WHERE id = $1", id)
+	sqlRow = tx.QueryRow("SELECT id, name, updated_ts, "+tagKindColumn+" FROM tag WHERE id = $1", id)
 
-	err = sqlRow.Scan(&tag.ID, &tag.Name, &tag.UpdatedTS)
+	err = sqlRow.Scan(&tag.ID, &tag.Name, &tag.UpdatedTS, &tag.Kind)
 	if err != nil {
 		goto End
 	}
@@ -187,7 +249,7 @@ func (e *ExoDB) GetTagByID(id int64) (Tag, error) {
 	tag, err = sqlGetTagByID(tx, id)
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
 
 	return tag, err
 }
@@ -205,7 +267,7 @@ func (e *ExoDB) GetTagByName(name string) (Tag, error) {
 	tag, err = sqlGetTagByName(tx, name)
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
 
 	return tag, err
 }
@@ -214,6 +276,12 @@ func sqlDeleteTagByID(tx *sql.Tx, id int64) error {
 	var statement *sql.Stmt
 	var err error
 
+	// the tag's ID may be reused, so its trashed rows are restored under its last name instead
+	_, err = tx.Exec("UPDATE trash_row SET tag_id = 0, tag_name = (SELECT name FROM tag WHERE id = $1) WHERE tag_id = $1", id)
+	if err != nil {
+		goto End
+	}
+
 	statement, err = tx.Prepare("DELETE FROM tag WHERE id = ?")
 	if err != nil {
 		goto End
@@ -228,6 +296,7 @@ End:
 	return err
 }
 
+// DeleteTagByID moves a tag and its rows into the trash
 func (e *ExoDB) DeleteTagByID(id int64) error {
 	var tx *sql.Tx
 	var err error
@@ -237,13 +306,13 @@ func (e *ExoDB) DeleteTagByID(id int64) error {
 		goto End
 	}
 
-	err = sqlDeleteTagByID(tx, id)
+	err = sqlTrashTag(tx, id)
 	if err != nil {
 		goto End
 	}
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
 	return err
 }
 
@@ -251,12 +320,12 @@ func sqlUpdateTagName(tx *sql.Tx, oldname string, newname string) error {
 	var statement *sql.Stmt
 	var err error
 
-	statement, err = tx.Prepare("UPDATE tag SET name = ?, updated_ts = ? WHERE name = ?")
+	statement, err = tx.Prepare("UPDATE tag SET name = ?, key = ?, updated_ts = ? WHERE key = ?")
 	if err != nil {
 		goto End
 	}
 
-	_, err = statement.Exec(newname, time.Now().UnixNano(), oldname)
+	_, err = statement.Exec(newname, TagKey(newname), time.Now().UnixNano(), TagKey(oldname))
 	if err != nil {
 		goto End
 	}
@@ -265,10 +334,15 @@ End:
 	return err
 }
 
+// RenameTag renames a tag along with the tags namespaced below it, and rewrites the rows linking any of them
 func (e *ExoDB) RenameTag(oldname string, newname string) (Tag, error) {
 	var tx *sql.Tx
 	var refs Refs
 	var tag Tag
+	var descendants []Tag
+	var renames map[string]string
+	var oldkey string
+	var levels int
 	var err error
 
 	tx, err = e.conn.Begin()
@@ -276,27 +350,62 @@ func (e *ExoDB) RenameTag(oldname string, newname string) (Tag, error) {
 		goto End
 	}
 
+	tag, err = sqlGetTagByName(tx, oldname)
+	if err != nil {
+		goto End
+	}
+
+	descendants, err = sqlGetDescendantTags(tx, TagKey(oldname))
+	if err != nil {
+		goto End
+	}
+
+	// work/a renamed to job/a moves work/a/b to job/a/b
+	oldkey = TagKey(oldname)
+	renames = map[string]string{oldkey: newname}
+	levels = len(strings.Split(oldkey, NamespaceSeparator))
+	for _, descendant := range descendants {
+		key := TagKey(descendant.Name)
+		suffix := key[len(oldkey)+len(NamespaceSeparator):]
+		if segments := strings.Split(descendant.Name, NamespaceSeparator); len(segments) > levels {
+			suffix = strings.Join(segments[levels:], NamespaceSeparator)
+		}
+		renames[key] = newname + NamespaceSeparator + suffix
+	}
+
+	// renaming the deepest tags first frees up the names of their parents, for renames within the same namespace
+	for i := len(descendants) - 1; i >= 0; i-- {
+		key := TagKey(descendants[i].Name)
+		err = sqlUpdateTagName(tx, key, renames[key])
+		if err != nil {
+			goto End
+		}
+	}
+
 	err = sqlUpdateTagName(tx, oldname, newname)
 	if err != nil {
 		goto End
 	}
 
+	err = sqlAddParentTags(tx, newname)
+	if err != nil {
+		goto End
+	}
+
 	// Now update all rows that reference oldname
 	tag, err = sqlGetTagByName(tx, newname)
 	if err != nil {
 		goto End
 	}
 
-	refs, err = sqlGetRefsToTagByTagID(tx, tag.ID)
+	refs, err = sqlGetRefsToTagAndDescendants(tx, tag.ID)
 	if err != nil {
 		goto End
 	}
 
 	for _, rows := range refs {
 		for _, row := range rows {
-			oldtag := fmt.Sprintf("[[%s]]", oldname)
-			newtag := fmt.Sprintf("[[%s]]", newname)
-			err = sqlUpdateRowText(tx, row.ID, strings.ReplaceAll(row.Text, oldtag, newtag))
+			err = sqlUpdateRowText(tx, row.ID, renameRefs(row.Text, renames))
 			if err != nil {
 				goto End
 			}
@@ -304,7 +413,7 @@ func (e *ExoDB) RenameTag(oldname string, newname string) (Tag, error) {
 	}
 
 End:
-	sqlCommitOrRollback(tx, err)
+	err = sqlCommitOrRollback(tx, err)
 
 	return tag, err
 }
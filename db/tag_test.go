@@ -220,3 +220,80 @@ func TestDeleteTagByID(t *testing.T) {
 		t.Fatal(fmt.Sprintf("Remaining tag name (%s) did not match expected (%s)", tags[0].Name, tag2.Name))
 	}
 }
+
+func TestTagKey(t *testing.T) {
+	for _, names := range [][2]string{
+		{"todo", "Todo"},
+		{"todo", " todo "},
+		{"to do", "To\tDo"},
+		{"straße", "STRASSE"},
+		{"café", "café"},
+		{"ｔｏｄｏ", "todo"},
+	} {
+		if TagKey(names[0]) != TagKey(names[1]) {
+			t.Errorf("expected %q and %q to have the same key, got %q and %q", names[0], names[1], TagKey(names[0]), TagKey(names[1]))
+		}
+	}
+
+	if TagKey("todo") == TagKey("to do") {
+		t.Error("expected todo and to do to have different keys")
+	}
+}
+
+func TestTagIdentity(t *testing.T) {
+	var db ExoDB
+	var err error
+	var notes, tag Tag
+	var tags []Tag
+	var refs Refs
+
+	db = setupDB(t)
+
+	notes, err = db.AddTag("notes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"[[Todo]] one", "[[todo]] two", "[[ todo ]] three"} {
+		_, err = db.AddRow(notes.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tags, err = db.GetAllTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 {
+		t.Fatalf("expected 2 tags, got %v", tags)
+	}
+
+	// the first spelling is the one shown
+	tag, err = db.GetTagByName("TODO")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Name != "Todo" {
+		t.Fatalf("expected display name Todo, got %q", tag.Name)
+	}
+
+	refs, err = db.GetRefsToTagByTagID(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rows := range refs {
+		if len(rows) != 3 {
+			t.Fatalf("expected 3 refs, got %v", rows)
+		}
+	}
+
+	// renaming rewrites every spelling
+	_, err = db.RenameTag("todo", "task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if texts := rowTexts(t, db, notes.ID); texts != "[[task]] one,[[task]] two,[[task]] three," {
+		t.Fatalf("unexpected texts after rename: %s", texts)
+	}
+}
@@ -0,0 +1,199 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// DateTagFormat is the layout used to name the tag for a given day
+const DateTagFormat = "January 02 2006"
+
+// Workspace settings controlling daily note templates
+const (
+	// SettingTemplateTag names the tag whose rows are copied onto new date tags. A tag named
+	// "<template tag>/<Weekday>" (for instance "template/Monday") takes precedence on that day.
+	// Setting it to the empty string disables templates.
+	SettingTemplateTag = "template.tag"
+	// SettingTaskTag names the tag that marks a row as a task
+	SettingTaskTag = "template.task_tag"
+	// SettingDoneTag names the tag that marks a task as finished
+	SettingDoneTag = "template.done_tag"
+)
+
+const (
+	defaultTemplateTag = "template"
+	defaultTaskTag     = "todo"
+	defaultDoneTag     = "done"
+)
+
+// Placeholders expanded when a template is applied
+const (
+	placeholderDate      = "{{date}}"
+	placeholderWeekday   = "{{weekday}}"
+	placeholderYesterday = "{{yesterday}}"
+	// a template row consisting solely of this placeholder is replaced by a copy of every row under
+	// yesterday's tag that references the task tag but not the done tag
+	placeholderYesterdayTasks = "{{yesterday_tasks}}"
+)
+
+// sqlGetTemplateRows returns the rows of the template that applies on the given day
+func sqlGetTemplateRows(tx *sql.Tx, t time.Time) ([]Row, error) {
+	var templateName string
+	var tag Tag
+	var rows []Row
+	var err error
+
+	templateName, err = sqlGetSetting(tx, SettingTemplateTag, defaultTemplateTag)
+	if err != nil || templateName == "" {
+		goto End
+	}
+
+	// a weekday-specific template wins over the generic one
+	for _, name := range []string{templateName + "/" + t.Weekday().String(), templateName} {
+		tag, err = sqlGetTagByName(tx, name)
+		if err == sql.ErrNoRows {
+			err = nil
+			continue
+		}
+		if err != nil {
+			goto End
+		}
+
+		rows, err = sqlGetRowsForTagID(tx, tag.ID)
+		if err != nil || len(rows) > 0 {
+			goto End
+		}
+	}
+
+End:
+	return rows, err
+}
+
+// sqlGetOpenTasksForTag returns the rows under the named tag that reference taskTag but not doneTag
+func sqlGetOpenTasksForTag(tx *sql.Tx, name string, taskTag string, doneTag string) ([]Row, error) {
+	var rows []Row
+	var sqlRows *sql.Rows
+	var err error
+
+	sqlRows, err = tx.Query(`SELECT r.id, r.tag_id, r.rank, `+openedText("r")+`, r.parent_row_id, r.updated_ts
+							 FROM row AS r, tag AS owner
+							 WHERE owner.id = r.tag_id
+							 AND owner.key = $1
+							 AND `+visibleRow("r")+`
+							 AND EXISTS (SELECT 1 FROM ref, tag WHERE ref.row_id = r.id AND ref.tag_id = tag.id AND tag.key = $2)
+							 AND NOT EXISTS (SELECT 1 FROM ref, tag WHERE ref.row_id = r.id AND ref.tag_id = tag.id AND tag.key = $3)
+							 ORDER BY r.rank, r.id`, TagKey(name), TagKey(taskTag), TagKey(doneTag))
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	for sqlRows.Next() {
+		var row Row
+		err = sqlRows.Scan(&row.ID, &row.TagID, &row.Rank, &row.Text, &row.ParentRowID, &row.UpdatedTS)
+		if err != nil {
+			goto End
+		}
+		rows = append(rows, row)
+	}
+
+End:
+	return rows, err
+}
+
+// expandTemplateRow returns the rows a single template row expands to on the given day
+func expandTemplateRow(text string, t time.Time, yesterdayTasks []Row) []string {
+	var expanded []string
+
+	if strings.TrimSpace(text) == placeholderYesterdayTasks {
+		for _, task := range yesterdayTasks {
+			expanded = append(expanded, task.Text)
+		}
+		return expanded
+	}
+
+	replacer := strings.NewReplacer(
+		placeholderDate, t.Format(DateTagFormat),
+		placeholderWeekday, t.Weekday().String(),
+		placeholderYesterday, t.AddDate(0, 0, -1).Format(DateTagFormat),
+	)
+
+	return append(expanded, replacer.Replace(text))
+}
+
+func sqlApplyTemplate(tx *sql.Tx, tagID int64, t time.Time) error {
+	var templateRows []Row
+	var yesterdayTasks []Row
+	var taskTag, doneTag string
+	var err error
+
+	templateRows, err = sqlGetTemplateRows(tx, t)
+	if err != nil || len(templateRows) == 0 {
+		goto End
+	}
+
+	taskTag, err = sqlGetSetting(tx, SettingTaskTag, defaultTaskTag)
+	if err != nil {
+		goto End
+	}
+
+	doneTag, err = sqlGetSetting(tx, SettingDoneTag, defaultDoneTag)
+	if err != nil {
+		goto End
+	}
+
+	yesterdayTasks, err = sqlGetOpenTasksForTag(tx, t.AddDate(0, 0, -1).Format(DateTagFormat), taskTag, doneTag)
+	if err != nil {
+		goto End
+	}
+
+	for _, templateRow := range templateRows {
+		for _, text := range expandTemplateRow(templateRow.Text, t, yesterdayTasks) {
+			_, err = sqlAppendRow(tx, tagID, text, 0)
+			if err != nil {
+				goto End
+			}
+		}
+	}
+
+End:
+	return err
+}
+
+// AddDateTag returns the tag for the given day, creating it if necessary. A newly created date tag is
+// populated from the workspace's daily template.
+func (e *ExoDB) AddDateTag(t time.Time) (Tag, error) {
+	var tx *sql.Tx
+	var tag Tag
+	var tagID int64
+	var created bool
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	tagID, created, err = sqlInsertTag(tx, t.Format(DateTagFormat))
+	if err != nil {
+		goto End
+	}
+
+	if created {
+		err = sqlApplyTemplate(tx, tagID, t)
+		if err != nil {
+			goto End
+		}
+	}
+
+	tag, err = sqlGetTagByID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return tag, err
+}
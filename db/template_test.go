@@ -0,0 +1,149 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAddDateTagAppliesTemplate(t *testing.T) {
+	var db ExoDB
+	var template, yesterday, today Tag
+	var rows []Row
+	var err error
+
+	db = setupDB(t)
+
+	day := time.Date(2021, time.March, 2, 0, 0, 0, 0, time.UTC)
+
+	template, err = db.AddTag("template")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"notes for {{date}} ({{weekday}})", "{{yesterday_tasks}}", "see [[{{yesterday}}]]"} {
+		_, err = db.AddRow(template.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	yesterday, err = db.AddTag(day.AddDate(0, 0, -1).Format(DateTagFormat))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"[[todo]] open task", "[[todo]] [[done]] finished task", "not a task"} {
+		_, err = db.AddRow(yesterday.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	today, err = db.AddDateTag(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if today.Name != "March 02 2021" {
+		t.Fatal("unexpected date tag name: " + today.Name)
+	}
+
+	rows, err = db.GetRowsForTagID(today.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"notes for March 02 2021 (Tuesday)", "[[todo]] open task", "see [[March 01 2021]]"}
+	if len(rows) != len(expected) {
+		t.Fatal(fmt.Sprintf("expected %d rows, got %d", len(expected), len(rows)))
+	}
+
+	for i, row := range rows {
+		if row.Text != expected[i] {
+			t.Error(fmt.Sprintf("row %d: expected %q, got %q", i, expected[i], row.Text))
+		}
+	}
+}
+
+func TestAddDateTagExistingTagUntouched(t *testing.T) {
+	var db ExoDB
+	var template, today Tag
+	var rows []Row
+	var err error
+
+	db = setupDB(t)
+
+	day := time.Date(2021, time.March, 2, 0, 0, 0, 0, time.UTC)
+
+	template, err = db.AddTag("template")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AddRow(template.ID, "template row", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.AddTag(day.Format(DateTagFormat))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	today, err = db.AddDateTag(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err = db.GetRowsForTagID(today.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 0 {
+		t.Fatal(fmt.Sprintf("template applied to an existing tag (%d rows)", len(rows)))
+	}
+}
+
+func TestWeekdayTemplate(t *testing.T) {
+	var db ExoDB
+	var template, today Tag
+	var rows []Row
+	var err error
+
+	db = setupDB(t)
+
+	day := time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC)
+
+	err = db.SetSetting(SettingTemplateTag, "daily")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, text := range map[string]string{"daily": "any day", "daily/Monday": "it's {{weekday}}"} {
+		template, err = db.AddTag(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = db.AddRow(template.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	today, err = db.AddDateTag(day)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err = db.GetRowsForTagID(today.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 1 || rows[0].Text != "it's Monday" {
+		t.Fatal(fmt.Sprintf("weekday template not applied: %v", rows))
+	}
+}
@@ -0,0 +1,513 @@
+package db
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// SettingTrashExpireDays is the setting holding how many days deleted rows and tags are kept in the trash. 0 keeps
+// them until the trash is purged.
+const SettingTrashExpireDays = "trash.expire_days"
+
+const defaultTrashExpireDays = "30"
+
+// TrashedRow is a deleted row, along with where it used to live
+type TrashedRow struct {
+	ID         int64
+	Row        Row
+	TagName    string
+	DeletedTS  int64
+	TrashTagID int64 // set if the row was deleted along with its tag
+}
+
+// TrashedTag is a deleted tag. Rows that were deleted along with it are restored with it.
+type TrashedTag struct {
+	ID        int64
+	TagID     int64
+	Name      string
+	Query     string
+	DeletedTS int64
+	RowCount  int
+}
+
+// sqlTrashRow moves a row into the trash. trashTagID is 0 unless the row is being deleted along with its tag.
+func sqlTrashRow(tx *sql.Tx, rowID int64, trashTagID int64) error {
+	var statement *sql.Stmt
+	var tagID int64
+	var err error
+
+	err = tx.QueryRow("SELECT tag_id FROM row WHERE id = $1", rowID).Scan(&tagID)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	if err != nil {
+		goto End
+	}
+
+	// the rows of hidden tags can't be deleted; those of unlocked tags go to the trash still sealed
+	err = sqlCheckTagUnlocked(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	statement, err = tx.Prepare(`INSERT INTO trash_row (row_id, tag_id, tag_name, rank, text, parent_row_id, updated_ts, deleted_ts, trash_tag_id)
+								 SELECT r.id, r.tag_id, t.name, r.rank, r.text, r.parent_row_id, r.updated_ts, ?, NULLIF(?, 0)
+								 FROM row AS r, tag AS t
+								 WHERE r.id = ? AND t.id = r.tag_id`)
+	if err != nil {
+		goto End
+	}
+
+	_, err = statement.Exec(time.Now().UnixNano(), trashTagID, rowID)
+	if err != nil {
+		goto End
+	}
+
+	err = sqlDeleteRowByID(tx, rowID)
+	if err != nil {
+		goto End
+	}
+
+End:
+	return err
+}
+
+// sqlTrashTag moves a tag and all of its rows into the trash
+func sqlTrashTag(tx *sql.Tx, tagID int64) error {
+	var tag Tag
+	var query sql.NullString
+	var rows []Row
+	var res sql.Result
+	var trashTagID int64
+	var err error
+
+	tag, err = sqlGetTagByID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	// deleting a locked tag would lose the key to its rows
+	if tag.Kind == TagKindLocked {
+		err = ErrTagLocked
+		goto End
+	}
+
+	rows, err = sqlGetRowsForTagID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	if tag.Kind == TagKindQuery {
+		query.String, err = sqlGetQueryForTag(tx, tagID)
+		if err != nil {
+			goto End
+		}
+		query.Valid = true
+	} else if len(rows) == 0 {
+		// there's nothing worth restoring in a tag without rows, like the date tags left behind while browsing
+		err = sqlDeleteTagByID(tx, tagID)
+		goto End
+	}
+
+	res, err = tx.Exec("INSERT INTO trash_tag (tag_id, name, query, deleted_ts) VALUES ($1, $2, $3, $4)", tag.ID, tag.Name, query, time.Now().UnixNano())
+	if err != nil {
+		goto End
+	}
+
+	trashTagID, err = res.LastInsertId()
+	if err != nil {
+		goto End
+	}
+
+	for _, row := range rows {
+		err = sqlTrashRow(tx, row.ID, trashTagID)
+		if err != nil {
+			goto End
+		}
+	}
+
+	err = sqlDeleteTagByID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+End:
+	return err
+}
+
+func scanTrashedRows(sqlRows *sql.Rows) ([]TrashedRow, error) {
+	var trashedRows []TrashedRow
+	var err error
+
+	defer sqlRows.Close()
+
+	for sqlRows.Next() {
+		var t TrashedRow
+		var trashTagID sql.NullInt64
+		err = sqlRows.Scan(&t.ID, &t.Row.ID, &t.Row.TagID, &t.TagName, &t.Row.Rank, &t.Row.Text, &t.Row.ParentRowID, &t.Row.UpdatedTS, &t.DeletedTS, &trashTagID)
+		if err != nil {
+			break
+		}
+		t.TrashTagID = trashTagID.Int64
+		trashedRows = append(trashedRows, t)
+	}
+
+	return trashedRows, err
+}
+
+// trashRowColumns selects the columns of trash_row scanned by scanTrashedRows, with the text unsealed and the current
+// name of the row's tag if it still exists
+var trashRowColumns = "id, row_id, tag_id, COALESCE((SELECT name FROM tag WHERE tag.id = trash_row.tag_id), tag_name), rank, " +
+	openedText("trash_row") + ", parent_row_id, updated_ts, deleted_ts, trash_tag_id"
+
+// sqlGetTrashedRows returns the rows deleted on their own, most recently deleted first
+func sqlGetTrashedRows(tx *sql.Tx) ([]TrashedRow, error) {
+	var sqlRows *sql.Rows
+	var err error
+
+	sqlRows, err = tx.Query("SELECT " + trashRowColumns + " FROM trash_row WHERE trash_tag_id IS NULL AND " + visibleRow("trash_row") + " ORDER BY deleted_ts desc, id desc")
+	if err != nil {
+		return nil, err
+	}
+
+	return scanTrashedRows(sqlRows)
+}
+
+func sqlGetTrashedTags(tx *sql.Tx) ([]TrashedTag, error) {
+	var trashedTags []TrashedTag
+	var sqlRows *sql.Rows
+	var err error
+
+	sqlRows, err = tx.Query(`SELECT id, tag_id, name, query, deleted_ts, (SELECT COUNT(*) FROM trash_row WHERE trash_tag_id = trash_tag.id)
+							 FROM trash_tag ORDER BY deleted_ts desc, id desc`)
+	if err != nil {
+		goto End
+	}
+	defer sqlRows.Close()
+
+	for sqlRows.Next() {
+		var t TrashedTag
+		var query sql.NullString
+		err = sqlRows.Scan(&t.ID, &t.TagID, &t.Name, &query, &t.DeletedTS, &t.RowCount)
+		if err != nil {
+			goto End
+		}
+		t.Query = query.String
+		trashedTags = append(trashedTags, t)
+	}
+
+End:
+	return trashedTags, err
+}
+
+// sqlRestoreRow puts a trashed row back at its old rank under its old tag, keeping its ID if it's still free. If the
+// tag was deleted since, the row goes under a tag with the tag's last name.
+func sqlRestoreRow(tx *sql.Tx, t TrashedRow) (int64, error) {
+	var tagID, rowID int64
+	var tagExists, isQueryTag, idTaken bool
+	var position int
+	var ranks []float64
+	var res sql.Result
+	var err error
+
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM tag WHERE id = $1)", t.Row.TagID).Scan(&tagExists)
+	if err != nil {
+		goto End
+	}
+
+	if tagExists {
+		tagID = t.Row.TagID
+	} else {
+		tagID, err = sqlAddTag(tx, t.TagName)
+		if err != nil {
+			goto End
+		}
+	}
+
+	err = sqlCheckTagUnlocked(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+	isQueryTag, err = sqlIsQueryTag(tx, tagID)
+	if err != nil {
+		goto End
+	}
+	if isQueryTag {
+		err = ErrQueryTag
+		goto End
+	}
+
+	// the row goes back in front of the rows that were after it
+	err = tx.QueryRow("SELECT COUNT(*) FROM row WHERE tag_id = $1 AND rank < $2", tagID, t.Row.Rank).Scan(&position)
+	if err != nil {
+		goto End
+	}
+
+	ranks, err = sqlRanksAt(tx, tagID, position, 1, nil)
+	if err != nil {
+		goto End
+	}
+
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM row WHERE id = $1)", t.Row.ID).Scan(&idTaken)
+	if err != nil {
+		goto End
+	}
+
+	if idTaken {
+		rowID, err = sqlAddRow(tx, tagID, t.Row.Text, t.Row.ParentRowID, ranks[0])
+		if err != nil {
+			goto End
+		}
+	} else {
+		res, err = tx.Exec("INSERT INTO row (id, tag_id, text, parent_row_id, rank, updated_ts) VALUES ($1, $2, "+sealedText("$2", "$3")+", $4, $5, $6)",
+			t.Row.ID, tagID, t.Row.Text, t.Row.ParentRowID, ranks[0], t.Row.UpdatedTS)
+		if err != nil {
+			goto End
+		}
+		rowID, err = res.LastInsertId()
+		if err != nil {
+			goto End
+		}
+		err = sqlUpdateTagTS(tx, tagID)
+		if err != nil {
+			goto End
+		}
+	}
+
+	err = sqlUpdateRefsForRowID(tx, rowID)
+	if err != nil {
+		goto End
+	}
+
+	_, err = tx.Exec("DELETE FROM trash_row WHERE id = $1", t.ID)
+	if err != nil {
+		goto End
+	}
+
+End:
+	return rowID, err
+}
+
+func (e *ExoDB) GetTrashedRows() ([]TrashedRow, error) {
+	var tx *sql.Tx
+	var trashedRows []TrashedRow
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	trashedRows, err = sqlGetTrashedRows(tx)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return trashedRows, err
+}
+
+func (e *ExoDB) GetTrashedTags() ([]TrashedTag, error) {
+	var tx *sql.Tx
+	var trashedTags []TrashedTag
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	trashedTags, err = sqlGetTrashedTags(tx)
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return trashedTags, err
+}
+
+// RestoreRow takes a row out of the trash. Its old tag is recreated if it was deleted in the meantime.
+func (e *ExoDB) RestoreRow(trashID int64) (Row, error) {
+	var tx *sql.Tx
+	var sqlRows *sql.Rows
+	var trashedRows []TrashedRow
+	var row Row
+	var rowID int64
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	sqlRows, err = tx.Query("SELECT "+trashRowColumns+" FROM trash_row WHERE id = $1 AND "+visibleRow("trash_row"), trashID)
+	if err != nil {
+		goto End
+	}
+
+	trashedRows, err = scanTrashedRows(sqlRows)
+	if err != nil {
+		goto End
+	}
+
+	if len(trashedRows) == 0 {
+		err = sql.ErrNoRows
+		goto End
+	}
+
+	rowID, err = sqlRestoreRow(tx, trashedRows[0])
+	if err != nil {
+		goto End
+	}
+
+	row, err = sqlGetRowByID(tx, rowID)
+	if err != nil {
+		goto End
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return row, err
+}
+
+// RestoreTag takes a tag and the rows deleted along with it out of the trash
+func (e *ExoDB) RestoreTag(trashID int64) (Tag, error) {
+	var tx *sql.Tx
+	var sqlRows *sql.Rows
+	var trashedRows []TrashedRow
+	var tag Tag
+	var name string
+	var query sql.NullString
+	var tagID int64
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	err = tx.QueryRow("SELECT name, query FROM trash_tag WHERE id = $1", trashID).Scan(&name, &query)
+	if err != nil {
+		goto End
+	}
+
+	tagID, err = sqlAddTag(tx, name)
+	if err != nil {
+		goto End
+	}
+
+	if query.Valid {
+		err = sqlSetQueryForTag(tx, tagID, query.String)
+		if err != nil {
+			goto End
+		}
+	}
+
+	sqlRows, err = tx.Query("SELECT "+trashRowColumns+" FROM trash_row WHERE trash_tag_id = $1 ORDER BY rank, row_id", trashID)
+	if err != nil {
+		goto End
+	}
+
+	trashedRows, err = scanTrashedRows(sqlRows)
+	if err != nil {
+		goto End
+	}
+
+	for _, t := range trashedRows {
+		t.Row.TagID = tagID
+		_, err = sqlRestoreRow(tx, t)
+		if err != nil {
+			goto End
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM trash_tag WHERE id = $1", trashID)
+	if err != nil {
+		goto End
+	}
+
+	tag, err = sqlGetTagByID(tx, tagID)
+	if err != nil {
+		goto End
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return tag, err
+}
+
+// ExpireTrash permanently deletes everything that has been in the trash for longer than the trash.expire_days
+// setting allows, and returns how many rows and tags were deleted
+func (e *ExoDB) ExpireTrash() (int64, error) {
+	var tx *sql.Tx
+	var setting string
+	var days int
+	var cutoff int64
+	var res sql.Result
+	var expiredRows, expiredTags int64
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	setting, err = sqlGetSetting(tx, SettingTrashExpireDays, defaultTrashExpireDays)
+	if err != nil {
+		goto End
+	}
+
+	days, err = strconv.Atoi(setting)
+	if err != nil || days <= 0 {
+		// a bad or disabled policy never expires anything
+		err = nil
+		goto End
+	}
+
+	cutoff = time.Now().AddDate(0, 0, -days).UnixNano()
+
+	res, err = tx.Exec("DELETE FROM trash_row WHERE trash_tag_id IS NULL AND deleted_ts < $1", cutoff)
+	if err != nil {
+		goto End
+	}
+	expiredRows, _ = res.RowsAffected()
+
+	res, err = tx.Exec("DELETE FROM trash_tag WHERE deleted_ts < $1", cutoff)
+	if err != nil {
+		goto End
+	}
+	expiredTags, _ = res.RowsAffected()
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return expiredRows + expiredTags, err
+}
+
+// PurgeTrash permanently deletes everything in the trash
+func (e *ExoDB) PurgeTrash() error {
+	var tx *sql.Tx
+	var err error
+
+	tx, err = e.conn.Begin()
+	if err != nil {
+		goto End
+	}
+
+	_, err = tx.Exec("DELETE FROM trash_row")
+	if err != nil {
+		goto End
+	}
+
+	_, err = tx.Exec("DELETE FROM trash_tag")
+	if err != nil {
+		goto End
+	}
+
+End:
+	err = sqlCommitOrRollback(tx, err)
+
+	return err
+}
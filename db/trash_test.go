@@ -0,0 +1,231 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTrashRow(t *testing.T) {
+	var db ExoDB
+	var tag Tag
+	var rows []Row
+	var restored Row
+	var trashedRows []TrashedRow
+	var refs Refs
+	var err error
+
+	db = setupDB(t)
+
+	tag, err = db.AddTag("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"one", "two [[other]]", "three"} {
+		var row Row
+		row, err = db.AddRow(tag.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+
+	err = db.DeleteRowByID(rows[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trashedRows, err = db.GetTrashedRows()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(trashedRows) != 1 || trashedRows[0].Row.ID != rows[1].ID || trashedRows[0].TagName != "test" || trashedRows[0].Row.Rank != 1 {
+		t.Fatal(fmt.Sprintf("unexpected trash contents: %+v", trashedRows))
+	}
+
+	restored, err = db.RestoreRow(trashedRows[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restored.ID != rows[1].ID || restored.TagID != tag.ID {
+		t.Fatal(fmt.Sprintf("row wasn't restored in place: %+v", restored))
+	}
+
+	rows, err = db.GetRowsForTagID(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 3 || rows[1].ID != restored.ID {
+		t.Fatal(fmt.Sprintf("row wasn't restored at its old rank: %+v", rows))
+	}
+
+	refs, err = db.GetRefsToTagByTagName("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(refs) != 1 {
+		t.Fatal("refs of the restored row weren't recreated")
+	}
+
+	trashedRows, err = db.GetTrashedRows()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(trashedRows) != 0 {
+		t.Fatal("restored row is still in the trash")
+	}
+}
+
+func TestTrashTag(t *testing.T) {
+	var db ExoDB
+	var tag Tag
+	var trashedTags []TrashedTag
+	var rows []Row
+	var n int64
+	var err error
+
+	db = setupDB(t)
+
+	tag, err = db.AddTag("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"one", "two"} {
+		_, err = db.AddRow(tag.ID, text, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = db.DeleteTagByID(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trashedTags, err = db.GetTrashedTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(trashedTags) != 1 || trashedTags[0].Name != "test" || trashedTags[0].RowCount != 2 {
+		t.Fatal(fmt.Sprintf("unexpected trash contents: %+v", trashedTags))
+	}
+
+	tag, err = db.RestoreTag(trashedTags[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err = db.GetRowsForTagID(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 2 || rows[0].Text != "one" || rows[1].Text != "two" {
+		t.Fatal(fmt.Sprintf("tag rows weren't restored: %+v", rows))
+	}
+
+	err = db.DeleteTagByID(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is old enough to expire yet
+	n, err = db.ExpireTrash()
+	if err != nil || n != 0 {
+		t.Fatal(fmt.Sprintf("ExpireTrash expired %d entries: %v", n, err))
+	}
+
+	_, err = db.conn.Exec("UPDATE trash_tag SET deleted_ts = $1", time.Now().AddDate(0, 0, -31).UnixNano())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err = db.ExpireTrash()
+	if err != nil || n != 1 {
+		t.Fatal(fmt.Sprintf("expected ExpireTrash to expire 1 entry, got %d: %v", n, err))
+	}
+
+	var count int
+	err = db.conn.QueryRow("SELECT COUNT(*) FROM trash_row").Scan(&count)
+	if err != nil || count != 0 {
+		t.Fatal(fmt.Sprintf("rows of an expired tag were left in the trash: %d", count))
+	}
+}
+
+func TestRestoreRowIntoRenamedTag(t *testing.T) {
+	db := setupDB(t)
+
+	tag, err := db.AddTag("before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, err := db.AddRow(tag.ID, "one", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.AddRow(tag.ID, "two", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.DeleteRowByID(row.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, err = db.RenameTag("before", "after")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trashedRows, err := db.GetTrashedRows()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trashedRows) != 1 || trashedRows[0].TagName != "after" {
+		t.Fatal(fmt.Sprintf("expected the trashed row to list its tag's new name: %+v", trashedRows))
+	}
+
+	restored, err := db.RestoreRow(trashedRows[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.TagID != tag.ID {
+		t.Fatal(fmt.Sprintf("row wasn't restored into the renamed tag: %+v", restored))
+	}
+	if _, err = db.GetTagByName("before"); err == nil {
+		t.Fatal("restoring the row recreated the tag's old name")
+	}
+}
+
+func TestDeleteTagWithoutRows(t *testing.T) {
+	db := setupDB(t)
+
+	tag, err := db.AddTag("empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.DeleteTagByID(tag.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trashedTags, err := db.GetTrashedTags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trashedTags) != 0 {
+		t.Fatal(fmt.Sprintf("tag without rows went to the trash: %+v", trashedTags))
+	}
+	if _, err = db.GetTagByID(tag.ID); err == nil {
+		t.Fatal("tag without rows wasn't deleted")
+	}
+}
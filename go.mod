@@ -7,6 +7,8 @@ require (
 	github.com/AllenDang/giu v0.4.3-0.20201224132820-8761648db044
 	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/peterh/liner v1.2.2
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/text v0.3.3
 )
 
 require (
@@ -19,5 +21,4 @@ require (
 	golang.org/x/image v0.0.0-20200618115811-c13761719519 // indirect
 	golang.org/x/net v0.0.0-20201224014010-6772e930b67b // indirect
 	golang.org/x/sys v0.10.0 // indirect
-	golang.org/x/text v0.3.3 // indirect
 )
@@ -4,3 +4,5 @@ CC=x86_64-w64-mingw32-gcc CGO_ENABLED=1 GOOS=windows GOARCH=amd64 go build -o bu
 CC=x86_64-w64-mingw32-gcc CGO_ENABLED=1 GOOS=windows GOARCH=amd64 go build -o build/exotui-windows-amd64.exe ./cmd/exotui
 GOOS=linux GOARCH=amd64 go build -ldflags '-linkmode external -extldflags -static -w' -o build/exotui-linux-amd64 ./cmd/exotui
 GOOS=linux GOARCH=amd64 go build -o build/exogio-linux-amd64 ./cmd/exogio
+GOOS=linux GOARCH=amd64 go build -o build/exo-linux-amd64 ./cmd/exo
+GOOS=linux GOARCH=amd64 go build -o build/exopublish-linux-amd64 ./cmd/exopublish
@@ -0,0 +1,55 @@
+// Package web holds the HTML templates shared by exoweb and exopublish, and renders row text as HTML.
+package web
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"strings"
+
+	"github.com/neutralinsomniac/exocortex/db"
+)
+
+//go:embed templates/*.gohtml
+var templateFS embed.FS
+
+// Templates are the HTML templates. tagURL returns a tag's address, exoweb's /tag/<id> by default; other users can
+// replace it with Funcs on a clone.
+var Templates = template.Must(template.New("").Funcs(template.FuncMap{
+	"tagURL": func(tag db.Tag) string {
+		return fmt.Sprintf("/tag/%d", tag.ID)
+	},
+}).ParseFS(templateFS, "templates/*.gohtml"))
+
+// RenderRow renders row text as HTML. A link becomes an anchor if tagURL returns an address for the linked tag's
+// name, and plain text otherwise.
+func RenderRow(text string, tagURL func(name string) (string, bool)) template.HTML {
+	var b strings.Builder
+
+	for i, line := range strings.Split(text, "\n") {
+		if i > 0 {
+			b.WriteString("<br>")
+		}
+		if _, ok := db.ParseProperty(line); ok {
+			sep := strings.Index(line, "::")
+			fmt.Fprintf(&b, "<strong>%s</strong>::", template.HTMLEscapeString(line[:sep]))
+			line = line[sep+2:]
+		}
+		for _, node := range db.ParseText(line) {
+			switch node.Kind {
+			case db.NodeRef:
+				if url, ok := tagURL(node.Text); ok {
+					fmt.Fprintf(&b, `<a href="%s">%s</a>`, template.HTMLEscapeString(url), template.HTMLEscapeString(node.Text))
+				} else {
+					b.WriteString(template.HTMLEscapeString(node.Text))
+				}
+			case db.NodeCode:
+				fmt.Fprintf(&b, "<code>%s</code>", template.HTMLEscapeString(node.Text))
+			default:
+				b.WriteString(template.HTMLEscapeString(node.Text))
+			}
+		}
+	}
+
+	return template.HTML(b.String())
+}